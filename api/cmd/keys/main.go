@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/marcioecom/permit/internal/config"
+	"github.com/marcioecom/permit/internal/crypto"
+	"github.com/marcioecom/permit/internal/database"
+	"github.com/marcioecom/permit/internal/models"
+	"github.com/marcioecom/permit/internal/repository"
+	"github.com/marcioecom/permit/internal/service"
+	"github.com/rs/zerolog/log"
+)
+
+type Options struct {
+	List        bool   `short:"l" long:"list" description:"List stored signing keys"`
+	Rotate      bool   `short:"r" long:"rotate" description:"Rotate the active signing keys"`
+	Environment string `short:"e" long:"environment" description:"Only rotate the keys of this environment"`
+}
+
+var (
+	opts       Options
+	optsParser = flags.NewParser(&opts, flags.Default)
+)
+
+func main() {
+	// Parse flags
+	if _, err := optsParser.Parse(); err != nil {
+		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type != flags.ErrHelp {
+			log.Err(err).Msg("Failed to parse args")
+		}
+		os.Exit(0)
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load config")
+	}
+	if cfg.JWTMasterKey == "" {
+		log.Fatal().Msg("JWT_MASTER_KEY must be set to manage stored signing keys")
+	}
+
+	cipher, err := crypto.NewKeyCipher(cfg.JWTMasterKey)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load JWT master key")
+	}
+
+	ctx := context.Background()
+	db, err := database.New(ctx, cfg.DatabaseURL)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to connect to database")
+	}
+
+	signingKeyRepo := repository.NewPostgresSigningKeyRepo(db.Pool)
+	envRepo := repository.NewPostgresEnvironmentRepo(db.Pool)
+	signingKeyService := service.NewSigningKeyService(crypto.NewKeyManager(), signingKeyRepo, envRepo, cipher, cfg.JWTKeyRotationInterval)
+
+	switch {
+	case opts.Rotate && opts.Environment != "":
+		err = signingKeyService.RotateEnvironment(ctx, opts.Environment)
+	case opts.Rotate:
+		err = signingKeyService.Rotate(ctx)
+	case opts.List:
+		var keys []*models.SigningKey
+		keys, err = signingKeyService.Keys(ctx)
+		for _, key := range keys {
+			log.Info().
+				Str("kid", key.ID).
+				Str("environmentId", key.EnvironmentID).
+				Str("algorithm", key.Algorithm).
+				Str("status", key.Status).
+				Time("createdAt", key.CreatedAt).
+				Msg("signing key")
+		}
+	}
+
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to run keys script")
+	}
+}
@@ -49,44 +49,121 @@ func main() {
 
 	userRepo := repository.NewPostgresUserRepo(db.Pool)
 	otpRepo := repository.NewPostgresOTPCodeRepo(db.Pool)
+	loginAttemptRepo := repository.NewPostgresLoginAttemptRepo(db.Pool)
 	projectRepo := repository.NewPostgresProjectRepo(db.Pool)
 	identityRepo := repository.NewIdentityRepository(db.Pool)
 	envRepo := repository.NewPostgresEnvironmentRepo(db.Pool)
 	oauthRepo := repository.NewPostgresOAuthRepo(db.Pool)
+	refreshTokenRepo := repository.NewPostgresRefreshTokenRepo(db.Pool)
+	sessionRepo := repository.NewPostgresSessionRepo(db.Pool)
+	denylistRepo := repository.NewPostgresAccessTokenDenylistRepo(db.Pool)
+	oidcRepo := repository.NewPostgresOIDCRepo(db.Pool)
+	mfaRepo := repository.NewPostgresMFARepo(db.Pool)
 
 	keyManager := crypto.NewKeyManager()
-	if cfg.JWTPrivateKey != "" {
+	var signingKeyService *service.SigningKeyService
+	var keyProvisioner service.KeyProvisioner
+	switch {
+	case cfg.JWTPrivateKey != "":
+		// A token of one environment would verify in every other, so sharing
+		// the key has to be asked for
+		if !cfg.JWTSharedKey {
+			log.Fatal().Msg("JWT_PRIVATE_KEY is shared by every environment; set JWT_MASTER_KEY instead, or JWT_SHARED_KEY=true to accept that")
+		}
 		if err := keyManager.LoadFromPEM(cfg.JWTPrivateKey); err != nil {
 			log.Fatal().Err(err).Msg("failed to load JWT private key")
 		}
-	} else {
-		log.Warn().Msg("JWT_PRIVATE_KEY not set, generating ephemeral keys")
+		log.Warn().Msg("JWT_PRIVATE_KEY only covers one algorithm and is shared by every environment; set JWT_MASTER_KEY instead")
+	case cfg.JWTMasterKey != "":
+		cipher, err := crypto.NewKeyCipher(cfg.JWTMasterKey)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to load JWT master key")
+		}
+		signingKeyRepo := repository.NewPostgresSigningKeyRepo(db.Pool)
+		signingKeyService = service.NewSigningKeyService(keyManager, signingKeyRepo, envRepo, cipher, cfg.JWTKeyRotationInterval)
+		if err := signingKeyService.Load(ctx); err != nil {
+			log.Fatal().Err(err).Msg("failed to load JWT signing keys")
+		}
+		keyProvisioner = signingKeyService
+	default:
+		log.Warn().Msg("JWT_PRIVATE_KEY and JWT_MASTER_KEY not set, generating ephemeral keys")
 		if err := keyManager.GenerateKeyPair(); err != nil {
 			log.Fatal().Err(err).Msg("failed to generate JWT keys")
 		}
+		keyProvisioner = service.NewMemoryKeyProvisioner(keyManager)
+	}
+	if err := keyManager.EnsureAlgorithms(crypto.SupportedAlgorithms...); err != nil {
+		log.Fatal().Err(err).Msg("failed to generate JWT keys")
+	}
+	if err := keyManager.EnsureNextKey(); err != nil {
+		log.Fatal().Err(err).Msg("failed to generate next JWT key")
 	}
 	jwtService := crypto.NewJWTService(keyManager, "permit")
 
+	var codeHasher *crypto.CodeHasher
+	if cfg.OTPHashKey != "" {
+		codeHasher, err = crypto.NewCodeHasher(cfg.OTPHashKey)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to load OTP hash key")
+		}
+	} else {
+		log.Warn().Msg("OTP_HASH_KEY not set, generating an ephemeral key; pending codes won't survive a restart")
+		codeHasher, err = crypto.NewEphemeralCodeHasher()
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to generate OTP hash key")
+		}
+	}
+
+	mfaKey := cfg.MFAEncryptionKey
+	if mfaKey == "" {
+		mfaKey = cfg.JWTMasterKey
+	}
+	var mfaCipher *crypto.KeyCipher
+	if mfaKey != "" {
+		mfaCipher, err = crypto.NewKeyCipher(mfaKey)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to load MFA encryption key")
+		}
+	} else {
+		log.Warn().Msg("MFA_ENCRYPTION_KEY and JWT_MASTER_KEY not set, generating an ephemeral key; enrolled authenticators won't survive a restart")
+		mfaCipher, err = crypto.NewEphemeralKeyCipher()
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to generate MFA encryption key")
+		}
+	}
+
 	emailService := infra.NewEmailService(cfg)
+	if cfg.TwilioAccountSID == "" {
+		log.Warn().Msg("TWILIO_ACCOUNT_SID not set, SMS codes will be logged instead of sent")
+	}
+	smsService := infra.NewSMSService(cfg)
 
-	authService := service.NewAuthService(jwtService, emailService, userRepo, otpRepo, identityRepo, projectRepo, envRepo)
-	sessionService := service.NewSessionService(jwtService, userRepo)
+	sessionService := service.NewSessionService(jwtService, userRepo, refreshTokenRepo, sessionRepo, denylistRepo, projectRepo, envRepo, identityRepo, keyProvisioner)
+	mfaService := service.NewMFAService(mfaCipher, codeHasher, sessionService, mfaRepo, userRepo, identityRepo, projectRepo, envRepo)
+	authService := service.NewAuthService(cfg, jwtService, codeHasher, sessionService, mfaService, emailService, smsService, userRepo, otpRepo, loginAttemptRepo, oauthRepo, identityRepo, projectRepo, envRepo)
 	projectService := service.NewProjectService(projectRepo, envRepo)
-	oauthService := service.NewOAuthService(cfg, jwtService, oauthRepo, envRepo, userRepo, identityRepo, projectRepo)
-	envService := service.NewEnvironmentService(envRepo, oauthRepo, projectRepo)
+	oauthService := service.NewOAuthService(cfg, jwtService, sessionService, mfaService, oauthRepo, envRepo, userRepo, identityRepo, projectRepo)
+	envService := service.NewEnvironmentService(envRepo, oauthRepo, oidcRepo, projectRepo)
+	tokenService := service.NewTokenService(jwtService, sessionService, refreshTokenRepo, sessionRepo, denylistRepo, projectRepo, userRepo)
+	oidcService := service.NewOIDCService(cfg, jwtService, sessionService, oidcRepo, oauthRepo, envRepo, userRepo)
 
 	handlers := &handler.Handlers{
 		Health:    handler.NewHealthHandler(db.Pool),
 		Auth:      handler.NewAuthHandler(authService),
 		Session:   handler.NewSessionHandler(sessionService),
 		Project:   handler.NewProjectHandler(projectService),
-		JWKS:      handler.NewJWKSHandler(jwtService, projectRepo),
-		Dashboard: handler.NewDashboardHandler(projectService, envService),
+		JWKS:      handler.NewJWKSHandler(jwtService, projectRepo, envRepo, cfg.PublicURL),
+		Dashboard: handler.NewDashboardHandler(projectService, envService, sessionService),
 		OAuth:     handler.NewOAuthHandler(oauthService),
+		Token:     handler.NewTokenHandler(tokenService, projectRepo),
+		OIDC:      handler.NewOIDCHandler(oidcService),
+		MFA:       handler.NewMFAHandler(mfaService),
 	}
 	services := &handler.Services{
-		JWTService:  jwtService,
-		ProjectRepo: projectRepo,
+		JWTService:   jwtService,
+		ProjectRepo:  projectRepo,
+		DenylistRepo: denylistRepo,
+		SessionRepo:  sessionRepo,
 	}
 
 	handler.SetupRoutes(r, handlers, services)
@@ -99,6 +176,16 @@ func main() {
 		IdleTimeout:  60 * time.Second,
 	}
 
+	rotationCtx, stopRotation := context.WithCancel(context.Background())
+	defer stopRotation()
+	switch {
+	case signingKeyService != nil:
+		go runKeySync(rotationCtx, signingKeyService)
+	case cfg.JWTKeyRotationInterval > 0:
+		go runKeyRotation(rotationCtx, keyManager, cfg.JWTKeyRotationInterval)
+	}
+	go runDenylistCleanup(rotationCtx, denylistRepo)
+
 	go func() {
 		log.Info().Msgf("Server starting on port %s", cfg.Port)
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -121,3 +208,65 @@ func main() {
 
 	log.Info().Msg("Server stopped gracefully")
 }
+
+// keySyncInterval is how often replicas reload the stored key ring, which
+// bounds how long a rotation made elsewhere takes to be picked up
+const keySyncInterval = time.Minute
+
+// runKeySync keeps the key ring in step with the key store until ctx is done.
+// Scheduled rotations happen during a sync once the active key is due.
+func runKeySync(ctx context.Context, signingKeyService *service.SigningKeyService) {
+	ticker := time.NewTicker(keySyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := signingKeyService.Sync(ctx); err != nil {
+				log.Error().Err(err).Msg("failed to sync JWT signing keys")
+			}
+		}
+	}
+}
+
+// denylistCleanupInterval is how often revoked access tokens that have since
+// expired are dropped from the denylist
+const denylistCleanupInterval = time.Hour
+
+// runDenylistCleanup prunes the access token denylist until ctx is done
+func runDenylistCleanup(ctx context.Context, denylistRepo repository.AccessTokenDenylistRepository) {
+	ticker := time.NewTicker(denylistCleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := denylistRepo.DeleteExpired(ctx); err != nil {
+				log.Error().Err(err).Msg("failed to prune access token denylist")
+			}
+		}
+	}
+}
+
+// runKeyRotation rotates the signing key every interval until ctx is done
+func runKeyRotation(ctx context.Context, keyManager *crypto.KeyManager, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := keyManager.Rotate(); err != nil {
+				log.Error().Err(err).Msg("failed to rotate JWT signing key")
+				continue
+			}
+			log.Info().Str("kid", keyManager.GetKeyID()).Msg("rotated JWT signing key")
+		}
+	}
+}
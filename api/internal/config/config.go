@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/joho/godotenv"
@@ -16,11 +17,38 @@ type Config struct {
 	ResendAPIKey  string
 	EmailFrom     string
 	JWTPrivateKey string
+	// JWTSharedKey acknowledges that JWTPrivateKey signs every environment's
+	// tokens, which otherwise refuses to start
+	JWTSharedKey bool
+	// JWTMasterKey encrypts signing keys stored in the database (base64, 32 bytes)
+	JWTMasterKey string
+
+	// OTPHashKey keys the hashes one-time codes are stored as (base64, at
+	// least 32 bytes)
+	OTPHashKey string
+
+	// MFAEncryptionKey encrypts stored TOTP secrets (base64, 32 bytes);
+	// JWTMasterKey is used when it's unset
+	MFAEncryptionKey string
+
+	// JWTKeyRotationInterval rotates the signing key on a schedule; zero disables it
+	JWTKeyRotationInterval time.Duration
 
 	UseMailHog bool
 	SMTPHost   string
 	SMTPPort   string
 
+	// Twilio, or a provider with a compatible Messages API, sends SMS codes;
+	// without an account SID they are only logged
+	TwilioBaseURL    string
+	TwilioAccountSID string
+	TwilioAuthToken  string `validate:"required_with=TwilioAccountSID"`
+	TwilioFromNumber string `validate:"required_with=TwilioAccountSID"`
+
+	// PublicURL is the API's externally reachable base URL, used to build
+	// OpenID Connect issuer URLs
+	PublicURL string
+
 	// OAuth shared credentials (used for development environments)
 	OAuthCallbackBaseURL     string
 	SharedGoogleClientID     string `validate:"required"`
@@ -39,11 +67,21 @@ func Load() (*Config, error) {
 		ResendAPIKey:  os.Getenv("RESEND_API_KEY"),
 		EmailFrom:     getEnv("EMAIL_FROM", "Permit <noreply@permit.marcio.run>"),
 		JWTPrivateKey: os.Getenv("JWT_PRIVATE_KEY"),
+		JWTSharedKey:  os.Getenv("JWT_SHARED_KEY") == "true",
+		JWTMasterKey:  os.Getenv("JWT_MASTER_KEY"),
+		OTPHashKey:    os.Getenv("OTP_HASH_KEY"),
+
+		MFAEncryptionKey: os.Getenv("MFA_ENCRYPTION_KEY"),
 
 		UseMailHog: os.Getenv("USE_MAILHOG") == "true",
 		SMTPHost:   getEnv("SMTP_HOST", "localhost"),
 		SMTPPort:   getEnv("SMTP_PORT", "1025"),
 
+		TwilioBaseURL:    getEnv("TWILIO_BASE_URL", "https://api.twilio.com"),
+		TwilioAccountSID: os.Getenv("TWILIO_ACCOUNT_SID"),
+		TwilioAuthToken:  os.Getenv("TWILIO_AUTH_TOKEN"),
+		TwilioFromNumber: os.Getenv("TWILIO_FROM_NUMBER"),
+
 		OAuthCallbackBaseURL:     getEnv("OAUTH_CALLBACK_BASE_URL", "http://localhost:8080"),
 		SharedGoogleClientID:     os.Getenv("PERMIT_SHARED_GOOGLE_CLIENT_ID"),
 		SharedGoogleClientSecret: os.Getenv("PERMIT_SHARED_GOOGLE_CLIENT_SECRET"),
@@ -51,6 +89,14 @@ func Load() (*Config, error) {
 		SharedGitHubClientSecret: os.Getenv("PERMIT_SHARED_GITHUB_CLIENT_SECRET"),
 	}
 
+	config.PublicURL = strings.TrimRight(getEnv("PUBLIC_URL", config.OAuthCallbackBaseURL), "/")
+
+	rotationInterval, err := time.ParseDuration(getEnv("JWT_KEY_ROTATION_INTERVAL", "0"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT_KEY_ROTATION_INTERVAL: %w", err)
+	}
+	config.JWTKeyRotationInterval = rotationInterval
+
 	if err := config.validate(); err != nil {
 		return nil, err
 	}
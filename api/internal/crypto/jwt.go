@@ -1,7 +1,9 @@
 package crypto
 
 import (
+	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -9,8 +11,16 @@ import (
 )
 
 const (
+	// Default lifetimes for environments that don't configure their own
 	AccessTokenDuration  = 15 * time.Minute
 	RefreshTokenDuration = 7 * 24 * time.Hour
+
+	// Upper bounds for lifetimes configured on an environment
+	MaxAccessTokenDuration  = 24 * time.Hour
+	MaxRefreshTokenDuration = 90 * 24 * time.Hour
+
+	// MaxTokenLifetime is how long a retired signing key must keep verifying
+	MaxTokenLifetime = MaxRefreshTokenDuration
 )
 
 // AccessTokenClaims represents the claims in an access token
@@ -20,15 +30,131 @@ type AccessTokenClaims struct {
 	UserID        string `json:"uid"`
 	ProjectID     string `json:"pid"`
 	EnvironmentID string `json:"eid,omitempty"`
-	Provider      string `json:"provider"` // "email" | "google" | "github"
+	SessionID     string `json:"sid,omitempty"` // refresh token family the token was issued for
+	Provider      string `json:"provider"`      // "email" | "google" | "github"
+
+	// TokenType is never set on access tokens; refresh and client tokens
+	// carry it, which is how they are told apart
+	TokenType string `json:"type,omitempty"`
+
+	// AuthTime is when the user last actively authenticated, which refreshes
+	// carry over and re-authentication moves forward. AMR lists the methods
+	// used, as in RFC 8176.
+	AuthTime int64    `json:"auth_time,omitempty"`
+	AMR      []string `json:"amr,omitempty"`
+
+	// Scope lists the OIDC scopes granted to the relying party the token was
+	// issued to; it is empty on first-party tokens
+	Scope string `json:"scope,omitempty"`
+
+	// Actor is set on impersonation tokens and identifies who is acting as
+	// the user, as in RFC 8693
+	Actor *Actor `json:"act,omitempty"`
+
+	// Custom holds the project's templated claims. They are merged into the
+	// token alongside the claims above, which always take precedence.
+	Custom map[string]any `json:"-"`
+}
+
+// Actor is the RFC 8693 act claim of an impersonation token
+type Actor struct {
+	Subject string `json:"sub"`
+	Email   string `json:"email,omitempty"`
+}
+
+// ReservedClaims are the claims set by permit itself, which custom claims
+// may never overwrite
+var ReservedClaims = []string{
+	"iss", "sub", "aud", "exp", "nbf", "iat", "jti",
+	"email", "uid", "pid", "eid", "sid", "provider", "type",
+	"client_id", "scope", "act", "auth_time", "amr",
+}
+
+// IsReservedClaim reports whether a claim name is set by permit itself
+func IsReservedClaim(name string) bool {
+	for _, reserved := range ReservedClaims {
+		if name == reserved {
+			return true
+		}
+	}
+	return false
+}
+
+// MarshalJSON encodes the claims with the custom claims merged in
+func (c AccessTokenClaims) MarshalJSON() ([]byte, error) {
+	type plain AccessTokenClaims
+	encoded, err := json.Marshal(plain(c))
+	if err != nil || len(c.Custom) == 0 {
+		return encoded, err
+	}
+
+	var fixed map[string]json.RawMessage
+	if err := json.Unmarshal(encoded, &fixed); err != nil {
+		return nil, err
+	}
+
+	merged := make(map[string]any, len(fixed)+len(c.Custom))
+	for name, value := range c.Custom {
+		if !IsReservedClaim(name) {
+			merged[name] = value
+		}
+	}
+	for name, value := range fixed {
+		merged[name] = value
+	}
+	return json.Marshal(merged)
+}
+
+// UnmarshalJSON decodes the claims, collecting unknown ones into Custom
+func (c *AccessTokenClaims) UnmarshalJSON(data []byte) error {
+	type plain AccessTokenClaims
+	if err := json.Unmarshal(data, (*plain)(c)); err != nil {
+		return err
+	}
+
+	var all map[string]any
+	if err := json.Unmarshal(data, &all); err != nil {
+		return err
+	}
+	for name := range all {
+		if IsReservedClaim(name) {
+			delete(all, name)
+		}
+	}
+	if len(all) > 0 {
+		c.Custom = all
+	}
+	return nil
 }
 
 // RefreshTokenClaims represents the claims in a refresh token
 type RefreshTokenClaims struct {
 	jwt.RegisteredClaims
-	UserID    string `json:"uid"`
-	ProjectID string `json:"pid"`
-	TokenType string `json:"type"`
+	UserID        string `json:"uid"`
+	ProjectID     string `json:"pid"`
+	EnvironmentID string `json:"eid,omitempty"`
+	TokenType     string `json:"type"`
+}
+
+// ClientTokenClaims represents the claims in an access token issued to an
+// API key through the client credentials grant. The subject is the client ID.
+type ClientTokenClaims struct {
+	jwt.RegisteredClaims
+	ClientID      string `json:"client_id"`
+	Scope         string `json:"scope,omitempty"`
+	ProjectID     string `json:"pid"`
+	EnvironmentID string `json:"eid,omitempty"`
+	TokenType     string `json:"type"`
+}
+
+// IDTokenClaims represents the claims in an OpenID Connect ID token
+type IDTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce         string `json:"nonce,omitempty"`
+	AuthTime      int64  `json:"auth_time,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified,omitempty"`
+	EnvironmentID string `json:"eid"`
 }
 
 // JWTService handles JWT token operations
@@ -45,34 +171,57 @@ func NewJWTService(keyManager *KeyManager, issuer string) *JWTService {
 	}
 }
 
+// AccessTokenInput describes the access token to sign
+type AccessTokenInput struct {
+	Email         string
+	UserID        string
+	ProjectID     string
+	EnvironmentID string
+	SessionID     string
+	Provider      string
+	Algorithm     string         // defaults to DefaultAlgorithm
+	ExpiresAt     time.Time      // defaults to AccessTokenDuration from now
+	CustomClaims  map[string]any // rendered from the project's claims template
+	Actor         *Actor         // set when impersonating the user
+	AuthTime      time.Time      // when the user last authenticated
+	AMR           []string       // authentication methods, e.g. "otp" or "oauth"
+	Scope         string         // OIDC scopes, for tokens issued to a relying party
+}
+
 // SignAccessToken creates a signed access token
-func (s *JWTService) SignAccessToken(email, userID, projectID, environmentID, provider string) (string, error) {
-	if !s.keyManager.IsLoaded() {
-		return "", fmt.Errorf("keys not loaded")
+func (s *JWTService) SignAccessToken(input AccessTokenInput) (string, error) {
+	now := time.Now()
+	expiresAt := input.ExpiresAt
+	if expiresAt.IsZero() {
+		expiresAt = now.Add(AccessTokenDuration)
 	}
 
-	now := time.Now()
 	claims := AccessTokenClaims{
 		RegisteredClaims: jwt.RegisteredClaims{
 			Issuer:    s.issuer,
-			Subject:   userID,
-			Audience:  jwt.ClaimStrings{projectID},
-			ExpiresAt: jwt.NewNumericDate(now.Add(AccessTokenDuration)),
+			Subject:   input.UserID,
+			Audience:  jwt.ClaimStrings{input.ProjectID},
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
 			IssuedAt:  jwt.NewNumericDate(now),
 			NotBefore: jwt.NewNumericDate(now),
 			ID:        ulid.Make().String(),
 		},
-		Email:         email,
-		UserID:        userID,
-		ProjectID:     projectID,
-		EnvironmentID: environmentID,
-		Provider:      provider,
+		Email:         input.Email,
+		UserID:        input.UserID,
+		ProjectID:     input.ProjectID,
+		EnvironmentID: input.EnvironmentID,
+		SessionID:     input.SessionID,
+		Provider:      input.Provider,
+		AMR:           input.AMR,
+		Scope:         input.Scope,
+		Actor:         input.Actor,
+		Custom:        input.CustomClaims,
+	}
+	if !input.AuthTime.IsZero() {
+		claims.AuthTime = input.AuthTime.Unix()
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	token.Header["kid"] = s.keyManager.GetKeyID()
-
-	signedToken, err := token.SignedString(s.keyManager.GetPrivateKey())
+	signedToken, err := s.sign(claims, input.EnvironmentID, input.Algorithm)
 	if err != nil {
 		return "", fmt.Errorf("failed to sign access token: %w", err)
 	}
@@ -80,32 +229,40 @@ func (s *JWTService) SignAccessToken(email, userID, projectID, environmentID, pr
 	return signedToken, nil
 }
 
+// RefreshTokenInput describes the refresh token to sign
+type RefreshTokenInput struct {
+	UserID        string
+	ProjectID     string
+	EnvironmentID string
+	Algorithm     string    // defaults to DefaultAlgorithm
+	ExpiresAt     time.Time // defaults to RefreshTokenDuration from now
+}
+
 // SignRefreshToken creates a signed refresh token
-func (s *JWTService) SignRefreshToken(userID, projectID string) (string, error) {
-	if !s.keyManager.IsLoaded() {
-		return "", fmt.Errorf("keys not loaded")
+func (s *JWTService) SignRefreshToken(input RefreshTokenInput) (string, error) {
+	now := time.Now()
+	expiresAt := input.ExpiresAt
+	if expiresAt.IsZero() {
+		expiresAt = now.Add(RefreshTokenDuration)
 	}
 
-	now := time.Now()
 	claims := RefreshTokenClaims{
 		RegisteredClaims: jwt.RegisteredClaims{
 			Issuer:    s.issuer,
-			Subject:   userID,
-			Audience:  jwt.ClaimStrings{projectID},
-			ExpiresAt: jwt.NewNumericDate(now.Add(RefreshTokenDuration)),
+			Subject:   input.UserID,
+			Audience:  jwt.ClaimStrings{input.ProjectID},
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
 			IssuedAt:  jwt.NewNumericDate(now),
 			NotBefore: jwt.NewNumericDate(now),
 			ID:        ulid.Make().String(),
 		},
-		UserID:    userID,
-		ProjectID: projectID,
-		TokenType: "refresh",
+		UserID:        input.UserID,
+		ProjectID:     input.ProjectID,
+		EnvironmentID: input.EnvironmentID,
+		TokenType:     "refresh",
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	token.Header["kid"] = s.keyManager.GetKeyID()
-
-	signedToken, err := token.SignedString(s.keyManager.GetPrivateKey())
+	signedToken, err := s.sign(claims, input.EnvironmentID, input.Algorithm)
 	if err != nil {
 		return "", fmt.Errorf("failed to sign refresh token: %w", err)
 	}
@@ -113,6 +270,96 @@ func (s *JWTService) SignRefreshToken(userID, projectID string) (string, error)
 	return signedToken, nil
 }
 
+// ClientTokenInput describes the access token to sign for an API key
+type ClientTokenInput struct {
+	ClientID      string
+	ProjectID     string
+	EnvironmentID string
+	Scopes        []string
+	Algorithm     string    // defaults to DefaultAlgorithm
+	ExpiresAt     time.Time // defaults to AccessTokenDuration from now
+}
+
+// SignClientToken creates a signed access token for machine-to-machine calls
+func (s *JWTService) SignClientToken(input ClientTokenInput) (string, error) {
+	now := time.Now()
+	expiresAt := input.ExpiresAt
+	if expiresAt.IsZero() {
+		expiresAt = now.Add(AccessTokenDuration)
+	}
+
+	claims := ClientTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.issuer,
+			Subject:   input.ClientID,
+			Audience:  jwt.ClaimStrings{input.ProjectID},
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ID:        ulid.Make().String(),
+		},
+		ClientID:      input.ClientID,
+		Scope:         strings.Join(input.Scopes, " "),
+		ProjectID:     input.ProjectID,
+		EnvironmentID: input.EnvironmentID,
+		TokenType:     "client",
+	}
+
+	signedToken, err := s.sign(claims, input.EnvironmentID, input.Algorithm)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign client token: %w", err)
+	}
+
+	return signedToken, nil
+}
+
+// IDTokenInput describes the ID token to sign for a relying party
+type IDTokenInput struct {
+	Issuer        string // the environment's OIDC issuer URL
+	UserID        string
+	ClientID      string
+	EnvironmentID string
+	Email         string // only set when the email scope was granted
+	Nonce         string
+	AuthTime      time.Time
+	Algorithm     string    // defaults to DefaultAlgorithm
+	ExpiresAt     time.Time // defaults to AccessTokenDuration from now
+}
+
+// SignIDToken creates a signed OpenID Connect ID token
+func (s *JWTService) SignIDToken(input IDTokenInput) (string, error) {
+	now := time.Now()
+	expiresAt := input.ExpiresAt
+	if expiresAt.IsZero() {
+		expiresAt = now.Add(AccessTokenDuration)
+	}
+
+	claims := IDTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    input.Issuer,
+			Subject:   input.UserID,
+			Audience:  jwt.ClaimStrings{input.ClientID},
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        ulid.Make().String(),
+		},
+		Nonce:         input.Nonce,
+		Email:         input.Email,
+		EmailVerified: input.Email != "",
+		EnvironmentID: input.EnvironmentID,
+	}
+	if !input.AuthTime.IsZero() {
+		claims.AuthTime = input.AuthTime.Unix()
+	}
+
+	signedToken, err := s.sign(claims, input.EnvironmentID, input.Algorithm)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign ID token: %w", err)
+	}
+
+	return signedToken, nil
+}
+
 // VerifyAccessToken verifies and parses an access token
 func (s *JWTService) VerifyAccessToken(tokenString string) (*AccessTokenClaims, error) {
 	if !s.keyManager.IsLoaded() {
@@ -120,17 +367,7 @@ func (s *JWTService) VerifyAccessToken(tokenString string) (*AccessTokenClaims,
 	}
 
 	token, err := jwt.ParseWithClaims(tokenString, &AccessTokenClaims{}, func(token *jwt.Token) (any, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-
-		if kid, ok := token.Header["kid"].(string); ok {
-			if kid != s.keyManager.GetKeyID() {
-				return nil, fmt.Errorf("unknown key ID: %s", kid)
-			}
-		}
-
-		return s.keyManager.GetPublicKey(), nil
+		return s.verificationKey(token)
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse token: %w", err)
@@ -141,6 +378,12 @@ func (s *JWTService) VerifyAccessToken(tokenString string) (*AccessTokenClaims,
 		return nil, fmt.Errorf("invalid token claims")
 	}
 
+	// Refresh and client tokens are signed with the same keys but carry a
+	// type, and ID tokens carry no uid
+	if claims.TokenType != "" || claims.UserID == "" {
+		return nil, fmt.Errorf("token is not an access token")
+	}
+
 	return claims, nil
 }
 
@@ -151,17 +394,7 @@ func (s *JWTService) VerifyRefreshToken(tokenString string) (*RefreshTokenClaims
 	}
 
 	token, err := jwt.ParseWithClaims(tokenString, &RefreshTokenClaims{}, func(token *jwt.Token) (any, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-
-		if kid, ok := token.Header["kid"].(string); ok {
-			if kid != s.keyManager.GetKeyID() {
-				return nil, fmt.Errorf("unknown key ID: %s", kid)
-			}
-		}
-
-		return s.keyManager.GetPublicKey(), nil
+		return s.verificationKey(token)
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse refresh token: %w", err)
@@ -179,7 +412,110 @@ func (s *JWTService) VerifyRefreshToken(tokenString string) (*RefreshTokenClaims
 	return claims, nil
 }
 
+// VerifyClientToken verifies and parses an access token issued through the
+// client credentials grant
+func (s *JWTService) VerifyClientToken(tokenString string) (*ClientTokenClaims, error) {
+	if !s.keyManager.IsLoaded() {
+		return nil, fmt.Errorf("keys not loaded")
+	}
+
+	token, err := jwt.ParseWithClaims(tokenString, &ClientTokenClaims{}, func(token *jwt.Token) (any, error) {
+		return s.verificationKey(token)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse client token: %w", err)
+	}
+
+	claims, ok := token.Claims.(*ClientTokenClaims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("invalid client token claims")
+	}
+
+	if claims.TokenType != "client" {
+		return nil, fmt.Errorf("token is not a client token")
+	}
+
+	return claims, nil
+}
+
+// sign signs claims with an environment's active key for an algorithm
+func (s *JWTService) sign(claims jwt.Claims, environmentID, algorithm string) (string, error) {
+	if algorithm == "" {
+		algorithm = DefaultAlgorithm
+	}
+
+	key, ok := s.keyManager.SigningKey(environmentID, algorithm)
+	if !ok {
+		return "", fmt.Errorf("no active %s key loaded", algorithm)
+	}
+
+	token := jwt.NewWithClaims(signingMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.ID
+
+	return token.SignedString(key.PrivateKey)
+}
+
+// verificationKey resolves the public key for a token from its kid header
+// among the keys trusted for the token's environment, so a key belonging to
+// one environment can never verify another's tokens. Tokens issued without a
+// kid fall back to the active default key. The token's alg must match the
+// algorithm of the key it resolves to.
+func (s *JWTService) verificationKey(token *jwt.Token) (any, error) {
+	environmentID := environmentOf(token.Claims)
+
+	var key SigningKey
+	var found bool
+	if kid, ok := token.Header["kid"].(string); ok {
+		key, found = s.keyManager.VerificationKey(environmentID, kid)
+		if !found {
+			return nil, fmt.Errorf("unknown key ID: %s", kid)
+		}
+	} else {
+		key, found = s.keyManager.SigningKey(environmentID, DefaultAlgorithm)
+		if !found {
+			return nil, fmt.Errorf("keys not loaded")
+		}
+	}
+
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.PublicKey(), nil
+}
+
+// environmentOf returns the environment a token was issued for
+func environmentOf(claims jwt.Claims) string {
+	switch c := claims.(type) {
+	case *AccessTokenClaims:
+		return c.EnvironmentID
+	case *RefreshTokenClaims:
+		return c.EnvironmentID
+	case *ClientTokenClaims:
+		return c.EnvironmentID
+	case *IDTokenClaims:
+		return c.EnvironmentID
+	default:
+		return ""
+	}
+}
+
+func signingMethod(algorithm string) jwt.SigningMethod {
+	switch algorithm {
+	case AlgorithmES256:
+		return jwt.SigningMethodES256
+	case AlgorithmEdDSA:
+		return jwt.SigningMethodEdDSA
+	default:
+		return jwt.SigningMethodRS256
+	}
+}
+
 // GetKeyManager returns the key manager (for JWKS handler)
 func (s *JWTService) GetKeyManager() *KeyManager {
 	return s.keyManager
 }
+
+// Issuer returns the iss claim of access and refresh tokens
+func (s *JWTService) Issuer() string {
+	return s.issuer
+}
@@ -0,0 +1,351 @@
+package crypto_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/marcioecom/permit/internal/crypto"
+)
+
+func newTestJWTService(t *testing.T) *crypto.JWTService {
+	t.Helper()
+	km := crypto.NewKeyManager()
+	if err := km.GenerateKeyPair(); err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+	return crypto.NewJWTService(km, "permit")
+}
+
+func TestVerifyAccessToken_RejectsOtherTokenTypes(t *testing.T) {
+	jwtService := newTestJWTService(t)
+
+	accessToken, err := jwtService.SignAccessToken(crypto.AccessTokenInput{UserID: "user-1", ProjectID: "project-1"})
+	if err != nil {
+		t.Fatalf("Failed to sign access token: %v", err)
+	}
+	if _, err := jwtService.VerifyAccessToken(accessToken); err != nil {
+		t.Errorf("Expected access token to verify, got %v", err)
+	}
+
+	refreshToken, err := jwtService.SignRefreshToken(crypto.RefreshTokenInput{UserID: "user-1", ProjectID: "project-1"})
+	if err != nil {
+		t.Fatalf("Failed to sign refresh token: %v", err)
+	}
+	if _, err := jwtService.VerifyAccessToken(refreshToken); err == nil {
+		t.Error("Expected a refresh token not to verify as an access token")
+	}
+
+	clientToken, err := jwtService.SignClientToken(crypto.ClientTokenInput{ClientID: "client-1", ProjectID: "project-1"})
+	if err != nil {
+		t.Fatalf("Failed to sign client token: %v", err)
+	}
+	if _, err := jwtService.VerifyAccessToken(clientToken); err == nil {
+		t.Error("Expected a client token not to verify as an access token")
+	}
+}
+
+func TestGetJWKS_Format(t *testing.T) {
+	keyManager := newTestJWTService(t).GetKeyManager()
+
+	jwks := keyManager.GetJWKS()
+
+	if len(jwks.Keys) != 1 {
+		t.Errorf("expected 1 key, got %d", len(jwks.Keys))
+	}
+
+	key := jwks.Keys[0]
+	if key.Kty != "RSA" {
+		t.Errorf("expected key type RSA, got %s", key.Kty)
+	}
+	if key.Use != "sig" {
+		t.Errorf("expected use 'sig', got %s", key.Use)
+	}
+	if key.Alg != "RS256" {
+		t.Errorf("expected algorithm RS256, got %s", key.Alg)
+	}
+	if key.Kid == "" {
+		t.Error("expected key ID to be non-empty")
+	}
+	if key.N == "" {
+		t.Error("expected modulus (n) to be non-empty")
+	}
+	if key.E == "" {
+		t.Error("expected exponent (e) to be non-empty")
+	}
+
+	// Verify JSON encoding works
+	jsonBytes, err := json.Marshal(jwks)
+	if err != nil {
+		t.Fatalf("failed to marshal JWKS: %v", err)
+	}
+
+	var decoded crypto.JWKSResponse
+	if err := json.Unmarshal(jsonBytes, &decoded); err != nil {
+		t.Fatalf("failed to unmarshal JWKS: %v", err)
+	}
+
+	if len(decoded.Keys) != 1 {
+		t.Errorf("expected 1 key after round-trip, got %d", len(decoded.Keys))
+	}
+}
+
+func TestJWTService_Rotation(t *testing.T) {
+	jwtService := newTestJWTService(t)
+	keyManager := jwtService.GetKeyManager()
+	if err := keyManager.EnsureNextKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := jwtService.SignAccessToken(crypto.AccessTokenInput{
+		Email:     "user@example.com",
+		UserID:    "user-1",
+		ProjectID: "project-1",
+		Provider:  "email",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKid := keyManager.GetKeyID()
+
+	if err := keyManager.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if keyManager.GetKeyID() == oldKid {
+		t.Error("expected a new active key after rotation")
+	}
+
+	// retired, active and next keys are all published
+	if got := len(keyManager.GetJWKS().Keys); got != 3 {
+		t.Errorf("expected 3 keys after rotation, got %d", got)
+	}
+
+	if _, err := jwtService.VerifyAccessToken(token); err != nil {
+		t.Errorf("expected token signed by retired key to verify: %v", err)
+	}
+}
+
+func TestJWTService_Algorithms(t *testing.T) {
+	jwtService := newTestJWTService(t)
+	keyManager := jwtService.GetKeyManager()
+	if err := keyManager.EnsureAlgorithms(crypto.SupportedAlgorithms...); err != nil {
+		t.Fatal(err)
+	}
+
+	wantKty := map[string]string{
+		crypto.AlgorithmRS256: "RSA",
+		crypto.AlgorithmES256: "EC",
+		crypto.AlgorithmEdDSA: "OKP",
+	}
+	for _, key := range keyManager.GetJWKS().Keys {
+		if key.Kty != wantKty[key.Alg] {
+			t.Errorf("expected kty %s for %s, got %s", wantKty[key.Alg], key.Alg, key.Kty)
+		}
+	}
+
+	for _, alg := range crypto.SupportedAlgorithms {
+		token, err := jwtService.SignAccessToken(crypto.AccessTokenInput{
+			UserID:    "user-1",
+			ProjectID: "project-1",
+			Algorithm: alg,
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		if _, err := jwtService.VerifyAccessToken(token); err != nil {
+			t.Errorf("%s: expected token to verify: %v", alg, err)
+		}
+	}
+}
+
+func TestJWTService_EnvironmentIsolation(t *testing.T) {
+	jwtService := newTestJWTService(t)
+	keyManager := jwtService.GetKeyManager()
+	for _, env := range []string{"env-a", "env-b"} {
+		if err := keyManager.EnsureEnvironmentKeys(env, crypto.AlgorithmES256); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	jwksA := keyManager.EnvironmentJWKS("env-a")
+	if len(jwksA.Keys) != 1 {
+		t.Fatalf("expected 1 key for env-a, got %d", len(jwksA.Keys))
+	}
+	if jwksA.Keys[0].Kid == keyManager.EnvironmentJWKS("env-b").Keys[0].Kid {
+		t.Error("expected environments to have distinct keys")
+	}
+
+	token, err := jwtService.SignAccessToken(crypto.AccessTokenInput{
+		UserID:        "user-1",
+		ProjectID:     "project-1",
+		EnvironmentID: "env-a",
+		Algorithm:     crypto.AlgorithmES256,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jwtService.VerifyAccessToken(token); err != nil {
+		t.Errorf("expected env-a token to verify: %v", err)
+	}
+
+	// A token claiming env-b but signed with env-a's key must be rejected
+	key, _ := keyManager.SigningKey("env-a", crypto.AlgorithmES256)
+	forged := jwt.NewWithClaims(jwt.SigningMethodES256, crypto.AccessTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))},
+		EnvironmentID:    "env-b",
+	})
+	forged.Header["kid"] = key.ID
+	signed, err := forged.SignedString(key.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jwtService.VerifyAccessToken(signed); err == nil {
+		t.Error("expected token signed with another environment's key to be rejected")
+	}
+}
+
+func TestSignAccessToken_CustomClaims(t *testing.T) {
+	jwtService := newTestJWTService(t)
+
+	token, err := jwtService.SignAccessToken(crypto.AccessTokenInput{
+		UserID:       "user-1",
+		ProjectID:    "project-1",
+		CustomClaims: map[string]any{"role": "admin", "sub": "someone-else"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := jwtService.VerifyAccessToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "user-1" {
+		t.Errorf("expected custom claims not to overwrite sub, got %s", claims.Subject)
+	}
+	if claims.Custom["role"] != "admin" {
+		t.Errorf("expected role claim to round-trip, got %v", claims.Custom["role"])
+	}
+}
+
+func TestSignIDToken(t *testing.T) {
+	jwtService := newTestJWTService(t)
+	keyManager := jwtService.GetKeyManager()
+	if err := keyManager.EnsureEnvironmentKeys("env-a", crypto.AlgorithmES256); err != nil {
+		t.Fatal(err)
+	}
+
+	idToken, err := jwtService.SignIDToken(crypto.IDTokenInput{
+		Issuer:        "https://auth.example.com/oidc/env-a",
+		UserID:        "user-1",
+		ClientID:      "oidc_client",
+		EnvironmentID: "env-a",
+		Nonce:         "n-0S6_WzA2Mj",
+		AuthTime:      time.Now(),
+		Algorithm:     crypto.AlgorithmES256,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := &crypto.IDTokenClaims{}
+	_, err = jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (any, error) {
+		for _, key := range keyManager.EnvironmentJWKS("env-a").Keys {
+			if key.Kid == token.Header["kid"] {
+				k, _ := keyManager.SigningKey("env-a", crypto.AlgorithmES256)
+				return k.PublicKey(), nil
+			}
+		}
+		return nil, fmt.Errorf("kid not published in JWKS")
+	})
+	if err != nil {
+		t.Fatalf("expected ID token to verify with the environment's JWKS: %v", err)
+	}
+	if claims.Nonce != "n-0S6_WzA2Mj" || claims.Audience[0] != "oidc_client" {
+		t.Errorf("unexpected ID token claims: %+v", claims)
+	}
+
+	if _, err := jwtService.VerifyAccessToken(idToken); err == nil {
+		t.Error("expected ID token to be rejected as an access token")
+	}
+}
+
+func TestSignClientToken(t *testing.T) {
+	jwtService := newTestJWTService(t)
+
+	token, err := jwtService.SignClientToken(crypto.ClientTokenInput{
+		ClientID:  "pk_backend",
+		ProjectID: "project-1",
+		Scopes:    []string{"jobs:read", "jobs:write"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := jwtService.VerifyClientToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "pk_backend" || claims.Scope != "jobs:read jobs:write" {
+		t.Errorf("unexpected client token claims: %+v", claims)
+	}
+
+	if _, err := jwtService.VerifyAccessToken(token); err == nil {
+		t.Error("expected client token to be rejected as a user access token")
+	}
+	if _, err := jwtService.VerifyRefreshToken(token); err == nil {
+		t.Error("expected client token to be rejected as a refresh token")
+	}
+}
+
+func TestSignAccessToken_ActorClaim(t *testing.T) {
+	jwtService := newTestJWTService(t)
+
+	token, err := jwtService.SignAccessToken(crypto.AccessTokenInput{
+		UserID:       "user-1",
+		ProjectID:    "project-1",
+		Actor:        &crypto.Actor{Subject: "owner-1", Email: "owner@example.com"},
+		CustomClaims: map[string]any{"act": map[string]any{"sub": "someone-else"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := jwtService.VerifyAccessToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Actor == nil || claims.Actor.Subject != "owner-1" {
+		t.Errorf("expected act claim to identify the owner, got %+v", claims.Actor)
+	}
+}
+
+func TestSignAccessToken_AuthenticationClaims(t *testing.T) {
+	jwtService := newTestJWTService(t)
+
+	authTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	token, err := jwtService.SignAccessToken(crypto.AccessTokenInput{
+		UserID:       "user-1",
+		ProjectID:    "project-1",
+		AuthTime:     authTime,
+		AMR:          []string{"otp"},
+		CustomClaims: map[string]any{"auth_time": 0, "amr": []string{"mfa"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := jwtService.VerifyAccessToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.AuthTime != authTime.Unix() {
+		t.Errorf("expected auth_time %d, got %d", authTime.Unix(), claims.AuthTime)
+	}
+	if len(claims.AMR) != 1 || claims.AMR[0] != "otp" {
+		t.Errorf("expected amr [otp], got %v", claims.AMR)
+	}
+}
@@ -1,6 +1,10 @@
 package crypto
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
@@ -9,17 +13,90 @@ import (
 	"encoding/pem"
 	"fmt"
 	"math/big"
+	"sync"
+	"time"
 )
 
 const (
 	KeySize = 2048
 )
 
-// KeyManager handles RSA key pair management for JWT signing
+// Supported JWT signing algorithms
+const (
+	AlgorithmRS256 = "RS256"
+	AlgorithmES256 = "ES256"
+	AlgorithmEdDSA = "EdDSA"
+
+	// DefaultAlgorithm signs tokens for environments that haven't picked one
+	DefaultAlgorithm = AlgorithmRS256
+)
+
+// SupportedAlgorithms lists every algorithm the key ring can hold keys for
+var SupportedAlgorithms = []string{AlgorithmRS256, AlgorithmES256, AlgorithmEdDSA}
+
+// IsSupportedAlgorithm reports whether alg is one of SupportedAlgorithms
+func IsSupportedAlgorithm(alg string) bool {
+	for _, supported := range SupportedAlgorithms {
+		if alg == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyStatus describes where a signing key is in its rotation lifecycle.
+type KeyStatus string
+
+const (
+	// KeyStatusNext keys are published ahead of use so verifier caches
+	// already know them by the time they start signing.
+	KeyStatusNext KeyStatus = "next"
+	// KeyStatusActive is the single key per algorithm used to sign new tokens.
+	KeyStatusActive KeyStatus = "active"
+	// KeyStatusRetired keys no longer sign but keep verifying until every
+	// token they signed has expired.
+	KeyStatusRetired KeyStatus = "retired"
+)
+
+// SigningKey is one key pair in the key ring
+type SigningKey struct {
+	ID            string
+	EnvironmentID string // empty for platform keys
+	Algorithm     string
+	Status        KeyStatus
+	PrivateKey    crypto.Signer
+	CreatedAt     time.Time
+	ActivatedAt   *time.Time // set once the key starts signing
+	ExpiresAt     *time.Time // set once the key is retired
+}
+
+func (k *SigningKey) expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+// PublicKey returns the public half of the key pair
+func (k *SigningKey) PublicKey() crypto.PublicKey {
+	return k.PrivateKey.Public()
+}
+
+// KeyManager holds the keys used for JWT signing and verification. Keys are
+// grouped into rings, one per environment and algorithm, and each ring
+// rotates independently with at most one active key. Platform keys (no
+// environment) sign for environments that have no keys of their own.
 type KeyManager struct {
-	privateKey *rsa.PrivateKey
-	publicKey  *rsa.PublicKey
-	keyID      string
+	mu          sync.RWMutex
+	keys        []*SigningKey
+	missHandler func()
+}
+
+// ring identifies the keys of one environment and algorithm
+type ring struct {
+	environmentID string
+	algorithm     string
+}
+
+func (k *SigningKey) ring() ring {
+	return ring{environmentID: k.EnvironmentID, algorithm: k.Algorithm}
 }
 
 // JWK represents a JSON Web Key
@@ -28,8 +105,11 @@ type JWK struct {
 	Use string `json:"use"`
 	Kid string `json:"kid"`
 	Alg string `json:"alg"`
-	N   string `json:"n"`
-	E   string `json:"e"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
 }
 
 // JWKSResponse represents the JWKS endpoint response
@@ -42,29 +122,24 @@ func NewKeyManager() *KeyManager {
 	return &KeyManager{}
 }
 
-// LoadFromPEM loads an RSA private key from PEM-encoded string
+// LoadFromPEM loads a private key from PEM-encoded string as the active
+// platform key for its algorithm
 func (km *KeyManager) LoadFromPEM(privateKeyPEM string) error {
 	block, _ := pem.Decode([]byte(privateKeyPEM))
 	if block == nil {
 		return fmt.Errorf("failed to decode PEM block")
 	}
 
-	var privateKey *rsa.PrivateKey
+	var privateKey crypto.Signer
 	var err error
 
 	switch block.Type {
 	case "RSA PRIVATE KEY":
 		privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		privateKey, err = x509.ParseECPrivateKey(block.Bytes)
 	case "PRIVATE KEY":
-		key, parseErr := x509.ParsePKCS8PrivateKey(block.Bytes)
-		if parseErr != nil {
-			return fmt.Errorf("failed to parse PKCS8 private key: %w", parseErr)
-		}
-		var ok bool
-		privateKey, ok = key.(*rsa.PrivateKey)
-		if !ok {
-			return fmt.Errorf("key is not an RSA private key")
-		}
+		privateKey, err = ParsePrivateKey(block.Bytes)
 	default:
 		return fmt.Errorf("unsupported key type: %s", block.Type)
 	}
@@ -73,93 +148,591 @@ func (km *KeyManager) LoadFromPEM(privateKeyPEM string) error {
 		return fmt.Errorf("failed to parse private key: %w", err)
 	}
 
-	km.privateKey = privateKey
-	km.publicKey = &privateKey.PublicKey
-	km.keyID = km.generateKeyID()
+	key, err := newSigningKey(privateKey, KeyStatusActive)
+	if err != nil {
+		return err
+	}
+	km.setActive(key)
 
 	return nil
 }
 
-// GenerateKeyPair generates a new RSA key pair (for development)
+// GenerateKeyPair generates a new RSA key pair as the active platform key (for development)
 func (km *KeyManager) GenerateKeyPair() error {
-	privateKey, err := rsa.GenerateKey(rand.Reader, KeySize)
+	key, err := generateSigningKey(ring{algorithm: DefaultAlgorithm}, KeyStatusActive)
 	if err != nil {
-		return fmt.Errorf("failed to generate RSA key pair: %w", err)
+		return err
 	}
 
-	km.privateKey = privateKey
-	km.publicKey = &privateKey.PublicKey
-	km.keyID = km.generateKeyID()
+	km.setActive(key)
 
 	return nil
 }
 
-// generateKeyID creates a unique key ID based on the public key thumbprint
-func (km *KeyManager) generateKeyID() string {
-	if km.publicKey == nil {
-		return ""
+// setActive replaces the ring with a single active key
+func (km *KeyManager) setActive(key *SigningKey) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	km.keys = []*SigningKey{key}
+}
+
+// SetKeys replaces the ring with keys loaded from a key store
+func (km *KeyManager) SetKeys(keys []SigningKey) {
+	loaded := make([]*SigningKey, 0, len(keys))
+	for i := range keys {
+		key := keys[i]
+		loaded = append(loaded, &key)
+	}
+
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	km.keys = loaded
+}
+
+// SetMissHandler registers fn to be called when verification meets an
+// unknown key, giving it a chance to reload keys created by other replicas
+func (km *KeyManager) SetMissHandler(fn func()) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	km.missHandler = fn
+}
+
+// EnsureAlgorithms generates an active platform key for each algorithm that
+// has none
+func (km *KeyManager) EnsureAlgorithms(algorithms ...string) error {
+	for _, alg := range algorithms {
+		if err := km.ensureActive(ring{algorithm: alg}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EnsureEnvironmentKeys generates an active key for an environment and
+// algorithm if it has none
+func (km *KeyManager) EnsureEnvironmentKeys(environmentID, algorithm string) error {
+	return km.ensureActive(ring{environmentID: environmentID, algorithm: algorithm})
+}
+
+func (km *KeyManager) ensureActive(r ring) error {
+	if km.findByStatus(r, KeyStatusActive) != nil {
+		return nil
+	}
+
+	key, err := generateSigningKey(r, KeyStatusActive)
+	if err != nil {
+		return err
+	}
+	km.add(key)
+	return nil
+}
+
+// InheritPlatformKeys copies the platform keys that may have signed tokens
+// into an environment as retired keys, so tokens issued before the
+// environment had keys of its own keep verifying until they expire.
+func (km *KeyManager) InheritPlatformKeys(environmentID string) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	now := time.Now()
+	expiresAt := now.Add(MaxTokenLifetime)
+	for _, key := range km.keys {
+		if key.EnvironmentID != "" || key.Status == KeyStatusNext || key.expired(now) {
+			continue
+		}
+
+		inherited := *key
+		inherited.EnvironmentID = environmentID
+		inherited.Status = KeyStatusRetired
+		if inherited.ExpiresAt == nil || inherited.ExpiresAt.After(expiresAt) {
+			inherited.ExpiresAt = &expiresAt
+		}
+		km.keys = append(km.keys, &inherited)
+	}
+}
+
+// HasEnvironmentKeys reports whether an environment has keys of its own
+func (km *KeyManager) HasEnvironmentKeys(environmentID string) bool {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+
+	return km.hasEnvironmentKeysLocked(environmentID)
+}
+
+func (km *KeyManager) hasEnvironmentKeysLocked(environmentID string) bool {
+	for _, key := range km.keys {
+		if key.EnvironmentID == environmentID {
+			return true
+		}
+	}
+	return false
+}
+
+// EnsureNextKey generates and publishes a next key for every active ring that
+// has none
+func (km *KeyManager) EnsureNextKey() error {
+	for _, r := range km.activeRings() {
+		if km.findByStatus(r, KeyStatusNext) != nil {
+			continue
+		}
+
+		key, err := generateSigningKey(r, KeyStatusNext)
+		if err != nil {
+			return err
+		}
+		km.add(key)
+	}
+	return nil
+}
+
+func (km *KeyManager) add(key *SigningKey) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	km.keys = append(km.keys, key)
+}
+
+// Rotate rotates every active ring. The next key of each ring becomes active and the
+// current active key is retired. Retired keys keep verifying for
+// MaxTokenLifetime so tokens they already signed stay valid, and fresh next
+// keys are generated for the following rotation.
+func (km *KeyManager) Rotate() error {
+	rings := km.activeRings()
+	if len(rings) == 0 {
+		rings = []ring{{algorithm: DefaultAlgorithm}}
+	}
+	return km.rotate(rings)
+}
+
+// RotateEnvironment rotates only the rings of one environment, leaving every
+// other environment's keys untouched
+func (km *KeyManager) RotateEnvironment(environmentID string) error {
+	var rings []ring
+	for _, r := range km.activeRings() {
+		if r.environmentID == environmentID {
+			rings = append(rings, r)
+		}
+	}
+	return km.rotate(rings)
+}
+
+func (km *KeyManager) rotate(rings []ring) error {
+	var generated []*SigningKey
+	for _, r := range rings {
+		if km.findByStatus(r, KeyStatusNext) == nil {
+			key, err := generateSigningKey(r, KeyStatusNext)
+			if err != nil {
+				return err
+			}
+			generated = append(generated, key)
+		}
+	}
+
+	upcoming := make([]*SigningKey, 0, len(rings))
+	for _, r := range rings {
+		key, err := generateSigningKey(r, KeyStatusNext)
+		if err != nil {
+			return err
+		}
+		upcoming = append(upcoming, key)
+	}
+
+	rotating := make(map[ring]bool, len(rings))
+	for _, r := range rings {
+		rotating[r] = true
+	}
+
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	km.keys = append(km.keys, generated...)
+
+	now := time.Now()
+	expiresAt := now.Add(MaxTokenLifetime)
+	for _, key := range km.keys {
+		if !rotating[key.ring()] {
+			continue
+		}
+		switch key.Status {
+		case KeyStatusActive:
+			key.Status = KeyStatusRetired
+			key.ExpiresAt = &expiresAt
+		case KeyStatusNext:
+			key.Status = KeyStatusActive
+			key.ActivatedAt = &now
+		}
+	}
+	km.keys = append(km.keys, upcoming...)
+
+	km.pruneLocked(now)
+	return nil
+}
+
+// Prune drops retired keys whose verification window has passed
+func (km *KeyManager) Prune() {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	km.pruneLocked(time.Now())
+}
+
+func (km *KeyManager) pruneLocked(now time.Time) {
+	kept := km.keys[:0]
+	for _, key := range km.keys {
+		if !key.expired(now) {
+			kept = append(kept, key)
+		}
+	}
+	km.keys = kept
+}
+
+// Keys returns a snapshot of the key ring
+func (km *KeyManager) Keys() []SigningKey {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+
+	keys := make([]SigningKey, 0, len(km.keys))
+	for _, key := range km.keys {
+		keys = append(keys, *key)
+	}
+	return keys
+}
+
+// activeRings returns the rings that have an active key. Rings left with
+// only retired keys, such as inherited platform keys, are not rotated.
+func (km *KeyManager) activeRings() []ring {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+
+	var rings []ring
+	seen := make(map[ring]bool)
+	for _, key := range km.keys {
+		if key.Status != KeyStatusActive {
+			continue
+		}
+		if r := key.ring(); !seen[r] {
+			seen[r] = true
+			rings = append(rings, r)
+		}
+	}
+	return rings
+}
+
+// ActiveEnvironments returns the IDs of environments, "" for the platform,
+// that have an active key activated before cutoff
+func (km *KeyManager) ActiveEnvironments(cutoff time.Time) []string {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+
+	var environmentIDs []string
+	seen := make(map[string]bool)
+	for _, key := range km.keys {
+		if key.Status != KeyStatusActive || key.ActivatedAt == nil || !key.ActivatedAt.Before(cutoff) {
+			continue
+		}
+		if !seen[key.EnvironmentID] {
+			seen[key.EnvironmentID] = true
+			environmentIDs = append(environmentIDs, key.EnvironmentID)
+		}
+	}
+	return environmentIDs
+}
+
+func (km *KeyManager) findByStatus(r ring, status KeyStatus) *SigningKey {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+
+	for _, key := range km.keys {
+		if key.ring() == r && key.Status == status {
+			return key
+		}
+	}
+	return nil
+}
+
+// SigningKey returns the key currently signing an environment's tokens with
+// an algorithm. Environments without keys of their own use the platform keys.
+func (km *KeyManager) SigningKey(environmentID, algorithm string) (SigningKey, bool) {
+	if environmentID != "" && !km.HasEnvironmentKeys(environmentID) {
+		environmentID = ""
+	}
+
+	if key := km.findByStatus(ring{environmentID: environmentID, algorithm: algorithm}, KeyStatusActive); key != nil {
+		return *key, true
+	}
+	return SigningKey{}, false
+}
+
+// VerificationKey returns the key for a kid among the keys trusted for an
+// environment, as long as it has not expired. On a miss the miss handler is
+// given one chance to load the key.
+func (km *KeyManager) VerificationKey(environmentID, kid string) (SigningKey, bool) {
+	if key, ok := km.verificationKey(environmentID, kid); ok {
+		return key, true
+	}
+
+	km.mu.RLock()
+	missHandler := km.missHandler
+	km.mu.RUnlock()
+
+	if missHandler == nil {
+		return SigningKey{}, false
+	}
+	missHandler()
+	return km.verificationKey(environmentID, kid)
+}
+
+func (km *KeyManager) verificationKey(environmentID, kid string) (SigningKey, bool) {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+
+	if environmentID != "" && !km.hasEnvironmentKeysLocked(environmentID) {
+		environmentID = ""
+	}
+
+	now := time.Now()
+	for _, key := range km.keys {
+		if key.EnvironmentID == environmentID && key.ID == kid && !key.expired(now) {
+			return *key, true
+		}
+	}
+	return SigningKey{}, false
+}
+
+func generateSigningKey(r ring, status KeyStatus) (*SigningKey, error) {
+	var privateKey crypto.Signer
+	var err error
+
+	alg := r.algorithm
+	switch alg {
+	case AlgorithmRS256:
+		privateKey, err = rsa.GenerateKey(rand.Reader, KeySize)
+	case AlgorithmES256:
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgorithmEdDSA:
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm: %s", alg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate %s key pair: %w", alg, err)
+	}
+
+	key, err := newSigningKey(privateKey, status)
+	if err != nil {
+		return nil, err
 	}
+	key.EnvironmentID = r.environmentID
+	return key, nil
+}
+
+func newSigningKey(privateKey crypto.Signer, status KeyStatus) (*SigningKey, error) {
+	alg, err := algorithmFor(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	kid, err := generateKeyID(privateKey.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	key := &SigningKey{
+		ID:         kid,
+		Algorithm:  alg,
+		Status:     status,
+		PrivateKey: privateKey,
+		CreatedAt:  now,
+	}
+	if status == KeyStatusActive {
+		key.ActivatedAt = &now
+	}
+	return key, nil
+}
+
+// algorithmFor returns the JWT algorithm a private key signs with
+func algorithmFor(privateKey crypto.Signer) (string, error) {
+	switch k := privateKey.(type) {
+	case *rsa.PrivateKey:
+		return AlgorithmRS256, nil
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return "", fmt.Errorf("unsupported elliptic curve: %s", k.Curve.Params().Name)
+		}
+		return AlgorithmES256, nil
+	case ed25519.PrivateKey:
+		return AlgorithmEdDSA, nil
+	default:
+		return "", fmt.Errorf("unsupported private key type %T", privateKey)
+	}
+}
 
-	// Create thumbprint from public key components
-	nBytes := km.publicKey.N.Bytes()
-	eBytes := big.NewInt(int64(km.publicKey.E)).Bytes()
+// MarshalPrivateKey encodes a private key as PKCS#8 DER for storage
+func MarshalPrivateKey(privateKey crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal private key: %w", err)
+	}
+	return der, nil
+}
 
+// ParsePrivateKey decodes a PKCS#8 DER private key produced by MarshalPrivateKey
+func ParsePrivateKey(der []byte) (crypto.Signer, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse PKCS8 private key: %w", err)
+	}
+	privateKey, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	if _, err := algorithmFor(privateKey); err != nil {
+		return nil, err
+	}
+	return privateKey, nil
+}
+
+// generateKeyID creates a unique key ID based on the public key thumbprint
+func generateKeyID(publicKey crypto.PublicKey) (string, error) {
 	hash := sha256.New()
-	hash.Write(nBytes)
-	hash.Write(eBytes)
 
-	return base64.RawURLEncoding.EncodeToString(hash.Sum(nil))[:16]
+	switch k := publicKey.(type) {
+	case *rsa.PublicKey:
+		// Create thumbprint from public key components
+		hash.Write(k.N.Bytes())
+		hash.Write(big.NewInt(int64(k.E)).Bytes())
+	default:
+		der, err := x509.MarshalPKIXPublicKey(publicKey)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal public key: %w", err)
+		}
+		hash.Write(der)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(hash.Sum(nil))[:16], nil
 }
 
-// GetPrivateKey returns the private key for signing
-func (km *KeyManager) GetPrivateKey() *rsa.PrivateKey {
-	return km.privateKey
+// GetPrivateKey returns the active platform private key of the default algorithm
+func (km *KeyManager) GetPrivateKey() crypto.Signer {
+	if key, ok := km.SigningKey("", DefaultAlgorithm); ok {
+		return key.PrivateKey
+	}
+	return nil
 }
 
-// GetPublicKey returns the public key for verification
-func (km *KeyManager) GetPublicKey() *rsa.PublicKey {
-	return km.publicKey
+// GetPublicKey returns the active platform public key of the default algorithm
+func (km *KeyManager) GetPublicKey() crypto.PublicKey {
+	if key, ok := km.SigningKey("", DefaultAlgorithm); ok {
+		return key.PublicKey()
+	}
+	return nil
 }
 
-// GetKeyID returns the key identifier
+// GetKeyID returns the active platform key identifier of the default algorithm
 func (km *KeyManager) GetKeyID() string {
-	return km.keyID
+	if key, ok := km.SigningKey("", DefaultAlgorithm); ok {
+		return key.ID
+	}
+	return ""
 }
 
-// GetJWKS returns the JSON Web Key Set for the public key
+// GetJWKS returns the JSON Web Key Set for every non-expired platform key
 func (km *KeyManager) GetJWKS() JWKSResponse {
-	if km.publicKey == nil {
-		return JWKSResponse{Keys: []JWK{}}
+	return km.EnvironmentJWKS()
+}
+
+// EnvironmentJWKS returns the JSON Web Key Set trusted for a set of
+// environments: their own non-expired keys, plus the platform keys for any
+// environment without keys of its own.
+func (km *KeyManager) EnvironmentJWKS(environmentIDs ...string) JWKSResponse {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+
+	scopes := make(map[string]bool)
+	if len(environmentIDs) == 0 {
+		scopes[""] = true
+	}
+	for _, environmentID := range environmentIDs {
+		if km.hasEnvironmentKeysLocked(environmentID) {
+			scopes[environmentID] = true
+		} else {
+			scopes[""] = true
+		}
+	}
+
+	now := time.Now()
+	jwks := JWKSResponse{Keys: []JWK{}}
+	for _, key := range km.keys {
+		if !scopes[key.EnvironmentID] || key.expired(now) {
+			continue
+		}
+		jwks.Keys = append(jwks.Keys, key.JWK())
 	}
 
+	return jwks
+}
+
+// JWK returns the public key in JSON Web Key form
+func (k *SigningKey) JWK() JWK {
 	jwk := JWK{
-		Kty: "RSA",
 		Use: "sig",
-		Kid: km.keyID,
-		Alg: "RS256",
-		N:   base64.RawURLEncoding.EncodeToString(km.publicKey.N.Bytes()),
-		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(km.publicKey.E)).Bytes()),
+		Kid: k.ID,
+		Alg: k.Algorithm,
 	}
 
-	return JWKSResponse{Keys: []JWK{jwk}}
+	switch publicKey := k.PublicKey().(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+	case *ecdsa.PublicKey:
+		// Coordinates are left-padded to the curve size as RFC 7518 requires
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = publicKey.Curve.Params().Name
+		jwk.X = base64.RawURLEncoding.EncodeToString(publicKey.X.FillBytes(make([]byte, size)))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(publicKey.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(publicKey)
+	}
+
+	return jwk
 }
 
-// ExportPrivateKeyPEM exports the private key in PEM format (for backup/storage)
+// ExportPrivateKeyPEM exports the active private key in PEM format (for backup/storage)
 func (km *KeyManager) ExportPrivateKeyPEM() (string, error) {
-	if km.privateKey == nil {
+	privateKey := km.GetPrivateKey()
+	if privateKey == nil {
 		return "", fmt.Errorf("no private key loaded")
 	}
 
-	privateKeyBytes := x509.MarshalPKCS1PrivateKey(km.privateKey)
+	privateKeyBytes, err := MarshalPrivateKey(privateKey)
+	if err != nil {
+		return "", err
+	}
 	privateKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PRIVATE KEY",
+		Type:  "PRIVATE KEY",
 		Bytes: privateKeyBytes,
 	})
 
 	return string(privateKeyPEM), nil
 }
 
-// IsLoaded returns true if keys are loaded
+// IsLoaded returns true if any active signing key is loaded
 func (km *KeyManager) IsLoaded() bool {
-	return km.privateKey != nil && km.publicKey != nil
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+
+	for _, key := range km.keys {
+		if key.Status == KeyStatusActive {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,48 @@
+package crypto_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcioecom/permit/internal/crypto"
+)
+
+func TestTOTPCode_RFC6238Vectors(t *testing.T) {
+	// SHA-1 test vectors from RFC 6238 appendix B, truncated to six digits
+	secret := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for unix, want := range vectors {
+		if got := crypto.TOTPCode(secret, crypto.TOTPStep(time.Unix(unix, 0))); got != want {
+			t.Errorf("TOTPCode at %d = %s, want %s", unix, got, want)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret, err := crypto.GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	step := crypto.TOTPStep(now)
+
+	if matched, ok := crypto.VerifyTOTP(secret, crypto.TOTPCode(secret, step-1), now); !ok || matched != step-1 {
+		t.Errorf("Expected the previous step's code to be accepted for clock drift, got %d %v", matched, ok)
+	}
+	if _, ok := crypto.VerifyTOTP(secret, crypto.TOTPCode(secret, step-2), now); ok {
+		t.Error("Expected a code two steps old to be rejected")
+	}
+
+	uri := crypto.TOTPProvisioningURI("Acme", "user@example.com", secret)
+	if !strings.HasPrefix(uri, "otpauth://totp/Acme:user@example.com?") || !strings.Contains(uri, "secret="+crypto.EncodeTOTPSecret(secret)) {
+		t.Errorf("Unexpected provisioning URI %s", uri)
+	}
+}
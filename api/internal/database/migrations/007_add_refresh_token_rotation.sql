@@ -0,0 +1,12 @@
+-- +migrate Up
+ALTER TABLE refresh_tokens ADD COLUMN family_id TEXT;
+UPDATE refresh_tokens SET family_id = id;
+ALTER TABLE refresh_tokens ALTER COLUMN family_id SET NOT NULL;
+ALTER TABLE refresh_tokens ADD COLUMN replaced_by TEXT;
+
+CREATE INDEX idx_refresh_tokens_family ON refresh_tokens(family_id);
+
+-- +migrate Down
+DROP INDEX IF EXISTS idx_refresh_tokens_family;
+ALTER TABLE refresh_tokens DROP COLUMN IF EXISTS replaced_by;
+ALTER TABLE refresh_tokens DROP COLUMN IF EXISTS family_id;
@@ -0,0 +1,15 @@
+-- +migrate Up
+CREATE TABLE revoked_access_tokens (
+    jti TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_revoked_access_tokens_expires ON revoked_access_tokens(expires_at);
+
+CREATE INDEX idx_refresh_tokens_user_env ON refresh_tokens(user_id, environment_id);
+
+-- +migrate Down
+DROP INDEX IF EXISTS idx_refresh_tokens_user_env;
+DROP TABLE IF EXISTS revoked_access_tokens;
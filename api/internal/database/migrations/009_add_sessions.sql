@@ -0,0 +1,26 @@
+-- +migrate Up
+CREATE TABLE sessions (
+    id TEXT PRIMARY KEY, -- refresh token family ID
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    project_id TEXT NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    environment_id TEXT NOT NULL REFERENCES environments(id) ON DELETE CASCADE,
+    provider TEXT,
+    ip_address TEXT,
+    user_agent TEXT,
+    expires_at TIMESTAMPTZ NOT NULL,
+    revoked_at TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_sessions_user_env ON sessions(user_id, environment_id);
+
+-- Backfill one session per existing refresh token family
+INSERT INTO sessions (id, user_id, project_id, environment_id, expires_at, revoked_at, last_used_at, created_at)
+SELECT DISTINCT ON (family_id)
+    family_id, user_id, project_id, environment_id, expires_at, revoked_at, created_at, created_at
+FROM refresh_tokens
+ORDER BY family_id, created_at DESC;
+
+-- +migrate Down
+DROP TABLE IF EXISTS sessions;
@@ -0,0 +1,12 @@
+-- +migrate Up
+CREATE TABLE signing_keys (
+    id TEXT PRIMARY KEY, -- kid
+    status TEXT NOT NULL CHECK (status IN ('next', 'active', 'retired')),
+    private_key BYTEA NOT NULL, -- PKCS#8 DER encrypted with the master key
+    activated_at TIMESTAMPTZ,
+    expires_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS signing_keys;
@@ -0,0 +1,9 @@
+-- +migrate Up
+ALTER TABLE environments ADD COLUMN signing_algorithm TEXT NOT NULL DEFAULT 'RS256'
+    CHECK (signing_algorithm IN ('RS256', 'ES256', 'EdDSA'));
+
+ALTER TABLE signing_keys ADD COLUMN algorithm TEXT NOT NULL DEFAULT 'RS256';
+
+-- +migrate Down
+ALTER TABLE signing_keys DROP COLUMN IF EXISTS algorithm;
+ALTER TABLE environments DROP COLUMN IF EXISTS signing_algorithm;
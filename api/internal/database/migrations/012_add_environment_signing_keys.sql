@@ -0,0 +1,13 @@
+-- +migrate Up
+-- Keys are scoped to an environment; platform keys have no environment.
+-- Environments inherit retired copies of the platform keys, so the same kid
+-- may appear once per scope.
+ALTER TABLE signing_keys ADD COLUMN environment_id TEXT REFERENCES environments(id) ON DELETE CASCADE;
+ALTER TABLE signing_keys DROP CONSTRAINT signing_keys_pkey;
+CREATE UNIQUE INDEX uq_signing_keys_scope ON signing_keys ((COALESCE(environment_id, '')), id);
+
+-- +migrate Down
+DELETE FROM signing_keys WHERE environment_id IS NOT NULL;
+DROP INDEX IF EXISTS uq_signing_keys_scope;
+ALTER TABLE signing_keys ADD PRIMARY KEY (id);
+ALTER TABLE signing_keys DROP COLUMN IF EXISTS environment_id;
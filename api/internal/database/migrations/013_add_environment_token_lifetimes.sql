@@ -0,0 +1,14 @@
+-- +migrate Up
+-- Lifetimes are in seconds; a zero idle timeout or session lifetime disables it
+ALTER TABLE environments
+    ADD COLUMN access_token_ttl INTEGER NOT NULL DEFAULT 900,
+    ADD COLUMN refresh_token_ttl INTEGER NOT NULL DEFAULT 604800,
+    ADD COLUMN session_idle_timeout INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN session_max_lifetime INTEGER NOT NULL DEFAULT 0;
+
+-- +migrate Down
+ALTER TABLE environments
+    DROP COLUMN IF EXISTS access_token_ttl,
+    DROP COLUMN IF EXISTS refresh_token_ttl,
+    DROP COLUMN IF EXISTS session_idle_timeout,
+    DROP COLUMN IF EXISTS session_max_lifetime;
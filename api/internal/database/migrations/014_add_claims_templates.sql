@@ -0,0 +1,9 @@
+-- +migrate Up
+ALTER TABLE projects ADD COLUMN claims_template JSONB NOT NULL DEFAULT '{}'::jsonb;
+
+-- Per-user data owners can reference from claims templates as user.metadata
+ALTER TABLE project_users ADD COLUMN metadata JSONB NOT NULL DEFAULT '{}'::jsonb;
+
+-- +migrate Down
+ALTER TABLE project_users DROP COLUMN IF EXISTS metadata;
+ALTER TABLE projects DROP COLUMN IF EXISTS claims_template;
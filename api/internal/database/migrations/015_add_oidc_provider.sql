@@ -0,0 +1,53 @@
+-- +migrate Up
+-- Page of the customer's app where users sign in during an OIDC authorization
+ALTER TABLE environments ADD COLUMN login_url TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE oidc_clients (
+    id TEXT PRIMARY KEY, -- ULID
+    environment_id TEXT NOT NULL REFERENCES environments(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    client_id TEXT NOT NULL UNIQUE,
+    client_secret_hash TEXT, -- NULL for public clients, which must use PKCE
+    redirect_uris TEXT[] NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_oidc_clients_env ON oidc_clients(environment_id);
+
+-- Authorization requests waiting for the user to sign in
+CREATE TABLE oidc_authorization_requests (
+    id TEXT PRIMARY KEY, -- login challenge
+    environment_id TEXT NOT NULL REFERENCES environments(id) ON DELETE CASCADE,
+    client_id TEXT NOT NULL REFERENCES oidc_clients(client_id) ON DELETE CASCADE,
+    redirect_uri TEXT NOT NULL,
+    scope TEXT NOT NULL,
+    state TEXT NOT NULL DEFAULT '',
+    nonce TEXT NOT NULL DEFAULT '',
+    code_challenge TEXT NOT NULL DEFAULT '',
+    code_challenge_method TEXT NOT NULL DEFAULT '',
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_oidc_authorization_requests_expires ON oidc_authorization_requests(expires_at);
+
+-- Codes issued to relying parties carry the request they answer
+ALTER TABLE oauth_authorization_codes
+    ADD COLUMN client_id TEXT,
+    ADD COLUMN redirect_uri TEXT,
+    ADD COLUMN scope TEXT,
+    ADD COLUMN nonce TEXT,
+    ADD COLUMN code_challenge TEXT,
+    ADD COLUMN code_challenge_method TEXT;
+
+-- +migrate Down
+ALTER TABLE oauth_authorization_codes
+    DROP COLUMN IF EXISTS client_id,
+    DROP COLUMN IF EXISTS redirect_uri,
+    DROP COLUMN IF EXISTS scope,
+    DROP COLUMN IF EXISTS nonce,
+    DROP COLUMN IF EXISTS code_challenge,
+    DROP COLUMN IF EXISTS code_challenge_method;
+DROP TABLE IF EXISTS oidc_authorization_requests;
+DROP TABLE IF EXISTS oidc_clients;
+ALTER TABLE environments DROP COLUMN IF EXISTS login_url;
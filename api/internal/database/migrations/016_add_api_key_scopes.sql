@@ -0,0 +1,6 @@
+-- +migrate Up
+-- Scopes an API key may request through the client credentials grant
+ALTER TABLE project_api_keys ADD COLUMN scopes TEXT[] NOT NULL DEFAULT '{}';
+
+-- +migrate Down
+ALTER TABLE project_api_keys DROP COLUMN IF EXISTS scopes;
@@ -0,0 +1,10 @@
+-- +migrate Up
+ALTER TABLE sessions ADD COLUMN auth_time TIMESTAMPTZ NOT NULL DEFAULT NOW();
+ALTER TABLE sessions ADD COLUMN amr TEXT[] NOT NULL DEFAULT '{}';
+
+-- Existing sessions were authenticated when they were created
+UPDATE sessions SET auth_time = created_at;
+
+-- +migrate Down
+ALTER TABLE sessions DROP COLUMN IF EXISTS amr;
+ALTER TABLE sessions DROP COLUMN IF EXISTS auth_time;
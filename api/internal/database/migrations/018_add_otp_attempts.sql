@@ -0,0 +1,19 @@
+-- +migrate Up
+-- Wrong guesses against a user's pending codes; a code is dead once it
+-- reaches the limit
+ALTER TABLE otp_codes ADD COLUMN attempts INT NOT NULL DEFAULT 0;
+
+-- Failed verifications per email or IP, driving progressive lockouts
+CREATE TABLE login_attempts (
+    project_id TEXT NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    subject TEXT NOT NULL, -- "email:<address>" or "ip:<address>"
+    failures INT NOT NULL DEFAULT 0,
+    lockouts INT NOT NULL DEFAULT 0,
+    locked_until TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (project_id, subject)
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS login_attempts;
+ALTER TABLE otp_codes DROP COLUMN IF EXISTS attempts;
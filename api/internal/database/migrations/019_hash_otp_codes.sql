@@ -0,0 +1,15 @@
+-- +migrate Up
+-- Codes are stored as keyed hashes from now on. Pending plaintext codes can't
+-- be converted and are dropped; users request a new one.
+DELETE FROM otp_codes WHERE used_at IS NULL;
+ALTER TABLE otp_codes ADD COLUMN code_hash TEXT NOT NULL DEFAULT '';
+ALTER TABLE otp_codes ALTER COLUMN code_hash DROP DEFAULT;
+DROP INDEX IF EXISTS idx_otp_lookup;
+ALTER TABLE otp_codes DROP COLUMN code;
+CREATE INDEX idx_otp_pending ON otp_codes(project_id, user_id) WHERE used_at IS NULL;
+
+-- +migrate Down
+DROP INDEX IF EXISTS idx_otp_pending;
+ALTER TABLE otp_codes ADD COLUMN code TEXT NOT NULL DEFAULT '';
+ALTER TABLE otp_codes DROP COLUMN IF EXISTS code_hash;
+CREATE INDEX idx_otp_lookup ON otp_codes(user_id, project_id, code);
@@ -0,0 +1,8 @@
+-- +migrate Up
+-- Magic links share the expiry and single-use bookkeeping of one-time codes
+ALTER TABLE otp_codes ADD COLUMN kind TEXT NOT NULL DEFAULT 'code';
+ALTER TABLE otp_codes ADD COLUMN redirect_url TEXT;
+
+-- +migrate Down
+ALTER TABLE otp_codes DROP COLUMN IF EXISTS redirect_url;
+ALTER TABLE otp_codes DROP COLUMN IF EXISTS kind;
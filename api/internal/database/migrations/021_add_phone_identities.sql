@@ -0,0 +1,10 @@
+-- +migrate Up
+-- Users who sign in by SMS don't have an email; their number lives on a
+-- phone identity's provider_user_id, in E.164 form
+ALTER TABLE users ALTER COLUMN email DROP NOT NULL;
+CREATE UNIQUE INDEX idx_identities_phone ON identities(provider_user_id) WHERE provider = 'phone';
+
+-- +migrate Down
+DROP INDEX IF EXISTS idx_identities_phone;
+UPDATE users SET email = id || '@phone.invalid' WHERE email IS NULL;
+ALTER TABLE users ALTER COLUMN email SET NOT NULL;
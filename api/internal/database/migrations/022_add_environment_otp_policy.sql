@@ -0,0 +1,15 @@
+-- +migrate Up
+-- One-time code policy; the TTL is in seconds and max resends counts the codes
+-- a user can request after the first while it is still valid
+ALTER TABLE environments
+    ADD COLUMN otp_length INTEGER NOT NULL DEFAULT 6,
+    ADD COLUMN otp_alphabet TEXT NOT NULL DEFAULT 'numeric',
+    ADD COLUMN otp_ttl INTEGER NOT NULL DEFAULT 600,
+    ADD COLUMN otp_max_resends INTEGER NOT NULL DEFAULT 5;
+
+-- +migrate Down
+ALTER TABLE environments
+    DROP COLUMN IF EXISTS otp_length,
+    DROP COLUMN IF EXISTS otp_alphabet,
+    DROP COLUMN IF EXISTS otp_ttl,
+    DROP COLUMN IF EXISTS otp_max_resends;
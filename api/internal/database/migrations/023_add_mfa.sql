@@ -0,0 +1,38 @@
+-- +migrate Up
+-- Second factors users enroll per project. TOTP secrets are encrypted, and
+-- last_used_step is the time step of the last accepted code so it can't be
+-- replayed. A factor counts once confirmed with a first code.
+CREATE TABLE mfa_factors (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    project_id TEXT NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    type TEXT NOT NULL DEFAULT 'totp',
+    secret_encrypted BYTEA NOT NULL,
+    last_used_step BIGINT NOT NULL DEFAULT 0,
+    confirmed_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX idx_mfa_factors_user ON mfa_factors(user_id, project_id, type);
+
+-- Sign-ins waiting for a second factor before tokens are issued. Only the
+-- keyed hash of the challenge token is stored.
+CREATE TABLE mfa_challenges (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    project_id TEXT NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    environment_id TEXT NOT NULL REFERENCES environments(id) ON DELETE CASCADE,
+    provider TEXT NOT NULL,
+    token_hash TEXT NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE environments ADD COLUMN mfa_required BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- +migrate Down
+ALTER TABLE environments DROP COLUMN IF EXISTS mfa_required;
+DROP TABLE IF EXISTS mfa_challenges;
+DROP TABLE IF EXISTS mfa_factors;
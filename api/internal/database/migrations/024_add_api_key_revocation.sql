@@ -0,0 +1,8 @@
+-- +migrate Up
+-- Revoked API keys are kept for the dashboard but can no longer authenticate
+ALTER TABLE project_api_keys ADD COLUMN status TEXT NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'revoked'));
+ALTER TABLE project_api_keys ADD COLUMN revoked_at TIMESTAMPTZ;
+
+-- +migrate Down
+ALTER TABLE project_api_keys DROP COLUMN IF EXISTS revoked_at;
+ALTER TABLE project_api_keys DROP COLUMN IF EXISTS status;
@@ -0,0 +1,16 @@
+-- +migrate Up
+-- Sessions started through the OIDC provider belong to the relying party
+-- they were issued to, which alone may refresh them
+ALTER TABLE sessions ADD COLUMN client_id TEXT;
+
+-- Codes issued to relying parties carry how the user authenticated on the
+-- login page
+ALTER TABLE oauth_authorization_codes
+    ADD COLUMN auth_time TIMESTAMPTZ,
+    ADD COLUMN amr TEXT[];
+
+-- +migrate Down
+ALTER TABLE oauth_authorization_codes
+    DROP COLUMN IF EXISTS auth_time,
+    DROP COLUMN IF EXISTS amr;
+ALTER TABLE sessions DROP COLUMN IF EXISTS client_id;
@@ -0,0 +1,7 @@
+-- +migrate Up
+-- Scopes granted to the relying party an OIDC session was issued to, which
+-- its access tokens carry and the userinfo endpoint honors
+ALTER TABLE sessions ADD COLUMN scope TEXT;
+
+-- +migrate Down
+ALTER TABLE sessions DROP COLUMN IF EXISTS scope;
@@ -1,9 +1,15 @@
 package handler
 
 import (
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/marcioecom/permit/internal/handler/middleware"
 	"github.com/marcioecom/permit/internal/service"
 	"github.com/rs/zerolog/log"
 )
@@ -19,11 +25,64 @@ func NewAuthHandler(authService *service.AuthService) *AuthHandler {
 type OTPCodeStartRequest struct {
 	ProjectID string `json:"projectId" validate:"required"`
 	Email     string `json:"email" validate:"required,email"`
+	// EnvironmentID whose OTP policy applies; the project's default one when
+	// omitted
+	EnvironmentID string `json:"environmentId"`
+
+	// MagicLink also emails a sign-in link. Once clicked it redirects to
+	// redirectUrl, a callback path on the requesting origin, with a code to
+	// exchange at /oauth/token.
+	MagicLink   bool   `json:"magicLink"`
+	RedirectURL string `json:"redirectUrl" validate:"required_if=MagicLink true"`
+}
+
+type OTPCodeStartResponse struct {
+	Message     string    `json:"message"`
+	ChallengeID string    `json:"challengeId"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+
+	// CodeLength and CodeAlphabet ("numeric" or "alphanumeric") describe the
+	// code that was sent, so clients can size their input
+	CodeLength   int    `json:"codeLength"`
+	CodeAlphabet string `json:"codeAlphabet"`
+
+	// ResendAfter is when the user may request another code
+	ResendAfter time.Time `json:"resendAfter"`
 }
 
+// OTPCodeVerifyRequest identifies the code by the email it was sent to or by
+// the challengeId /otp/start returned
 type OTPCodeVerifyRequest struct {
+	ProjectID   string `json:"projectId" validate:"required"`
+	Code        string `json:"code" validate:"required,min=4,max=10,alphanum"`
+	Email       string `json:"email" validate:"omitempty,email"`
+	ChallengeID string `json:"challengeId" validate:"required_without=Email"`
+}
+
+type SMSCodeStartRequest struct {
 	ProjectID string `json:"projectId" validate:"required"`
-	Code      string `json:"code" validate:"required,len=6,numeric"`
+	// Phone in international format, e.g. "+55 11 98765-4321"
+	Phone         string `json:"phone" validate:"required"`
+	EnvironmentID string `json:"environmentId"`
+}
+
+// SMSCodeVerifyRequest identifies the code by the phone number it was sent
+// to or by the challengeId /sms/start returned
+type SMSCodeVerifyRequest struct {
+	ProjectID   string `json:"projectId" validate:"required"`
+	Code        string `json:"code" validate:"required,min=4,max=10,alphanum"`
+	Phone       string `json:"phone"`
+	ChallengeID string `json:"challengeId" validate:"required_without=Phone"`
+}
+
+type ReauthStartRequest struct {
+	// MaxAge in seconds; when the user authenticated more recently no code is
+	// sent. Omit it to always require re-authentication.
+	MaxAge *int `json:"maxAge" validate:"omitempty,min=0"`
+}
+
+type ReauthVerifyRequest struct {
+	Code string `json:"code" validate:"required,min=4,max=10,alphanum"`
 }
 
 func (h *AuthHandler) GetMe(w http.ResponseWriter, r *http.Request) {
@@ -39,20 +98,48 @@ func (h *AuthHandler) OtpStart(w http.ResponseWriter, r *http.Request) {
 
 	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
 
-	err := h.service.CreateOTPCode(r.Context(), service.CreateAuthInput{
-		Email:     req.Email,
-		ProjectID: req.ProjectID,
-		IPAddress: r.RemoteAddr,
-		UserAgent: r.UserAgent(),
-	})
+	input := service.CreateAuthInput{
+		Email:         req.Email,
+		ProjectID:     req.ProjectID,
+		EnvironmentID: req.EnvironmentID,
+		IPAddress:     r.RemoteAddr,
+		UserAgent:     r.UserAgent(),
+	}
+	if req.MagicLink {
+		input.MagicLink = true
+		input.RedirectURL = req.RedirectURL
+		input.ClientOrigin = requestOrigin(r)
+		if input.ClientOrigin == "" {
+			writeError(w, http.StatusBadRequest, "missing_origin", "Origin header is required")
+			return
+		}
+	}
+
+	output, err := h.service.CreateOTPCode(r.Context(), input)
 	if err != nil {
+		if err.Error() == "origin_not_allowed" || err.Error() == "invalid_redirect_url" {
+			writeError(w, http.StatusBadRequest, err.Error(), "Magic links can only redirect to an allowed origin")
+			return
+		}
+		if err.Error() == "too_many_resends" {
+			writeTooManyResends(w)
+			return
+		}
+		if writeResendCooldown(w, err) {
+			return
+		}
 		log.Warn().Err(err).Str("email", req.Email).Msg("OTP creation failed")
 		writeError(w, http.StatusBadRequest, "otp_creation_failed", "Failed to create OTP code")
 		return
 	}
 
-	writeSuccess(w, http.StatusOK, map[string]string{
-		"message": "If the email is valid, a verification code has been sent",
+	writeSuccess(w, http.StatusOK, OTPCodeStartResponse{
+		Message:      "If the email is valid, a verification code has been sent",
+		ChallengeID:  output.ChallengeID,
+		ExpiresAt:    output.ExpiresAt,
+		CodeLength:   output.CodeLength,
+		CodeAlphabet: output.CodeAlphabet,
+		ResendAfter:  output.ResendAfter,
 	})
 }
 
@@ -64,16 +151,245 @@ func (h *AuthHandler) OtpVerify(w http.ResponseWriter, r *http.Request) {
 	}
 
 	output, err := h.service.VerifyOTPCode(r.Context(), service.VerifyAuthInput{
+		Code:        req.Code,
+		Email:       strings.ToLower(strings.TrimSpace(req.Email)),
+		ChallengeID: req.ChallengeID,
+		ProjectID:   req.ProjectID,
+		IPAddress:   r.RemoteAddr,
+		UserAgent:   r.UserAgent(),
+	})
+	if err != nil {
+		if err.Error() == "too_many_attempts" {
+			writeTooManyAttempts(w)
+			return
+		}
+		if err.Error() == "invalid_code_format" {
+			writeInvalidCodeFormat(w)
+			return
+		}
+		log.Warn().Err(err).Str("projectId", req.ProjectID).Msg("OTP verification failed")
+		writeError(w, http.StatusBadRequest, "verification_failed", "Invalid or expired code")
+		return
+	}
+
+	writeSuccess(w, http.StatusOK, output)
+}
+
+func (h *AuthHandler) SMSStart(w http.ResponseWriter, r *http.Request) {
+	var req SMSCodeStartRequest
+	if err := decodeAndValidate(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "validation_error", err.Error())
+		return
+	}
+
+	output, err := h.service.CreateSMSCode(r.Context(), service.CreateSMSCodeInput{
+		Phone:         req.Phone,
+		ProjectID:     req.ProjectID,
+		EnvironmentID: req.EnvironmentID,
+		IPAddress:     r.RemoteAddr,
+		UserAgent:     r.UserAgent(),
+	})
+	if err != nil {
+		if err.Error() == "invalid_phone_number" {
+			writeError(w, http.StatusBadRequest, "invalid_phone_number", "Phone number must include the country code, e.g. +14155550123")
+			return
+		}
+		if err.Error() == "too_many_resends" {
+			writeTooManyResends(w)
+			return
+		}
+		if writeResendCooldown(w, err) {
+			return
+		}
+		log.Warn().Err(err).Str("projectId", req.ProjectID).Msg("SMS OTP creation failed")
+		writeError(w, http.StatusBadRequest, "otp_creation_failed", "Failed to create OTP code")
+		return
+	}
+
+	writeSuccess(w, http.StatusOK, OTPCodeStartResponse{
+		Message:      "If the phone number is valid, a verification code has been sent",
+		ChallengeID:  output.ChallengeID,
+		ExpiresAt:    output.ExpiresAt,
+		CodeLength:   output.CodeLength,
+		CodeAlphabet: output.CodeAlphabet,
+		ResendAfter:  output.ResendAfter,
+	})
+}
+
+func (h *AuthHandler) SMSVerify(w http.ResponseWriter, r *http.Request) {
+	var req SMSCodeVerifyRequest
+	if err := decodeAndValidate(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "validation_error", err.Error())
+		return
+	}
+
+	output, err := h.service.VerifySMSCode(r.Context(), service.VerifySMSCodeInput{
+		Code:        req.Code,
+		Phone:       req.Phone,
+		ChallengeID: req.ChallengeID,
+		ProjectID:   req.ProjectID,
+		IPAddress:   r.RemoteAddr,
+		UserAgent:   r.UserAgent(),
+	})
+	if err != nil {
+		if err.Error() == "too_many_attempts" {
+			writeTooManyAttempts(w)
+			return
+		}
+		if err.Error() == "invalid_code_format" {
+			writeInvalidCodeFormat(w)
+			return
+		}
+		log.Warn().Err(err).Str("projectId", req.ProjectID).Msg("SMS OTP verification failed")
+		writeError(w, http.StatusBadRequest, "verification_failed", "Invalid or expired code")
+		return
+	}
+
+	writeSuccess(w, http.StatusOK, output)
+}
+
+// MagicLink redeems a link emailed by /otp/start and redirects to the
+// client's callback with a Permit authorization code
+func (h *AuthHandler) MagicLink(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		writeError(w, http.StatusBadRequest, "missing_params", "token is required")
+		return
+	}
+
+	output, err := h.service.RedeemMagicLink(r.Context(), service.RedeemMagicLinkInput{
+		Token:     token,
+		IPAddress: r.RemoteAddr,
+		UserAgent: r.UserAgent(),
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("Magic link sign-in failed")
+		http.Error(w, "Authentication failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, output.RedirectURL, http.StatusTemporaryRedirect)
+}
+
+// ReauthStart begins step-up authentication for the caller's session by
+// sending them a code, unless they authenticated within maxAge
+func (h *AuthHandler) ReauthStart(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetClaims(r.Context())
+	if claims == nil {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Authentication required")
+		return
+	}
+
+	var req ReauthStartRequest
+	if err := decodeAndValidate(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "validation_error", err.Error())
+		return
+	}
+
+	input := service.StartReauthenticationInput{
+		Claims:    claims,
+		IPAddress: r.RemoteAddr,
+		UserAgent: r.UserAgent(),
+	}
+	if req.MaxAge != nil {
+		maxAge := time.Duration(*req.MaxAge) * time.Second
+		input.MaxAge = &maxAge
+	}
+
+	output, err := h.service.StartReauthentication(r.Context(), input)
+	if err != nil {
+		if !writeReauthError(w, err) {
+			log.Warn().Err(err).Str("userId", claims.UserID).Msg("Re-authentication start failed")
+			writeError(w, http.StatusBadRequest, "otp_creation_failed", "Failed to create OTP code")
+		}
+		return
+	}
+
+	writeSuccess(w, http.StatusOK, output)
+}
+
+// ReauthVerify completes step-up authentication, returning an access token
+// with a fresh auth_time for the same session
+func (h *AuthHandler) ReauthVerify(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetClaims(r.Context())
+	if claims == nil {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Authentication required")
+		return
+	}
+
+	var req ReauthVerifyRequest
+	if err := decodeAndValidate(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "validation_error", err.Error())
+		return
+	}
+
+	output, err := h.service.VerifyReauthentication(r.Context(), service.VerifyReauthenticationInput{
+		Claims:    claims,
 		Code:      req.Code,
-		ProjectID: req.ProjectID,
 		IPAddress: r.RemoteAddr,
 		UserAgent: r.UserAgent(),
 	})
 	if err != nil {
-		log.Warn().Err(err).Str("projectId", req.ProjectID).Msg("OTP verification failed")
-		writeError(w, http.StatusBadRequest, "verification_failed", "Invalid or expired code")
+		if err.Error() == "too_many_attempts" {
+			writeTooManyAttempts(w)
+			return
+		}
+		if err.Error() == "invalid_code_format" {
+			writeInvalidCodeFormat(w)
+			return
+		}
+		if !writeReauthError(w, err) {
+			log.Warn().Err(err).Str("userId", claims.UserID).Msg("Re-authentication failed")
+			writeError(w, http.StatusBadRequest, "verification_failed", "Invalid or expired code")
+		}
 		return
 	}
 
 	writeSuccess(w, http.StatusOK, output)
 }
+
+// writeReauthError writes the responses for tokens that can't be
+// re-authenticated, reporting whether err was one of them
+func writeReauthError(w http.ResponseWriter, err error) bool {
+	if err.Error() == "session_required" {
+		writeError(w, http.StatusForbidden, "session_required", "Token is not bound to a session")
+		return true
+	}
+	if err.Error() == "session_not_found" {
+		writeError(w, http.StatusUnauthorized, "session_not_found", "Session has ended")
+		return true
+	}
+	if err.Error() == "too_many_resends" {
+		writeTooManyResends(w)
+		return true
+	}
+	if writeResendCooldown(w, err) {
+		return true
+	}
+	return false
+}
+
+func writeTooManyAttempts(w http.ResponseWriter) {
+	writeError(w, http.StatusTooManyRequests, "too_many_attempts", "Too many failed attempts. Please try again later.")
+}
+
+// writeResendCooldown tells the client when it may request another code,
+// reporting whether err was a resend cooldown
+func writeResendCooldown(w http.ResponseWriter, err error) bool {
+	var cooldown *service.ResendCooldownError
+	if !errors.As(err, &cooldown) {
+		return false
+	}
+	seconds := max(int(math.Ceil(time.Until(cooldown.RetryAt).Seconds())), 1)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeError(w, http.StatusTooManyRequests, "resend_cooldown", fmt.Sprintf("Please wait %d seconds before requesting another code", seconds))
+	return true
+}
+
+func writeTooManyResends(w http.ResponseWriter) {
+	writeError(w, http.StatusTooManyRequests, "too_many_resends", "Too many codes requested. Please use the last one sent or try again later.")
+}
+
+func writeInvalidCodeFormat(w http.ResponseWriter) {
+	writeError(w, http.StatusBadRequest, "invalid_code_format", "Code doesn't match the expected length or characters")
+}
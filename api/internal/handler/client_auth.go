@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marcioecom/permit/internal/crypto"
+	"github.com/marcioecom/permit/internal/models"
+	"github.com/marcioecom/permit/internal/repository"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	errMissingClientCredentials = errors.New("missing client credentials")
+	errInvalidClientCredentials = errors.New("invalid client credentials")
+)
+
+// verifiedSecretTTL bounds how long a client secret that passed the bcrypt
+// comparison is accepted without repeating it. The API key is still loaded
+// on every call, so revoking or rotating it takes effect immediately.
+const verifiedSecretTTL = time.Minute
+
+type verifiedSecret struct {
+	secretHash string // HashToken of the client secret
+	storedHash string // bcrypt hash the secret was compared against
+	expiresAt  time.Time
+}
+
+var verifiedSecrets = struct {
+	sync.Mutex
+	byClientID map[string]verifiedSecret
+}{byClientID: make(map[string]verifiedSecret)}
+
+// authenticateClient resolves the API key behind a request's HTTP Basic
+// client_id/client_secret credentials
+func authenticateClient(r *http.Request, projectRepo repository.ProjectRepository) (*models.APIKey, error) {
+	clientID, clientSecret, ok := parseBasicAuth(r)
+	if !ok {
+		return nil, errMissingClientCredentials
+	}
+
+	apiKey, err := projectRepo.GetAPIKeyByClientID(r.Context(), clientID)
+	if err != nil {
+		log.Error().Err(err).Str("clientID", clientID).Msg("failed to fetch API key")
+		return nil, err
+	}
+
+	if apiKey == nil {
+		log.Warn().Str("clientID", clientID).Msg("API key not found")
+		return nil, errInvalidClientCredentials
+	}
+
+	// Revoked keys are refused before paying for the hash comparison
+	if apiKey.RevokedAt != nil {
+		log.Warn().Str("clientID", clientID).Msg("API key revoked")
+		return nil, errInvalidClientCredentials
+	}
+
+	if !secretRecentlyVerified(apiKey, clientSecret) {
+		if err := bcrypt.CompareHashAndPassword([]byte(apiKey.ClientSecretHash), []byte(clientSecret)); err != nil {
+			log.Warn().Str("clientID", clientID).Msg("Invalid client secret")
+			return nil, errInvalidClientCredentials
+		}
+		rememberVerifiedSecret(apiKey, clientSecret)
+	}
+
+	return apiKey, nil
+}
+
+// secretRecentlyVerified reports whether a client secret matched an API
+// key's current secret within the last verifiedSecretTTL
+func secretRecentlyVerified(apiKey *models.APIKey, clientSecret string) bool {
+	verifiedSecrets.Lock()
+	verified, ok := verifiedSecrets.byClientID[apiKey.ClientID]
+	verifiedSecrets.Unlock()
+
+	return ok && time.Now().Before(verified.expiresAt) &&
+		verified.storedHash == apiKey.ClientSecretHash &&
+		subtle.ConstantTimeCompare([]byte(verified.secretHash), []byte(crypto.HashToken(clientSecret))) == 1
+}
+
+func rememberVerifiedSecret(apiKey *models.APIKey, clientSecret string) {
+	verifiedSecrets.Lock()
+	defer verifiedSecrets.Unlock()
+
+	now := time.Now()
+	for clientID, verified := range verifiedSecrets.byClientID {
+		if now.After(verified.expiresAt) {
+			delete(verifiedSecrets.byClientID, clientID)
+		}
+	}
+	verifiedSecrets.byClientID[apiKey.ClientID] = verifiedSecret{
+		secretHash: crypto.HashToken(clientSecret),
+		storedHash: apiKey.ClientSecretHash,
+		expiresAt:  now.Add(verifiedSecretTTL),
+	}
+}
+
+func parseBasicAuth(r *http.Request) (clientID, clientSecret string, ok bool) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return "", "", false
+	}
+
+	const prefix = "Basic "
+	if !strings.HasPrefix(auth, prefix) {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+
+	credentials := string(decoded)
+	colonIndex := strings.Index(credentials, ":")
+	if colonIndex < 0 {
+		return "", "", false
+	}
+
+	return credentials[:colonIndex], credentials[colonIndex+1:], true
+}
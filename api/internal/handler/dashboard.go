@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"encoding/json"
 	"net/http"
 	"strconv"
 
@@ -14,12 +15,14 @@ import (
 type DashboardHandler struct {
 	projectService     *service.ProjectService
 	environmentService *service.EnvironmentService
+	sessionService     *service.SessionService
 }
 
-func NewDashboardHandler(projectService *service.ProjectService, environmentService *service.EnvironmentService) *DashboardHandler {
+func NewDashboardHandler(projectService *service.ProjectService, environmentService *service.EnvironmentService, sessionService *service.SessionService) *DashboardHandler {
 	return &DashboardHandler{
 		projectService:     projectService,
 		environmentService: environmentService,
+		sessionService:     sessionService,
 	}
 }
 
@@ -95,6 +98,115 @@ func (h *DashboardHandler) ListProjectUsers(w http.ResponseWriter, r *http.Reque
 	writeSuccess(w, http.StatusOK, result)
 }
 
+func (h *DashboardHandler) ListProjectUserSessions(w http.ResponseWriter, r *http.Request) {
+	ownerID := middleware.GetUserID(r.Context())
+
+	sessions, err := h.sessionService.ListProjectUserSessions(r.Context(), service.ProjectUserSessionsInput{
+		ProjectID:     chi.URLParam(r, "id"),
+		UserID:        chi.URLParam(r, "userId"),
+		EnvironmentID: r.URL.Query().Get("environmentId"),
+		OwnerID:       ownerID,
+	})
+	if err != nil {
+		if err.Error() == "forbidden" {
+			writeError(w, http.StatusForbidden, "forbidden", "You don't own this project")
+			return
+		}
+		if err.Error() == "project_not_found" {
+			writeError(w, http.StatusNotFound, "not_found", "Project not found")
+			return
+		}
+		log.Error().Err(err).Msg("Failed to list user sessions")
+		writeError(w, http.StatusInternalServerError, "internal_error", "Failed to list sessions")
+		return
+	}
+
+	writeSuccess(w, http.StatusOK, map[string]any{
+		"data": sessions,
+		"meta": map[string]int{"total": len(sessions)},
+	})
+}
+
+// RevokeProjectUserSessions force-logs a user out of every session in the
+// project, or only those in the environment given by ?environmentId=.
+func (h *DashboardHandler) RevokeProjectUserSessions(w http.ResponseWriter, r *http.Request) {
+	h.revokeProjectUserSessions(w, r, "")
+}
+
+func (h *DashboardHandler) RevokeProjectUserSession(w http.ResponseWriter, r *http.Request) {
+	h.revokeProjectUserSessions(w, r, chi.URLParam(r, "sessionId"))
+}
+
+func (h *DashboardHandler) revokeProjectUserSessions(w http.ResponseWriter, r *http.Request, sessionID string) {
+	err := h.sessionService.RevokeProjectUserSessions(r.Context(), service.ProjectUserSessionsInput{
+		ProjectID:     chi.URLParam(r, "id"),
+		UserID:        chi.URLParam(r, "userId"),
+		EnvironmentID: r.URL.Query().Get("environmentId"),
+		SessionID:     sessionID,
+		OwnerID:       middleware.GetUserID(r.Context()),
+		OwnerEmail:    middleware.GetEmail(r.Context()),
+		IPAddress:     r.RemoteAddr,
+		UserAgent:     r.UserAgent(),
+	})
+	if err != nil {
+		if err.Error() == "forbidden" {
+			writeError(w, http.StatusForbidden, "forbidden", "You don't own this project")
+			return
+		}
+		if err.Error() == "project_not_found" {
+			writeError(w, http.StatusNotFound, "not_found", "Project not found")
+			return
+		}
+		if err.Error() == "session_not_found" {
+			writeError(w, http.StatusNotFound, "not_found", "Session not found")
+			return
+		}
+		log.Error().Err(err).Msg("Failed to revoke user sessions")
+		writeError(w, http.StatusInternalServerError, "internal_error", "Failed to revoke sessions")
+		return
+	}
+
+	writeSuccess(w, http.StatusOK, map[string]string{"message": "Sessions revoked"})
+}
+
+// ImpersonateProjectUser mints a short-lived access token that lets the owner
+// act as one of their project's users, in the environment given by
+// ?environmentId= or the project's default one.
+func (h *DashboardHandler) ImpersonateProjectUser(w http.ResponseWriter, r *http.Request) {
+	output, err := h.sessionService.Impersonate(r.Context(), service.ImpersonateInput{
+		ProjectID:     chi.URLParam(r, "id"),
+		UserID:        chi.URLParam(r, "userId"),
+		EnvironmentID: r.URL.Query().Get("environmentId"),
+		OwnerID:       middleware.GetUserID(r.Context()),
+		OwnerEmail:    middleware.GetEmail(r.Context()),
+		IPAddress:     r.RemoteAddr,
+		UserAgent:     r.UserAgent(),
+	})
+	if err != nil {
+		if err.Error() == "forbidden" {
+			writeError(w, http.StatusForbidden, "forbidden", "You don't own this project")
+			return
+		}
+		if err.Error() == "project_not_found" {
+			writeError(w, http.StatusNotFound, "not_found", "Project not found")
+			return
+		}
+		if err.Error() == "environment_not_found" {
+			writeError(w, http.StatusNotFound, "not_found", "Environment not found")
+			return
+		}
+		if err.Error() == "user_not_found" {
+			writeError(w, http.StatusNotFound, "not_found", "User not found in this environment")
+			return
+		}
+		log.Error().Err(err).Msg("Failed to impersonate user")
+		writeError(w, http.StatusInternalServerError, "internal_error", "Failed to impersonate user")
+		return
+	}
+
+	writeSuccess(w, http.StatusOK, output)
+}
+
 func (h *DashboardHandler) ListAllUsers(w http.ResponseWriter, r *http.Request) {
 	ownerID := middleware.GetUserID(r.Context())
 	if ownerID == "" {
@@ -260,6 +372,120 @@ func (h *DashboardHandler) DeleteProject(w http.ResponseWriter, r *http.Request)
 	writeSuccess(w, http.StatusOK, map[string]string{"message": "Project deleted"})
 }
 
+// --- Claims template endpoints ---
+
+func (h *DashboardHandler) GetClaimsTemplate(w http.ResponseWriter, r *http.Request) {
+	ownerID := middleware.GetUserID(r.Context())
+	projectID := chi.URLParam(r, "id")
+
+	template, err := h.projectService.GetClaimsTemplate(r.Context(), projectID, ownerID)
+	if err != nil {
+		if err.Error() == "forbidden" {
+			writeError(w, http.StatusForbidden, "forbidden", "You don't own this project")
+			return
+		}
+		writeError(w, http.StatusNotFound, "not_found", "Project not found")
+		return
+	}
+
+	writeSuccess(w, http.StatusOK, map[string]any{"template": template})
+}
+
+type UpdateClaimsTemplateRequest struct {
+	Template json.RawMessage `json:"template" validate:"required"`
+}
+
+func (h *DashboardHandler) UpdateClaimsTemplate(w http.ResponseWriter, r *http.Request) {
+	ownerID := middleware.GetUserID(r.Context())
+	projectID := chi.URLParam(r, "id")
+
+	var req UpdateClaimsTemplateRequest
+	if err := decodeAndValidate(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "validation_error", err.Error())
+		return
+	}
+
+	template, err := h.projectService.UpdateClaimsTemplate(r.Context(), service.UpdateClaimsTemplateInput{
+		ProjectID: projectID,
+		OwnerID:   ownerID,
+		Template:  req.Template,
+	})
+	if err != nil {
+		if err.Error() == "forbidden" {
+			writeError(w, http.StatusForbidden, "forbidden", "You don't own this project")
+			return
+		}
+		if err.Error() == "project_not_found" {
+			writeError(w, http.StatusNotFound, "not_found", "Project not found")
+			return
+		}
+		if err.Error() == "reserved_claim" {
+			writeError(w, http.StatusBadRequest, "reserved_claim", "Claims template can't set reserved claims such as sub, aud, exp or iss")
+			return
+		}
+		if err.Error() == "invalid_claims_template" {
+			writeError(w, http.StatusBadRequest, "invalid_claims_template", "Claims template must be a JSON object referencing user, identity, project or environment data")
+			return
+		}
+		if err.Error() == "claims_template_too_large" {
+			writeError(w, http.StatusBadRequest, "claims_template_too_large", "Claims template is too large")
+			return
+		}
+		log.Error().Err(err).Msg("Failed to update claims template")
+		writeError(w, http.StatusInternalServerError, "internal_error", "Failed to update claims template")
+		return
+	}
+
+	writeSuccess(w, http.StatusOK, map[string]any{"template": template})
+}
+
+type UpdateUserMetadataRequest struct {
+	Metadata json.RawMessage `json:"metadata" validate:"required"`
+}
+
+// UpdateProjectUserMetadata sets the metadata claims templates read as
+// user.metadata, in every environment or only the one given by ?environmentId=.
+func (h *DashboardHandler) UpdateProjectUserMetadata(w http.ResponseWriter, r *http.Request) {
+	ownerID := middleware.GetUserID(r.Context())
+
+	var req UpdateUserMetadataRequest
+	if err := decodeAndValidate(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "validation_error", err.Error())
+		return
+	}
+
+	err := h.projectService.UpdateUserMetadata(r.Context(), service.UpdateUserMetadataInput{
+		ProjectID:     chi.URLParam(r, "id"),
+		UserID:        chi.URLParam(r, "userId"),
+		EnvironmentID: r.URL.Query().Get("environmentId"),
+		OwnerID:       ownerID,
+		Metadata:      req.Metadata,
+	})
+	if err != nil {
+		if err.Error() == "forbidden" {
+			writeError(w, http.StatusForbidden, "forbidden", "You don't own this project")
+			return
+		}
+		if err.Error() == "project_not_found" {
+			writeError(w, http.StatusNotFound, "not_found", "Project not found")
+			return
+		}
+		if err.Error() == "user_not_found" {
+			writeError(w, http.StatusNotFound, "user_not_found", "User not found")
+			return
+		}
+		if err.Error() == "invalid_metadata" || err.Error() == "metadata_too_large" {
+			writeError(w, http.StatusBadRequest, err.Error(), "Metadata must be a JSON object of at most 4KB")
+			return
+		}
+		log.Error().Err(err).Msg("Failed to update user metadata")
+		writeError(w, http.StatusInternalServerError, "internal_error", "Failed to update user metadata")
+		return
+	}
+
+	writeSuccess(w, http.StatusOK, map[string]any{"metadata": req.Metadata})
+}
+
 // --- Environment endpoints ---
 
 func (h *DashboardHandler) ListEnvironments(w http.ResponseWriter, r *http.Request) {
@@ -332,8 +558,23 @@ func (h *DashboardHandler) GetEnvironment(w http.ResponseWriter, r *http.Request
 }
 
 type UpdateEnvironmentRequest struct {
-	Name           *string  `json:"name"`
-	AllowedOrigins []string `json:"allowedOrigins"`
+	Name             *string  `json:"name"`
+	AllowedOrigins   []string `json:"allowedOrigins"`
+	SigningAlgorithm *string  `json:"signingAlgorithm" validate:"omitempty,oneof=RS256 ES256 EdDSA"`
+
+	AccessTokenTTL     *int `json:"accessTokenTtl" validate:"omitempty,min=0"`
+	RefreshTokenTTL    *int `json:"refreshTokenTtl" validate:"omitempty,min=0"`
+	SessionIdleTimeout *int `json:"sessionIdleTimeout" validate:"omitempty,min=0"`
+	SessionMaxLifetime *int `json:"sessionMaxLifetime" validate:"omitempty,min=0"`
+
+	LoginURL *string `json:"loginUrl"`
+
+	OTPLength     *int    `json:"otpLength" validate:"omitempty,min=4,max=10"`
+	OTPAlphabet   *string `json:"otpAlphabet" validate:"omitempty,oneof=numeric alphanumeric"`
+	OTPTTL        *int    `json:"otpTtl" validate:"omitempty,min=0"`
+	OTPMaxResends *int    `json:"otpMaxResends" validate:"omitempty,min=0"`
+
+	MFARequired *bool `json:"mfaRequired"`
 }
 
 func (h *DashboardHandler) UpdateEnvironment(w http.ResponseWriter, r *http.Request) {
@@ -347,16 +588,48 @@ func (h *DashboardHandler) UpdateEnvironment(w http.ResponseWriter, r *http.Requ
 	}
 
 	env, err := h.environmentService.Update(r.Context(), service.UpdateEnvironmentInput{
-		EnvironmentID:  envID,
-		Name:           req.Name,
-		AllowedOrigins: req.AllowedOrigins,
-		OwnerID:        ownerID,
+		EnvironmentID:    envID,
+		Name:             req.Name,
+		AllowedOrigins:   req.AllowedOrigins,
+		SigningAlgorithm: req.SigningAlgorithm,
+
+		AccessTokenTTL:     req.AccessTokenTTL,
+		RefreshTokenTTL:    req.RefreshTokenTTL,
+		SessionIdleTimeout: req.SessionIdleTimeout,
+		SessionMaxLifetime: req.SessionMaxLifetime,
+
+		LoginURL: req.LoginURL,
+
+		OTPLength:     req.OTPLength,
+		OTPAlphabet:   req.OTPAlphabet,
+		OTPTTL:        req.OTPTTL,
+		OTPMaxResends: req.OTPMaxResends,
+
+		MFARequired: req.MFARequired,
+
+		OwnerID: ownerID,
 	})
 	if err != nil {
 		if err.Error() == "forbidden" {
 			writeError(w, http.StatusForbidden, "forbidden", "You don't own this project")
 			return
 		}
+		if err.Error() == "unsupported_signing_algorithm" {
+			writeError(w, http.StatusBadRequest, "unsupported_signing_algorithm", "Signing algorithm must be RS256, ES256 or EdDSA")
+			return
+		}
+		if err.Error() == "invalid_token_lifetime" {
+			writeError(w, http.StatusBadRequest, "invalid_token_lifetime", "Token and session lifetimes are out of bounds")
+			return
+		}
+		if err.Error() == "invalid_login_url" {
+			writeError(w, http.StatusBadRequest, "invalid_login_url", "Login URL must be an absolute http(s) URL")
+			return
+		}
+		if err.Error() == "invalid_otp_policy" {
+			writeError(w, http.StatusBadRequest, "invalid_otp_policy", "One-time codes must be 4 to 10 numeric or alphanumeric characters, expire within 1 to 60 minutes and allow at most 20 resends")
+			return
+		}
 		log.Error().Err(err).Msg("Failed to update environment")
 		writeError(w, http.StatusBadRequest, "update_failed", err.Error())
 		return
@@ -440,3 +713,85 @@ func (h *DashboardHandler) DeleteOAuthProvider(w http.ResponseWriter, r *http.Re
 
 	writeSuccess(w, http.StatusOK, map[string]string{"message": "Provider deleted"})
 }
+
+// --- OIDC client endpoints ---
+
+func (h *DashboardHandler) ListOIDCClients(w http.ResponseWriter, r *http.Request) {
+	ownerID := middleware.GetUserID(r.Context())
+	envID := chi.URLParam(r, "envId")
+
+	clients, err := h.environmentService.ListOIDCClients(r.Context(), envID, ownerID)
+	if err != nil {
+		if err.Error() == "forbidden" {
+			writeError(w, http.StatusForbidden, "forbidden", "You don't own this project")
+			return
+		}
+		log.Error().Err(err).Msg("Failed to list OIDC clients")
+		writeError(w, http.StatusInternalServerError, "internal_error", "Failed to list OIDC clients")
+		return
+	}
+
+	writeSuccess(w, http.StatusOK, clients)
+}
+
+type CreateOIDCClientRequest struct {
+	Name         string   `json:"name" validate:"required"`
+	RedirectURIs []string `json:"redirectUris" validate:"required,min=1"`
+	Public       bool     `json:"public"`
+}
+
+func (h *DashboardHandler) CreateOIDCClient(w http.ResponseWriter, r *http.Request) {
+	ownerID := middleware.GetUserID(r.Context())
+	envID := chi.URLParam(r, "envId")
+
+	var req CreateOIDCClientRequest
+	if err := decodeAndValidate(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "validation_error", err.Error())
+		return
+	}
+
+	client, err := h.environmentService.CreateOIDCClient(r.Context(), service.CreateOIDCClientInput{
+		EnvironmentID: envID,
+		Name:          req.Name,
+		RedirectURIs:  req.RedirectURIs,
+		Public:        req.Public,
+		OwnerID:       ownerID,
+	})
+	if err != nil {
+		if err.Error() == "forbidden" {
+			writeError(w, http.StatusForbidden, "forbidden", "You don't own this project")
+			return
+		}
+		if err.Error() == "invalid_redirect_uri" {
+			writeError(w, http.StatusBadRequest, "invalid_redirect_uri", "Redirect URIs must be absolute http(s) URLs without a fragment")
+			return
+		}
+		log.Error().Err(err).Msg("Failed to create OIDC client")
+		writeError(w, http.StatusInternalServerError, "internal_error", "Failed to create OIDC client")
+		return
+	}
+
+	writeSuccess(w, http.StatusCreated, client)
+}
+
+func (h *DashboardHandler) DeleteOIDCClient(w http.ResponseWriter, r *http.Request) {
+	ownerID := middleware.GetUserID(r.Context())
+	envID := chi.URLParam(r, "envId")
+	clientID := chi.URLParam(r, "clientId")
+
+	if err := h.environmentService.DeleteOIDCClient(r.Context(), envID, clientID, ownerID); err != nil {
+		if err.Error() == "forbidden" {
+			writeError(w, http.StatusForbidden, "forbidden", "You don't own this project")
+			return
+		}
+		if err.Error() == "oidc_client_not_found" {
+			writeError(w, http.StatusNotFound, "oidc_client_not_found", "OIDC client not found")
+			return
+		}
+		log.Error().Err(err).Msg("Failed to delete OIDC client")
+		writeError(w, http.StatusInternalServerError, "internal_error", "Failed to delete OIDC client")
+		return
+	}
+
+	writeSuccess(w, http.StatusOK, map[string]string{"message": "OIDC client deleted"})
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/go-playground/validator/v10"
 )
@@ -35,6 +36,26 @@ func writeError(w http.ResponseWriter, status int, code, message string) {
 	})
 }
 
+// requestOrigin returns the origin a browser request came from, taken from
+// the Origin header or else the Referer
+func requestOrigin(r *http.Request) string {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		return origin
+	}
+	referer := r.Header.Get("Referer")
+	if referer == "" {
+		return ""
+	}
+	parts := strings.SplitN(referer, "//", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	if hostEnd := strings.IndexByte(parts[1], '/'); hostEnd > 0 {
+		return parts[0] + "//" + parts[1][:hostEnd]
+	}
+	return referer
+}
+
 func decodeAndValidate(r *http.Request, dst any) error {
 	if err := json.NewDecoder(r.Body).Decode(dst); err != nil {
 		return fmt.Errorf("invalid JSON body")
@@ -1,57 +1,66 @@
 package handler
 
 import (
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"net/http"
-	"strings"
+	"slices"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/marcioecom/permit/internal/crypto"
+	"github.com/marcioecom/permit/internal/models"
 	"github.com/marcioecom/permit/internal/repository"
 	"github.com/rs/zerolog/log"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type JWKSHandler struct {
 	jwtService  *crypto.JWTService
 	projectRepo repository.ProjectRepository
+	envRepo     repository.EnvironmentRepository
+	publicURL   string
 }
 
-func NewJWKSHandler(jwtService *crypto.JWTService, projectRepo repository.ProjectRepository) *JWKSHandler {
+func NewJWKSHandler(jwtService *crypto.JWTService, projectRepo repository.ProjectRepository, envRepo repository.EnvironmentRepository, publicURL string) *JWKSHandler {
 	return &JWKSHandler{
 		jwtService:  jwtService,
 		projectRepo: projectRepo,
+		envRepo:     envRepo,
+		publicURL:   publicURL,
 	}
 }
 
+// publicJWKSMaxAge bounds how long verifiers cache a public key set. Keys are
+// published ahead of rotation, and verifiers refetch on an unknown kid.
+const publicJWKSMaxAge = "public, max-age=3600"
+
 func (h *JWKSHandler) GetJWKS(w http.ResponseWriter, r *http.Request) {
-	clientID, clientSecret, ok := parseBasicAuth(r)
-	if !ok {
-		w.Header().Set("WWW-Authenticate", `Basic realm="Permit API"`)
-		http.Error(w, "Unauthorized: Missing or invalid Authorization header", http.StatusUnauthorized)
+	apiKey, err := authenticateClient(r, h.projectRepo)
+	if err != nil {
+		switch {
+		case errors.Is(err, errMissingClientCredentials):
+			w.Header().Set("WWW-Authenticate", `Basic realm="Permit API"`)
+			http.Error(w, "Unauthorized: Missing or invalid Authorization header", http.StatusUnauthorized)
+		case errors.Is(err, errInvalidClientCredentials):
+			http.Error(w, "Unauthorized: Invalid credentials", http.StatusUnauthorized)
+		default:
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
 		return
 	}
 
-	apiKey, err := h.projectRepo.GetAPIKeyByClientID(r.Context(), clientID)
+	envs, err := h.envRepo.GetByProjectID(r.Context(), apiKey.ProjectID)
 	if err != nil {
-		log.Error().Err(err).Str("clientID", clientID).Msg("failed to fetch API key")
+		log.Error().Err(err).Str("projectID", apiKey.ProjectID).Msg("failed to fetch environments")
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
-	if apiKey == nil {
-		log.Warn().Str("clientID", clientID).Msg("API key not found")
-		http.Error(w, "Unauthorized: Invalid credentials", http.StatusUnauthorized)
-		return
+	// Only publish the keys trusted for this project's environments
+	environmentIDs := make([]string, 0, len(envs))
+	for _, env := range envs {
+		environmentIDs = append(environmentIDs, env.ID)
 	}
-
-	if err := bcrypt.CompareHashAndPassword([]byte(apiKey.ClientSecretHash), []byte(clientSecret)); err != nil {
-		log.Warn().Str("clientID", clientID).Msg("Invalid client secret")
-		http.Error(w, "Unauthorized: Invalid credentials", http.StatusUnauthorized)
-		return
-	}
-
-	jwks := h.jwtService.GetKeyManager().GetJWKS()
+	jwks := h.jwtService.GetKeyManager().EnvironmentJWKS(environmentIDs...)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Cache-Control", "public, max-age=86400")
@@ -61,27 +70,123 @@ func (h *JWKSHandler) GetJWKS(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func parseBasicAuth(r *http.Request) (clientID, clientSecret string, ok bool) {
-	auth := r.Header.Get("Authorization")
-	if auth == "" {
-		return "", "", false
+// GetProjectJWKS serves the keys trusted for a project's environments without
+// authentication, so standard JWT libraries can fetch them
+func (h *JWKSHandler) GetProjectJWKS(w http.ResponseWriter, r *http.Request) {
+	envs, ok := h.projectEnvironments(w, r)
+	if !ok {
+		return
 	}
 
-	const prefix = "Basic "
-	if !strings.HasPrefix(auth, prefix) {
-		return "", "", false
+	w.Header().Set("Cache-Control", publicJWKSMaxAge)
+	writeJSON(w, http.StatusOK, h.jwks(envs))
+}
+
+// GetEnvironmentJWKS serves the keys trusted for a single environment
+func (h *JWKSHandler) GetEnvironmentJWKS(w http.ResponseWriter, r *http.Request) {
+	env, ok := h.environment(w, r)
+	if !ok {
+		return
 	}
 
-	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
-	if err != nil {
-		return "", "", false
+	w.Header().Set("Cache-Control", publicJWKSMaxAge)
+	writeJSON(w, http.StatusOK, h.jwks([]*models.Environment{env}))
+}
+
+// AuthorizationServerMetadata is the RFC 8414 metadata of a project or
+// environment: where to find the keys that verify its access tokens, and the
+// issuer they carry. Permit access tokens aren't OpenID Connect tokens, so it
+// isn't published as openid-configuration; the OIDC provider has its own.
+// Tokens are only issued to API keys, so there is no authorization endpoint
+// and the only response type is "none".
+type AuthorizationServerMetadata struct {
+	Issuer                            string   `json:"issuer"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	RevocationEndpoint                string   `json:"revocation_endpoint"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	SigningAlgValuesSupported         []string `json:"token_signing_alg_values_supported"`
+}
+
+func (h *JWKSHandler) GetProjectMetadata(w http.ResponseWriter, r *http.Request) {
+	envs, ok := h.projectEnvironments(w, r)
+	if !ok {
+		return
 	}
 
-	credentials := string(decoded)
-	colonIndex := strings.Index(credentials, ":")
-	if colonIndex < 0 {
-		return "", "", false
+	w.Header().Set("Cache-Control", publicJWKSMaxAge)
+	writeJSON(w, http.StatusOK, h.metadata("/projects/"+chi.URLParam(r, "projectId"), envs))
+}
+
+func (h *JWKSHandler) GetEnvironmentMetadata(w http.ResponseWriter, r *http.Request) {
+	env, ok := h.environment(w, r)
+	if !ok {
+		return
 	}
 
-	return credentials[:colonIndex], credentials[colonIndex+1:], true
+	w.Header().Set("Cache-Control", publicJWKSMaxAge)
+	writeJSON(w, http.StatusOK, h.metadata("/environments/"+env.ID, []*models.Environment{env}))
+}
+
+func (h *JWKSHandler) metadata(path string, envs []*models.Environment) *AuthorizationServerMetadata {
+	var algorithms []string
+	for _, env := range envs {
+		algorithm := env.SigningAlgorithm
+		if algorithm == "" {
+			algorithm = crypto.DefaultAlgorithm
+		}
+		if !slices.Contains(algorithms, algorithm) {
+			algorithms = append(algorithms, algorithm)
+		}
+	}
+
+	return &AuthorizationServerMetadata{
+		Issuer:                            h.jwtService.Issuer(),
+		JWKSURI:                           h.publicURL + path + "/.well-known/jwks.json",
+		TokenEndpoint:                     h.publicURL + "/oauth/token",
+		ResponseTypesSupported:            []string{"none"},
+		GrantTypesSupported:               []string{"client_credentials"},
+		SubjectTypesSupported:             []string{"public"},
+		IntrospectionEndpoint:             h.publicURL + "/oauth/introspect",
+		RevocationEndpoint:                h.publicURL + "/oauth/revoke",
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic"},
+		SigningAlgValuesSupported:         algorithms,
+	}
+}
+
+func (h *JWKSHandler) jwks(envs []*models.Environment) crypto.JWKSResponse {
+	environmentIDs := make([]string, 0, len(envs))
+	for _, env := range envs {
+		environmentIDs = append(environmentIDs, env.ID)
+	}
+	return h.jwtService.GetKeyManager().EnvironmentJWKS(environmentIDs...)
+}
+
+func (h *JWKSHandler) projectEnvironments(w http.ResponseWriter, r *http.Request) ([]*models.Environment, bool) {
+	projectID := chi.URLParam(r, "projectId")
+
+	envs, err := h.envRepo.GetByProjectID(r.Context(), projectID)
+	if err != nil {
+		log.Error().Err(err).Str("projectID", projectID).Msg("failed to fetch environments")
+		writeError(w, http.StatusInternalServerError, "internal_error", "Failed to fetch keys")
+		return nil, false
+	}
+	if len(envs) == 0 {
+		writeError(w, http.StatusNotFound, "project_not_found", "Project not found")
+		return nil, false
+	}
+	return envs, true
+}
+
+func (h *JWKSHandler) environment(w http.ResponseWriter, r *http.Request) (*models.Environment, bool) {
+	env, err := h.envRepo.GetByID(r.Context(), chi.URLParam(r, "envId"))
+	if err != nil || env == nil {
+		writeError(w, http.StatusNotFound, "environment_not_found", "Environment not found")
+		return nil, false
+	}
+	return env, true
 }
@@ -1,13 +1,18 @@
 package handler_test
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/marcioecom/permit/internal/crypto"
+	"github.com/marcioecom/permit/internal/handler"
+	"github.com/marcioecom/permit/internal/models"
+	"github.com/marcioecom/permit/internal/repository"
 )
 
 type mockProjectRepo struct {
@@ -76,50 +81,73 @@ func TestJWKSHandler_Unauthorized(t *testing.T) {
 	}
 }
 
-func TestJWKSResponse_Format(t *testing.T) {
+type fakeEnvironmentRepo struct {
+	repository.EnvironmentRepository
+	envs map[string][]*models.Environment
+}
+
+func (f *fakeEnvironmentRepo) GetByProjectID(_ context.Context, projectID string) ([]*models.Environment, error) {
+	return f.envs[projectID], nil
+}
+
+func TestProjectJWKS_Public(t *testing.T) {
 	keyManager := crypto.NewKeyManager()
 	if err := keyManager.GenerateKeyPair(); err != nil {
 		t.Fatal(err)
 	}
-
-	jwks := keyManager.GetJWKS()
-
-	if len(jwks.Keys) != 1 {
-		t.Errorf("expected 1 key, got %d", len(jwks.Keys))
+	for _, env := range []string{"env-a", "env-b"} {
+		if err := keyManager.EnsureEnvironmentKeys(env, crypto.AlgorithmES256); err != nil {
+			t.Fatal(err)
+		}
 	}
-
-	key := jwks.Keys[0]
-	if key.Kty != "RSA" {
-		t.Errorf("expected key type RSA, got %s", key.Kty)
+	jwtService := crypto.NewJWTService(keyManager, "permit")
+	envRepo := &fakeEnvironmentRepo{envs: map[string][]*models.Environment{
+		"project-1": {{ID: "env-a", ProjectID: "project-1", SigningAlgorithm: crypto.AlgorithmES256}},
+	}}
+	h := handler.NewJWKSHandler(jwtService, nil, envRepo, "https://auth.example.com")
+
+	r := chi.NewRouter()
+	r.Get("/projects/{projectId}/.well-known/jwks.json", h.GetProjectJWKS)
+	r.Get("/projects/{projectId}/.well-known/oauth-authorization-server", h.GetProjectMetadata)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/projects/project-1/.well-known/jwks.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 without credentials, got %d", rec.Code)
 	}
-	if key.Use != "sig" {
-		t.Errorf("expected use 'sig', got %s", key.Use)
+	if rec.Header().Get("Cache-Control") == "" {
+		t.Error("expected JWKS to be cacheable")
 	}
-	if key.Alg != "RS256" {
-		t.Errorf("expected algorithm RS256, got %s", key.Alg)
+	var jwks crypto.JWKSResponse
+	if err := json.NewDecoder(rec.Body).Decode(&jwks); err != nil {
+		t.Fatal(err)
 	}
-	if key.Kid == "" {
-		t.Error("expected key ID to be non-empty")
+	otherKid := keyManager.EnvironmentJWKS("env-b").Keys[0].Kid
+	for _, key := range jwks.Keys {
+		if key.Kid == otherKid {
+			t.Error("expected keys of other projects' environments to be left out")
+		}
 	}
-	if key.N == "" {
-		t.Error("expected modulus (n) to be non-empty")
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/projects/project-1/.well-known/oauth-authorization-server", nil))
+	var doc handler.AuthorizationServerMetadata
+	if err := json.NewDecoder(rec.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
 	}
-	if key.E == "" {
-		t.Error("expected exponent (e) to be non-empty")
+	if doc.Issuer != jwtService.Issuer() {
+		t.Errorf("expected issuer to match the tokens' iss, got %s", doc.Issuer)
 	}
-
-	// Verify JSON encoding works
-	jsonBytes, err := json.Marshal(jwks)
-	if err != nil {
-		t.Fatalf("failed to marshal JWKS: %v", err)
+	if len(doc.ResponseTypesSupported) == 0 || len(doc.SubjectTypesSupported) == 0 {
+		t.Errorf("expected response and subject types to be listed, got %+v", doc)
 	}
-
-	var decoded crypto.JWKSResponse
-	if err := json.Unmarshal(jsonBytes, &decoded); err != nil {
-		t.Fatalf("failed to unmarshal JWKS: %v", err)
+	if doc.JWKSURI != "https://auth.example.com/projects/project-1/.well-known/jwks.json" {
+		t.Errorf("unexpected jwks_uri %s", doc.JWKSURI)
 	}
 
-	if len(decoded.Keys) != 1 {
-		t.Errorf("expected 1 key after round-trip, got %d", len(decoded.Keys))
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/projects/unknown/.well-known/jwks.json", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown project, got %d", rec.Code)
 	}
 }
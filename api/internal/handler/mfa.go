@@ -0,0 +1,194 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/marcioecom/permit/internal/handler/middleware"
+	"github.com/marcioecom/permit/internal/service"
+	"github.com/rs/zerolog/log"
+)
+
+type MFAHandler struct {
+	service *service.MFAService
+}
+
+func NewMFAHandler(mfaService *service.MFAService) *MFAHandler {
+	return &MFAHandler{service: mfaService}
+}
+
+type MFAVerifyRequest struct {
+	MFAToken string `json:"mfaToken" validate:"required"`
+	Code     string `json:"code" validate:"required,len=6,numeric"`
+}
+
+type MFAEnrollRequest struct {
+	MFAToken string `json:"mfaToken" validate:"required"`
+}
+
+type MFACodeRequest struct {
+	Code string `json:"code" validate:"required,len=6,numeric"`
+}
+
+// Verify completes a sign-in that returned an MFA challenge, exchanging its
+// token and a TOTP code for tokens
+func (h *MFAHandler) Verify(w http.ResponseWriter, r *http.Request) {
+	var req MFAVerifyRequest
+	if err := decodeAndValidate(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "validation_error", err.Error())
+		return
+	}
+
+	output, err := h.service.VerifyChallenge(r.Context(), service.VerifyMFAInput{
+		Token:     req.MFAToken,
+		Code:      req.Code,
+		IPAddress: r.RemoteAddr,
+		UserAgent: r.UserAgent(),
+	})
+	if err != nil {
+		if err.Error() == "too_many_attempts" {
+			writeTooManyAttempts(w)
+			return
+		}
+		if !writeMFAError(w, err) {
+			log.Warn().Err(err).Msg("MFA verification failed")
+			writeError(w, http.StatusBadRequest, "verification_failed", "Invalid or expired code")
+		}
+		return
+	}
+
+	writeSuccess(w, http.StatusOK, output)
+}
+
+// EnrollChallenge returns a new authenticator secret for a sign-in that must
+// enroll one before it can be verified
+func (h *MFAHandler) EnrollChallenge(w http.ResponseWriter, r *http.Request) {
+	var req MFAEnrollRequest
+	if err := decodeAndValidate(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "validation_error", err.Error())
+		return
+	}
+
+	output, err := h.service.EnrollChallenge(r.Context(), req.MFAToken)
+	if err != nil {
+		if !writeMFAError(w, err) {
+			log.Warn().Err(err).Msg("MFA enrollment failed")
+			writeError(w, http.StatusBadRequest, "enrollment_failed", "Failed to enroll authenticator")
+		}
+		return
+	}
+
+	writeSuccess(w, http.StatusOK, output)
+}
+
+// Enroll returns a new authenticator secret for the signed-in user, to be
+// confirmed with ConfirmEnrollment
+func (h *MFAHandler) Enroll(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetClaims(r.Context())
+	if claims == nil {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Authentication required")
+		return
+	}
+
+	output, err := h.service.Enroll(r.Context(), claims)
+	if err != nil {
+		if !writeMFAError(w, err) {
+			log.Warn().Err(err).Str("userId", claims.UserID).Msg("MFA enrollment failed")
+			writeError(w, http.StatusBadRequest, "enrollment_failed", "Failed to enroll authenticator")
+		}
+		return
+	}
+
+	writeSuccess(w, http.StatusOK, output)
+}
+
+func (h *MFAHandler) ConfirmEnrollment(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetClaims(r.Context())
+	if claims == nil {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Authentication required")
+		return
+	}
+
+	var req MFACodeRequest
+	if err := decodeAndValidate(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "validation_error", err.Error())
+		return
+	}
+
+	err := h.service.ConfirmEnrollment(r.Context(), service.MFACodeInput{
+		Claims:    claims,
+		Code:      req.Code,
+		IPAddress: r.RemoteAddr,
+		UserAgent: r.UserAgent(),
+	})
+	if err != nil {
+		if !writeMFAError(w, err) {
+			log.Warn().Err(err).Str("userId", claims.UserID).Msg("MFA enrollment confirmation failed")
+			writeError(w, http.StatusBadRequest, "verification_failed", "Invalid or expired code")
+		}
+		return
+	}
+
+	writeSuccess(w, http.StatusOK, map[string]bool{"enrolled": true})
+}
+
+// RemoveFactor removes the signed-in user's authenticator, which they prove
+// they still hold with a current code
+func (h *MFAHandler) RemoveFactor(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetClaims(r.Context())
+	if claims == nil {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Authentication required")
+		return
+	}
+
+	var req MFACodeRequest
+	if err := decodeAndValidate(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "validation_error", err.Error())
+		return
+	}
+
+	err := h.service.RemoveFactor(r.Context(), service.MFACodeInput{
+		Claims:    claims,
+		Code:      req.Code,
+		IPAddress: r.RemoteAddr,
+		UserAgent: r.UserAgent(),
+	})
+	if err != nil {
+		if !writeMFAError(w, err) {
+			log.Warn().Err(err).Str("userId", claims.UserID).Msg("MFA removal failed")
+			writeError(w, http.StatusBadRequest, "verification_failed", "Invalid or expired code")
+		}
+		return
+	}
+
+	writeSuccess(w, http.StatusOK, map[string]bool{"removed": true})
+}
+
+// writeMFAError responds to the errors MFA endpoints share, reporting
+// whether err was one of them
+func writeMFAError(w http.ResponseWriter, err error) bool {
+	if err.Error() == "invalid_mfa_token" {
+		writeError(w, http.StatusUnauthorized, "invalid_mfa_token", "MFA token is invalid or was already used")
+		return true
+	}
+	if err.Error() == "mfa_token_expired" {
+		writeError(w, http.StatusUnauthorized, "mfa_token_expired", "MFA token has expired. Please sign in again.")
+		return true
+	}
+	if err.Error() == "mfa_enrollment_required" {
+		writeError(w, http.StatusBadRequest, "mfa_enrollment_required", "An authenticator must be enrolled first")
+		return true
+	}
+	if err.Error() == "mfa_already_enrolled" {
+		writeError(w, http.StatusConflict, "mfa_already_enrolled", "An authenticator is already enrolled")
+		return true
+	}
+	if err.Error() == "mfa_not_enrolled" {
+		writeError(w, http.StatusNotFound, "mfa_not_enrolled", "No authenticator is enrolled")
+		return true
+	}
+	if err.Error() == "code_already_used" {
+		writeError(w, http.StatusBadRequest, "code_already_used", "This code was already used. Please wait for the next one.")
+		return true
+	}
+	return false
+}
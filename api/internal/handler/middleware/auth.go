@@ -6,6 +6,8 @@ import (
 	"strings"
 
 	"github.com/marcioecom/permit/internal/crypto"
+	"github.com/marcioecom/permit/internal/repository"
+	"github.com/rs/zerolog/log"
 )
 
 type contextKey string
@@ -14,14 +16,21 @@ const (
 	UserIDKey    contextKey = "userId"
 	ProjectIDKey contextKey = "projectId"
 	EmailKey     contextKey = "email"
+	ClaimsKey    contextKey = "claims"
 )
 
 type AuthMiddleware struct {
-	jwtService *crypto.JWTService
+	jwtService   *crypto.JWTService
+	denylistRepo repository.AccessTokenDenylistRepository
+	sessionRepo  repository.SessionRepository
 }
 
-func NewAuthMiddleware(jwtService *crypto.JWTService) *AuthMiddleware {
-	return &AuthMiddleware{jwtService: jwtService}
+func NewAuthMiddleware(jwtService *crypto.JWTService, denylistRepo repository.AccessTokenDenylistRepository, sessionRepo repository.SessionRepository) *AuthMiddleware {
+	return &AuthMiddleware{
+		jwtService:   jwtService,
+		denylistRepo: denylistRepo,
+		sessionRepo:  sessionRepo,
+	}
 }
 
 func (m *AuthMiddleware) RequireAuth(next http.Handler) http.Handler {
@@ -45,15 +54,57 @@ func (m *AuthMiddleware) RequireAuth(next http.Handler) http.Handler {
 			return
 		}
 
+		revoked, err := m.denylistRepo.Contains(r.Context(), claims.ID)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to check access token denylist")
+			writeUnauthorized(w, "invalid_token", "Invalid or expired token")
+			return
+		}
+		if revoked {
+			writeUnauthorized(w, "token_revoked", "Token has been revoked")
+			return
+		}
+
+		// Revoking a session ends its access tokens too, not only its
+		// refresh tokens
+		if claims.SessionID != "" {
+			session, err := m.sessionRepo.GetByID(r.Context(), claims.SessionID)
+			if err != nil {
+				log.Error().Err(err).Msg("failed to check session")
+				writeUnauthorized(w, "invalid_token", "Invalid or expired token")
+				return
+			}
+			if session != nil && session.RevokedAt != nil {
+				writeUnauthorized(w, "session_revoked", "Session has been revoked")
+				return
+			}
+		}
+
 		ctx := r.Context()
 		ctx = context.WithValue(ctx, UserIDKey, claims.UserID)
 		ctx = context.WithValue(ctx, ProjectIDKey, claims.ProjectID)
 		ctx = context.WithValue(ctx, EmailKey, claims.Email)
+		ctx = context.WithValue(ctx, ClaimsKey, claims)
 
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// RejectImpersonation keeps impersonation tokens away from routes that act
+// on the account itself, such as the dashboard, so acting as a user never
+// grants access to projects that user owns. It must run after RequireAuth.
+func (m *AuthMiddleware) RejectImpersonation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if claims := GetClaims(r.Context()); claims != nil && claims.Actor != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"data":null,"error":{"code":"impersonation_not_allowed","message":"Not available while impersonating a user"}}`))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func GetUserID(ctx context.Context) string {
 	if v := ctx.Value(UserIDKey); v != nil {
 		return v.(string)
@@ -75,6 +126,13 @@ func GetEmail(ctx context.Context) string {
 	return ""
 }
 
+func GetClaims(ctx context.Context) *crypto.AccessTokenClaims {
+	if v := ctx.Value(ClaimsKey); v != nil {
+		return v.(*crypto.AccessTokenClaims)
+	}
+	return nil
+}
+
 func writeUnauthorized(w http.ResponseWriter, code, message string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusUnauthorized)
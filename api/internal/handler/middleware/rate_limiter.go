@@ -65,6 +65,15 @@ func IPKeyExtractor(r *http.Request) string {
 	return r.RemoteAddr
 }
 
+// ClientIDKeyExtractor extracts the client_id of HTTP Basic client
+// credentials as the rate limit key, falling back to the client IP
+func ClientIDKeyExtractor(r *http.Request) string {
+	if clientID, _, ok := r.BasicAuth(); ok && clientID != "" {
+		return "client:" + clientID
+	}
+	return IPKeyExtractor(r)
+}
+
 // RateLimitMiddleware creates a middleware that rate limits requests
 func RateLimitMiddleware(limiter *RateLimiter, keyExtractor KeyExtractor) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
@@ -87,5 +96,17 @@ func RateLimitMiddleware(limiter *RateLimiter, keyExtractor KeyExtractor) func(h
 // OTP rate limiter: 5 requests per hour = 5/3600 per second
 var OTPLimiter = NewRateLimiter(rate.Limit(5.0/3600.0), 5)
 
+// OTP verification rate limiter: 30 requests per hour = 30/3600 per second,
+// on top of the per-code and per-email lockouts in the auth service
+var OTPVerifyLimiter = NewRateLimiter(rate.Limit(30.0/3600.0), 10)
+
 // OAuth rate limiter: 20 requests per hour = 20/3600 per second
 var OAuthLimiter = NewRateLimiter(rate.Limit(20.0/3600.0), 20)
+
+// API key rate limiter for the client credentials endpoints, each call of
+// which checks a bcrypt hash: 10 requests per second per IP
+var ClientIPLimiter = NewRateLimiter(rate.Limit(10), 100)
+
+// API key rate limiter for the same endpoints per client ID, so one leaked
+// client ID can't be guessed at from many IPs: 10 requests per second
+var ClientIDLimiter = NewRateLimiter(rate.Limit(10), 100)
@@ -2,7 +2,6 @@ package handler
 
 import (
 	"net/http"
-	"strings"
 
 	"github.com/marcioecom/permit/internal/service"
 	"github.com/rs/zerolog/log"
@@ -29,22 +28,7 @@ func (h *OAuthHandler) Authorize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Extract client origin from Origin or Referer header
-	clientOrigin := r.Header.Get("Origin")
-	if clientOrigin == "" {
-		referer := r.Header.Get("Referer")
-		if referer != "" {
-			parts := strings.SplitN(referer, "//", 2)
-			if len(parts) == 2 {
-				hostEnd := strings.IndexByte(parts[1], '/')
-				if hostEnd > 0 {
-					clientOrigin = parts[0] + "//" + parts[1][:hostEnd]
-				} else {
-					clientOrigin = referer
-				}
-			}
-		}
-	}
+	clientOrigin := requestOrigin(r)
 	if clientOrigin == "" {
 		writeError(w, http.StatusBadRequest, "missing_origin", "Origin header is required")
 		return
@@ -104,6 +88,8 @@ func (h *OAuthHandler) ExchangeToken(w http.ResponseWriter, r *http.Request) {
 	output, err := h.service.ExchangeToken(r.Context(), service.TokenExchangeInput{
 		Code:          req.Code,
 		EnvironmentID: req.EnvironmentID,
+		IPAddress:     r.RemoteAddr,
+		UserAgent:     r.UserAgent(),
 	})
 	if err != nil {
 		log.Warn().Err(err).Msg("OAuth token exchange failed")
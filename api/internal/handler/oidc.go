@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/marcioecom/permit/internal/handler/middleware"
+	"github.com/marcioecom/permit/internal/service"
+	"github.com/rs/zerolog/log"
+)
+
+// OIDCHandler serves the OpenID Connect provider endpoints of an environment
+type OIDCHandler struct {
+	service *service.OIDCService
+}
+
+func NewOIDCHandler(oidcService *service.OIDCService) *OIDCHandler {
+	return &OIDCHandler{service: oidcService}
+}
+
+func (h *OIDCHandler) Discovery(w http.ResponseWriter, r *http.Request) {
+	doc, err := h.service.Discovery(r.Context(), chi.URLParam(r, "envId"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, "environment_not_found", "Environment not found")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	writeJSON(w, http.StatusOK, doc)
+}
+
+func (h *OIDCHandler) JWKS(w http.ResponseWriter, r *http.Request) {
+	jwks, err := h.service.JWKS(r.Context(), chi.URLParam(r, "envId"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, "environment_not_found", "Environment not found")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, jwks)
+}
+
+// Authorize starts the authorization code flow. Errors about the client or
+// redirect URI are shown here since the relying party can't be trusted with
+// them; the rest are sent back to it.
+func (h *OIDCHandler) Authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	output, err := h.service.Authorize(r.Context(), service.OIDCAuthorizeInput{
+		EnvironmentID:       chi.URLParam(r, "envId"),
+		ClientID:            query.Get("client_id"),
+		RedirectURI:         query.Get("redirect_uri"),
+		ResponseType:        query.Get("response_type"),
+		Scope:               query.Get("scope"),
+		State:               query.Get("state"),
+		Nonce:               query.Get("nonce"),
+		CodeChallenge:       query.Get("code_challenge"),
+		CodeChallengeMethod: query.Get("code_challenge_method"),
+	})
+	if err != nil {
+		if err.Error() == "invalid_client" {
+			writeJSON(w, http.StatusBadRequest, oauthError{Error: "invalid_client", Description: "Unknown client_id"})
+			return
+		}
+		if err.Error() == "invalid_redirect_uri" {
+			writeJSON(w, http.StatusBadRequest, oauthError{Error: "invalid_request", Description: "redirect_uri is not registered for this client"})
+			return
+		}
+		log.Error().Err(err).Msg("OIDC authorize failed")
+		writeJSON(w, http.StatusInternalServerError, oauthError{Error: "server_error"})
+		return
+	}
+
+	http.Redirect(w, r, output.RedirectURL, http.StatusFound)
+}
+
+type AcceptLoginRequest struct {
+	LoginChallenge string `json:"loginChallenge" validate:"required"`
+}
+
+// AcceptLogin is called by the environment's login page once the user has
+// signed in, and returns where to send the browser next
+func (h *OIDCHandler) AcceptLogin(w http.ResponseWriter, r *http.Request) {
+	var req AcceptLoginRequest
+	if err := decodeAndValidate(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "validation_error", err.Error())
+		return
+	}
+
+	output, err := h.service.AcceptLogin(r.Context(), service.AcceptLoginInput{
+		Challenge: req.LoginChallenge,
+		Claims:    middleware.GetClaims(r.Context()),
+	})
+	if err != nil {
+		if err.Error() == "invalid_login_challenge" {
+			writeError(w, http.StatusBadRequest, "invalid_login_challenge", "Login challenge is invalid or expired")
+			return
+		}
+		if err.Error() == "environment_mismatch" {
+			writeError(w, http.StatusForbidden, "environment_mismatch", "Signed in to a different environment")
+			return
+		}
+		log.Error().Err(err).Msg("Failed to accept OIDC login")
+		writeError(w, http.StatusInternalServerError, "internal_error", "Failed to accept login")
+		return
+	}
+
+	writeSuccess(w, http.StatusOK, output)
+}
+
+func (h *OIDCHandler) Token(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, oauthError{Error: "invalid_request", Description: "Body must be application/x-www-form-urlencoded"})
+		return
+	}
+
+	clientID, clientSecret, ok := parseBasicAuth(r)
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+		clientSecret = r.PostForm.Get("client_secret")
+	}
+
+	response, err := h.service.Token(r.Context(), service.OIDCTokenInput{
+		EnvironmentID: chi.URLParam(r, "envId"),
+		GrantType:     r.PostForm.Get("grant_type"),
+		Code:          r.PostForm.Get("code"),
+		RedirectURI:   r.PostForm.Get("redirect_uri"),
+		CodeVerifier:  r.PostForm.Get("code_verifier"),
+		RefreshToken:  r.PostForm.Get("refresh_token"),
+		ClientID:      clientID,
+		ClientSecret:  clientSecret,
+		IPAddress:     r.RemoteAddr,
+		UserAgent:     r.UserAgent(),
+	})
+	if err != nil {
+		if err.Error() == "invalid_client" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Permit OIDC"`)
+			writeJSON(w, http.StatusUnauthorized, oauthError{Error: "invalid_client"})
+			return
+		}
+		if err.Error() == "invalid_request" || err.Error() == "invalid_grant" || err.Error() == "unsupported_grant_type" {
+			writeJSON(w, http.StatusBadRequest, oauthError{Error: err.Error()})
+			return
+		}
+		log.Error().Err(err).Msg("OIDC token request failed")
+		writeJSON(w, http.StatusInternalServerError, oauthError{Error: "server_error"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (h *OIDCHandler) UserInfo(w http.ResponseWriter, r *http.Request) {
+	claims, err := h.service.UserInfo(r.Context(), chi.URLParam(r, "envId"), middleware.GetClaims(r.Context()))
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeJSON(w, http.StatusUnauthorized, oauthError{Error: "invalid_token"})
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, claims)
+}
@@ -170,8 +170,9 @@ func (h *ProjectHandler) UpdateWidget(w http.ResponseWriter, r *http.Request) {
 }
 
 type CreateAPIKeyRequest struct {
-	Name          string `json:"name"`
-	EnvironmentID string `json:"environmentId"`
+	Name          string   `json:"name"`
+	EnvironmentID string   `json:"environmentId"`
+	Scopes        []string `json:"scopes"`
 }
 
 func (h *ProjectHandler) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
@@ -186,8 +187,13 @@ func (h *ProjectHandler) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
 		ProjectID:     id,
 		Name:          req.Name,
 		EnvironmentID: req.EnvironmentID,
+		Scopes:        req.Scopes,
 	})
 	if err != nil {
+		if err.Error() == "invalid_scope" {
+			writeError(w, http.StatusBadRequest, "invalid_scope", "Scopes must be non-empty and contain no spaces, quotes or backslashes")
+			return
+		}
 		writeError(w, http.StatusInternalServerError, "internal_error", "Failed to create API key")
 		return
 	}
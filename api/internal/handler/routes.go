@@ -15,23 +15,55 @@ type Handlers struct {
 	JWKS      *JWKSHandler
 	Dashboard *DashboardHandler
 	OAuth     *OAuthHandler
+	Token     *TokenHandler
+	OIDC      *OIDCHandler
+	MFA       *MFAHandler
 }
 
 type Services struct {
-	JWTService  *crypto.JWTService
-	ProjectRepo repository.ProjectRepository
+	JWTService   *crypto.JWTService
+	ProjectRepo  repository.ProjectRepository
+	DenylistRepo repository.AccessTokenDenylistRepository
+	SessionRepo  repository.SessionRepository
 }
 
 func SetupRoutes(r *chi.Mux, h *Handlers, services *Services) {
 	r.Get("/health", h.Health.GetHealth)
 	r.Get("/.well-known/jwks.json", h.JWKS.GetJWKS)
 
+	// Public keys and RFC 8414 metadata for verifying access tokens without credentials
+	r.Get("/projects/{projectId}/.well-known/jwks.json", h.JWKS.GetProjectJWKS)
+	r.Get("/projects/{projectId}/.well-known/oauth-authorization-server", h.JWKS.GetProjectMetadata)
+	r.Get("/environments/{envId}/.well-known/jwks.json", h.JWKS.GetEnvironmentJWKS)
+	r.Get("/environments/{envId}/.well-known/oauth-authorization-server", h.JWKS.GetEnvironmentMetadata)
+
 	// OAuth callback from providers (Google/GitHub redirect here)
 	r.Get("/oauth/callback", h.OAuth.Callback)
 
 	corsMiddleware := middleware.NewCORSMiddleware(services.ProjectRepo)
 	otpRateLimiter := middleware.RateLimitMiddleware(middleware.OTPLimiter, middleware.IPKeyExtractor)
-	authMiddleware := middleware.NewAuthMiddleware(services.JWTService)
+	otpVerifyRateLimiter := middleware.RateLimitMiddleware(middleware.OTPVerifyLimiter, middleware.IPKeyExtractor)
+	clientIPRateLimiter := middleware.RateLimitMiddleware(middleware.ClientIPLimiter, middleware.IPKeyExtractor)
+	clientIDRateLimiter := middleware.RateLimitMiddleware(middleware.ClientIDLimiter, middleware.ClientIDKeyExtractor)
+	authMiddleware := middleware.NewAuthMiddleware(services.JWTService, services.DenylistRepo, services.SessionRepo)
+
+	// Token endpoints for project backends, authenticated with API key credentials
+	r.Group(func(r chi.Router) {
+		r.Use(clientIPRateLimiter, clientIDRateLimiter)
+		r.Post("/oauth/token", h.Token.Token)
+		r.Post("/oauth/introspect", h.Token.Introspect)
+		r.Post("/oauth/revoke", h.Token.Revoke)
+	})
+
+	// OpenID Connect provider, one issuer per environment
+	r.Route("/oidc/{envId}", func(r chi.Router) {
+		r.Get("/.well-known/openid-configuration", h.OIDC.Discovery)
+		r.Get("/jwks.json", h.OIDC.JWKS)
+		r.Get("/authorize", h.OIDC.Authorize)
+		r.Post("/token", h.OIDC.Token)
+		r.With(authMiddleware.RequireAuth).Get("/userinfo", h.OIDC.UserInfo)
+		r.With(authMiddleware.RequireAuth).Post("/userinfo", h.OIDC.UserInfo)
+	})
 
 	r.Route("/api/v1", func(r chi.Router) {
 		r.Route("/auth", func(r chi.Router) {
@@ -40,23 +72,49 @@ func SetupRoutes(r *chi.Mux, h *Handlers, services *Services) {
 			r.With(authMiddleware.RequireAuth).Get("/me", h.Session.GetMe)
 
 			r.With(otpRateLimiter).Post("/otp/start", h.Auth.OtpStart)
-			r.Post("/otp/verify", h.Auth.OtpVerify)
+			r.With(otpVerifyRateLimiter).Post("/otp/verify", h.Auth.OtpVerify)
+			r.With(otpVerifyRateLimiter).Get("/magic-link", h.Auth.MagicLink)
+			r.With(otpRateLimiter).Post("/sms/start", h.Auth.SMSStart)
+			r.With(otpVerifyRateLimiter).Post("/sms/verify", h.Auth.SMSVerify)
+
+			// Second factor for sign-ins that returned an MFA challenge
+			r.With(otpVerifyRateLimiter).Post("/mfa/verify", h.MFA.Verify)
+			r.With(otpRateLimiter).Post("/mfa/enroll", h.MFA.EnrollChallenge)
 
 			r.Post("/refresh", h.Session.Refresh)
 			r.With(authMiddleware.RequireAuth).Post("/logout", h.Session.Logout)
+			r.With(authMiddleware.RequireAuth, authMiddleware.RejectImpersonation).Post("/logout/all", h.Session.LogoutAll)
+
+			r.Group(func(r chi.Router) {
+				r.Use(authMiddleware.RequireAuth)
+				r.Get("/sessions", h.Session.ListSessions)
+				r.With(authMiddleware.RejectImpersonation).Delete("/sessions/{sessionId}", h.Session.RevokeSession)
+				r.With(otpRateLimiter).Post("/reauth/start", h.Auth.ReauthStart)
+				r.With(otpVerifyRateLimiter).Post("/reauth/verify", h.Auth.ReauthVerify)
+			})
+
+			r.Group(func(r chi.Router) {
+				r.Use(authMiddleware.RequireAuth, authMiddleware.RejectImpersonation)
+				r.Post("/mfa/totp", h.MFA.Enroll)
+				r.With(otpVerifyRateLimiter).Post("/mfa/totp/confirm", h.MFA.ConfirmEnrollment)
+				r.With(otpVerifyRateLimiter).Delete("/mfa/totp", h.MFA.RemoveFactor)
+			})
 
 			// OAuth endpoints
 			r.Post("/oauth/authorize", h.OAuth.Authorize)
 			r.Post("/oauth/token", h.OAuth.ExchangeToken)
+
+			// Hands an OIDC authorization request back once the user signs in
+			r.With(authMiddleware.RequireAuth, authMiddleware.RejectImpersonation).Post("/oidc/accept", h.OIDC.AcceptLogin)
 		})
 
 		r.Route("/projects", func(r chi.Router) {
-			r.With(authMiddleware.RequireAuth).Post("/", h.Project.Create)
+			r.With(authMiddleware.RequireAuth, authMiddleware.RejectImpersonation).Post("/", h.Project.Create)
 			r.Get("/{id}", h.Project.GetByID)
 			r.Get("/{id}/widget", h.Project.GetWidget)
 
 			r.Group(func(r chi.Router) {
-				r.Use(authMiddleware.RequireAuth)
+				r.Use(authMiddleware.RequireAuth, authMiddleware.RejectImpersonation)
 				r.Patch("/{id}", h.Project.Update)
 				r.Patch("/{id}/widget", h.Project.UpdateWidget)
 				r.Post("/{id}/api-keys", h.Project.CreateAPIKey)
@@ -65,12 +123,19 @@ func SetupRoutes(r *chi.Mux, h *Handlers, services *Services) {
 
 		// Dashboard routes (owner-authenticated)
 		r.Route("/dashboard", func(r chi.Router) {
-			r.Use(authMiddleware.RequireAuth)
+			r.Use(authMiddleware.RequireAuth, authMiddleware.RejectImpersonation)
 
 			r.Get("/projects", h.Dashboard.ListProjects)
 			r.Get("/projects/{id}", h.Dashboard.GetProject)
 			r.Delete("/projects/{id}", h.Dashboard.DeleteProject)
 			r.Get("/projects/{id}/users", h.Dashboard.ListProjectUsers)
+			r.Get("/projects/{id}/users/{userId}/sessions", h.Dashboard.ListProjectUserSessions)
+			r.Delete("/projects/{id}/users/{userId}/sessions", h.Dashboard.RevokeProjectUserSessions)
+			r.Delete("/projects/{id}/users/{userId}/sessions/{sessionId}", h.Dashboard.RevokeProjectUserSession)
+			r.Put("/projects/{id}/users/{userId}/metadata", h.Dashboard.UpdateProjectUserMetadata)
+			r.Post("/projects/{id}/users/{userId}/impersonate", h.Dashboard.ImpersonateProjectUser)
+			r.Get("/projects/{id}/claims-template", h.Dashboard.GetClaimsTemplate)
+			r.Put("/projects/{id}/claims-template", h.Dashboard.UpdateClaimsTemplate)
 			r.Get("/projects/{id}/api-keys", h.Dashboard.ListAPIKeys)
 			r.Delete("/projects/{id}/api-keys/{keyId}", h.Dashboard.RevokeAPIKey)
 
@@ -92,6 +157,13 @@ func SetupRoutes(r *chi.Mux, h *Handlers, services *Services) {
 					r.Put("/", h.Dashboard.UpsertOAuthProvider)
 					r.Delete("/{provider}", h.Dashboard.DeleteOAuthProvider)
 				})
+
+				// Relying parties of the environment's OIDC provider
+				r.Route("/{envId}/oidc-clients", func(r chi.Router) {
+					r.Get("/", h.Dashboard.ListOIDCClients)
+					r.Post("/", h.Dashboard.CreateOIDCClient)
+					r.Delete("/{clientId}", h.Dashboard.DeleteOIDCClient)
+				})
 			})
 		})
 	})
@@ -3,8 +3,10 @@ package handler
 import (
 	"net/http"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/marcioecom/permit/internal/handler/middleware"
 	"github.com/marcioecom/permit/internal/service"
+	"github.com/rs/zerolog/log"
 )
 
 type SessionHandler struct {
@@ -28,6 +30,8 @@ func (h *SessionHandler) Refresh(w http.ResponseWriter, r *http.Request) {
 
 	output, err := h.service.RefreshToken(r.Context(), service.RefreshTokenInput{
 		RefreshToken: req.RefreshToken,
+		IPAddress:    r.RemoteAddr,
+		UserAgent:    r.UserAgent(),
 	})
 	if err != nil {
 		writeError(w, http.StatusUnauthorized, "refresh_failed", "Invalid or expired refresh token")
@@ -54,5 +58,82 @@ func (h *SessionHandler) GetMe(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *SessionHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	h.logout(w, r, false)
+}
+
+func (h *SessionHandler) LogoutAll(w http.ResponseWriter, r *http.Request) {
+	h.logout(w, r, true)
+}
+
+func (h *SessionHandler) logout(w http.ResponseWriter, r *http.Request, everywhere bool) {
+	claims := middleware.GetClaims(r.Context())
+	if claims == nil {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Authentication required")
+		return
+	}
+
+	err := h.service.Logout(r.Context(), service.LogoutInput{
+		Claims:     claims,
+		Everywhere: everywhere,
+		IPAddress:  r.RemoteAddr,
+		UserAgent:  r.UserAgent(),
+	})
+	if err != nil {
+		if err.Error() == "environment_required" {
+			writeError(w, http.StatusBadRequest, "environment_required", "Token is not bound to an environment")
+			return
+		}
+		log.Error().Err(err).Str("userId", claims.UserID).Msg("Failed to logout")
+		writeError(w, http.StatusInternalServerError, "internal_error", "Failed to logout")
+		return
+	}
+
 	writeSuccess(w, http.StatusOK, map[string]string{"message": "Logged out successfully"})
 }
+
+func (h *SessionHandler) ListSessions(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetClaims(r.Context())
+	if claims == nil {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Authentication required")
+		return
+	}
+
+	sessions, err := h.service.ListSessions(r.Context(), claims)
+	if err != nil {
+		if err.Error() == "environment_required" {
+			writeError(w, http.StatusBadRequest, "environment_required", "Token is not bound to an environment")
+			return
+		}
+		log.Error().Err(err).Str("userId", claims.UserID).Msg("Failed to list sessions")
+		writeError(w, http.StatusInternalServerError, "internal_error", "Failed to list sessions")
+		return
+	}
+
+	writeSuccess(w, http.StatusOK, sessions)
+}
+
+func (h *SessionHandler) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetClaims(r.Context())
+	if claims == nil {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Authentication required")
+		return
+	}
+
+	err := h.service.RevokeSession(r.Context(), service.RevokeSessionInput{
+		Claims:    claims,
+		SessionID: chi.URLParam(r, "sessionId"),
+		IPAddress: r.RemoteAddr,
+		UserAgent: r.UserAgent(),
+	})
+	if err != nil {
+		if err.Error() == "session_not_found" {
+			writeError(w, http.StatusNotFound, "not_found", "Session not found")
+			return
+		}
+		log.Error().Err(err).Str("userId", claims.UserID).Msg("Failed to revoke session")
+		writeError(w, http.StatusInternalServerError, "internal_error", "Failed to revoke session")
+		return
+	}
+
+	writeSuccess(w, http.StatusOK, map[string]string{"message": "Session revoked"})
+}
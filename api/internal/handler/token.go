@@ -0,0 +1,155 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/marcioecom/permit/internal/models"
+	"github.com/marcioecom/permit/internal/repository"
+	"github.com/marcioecom/permit/internal/service"
+	"github.com/rs/zerolog/log"
+)
+
+// TokenHandler serves the OAuth token endpoints project backends call with
+// their API key credentials
+type TokenHandler struct {
+	service     *service.TokenService
+	projectRepo repository.ProjectRepository
+}
+
+func NewTokenHandler(tokenService *service.TokenService, projectRepo repository.ProjectRepository) *TokenHandler {
+	return &TokenHandler{service: tokenService, projectRepo: projectRepo}
+}
+
+// oauthError is the error body defined by RFC 6749 section 5.2
+type oauthError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+// Introspect implements RFC 7662 token introspection for access and refresh
+// tokens issued within the calling API key's project.
+func (h *TokenHandler) Introspect(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	apiKey, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, oauthError{Error: "invalid_request", Description: "Body must be application/x-www-form-urlencoded"})
+		return
+	}
+	token := r.PostForm.Get("token")
+	if token == "" {
+		writeJSON(w, http.StatusBadRequest, oauthError{Error: "invalid_request", Description: "token is required"})
+		return
+	}
+
+	response, err := h.service.Introspect(r.Context(), service.IntrospectInput{
+		ProjectID: apiKey.ProjectID,
+		Token:     token,
+	})
+	if err != nil {
+		log.Error().Err(err).Str("clientID", apiKey.ClientID).Msg("failed to introspect token")
+		writeJSON(w, http.StatusInternalServerError, oauthError{Error: "server_error"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// Revoke implements RFC 7009 token revocation for access and refresh tokens
+// issued within the calling API key's project. It succeeds for tokens that
+// are invalid or already revoked.
+func (h *TokenHandler) Revoke(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	apiKey, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, oauthError{Error: "invalid_request", Description: "Body must be application/x-www-form-urlencoded"})
+		return
+	}
+	token := r.PostForm.Get("token")
+	if token == "" {
+		writeJSON(w, http.StatusBadRequest, oauthError{Error: "invalid_request", Description: "token is required"})
+		return
+	}
+
+	err := h.service.Revoke(r.Context(), service.RevokeInput{
+		ProjectID: apiKey.ProjectID,
+		ClientID:  apiKey.ClientID,
+		Token:     token,
+		IPAddress: r.RemoteAddr,
+		UserAgent: r.UserAgent(),
+	})
+	if err != nil {
+		log.Error().Err(err).Str("clientID", apiKey.ClientID).Msg("failed to revoke token")
+		writeJSON(w, http.StatusServiceUnavailable, oauthError{Error: "server_error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Token implements the RFC 6749 client credentials grant, issuing an access
+// token that identifies the calling API key
+func (h *TokenHandler) Token(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	apiKey, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, oauthError{Error: "invalid_request", Description: "Body must be application/x-www-form-urlencoded"})
+		return
+	}
+	grantType := r.PostForm.Get("grant_type")
+	if grantType == "" {
+		writeJSON(w, http.StatusBadRequest, oauthError{Error: "invalid_request", Description: "grant_type is required"})
+		return
+	}
+	if grantType != "client_credentials" {
+		writeJSON(w, http.StatusBadRequest, oauthError{Error: "unsupported_grant_type"})
+		return
+	}
+
+	response, err := h.service.IssueClientToken(r.Context(), service.ClientCredentialsInput{
+		APIKey: apiKey,
+		Scope:  r.PostForm.Get("scope"),
+	})
+	if err != nil {
+		if err.Error() == "invalid_scope" {
+			writeJSON(w, http.StatusBadRequest, oauthError{Error: "invalid_scope", Description: "Requested scope is not granted to this client"})
+			return
+		}
+		log.Error().Err(err).Str("clientID", apiKey.ClientID).Msg("failed to issue client token")
+		writeJSON(w, http.StatusInternalServerError, oauthError{Error: "server_error"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// authenticate writes an invalid_client error unless the request carries
+// valid API key credentials
+func (h *TokenHandler) authenticate(w http.ResponseWriter, r *http.Request) (*models.APIKey, bool) {
+	apiKey, err := authenticateClient(r, h.projectRepo)
+	if err != nil {
+		if errors.Is(err, errMissingClientCredentials) || errors.Is(err, errInvalidClientCredentials) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Permit API"`)
+			writeJSON(w, http.StatusUnauthorized, oauthError{Error: "invalid_client"})
+			return nil, false
+		}
+		writeJSON(w, http.StatusInternalServerError, oauthError{Error: "server_error"})
+		return nil, false
+	}
+	return apiKey, true
+}
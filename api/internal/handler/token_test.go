@@ -0,0 +1,177 @@
+package handler_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcioecom/permit/internal/crypto"
+	"github.com/marcioecom/permit/internal/handler"
+	"github.com/marcioecom/permit/internal/models"
+	"github.com/marcioecom/permit/internal/repository"
+	"github.com/marcioecom/permit/internal/service"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestIntrospect_RequiresClientCredentials(t *testing.T) {
+	h := handler.NewTokenHandler(nil, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/oauth/introspect", strings.NewReader("token=abc"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+
+	h.Introspect(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rec.Code)
+	}
+	if rec.Header().Get("WWW-Authenticate") == "" {
+		t.Error("expected WWW-Authenticate header")
+	}
+
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Error != "invalid_client" {
+		t.Errorf("expected invalid_client, got %s", body.Error)
+	}
+}
+
+func TestRevoke_RequiresClientCredentials(t *testing.T) {
+	h := handler.NewTokenHandler(nil, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/oauth/revoke", strings.NewReader("token=abc&token_type_hint=refresh_token"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+
+	h.Revoke(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rec.Code)
+	}
+}
+
+func TestToken_RequiresClientCredentials(t *testing.T) {
+	h := handler.NewTokenHandler(nil, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader("grant_type=client_credentials"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+
+	h.Token(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rec.Code)
+	}
+}
+
+type fakeAPIKeyRepo struct {
+	repository.ProjectRepository
+	apiKey *models.APIKey
+}
+
+func (f *fakeAPIKeyRepo) GetAPIKeyByClientID(_ context.Context, clientID string) (*models.APIKey, error) {
+	if f.apiKey != nil && f.apiKey.ClientID == clientID {
+		return f.apiKey, nil
+	}
+	return nil, nil
+}
+
+func TestTokenEndpoints_RejectRevokedAPIKey(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("sk_secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokedAt := time.Now()
+	h := handler.NewTokenHandler(nil, &fakeAPIKeyRepo{apiKey: &models.APIKey{
+		ID:               "key-1",
+		ProjectID:        "project-1",
+		ClientID:         "pk_revoked",
+		ClientSecretHash: string(hash),
+		RevokedAt:        &revokedAt,
+	}})
+	credentials := "Basic " + base64.StdEncoding.EncodeToString([]byte("pk_revoked:sk_secret"))
+
+	endpoints := []struct {
+		name  string
+		body  string
+		serve http.HandlerFunc
+	}{
+		{"token", "grant_type=client_credentials", h.Token},
+		{"introspect", "token=abc", h.Introspect},
+		{"revoke", "token=abc", h.Revoke},
+	}
+	for _, e := range endpoints {
+		req := httptest.NewRequest(http.MethodPost, "/oauth/"+e.name, strings.NewReader(e.body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", credentials)
+		rec := httptest.NewRecorder()
+
+		e.serve(rec, req)
+
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401 for a revoked API key, got %d", e.name, rec.Code)
+		}
+	}
+}
+
+func TestIntrospect_VerifiedSecretFollowsAPIKey(t *testing.T) {
+	keyManager := crypto.NewKeyManager()
+	if err := keyManager.GenerateKeyPair(); err != nil {
+		t.Fatal(err)
+	}
+	tokenService := service.NewTokenService(crypto.NewJWTService(keyManager, "permit"), nil, nil, nil, nil, nil, nil)
+	hash, err := bcrypt.GenerateFromPassword([]byte("sk_secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := &fakeAPIKeyRepo{apiKey: &models.APIKey{
+		ID:               "key-1",
+		ProjectID:        "project-1",
+		ClientID:         "pk_cached",
+		ClientSecretHash: string(hash),
+	}}
+	h := handler.NewTokenHandler(tokenService, repo)
+
+	introspect := func(secret string) int {
+		req := httptest.NewRequest(http.MethodPost, "/oauth/introspect", strings.NewReader("token=abc"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("pk_cached:"+secret)))
+		rec := httptest.NewRecorder()
+		h.Introspect(rec, req)
+		return rec.Code
+	}
+
+	if code := introspect("sk_secret"); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if code := introspect("sk_other"); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for another secret once one was verified, got %d", code)
+	}
+
+	rotated, err := bcrypt.GenerateFromPassword([]byte("sk_rotated"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.apiKey.ClientSecretHash = string(rotated)
+	if code := introspect("sk_secret"); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for the old secret after rotation, got %d", code)
+	}
+	if code := introspect("sk_rotated"); code != http.StatusOK {
+		t.Fatalf("expected 200 for the rotated secret, got %d", code)
+	}
+
+	revokedAt := time.Now()
+	repo.apiKey.RevokedAt = &revokedAt
+	if code := introspect("sk_rotated"); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 right after revocation, got %d", code)
+	}
+}
@@ -1,9 +1,19 @@
 package infra
 
-import "github.com/marcioecom/permit/internal/config"
+import (
+	"fmt"
+	"time"
 
+	"github.com/marcioecom/permit/internal/config"
+)
+
+// EmailSender delivers one-time codes. expiresIn is how long they stay
+// valid, as stated in the message.
 type EmailSender interface {
-	SendOTP(to, code, projectName string) error
+	SendOTP(to, code, projectName string, expiresIn time.Duration) error
+	// SendMagicLink sends a sign-in link along with a code that can be
+	// entered instead
+	SendMagicLink(to, link, code, projectName string, expiresIn time.Duration) error
 }
 
 func NewEmailService(cfg *config.Config) EmailSender {
@@ -12,3 +22,18 @@ func NewEmailService(cfg *config.Config) EmailSender {
 	}
 	return NewResendEmailService(cfg.ResendAPIKey, cfg.EmailFrom)
 }
+
+// formatExpiry writes a code lifetime for humans, e.g. "10 minutes"
+func formatExpiry(d time.Duration) string {
+	unit, n := "second", int(d/time.Second)
+	switch {
+	case d >= time.Hour && d%time.Hour == 0:
+		unit, n = "hour", int(d/time.Hour)
+	case d >= time.Minute && d%time.Minute == 0:
+		unit, n = "minute", int(d/time.Minute)
+	}
+	if n == 1 {
+		return fmt.Sprintf("1 %s", unit)
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
@@ -2,6 +2,8 @@ package infra
 
 import (
 	"fmt"
+	"html"
+	"time"
 
 	"github.com/resend/resend-go/v3"
 )
@@ -19,7 +21,7 @@ func NewResendEmailService(apiKey, fromAddr string) *ResendEmailService {
 }
 
 // SendOTP sends an OTP code to the specified email address
-func (s *ResendEmailService) SendOTP(to, code, projectName string) error {
+func (s *ResendEmailService) SendOTP(to, code, projectName string, expiresIn time.Duration) error {
 	html := fmt.Sprintf(`
 		<div style="font-family: sans-serif; max-width: 400px; margin: 0 auto;">
 			<h2>Your verification code</h2>
@@ -28,10 +30,10 @@ func (s *ResendEmailService) SendOTP(to, code, projectName string) error {
 				%s
 			</div>
 			<p style="color: #666; font-size: 14px; margin-top: 20px;">
-				This code expires in 10 minutes. If you didn't request this code, you can safely ignore this email.
+				This code expires in %s. If you didn't request this code, you can safely ignore this email.
 			</p>
 		</div>
-	`, projectName, code)
+	`, projectName, code, formatExpiry(expiresIn))
 
 	params := &resend.SendEmailRequest{
 		From:    s.fromAddr,
@@ -47,3 +49,38 @@ func (s *ResendEmailService) SendOTP(to, code, projectName string) error {
 
 	return nil
 }
+
+// SendMagicLink sends a sign-in link and its fallback code to the specified
+// email address
+func (s *ResendEmailService) SendMagicLink(to, link, code, projectName string, expiresIn time.Duration) error {
+	body := fmt.Sprintf(`
+		<div style="font-family: sans-serif; max-width: 400px; margin: 0 auto;">
+			<h2>Sign in to %s</h2>
+			<p>Click the button below to sign in:</p>
+			<p style="text-align: center; padding: 20px 0;">
+				<a href="%s" style="display: inline-block; padding: 12px 24px; background: #111; color: #fff; text-decoration: none; border-radius: 8px;">Sign in</a>
+			</p>
+			<p>Or enter this code:</p>
+			<div style="font-size: 32px; font-weight: bold; letter-spacing: 4px; padding: 20px; background: #f4f4f4; text-align: center; border-radius: 8px;">
+				%s
+			</div>
+			<p style="color: #666; font-size: 14px; margin-top: 20px;">
+				The link and code expire in %s and can only be used once. If you didn't request them, you can safely ignore this email.
+			</p>
+		</div>
+	`, projectName, html.EscapeString(link), code, formatExpiry(expiresIn))
+
+	params := &resend.SendEmailRequest{
+		From:    s.fromAddr,
+		To:      []string{to},
+		Subject: fmt.Sprintf("Sign in to %s", projectName),
+		Html:    body,
+	}
+
+	_, err := s.client.Emails.Send(params)
+	if err != nil {
+		return fmt.Errorf("failed to send magic link email: %w", err)
+	}
+
+	return nil
+}
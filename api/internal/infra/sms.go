@@ -0,0 +1,19 @@
+package infra
+
+import (
+	"time"
+
+	"github.com/marcioecom/permit/internal/config"
+)
+
+// SMSSender texts one-time codes to E.164 phone numbers
+type SMSSender interface {
+	SendOTP(to, code, projectName string, expiresIn time.Duration) error
+}
+
+func NewSMSService(cfg *config.Config) SMSSender {
+	if cfg.TwilioAccountSID == "" {
+		return NewLogSMSService()
+	}
+	return NewTwilioSMSService(cfg.TwilioBaseURL, cfg.TwilioAccountSID, cfg.TwilioAuthToken, cfg.TwilioFromNumber)
+}
@@ -0,0 +1,20 @@
+package infra
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// LogSMSService writes texts to the log instead of sending them, for local
+// development without an SMS provider
+type LogSMSService struct{}
+
+func NewLogSMSService() *LogSMSService {
+	return &LogSMSService{}
+}
+
+func (s *LogSMSService) SendOTP(to, code, projectName string, expiresIn time.Duration) error {
+	log.Info().Str("to", to).Str("project", projectName).Str("code", code).Dur("expiresIn", expiresIn).Msg("SMS OTP (not sent)")
+	return nil
+}
@@ -2,7 +2,9 @@ package infra
 
 import (
 	"fmt"
+	"html"
 	"net/smtp"
+	"time"
 )
 
 type SMTPEmailService struct {
@@ -19,7 +21,7 @@ func NewSMTPEmailService(host, port, fromAddr string) *SMTPEmailService {
 	}
 }
 
-func (s *SMTPEmailService) SendOTP(to, code, projectName string) error {
+func (s *SMTPEmailService) SendOTP(to, code, projectName string, expiresIn time.Duration) error {
 	subject := fmt.Sprintf("Your %s verification code: %s", projectName, code)
 
 	htmlBody := fmt.Sprintf(`
@@ -30,11 +32,38 @@ func (s *SMTPEmailService) SendOTP(to, code, projectName string) error {
 				%s
 			</div>
 			<p style="color: #666; font-size: 14px; margin-top: 20px;">
-				This code expires in 10 minutes. If you didn't request this code, you can safely ignore this email.
+				This code expires in %s. If you didn't request this code, you can safely ignore this email.
 			</p>
 		</div>
-	`, projectName, code)
+	`, projectName, code, formatExpiry(expiresIn))
 
+	return s.send(to, subject, htmlBody)
+}
+
+func (s *SMTPEmailService) SendMagicLink(to, link, code, projectName string, expiresIn time.Duration) error {
+	subject := fmt.Sprintf("Sign in to %s", projectName)
+
+	htmlBody := fmt.Sprintf(`
+		<div style="font-family: sans-serif; max-width: 400px; margin: 0 auto;">
+			<h2>Sign in to %s</h2>
+			<p>Click the button below to sign in:</p>
+			<p style="text-align: center; padding: 20px 0;">
+				<a href="%s" style="display: inline-block; padding: 12px 24px; background: #111; color: #fff; text-decoration: none; border-radius: 8px;">Sign in</a>
+			</p>
+			<p>Or enter this code:</p>
+			<div style="font-size: 32px; font-weight: bold; letter-spacing: 4px; padding: 20px; background: #f4f4f4; text-align: center; border-radius: 8px;">
+				%s
+			</div>
+			<p style="color: #666; font-size: 14px; margin-top: 20px;">
+				The link and code expire in %s and can only be used once. If you didn't request them, you can safely ignore this email.
+			</p>
+		</div>
+	`, projectName, html.EscapeString(link), code, formatExpiry(expiresIn))
+
+	return s.send(to, subject, htmlBody)
+}
+
+func (s *SMTPEmailService) send(to, subject, htmlBody string) error {
 	msg := []byte(fmt.Sprintf(
 		"From: %s\r\n"+
 			"To: %s\r\n"+
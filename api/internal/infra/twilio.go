@@ -0,0 +1,60 @@
+package infra
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TwilioSMSService sends texts through Twilio's Messages API, or any
+// provider that mirrors it at another base URL
+type TwilioSMSService struct {
+	baseURL    string
+	accountSID string
+	authToken  string
+	fromNumber string
+	httpClient *http.Client
+}
+
+func NewTwilioSMSService(baseURL, accountSID, authToken, fromNumber string) *TwilioSMSService {
+	return &TwilioSMSService{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		accountSID: accountSID,
+		authToken:  authToken,
+		fromNumber: fromNumber,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// SendOTP texts an OTP code to the specified E.164 phone number
+func (s *TwilioSMSService) SendOTP(to, code, projectName string, expiresIn time.Duration) error {
+	form := url.Values{
+		"From": {s.fromNumber},
+		"To":   {to},
+		"Body": {fmt.Sprintf("Your %s verification code is %s. It expires in %s.", projectName, code, formatExpiry(expiresIn))},
+	}
+
+	endpoint := s.baseURL + "/2010-04-01/Accounts/" + url.PathEscape(s.accountSID) + "/Messages.json"
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(s.accountSID, s.authToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send OTP SMS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("failed to send OTP SMS: status %d: %s", resp.StatusCode, body)
+	}
+
+	return nil
+}
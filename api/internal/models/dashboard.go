@@ -7,16 +7,17 @@ import "time"
 // Auth log models
 
 type AuthLog struct {
-	ID        string            `json:"id"`
-	ProjectID string            `json:"projectId"`
-	UserID    string            `json:"userId,omitempty"`
-	UserEmail string            `json:"userEmail"`
-	EventType string            `json:"eventType"`
-	Status    string            `json:"status"`
-	IPAddress string            `json:"ipAddress,omitempty"`
-	UserAgent string            `json:"userAgent,omitempty"`
-	Metadata  map[string]string `json:"metadata,omitempty"`
-	CreatedAt time.Time         `json:"timestamp"`
+	ID            string            `json:"id"`
+	ProjectID     string            `json:"projectId"`
+	EnvironmentID string            `json:"environmentId,omitempty"`
+	UserID        string            `json:"userId,omitempty"`
+	UserEmail     string            `json:"userEmail"`
+	EventType     string            `json:"eventType"`
+	Status        string            `json:"status"`
+	IPAddress     string            `json:"ipAddress,omitempty"`
+	UserAgent     string            `json:"userAgent,omitempty"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	CreatedAt     time.Time         `json:"timestamp"`
 }
 
 type ListAuthLogsInput struct {
@@ -102,14 +103,15 @@ type PaginationMeta struct {
 }
 
 type APIKeyInfo struct {
-	ID                 string  `json:"id"`
-	Name               string  `json:"name"`
-	ClientID           string  `json:"clientId"`
-	ClientSecretMasked string  `json:"clientSecretMasked"`
-	Status             string  `json:"status"`
-	EnvironmentName    string  `json:"environmentName"`
-	LastUsedAt         *string `json:"lastUsedAt"`
-	CreatedAt          string  `json:"createdAt"`
+	ID                 string   `json:"id"`
+	Name               string   `json:"name"`
+	ClientID           string   `json:"clientId"`
+	ClientSecretMasked string   `json:"clientSecretMasked"`
+	Status             string   `json:"status"`
+	EnvironmentName    string   `json:"environmentName"`
+	Scopes             []string `json:"scopes"`
+	LastUsedAt         *string  `json:"lastUsedAt"`
+	CreatedAt          string   `json:"createdAt"`
 }
 
 type RevokedKeyInfo struct {
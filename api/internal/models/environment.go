@@ -8,12 +8,43 @@ const (
 	EnvTypeProduction  = "production"
 )
 
+// OTP code alphabets. Alphanumeric codes leave out 0, 1, I and O, which are
+// easily mistaken for each other.
+const (
+	OTPAlphabetNumeric      = "numeric"
+	OTPAlphabetAlphanumeric = "alphanumeric"
+)
+
 type Environment struct {
-	ID             string    `json:"id"`
-	ProjectID      string    `json:"projectId"`
-	Name           string    `json:"name"`
-	Type           string    `json:"type"`
-	AllowedOrigins []string  `json:"allowedOrigins"`
-	CreatedAt      time.Time `json:"createdAt"`
-	UpdatedAt      time.Time `json:"updatedAt"`
+	ID               string   `json:"id"`
+	ProjectID        string   `json:"projectId"`
+	Name             string   `json:"name"`
+	Type             string   `json:"type"`
+	AllowedOrigins   []string `json:"allowedOrigins"`
+	SigningAlgorithm string   `json:"signingAlgorithm"` // "RS256" | "ES256" | "EdDSA"
+
+	// Token and session lifetimes in seconds; zero disables the idle timeout
+	// and the absolute session lifetime
+	AccessTokenTTL     int `json:"accessTokenTtl"`
+	RefreshTokenTTL    int `json:"refreshTokenTtl"`
+	SessionIdleTimeout int `json:"sessionIdleTimeout"`
+	SessionMaxLifetime int `json:"sessionMaxLifetime"`
+
+	// LoginURL is where OIDC authorization requests send users to sign in
+	LoginURL string `json:"loginUrl"`
+
+	// One-time code policy for email and SMS codes. OTPTTL is in seconds;
+	// OTPMaxResends is how many more codes a user can request while the
+	// first is still valid.
+	OTPLength     int    `json:"otpLength"`
+	OTPAlphabet   string `json:"otpAlphabet"`
+	OTPTTL        int    `json:"otpTtl"`
+	OTPMaxResends int    `json:"otpMaxResends"`
+
+	// MFARequired makes every user complete a second factor, enrolling one
+	// on their next sign-in if they have none
+	MFARequired bool `json:"mfaRequired"`
+
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
 }
@@ -2,6 +2,8 @@ package models
 
 import (
 	"encoding/json"
+	"errors"
+	"strings"
 	"time"
 )
 
@@ -9,7 +11,7 @@ import (
 type Identity struct {
 	ID             string          `json:"id"`
 	UserID         string          `json:"userId"`
-	Provider       string          `json:"provider"` // "email", "google", "github"
+	Provider       string          `json:"provider"` // "email", "phone", "google", "github"
 	ProviderUserID string          `json:"providerUserId,omitempty"`
 	Email          string          `json:"email,omitempty"`
 	Metadata       json.RawMessage `json:"metadata,omitempty"`
@@ -19,6 +21,7 @@ type Identity struct {
 // IdentityProvider constants
 const (
 	ProviderEmail  = "email"
+	ProviderPhone  = "phone"
 	ProviderGoogle = "google"
 	ProviderGitHub = "github"
 )
@@ -26,9 +29,40 @@ const (
 // IsValidProvider checks if a provider string is valid
 func IsValidProvider(provider string) bool {
 	switch provider {
-	case ProviderEmail, ProviderGoogle, ProviderGitHub:
+	case ProviderEmail, ProviderPhone, ProviderGoogle, ProviderGitHub:
 		return true
 	default:
 		return false
 	}
 }
+
+var ErrInvalidPhoneNumber = errors.New("invalid_phone_number")
+
+// NormalizePhoneNumber returns a phone number in E.164 form, e.g.
+// "+5511987654321". Spaces, dashes, dots and parentheses are dropped and a
+// leading "00" is read as "+"; numbers without a country code are rejected.
+func NormalizePhoneNumber(phone string) (string, error) {
+	phone = strings.TrimSpace(phone)
+	if strings.HasPrefix(phone, "00") {
+		phone = "+" + phone[2:]
+	}
+	if !strings.HasPrefix(phone, "+") {
+		return "", ErrInvalidPhoneNumber
+	}
+
+	digits := make([]byte, 0, len(phone))
+	for _, r := range phone[1:] {
+		switch {
+		case r >= '0' && r <= '9':
+			digits = append(digits, byte(r))
+		case r == ' ' || r == '-' || r == '.' || r == '(' || r == ')':
+		default:
+			return "", ErrInvalidPhoneNumber
+		}
+	}
+	// E.164 allows at most 15 digits, and country codes don't start with 0
+	if len(digits) < 8 || len(digits) > 15 || digits[0] == '0' {
+		return "", ErrInvalidPhoneNumber
+	}
+	return "+" + string(digits), nil
+}
@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// LoginAttempt counts failed verifications for one subject of a project, an
+// email address or an IP, and how often it has been locked out for them.
+type LoginAttempt struct {
+	ProjectID   string     `json:"projectId"`
+	Subject     string     `json:"subject"`
+	Failures    int        `json:"failures"`
+	Lockouts    int        `json:"lockouts"`
+	LockedUntil *time.Time `json:"lockedUntil,omitempty"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+}
@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+const MFAFactorTOTP = "totp"
+
+// MFAFactor is a second factor a user enrolled in a project
+type MFAFactor struct {
+	ID              string     `json:"id"`
+	UserID          string     `json:"userId"`
+	ProjectID       string     `json:"projectId"`
+	Type            string     `json:"type"` // MFAFactorTOTP
+	SecretEncrypted []byte     `json:"-"`
+	LastUsedStep    int64      `json:"-"`           // TOTP time step of the last accepted code
+	ConfirmedAt     *time.Time `json:"confirmedAt"` // nil until a first code is verified
+	CreatedAt       time.Time  `json:"createdAt"`
+}
+
+// MFAChallenge is a sign-in that passed its first factor and waits for the
+// second before tokens are issued
+type MFAChallenge struct {
+	ID            string     `json:"id"`
+	UserID        string     `json:"userId"`
+	ProjectID     string     `json:"projectId"`
+	EnvironmentID string     `json:"environmentId"`
+	Provider      string     `json:"provider"` // provider of the first factor
+	TokenHash     string     `json:"-"`        // keyed hash of the challenge token, bound to ID
+	Attempts      int        `json:"attempts"`
+	ExpiresAt     time.Time  `json:"expiresAt"`
+	UsedAt        *time.Time `json:"usedAt"`
+	CreatedAt     time.Time  `json:"createdAt"`
+}
@@ -37,6 +37,19 @@ type OAuthAuthorizationCode struct {
 	ExpiresAt     time.Time  `json:"expiresAt"`
 	UsedAt        *time.Time `json:"usedAt,omitempty"`
 	CreatedAt     time.Time  `json:"createdAt"`
+
+	// Set for codes issued to OIDC relying parties; empty for social logins
+	ClientID            string `json:"clientId,omitempty"`
+	RedirectURI         string `json:"redirectUri,omitempty"`
+	Scope               string `json:"scope,omitempty"`
+	Nonce               string `json:"-"`
+	CodeChallenge       string `json:"-"`
+	CodeChallengeMethod string `json:"-"`
+
+	// How the user authenticated on the login page, carried over to the
+	// relying party's session
+	AuthTime *time.Time `json:"-"`
+	AMR      []string   `json:"-"`
 }
 
 // OAuthUserProfile represents user info fetched from a provider.
@@ -0,0 +1,36 @@
+package models
+
+import "time"
+
+// OIDCClient is a relying party, such as Grafana, that signs users in with an
+// environment acting as an OpenID Connect provider.
+type OIDCClient struct {
+	ID               string    `json:"id"`
+	EnvironmentID    string    `json:"environmentId"`
+	Name             string    `json:"name"`
+	ClientID         string    `json:"clientId"`
+	ClientSecretHash *string   `json:"-"` // nil for public clients
+	RedirectURIs     []string  `json:"redirectUris"`
+	CreatedAt        time.Time `json:"createdAt"`
+}
+
+// IsPublic reports whether the client has no secret and must use PKCE
+func (c *OIDCClient) IsPublic() bool {
+	return c.ClientSecretHash == nil
+}
+
+// OIDCAuthorizationRequest is an authorization request waiting for the user
+// to sign in on the environment's login page. Its ID is the login challenge.
+type OIDCAuthorizationRequest struct {
+	ID                  string    `json:"id"`
+	EnvironmentID       string    `json:"environmentId"`
+	ClientID            string    `json:"clientId"`
+	RedirectURI         string    `json:"redirectUri"`
+	Scope               string    `json:"scope"`
+	State               string    `json:"state"`
+	Nonce               string    `json:"nonce"`
+	CodeChallenge       string    `json:"-"`
+	CodeChallengeMethod string    `json:"-"`
+	ExpiresAt           time.Time `json:"expiresAt"`
+	CreatedAt           time.Time `json:"createdAt"`
+}
@@ -4,12 +4,21 @@ import (
 	"time"
 )
 
+const (
+	OTPKindCode      = "code"
+	OTPKindMagicLink = "magic_link"
+	OTPKindSMS       = "sms"
+)
+
 type OTPCode struct {
 	ID            string     `json:"id"`
 	UserID        string     `json:"userId"`
 	ProjectID     string     `json:"projectId"`
 	EnvironmentID string     `json:"environmentId"`
-	Code          string     `json:"code"`
+	Kind          string     `json:"kind"`                  // OTPKindCode, OTPKindMagicLink or OTPKindSMS
+	CodeHash      string     `json:"-"`                     // keyed hash of the code, bound to ID
+	Attempts      int        `json:"attempts"`              // wrong guesses made while it was pending
+	RedirectURL   string     `json:"redirectUrl,omitempty"` // where a magic link sends the user
 	ExpiresAt     time.Time  `json:"expiresAt"`
 	UsedAt        *time.Time `json:"usedAt"`
 	CreatedAt     time.Time  `json:"created_at"`
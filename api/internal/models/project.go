@@ -13,6 +13,7 @@ type Project struct {
 	AllowedOrigins   []string        `json:"allowedOrigins"`
 	AllowedProviders []string        `json:"allowedProviders"`
 	ThemeConfig      json.RawMessage `json:"themeConfig"`
+	ClaimsTemplate   json.RawMessage `json:"claimsTemplate"` // custom access token claims, see service.RenderClaimsTemplate
 	CreatedAt        time.Time       `json:"createdAt"`
 	UpdatedAt        time.Time       `json:"updatedAt"`
 }
@@ -24,7 +25,9 @@ type APIKey struct {
 	Name             string     `json:"name"`
 	ClientID         string     `json:"clientId"`
 	ClientSecretHash string     `json:"-"`
+	Scopes           []string   `json:"scopes"` // grantable through the client credentials grant
 	LastUsedAt       *time.Time `json:"lastUsedAt,omitempty"`
+	RevokedAt        *time.Time `json:"revokedAt,omitempty"`
 	CreatedAt        time.Time  `json:"createdAt"`
 }
 
@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// RefreshToken is the persisted state of an issued refresh token. Only the
+// hash of the token is stored; every token rotated from the same login shares
+// a FamilyID so the whole chain can be revoked at once.
+type RefreshToken struct {
+	ID            string     `json:"id"`
+	UserID        string     `json:"userId"`
+	ProjectID     string     `json:"projectId"`
+	EnvironmentID string     `json:"environmentId"`
+	FamilyID      string     `json:"familyId"`
+	TokenHash     string     `json:"-"`
+	ReplacedBy    *string    `json:"replacedBy,omitempty"`
+	ExpiresAt     time.Time  `json:"expiresAt"`
+	RevokedAt     *time.Time `json:"revokedAt,omitempty"`
+	CreatedAt     time.Time  `json:"createdAt"`
+}
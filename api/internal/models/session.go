@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// Session is a signed-in device: one refresh token family plus the metadata
+// captured when it was created and last refreshed.
+type Session struct {
+	ID            string     `json:"id"`
+	UserID        string     `json:"userId"`
+	ProjectID     string     `json:"projectId"`
+	EnvironmentID string     `json:"environmentId"`
+	Provider      string     `json:"provider"`
+	IPAddress     string     `json:"ipAddress"`
+	UserAgent     string     `json:"userAgent"`
+	AuthTime      time.Time  `json:"authTime"`           // last time the user actively authenticated
+	AMR           []string   `json:"amr"`                // methods used then, e.g. "otp" or "oauth"
+	ClientID      string     `json:"clientId,omitempty"` // OIDC relying party the session was issued to
+	Scope         string     `json:"scope,omitempty"`    // OIDC scopes granted to that relying party
+	ExpiresAt     time.Time  `json:"expiresAt"`
+	RevokedAt     *time.Time `json:"revokedAt,omitempty"`
+	LastUsedAt    time.Time  `json:"lastUsedAt"`
+	CreatedAt     time.Time  `json:"createdAt"`
+}
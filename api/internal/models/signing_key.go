@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// SigningKey is a JWT signing key as persisted in the shared key store. The
+// private key is PKCS#8 DER encrypted under the configured master key.
+// Platform keys have an empty EnvironmentID.
+type SigningKey struct {
+	ID            string     `json:"id"`
+	EnvironmentID string     `json:"environmentId,omitempty"`
+	Algorithm     string     `json:"algorithm"`
+	Status        string     `json:"status"`
+	PrivateKey    []byte     `json:"-"`
+	ActivatedAt   *time.Time `json:"activatedAt,omitempty"`
+	ExpiresAt     *time.Time `json:"expiresAt,omitempty"`
+	CreatedAt     time.Time  `json:"createdAt"`
+}
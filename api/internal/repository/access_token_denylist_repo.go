@@ -0,0 +1,44 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type AccessTokenDenylistRepository interface {
+	Add(ctx context.Context, jti, userID string, expiresAt time.Time) error
+	Contains(ctx context.Context, jti string) (bool, error)
+	DeleteExpired(ctx context.Context) error
+}
+
+type postgresAccessTokenDenylistRepo struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresAccessTokenDenylistRepo(db *pgxpool.Pool) AccessTokenDenylistRepository {
+	return &postgresAccessTokenDenylistRepo{db: db}
+}
+
+func (r *postgresAccessTokenDenylistRepo) Add(ctx context.Context, jti, userID string, expiresAt time.Time) error {
+	_, err := r.db.Exec(ctx, `
+		INSERT INTO revoked_access_tokens (jti, user_id, expires_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (jti) DO NOTHING
+	`, jti, userID, expiresAt)
+	return err
+}
+
+func (r *postgresAccessTokenDenylistRepo) Contains(ctx context.Context, jti string) (bool, error) {
+	var exists bool
+	err := r.db.QueryRow(ctx, `
+		SELECT EXISTS(SELECT 1 FROM revoked_access_tokens WHERE jti = $1)
+	`, jti).Scan(&exists)
+	return exists, err
+}
+
+func (r *postgresAccessTokenDenylistRepo) DeleteExpired(ctx context.Context) error {
+	_, err := r.db.Exec(ctx, `DELETE FROM revoked_access_tokens WHERE expires_at < NOW()`)
+	return err
+}
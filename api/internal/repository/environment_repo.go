@@ -3,6 +3,7 @@ package repository
 import (
 	"context"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/marcioecom/permit/internal/models"
 )
@@ -10,6 +11,7 @@ import (
 type EnvironmentRepository interface {
 	Create(ctx context.Context, env *models.Environment) error
 	GetByID(ctx context.Context, id string) (*models.Environment, error)
+	List(ctx context.Context) ([]*models.Environment, error)
 	GetByProjectID(ctx context.Context, projectID string) ([]*models.Environment, error)
 	GetByProjectAndType(ctx context.Context, projectID, envType string) (*models.Environment, error)
 	GetDefaultForProject(ctx context.Context, projectID string) (*models.Environment, error)
@@ -24,6 +26,24 @@ func NewPostgresEnvironmentRepo(db *pgxpool.Pool) EnvironmentRepository {
 	return &postgresEnvironmentRepo{db: db}
 }
 
+const environmentColumns = `id, project_id, name, type, allowed_origins, signing_algorithm,
+	access_token_ttl, refresh_token_ttl, session_idle_timeout, session_max_lifetime, login_url,
+	otp_length, otp_alphabet, otp_ttl, otp_max_resends, mfa_required, created_at, updated_at`
+
+func scanEnvironment(row pgx.Row) (*models.Environment, error) {
+	var env models.Environment
+	err := row.Scan(
+		&env.ID, &env.ProjectID, &env.Name, &env.Type, &env.AllowedOrigins, &env.SigningAlgorithm,
+		&env.AccessTokenTTL, &env.RefreshTokenTTL, &env.SessionIdleTimeout, &env.SessionMaxLifetime, &env.LoginURL,
+		&env.OTPLength, &env.OTPAlphabet, &env.OTPTTL, &env.OTPMaxResends, &env.MFARequired,
+		&env.CreatedAt, &env.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &env, nil
+}
+
 func (r *postgresEnvironmentRepo) Create(ctx context.Context, env *models.Environment) error {
 	_, err := r.db.Exec(ctx, `
 		INSERT INTO environments (id, project_id, name, type, allowed_origins)
@@ -33,22 +53,28 @@ func (r *postgresEnvironmentRepo) Create(ctx context.Context, env *models.Enviro
 }
 
 func (r *postgresEnvironmentRepo) GetByID(ctx context.Context, id string) (*models.Environment, error) {
-	var env models.Environment
-	err := r.db.QueryRow(ctx, `
-		SELECT id, project_id, name, type, allowed_origins, created_at, updated_at
+	return scanEnvironment(r.db.QueryRow(ctx, `
+		SELECT `+environmentColumns+`
 		FROM environments WHERE id = $1
-	`, id).Scan(&env.ID, &env.ProjectID, &env.Name, &env.Type, &env.AllowedOrigins, &env.CreatedAt, &env.UpdatedAt)
-	if err != nil {
-		return nil, err
-	}
-	return &env, nil
+	`, id))
+}
+
+func (r *postgresEnvironmentRepo) List(ctx context.Context) ([]*models.Environment, error) {
+	return r.list(ctx, `
+		SELECT `+environmentColumns+`
+		FROM environments ORDER BY created_at ASC
+	`)
 }
 
 func (r *postgresEnvironmentRepo) GetByProjectID(ctx context.Context, projectID string) ([]*models.Environment, error) {
-	rows, err := r.db.Query(ctx, `
-		SELECT id, project_id, name, type, allowed_origins, created_at, updated_at
+	return r.list(ctx, `
+		SELECT `+environmentColumns+`
 		FROM environments WHERE project_id = $1 ORDER BY created_at ASC
 	`, projectID)
+}
+
+func (r *postgresEnvironmentRepo) list(ctx context.Context, query string, args ...any) ([]*models.Environment, error) {
+	rows, err := r.db.Query(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -56,25 +82,20 @@ func (r *postgresEnvironmentRepo) GetByProjectID(ctx context.Context, projectID
 
 	var envs []*models.Environment
 	for rows.Next() {
-		var env models.Environment
-		if err := rows.Scan(&env.ID, &env.ProjectID, &env.Name, &env.Type, &env.AllowedOrigins, &env.CreatedAt, &env.UpdatedAt); err != nil {
+		env, err := scanEnvironment(rows)
+		if err != nil {
 			return nil, err
 		}
-		envs = append(envs, &env)
+		envs = append(envs, env)
 	}
 	return envs, rows.Err()
 }
 
 func (r *postgresEnvironmentRepo) GetByProjectAndType(ctx context.Context, projectID, envType string) (*models.Environment, error) {
-	var env models.Environment
-	err := r.db.QueryRow(ctx, `
-		SELECT id, project_id, name, type, allowed_origins, created_at, updated_at
+	return scanEnvironment(r.db.QueryRow(ctx, `
+		SELECT `+environmentColumns+`
 		FROM environments WHERE project_id = $1 AND type = $2
-	`, projectID, envType).Scan(&env.ID, &env.ProjectID, &env.Name, &env.Type, &env.AllowedOrigins, &env.CreatedAt, &env.UpdatedAt)
-	if err != nil {
-		return nil, err
-	}
-	return &env, nil
+	`, projectID, envType))
 }
 
 func (r *postgresEnvironmentRepo) GetDefaultForProject(ctx context.Context, projectID string) (*models.Environment, error) {
@@ -83,7 +104,17 @@ func (r *postgresEnvironmentRepo) GetDefaultForProject(ctx context.Context, proj
 
 func (r *postgresEnvironmentRepo) Update(ctx context.Context, env *models.Environment) error {
 	_, err := r.db.Exec(ctx, `
-		UPDATE environments SET name = $1, allowed_origins = $2 WHERE id = $3
-	`, env.Name, env.AllowedOrigins, env.ID)
+		UPDATE environments
+		SET name = $1, allowed_origins = $2, signing_algorithm = $3,
+			access_token_ttl = $4, refresh_token_ttl = $5, session_idle_timeout = $6, session_max_lifetime = $7,
+			login_url = $8,
+			otp_length = $9, otp_alphabet = $10, otp_ttl = $11, otp_max_resends = $12,
+			mfa_required = $13
+		WHERE id = $14
+	`, env.Name, env.AllowedOrigins, env.SigningAlgorithm,
+		env.AccessTokenTTL, env.RefreshTokenTTL, env.SessionIdleTimeout, env.SessionMaxLifetime,
+		env.LoginURL,
+		env.OTPLength, env.OTPAlphabet, env.OTPTTL, env.OTPMaxResends,
+		env.MFARequired, env.ID)
 	return err
 }
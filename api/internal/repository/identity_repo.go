@@ -13,6 +13,9 @@ type IdentityRepository interface {
 	GetByUserID(ctx context.Context, userID string) ([]*models.Identity, error)
 	GetByProviderAndEmail(ctx context.Context, provider, email string) (*models.Identity, error)
 	GetByUserAndProvider(ctx context.Context, userID, provider string) (*models.Identity, error)
+	// GetByProviderUserID finds an identity by the provider's own ID for the
+	// user, such as a phone identity's E.164 number
+	GetByProviderUserID(ctx context.Context, provider, providerUserID string) (*models.Identity, error)
 	Delete(ctx context.Context, id string) error
 }
 
@@ -103,6 +106,25 @@ func (r *identityRepository) GetByUserAndProvider(ctx context.Context, userID, p
 	return i, nil
 }
 
+func (r *identityRepository) GetByProviderUserID(ctx context.Context, provider, providerUserID string) (*models.Identity, error) {
+	query := `
+		SELECT id, user_id, provider, provider_user_id, email, metadata, created_at
+		FROM identities
+		WHERE provider = $1 AND provider_user_id = $2
+	`
+	row := r.db.QueryRow(ctx, query, provider, providerUserID)
+
+	i := &models.Identity{}
+	err := row.Scan(&i.ID, &i.UserID, &i.Provider, &i.ProviderUserID, &i.Email, &i.Metadata, &i.CreatedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return i, nil
+}
+
 func (r *identityRepository) Delete(ctx context.Context, id string) error {
 	_, err := r.db.Exec(ctx, "DELETE FROM identities WHERE id = $1", id)
 	return err
@@ -0,0 +1,75 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/marcioecom/permit/internal/models"
+)
+
+type LoginAttemptRepository interface {
+	Get(ctx context.Context, projectID, subject string) (*models.LoginAttempt, error)
+	// RecordFailure counts a failed verification and returns the updated
+	// state. Counters left untouched for longer than resetAfter start over.
+	RecordFailure(ctx context.Context, projectID, subject string, resetAfter time.Duration) (*models.LoginAttempt, error)
+	Lock(ctx context.Context, projectID, subject string, until time.Time) error
+	Reset(ctx context.Context, projectID, subject string) error
+}
+
+type postgresLoginAttemptRepo struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresLoginAttemptRepo(db *pgxpool.Pool) LoginAttemptRepository {
+	return &postgresLoginAttemptRepo{db: db}
+}
+
+const loginAttemptColumns = `project_id, subject, failures, lockouts, locked_until, updated_at`
+
+func scanLoginAttempt(row pgx.Row) (*models.LoginAttempt, error) {
+	var a models.LoginAttempt
+	if err := row.Scan(&a.ProjectID, &a.Subject, &a.Failures, &a.Lockouts, &a.LockedUntil, &a.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (r *postgresLoginAttemptRepo) Get(ctx context.Context, projectID, subject string) (*models.LoginAttempt, error) {
+	a, err := scanLoginAttempt(r.db.QueryRow(ctx, `
+		SELECT `+loginAttemptColumns+` FROM login_attempts WHERE project_id = $1 AND subject = $2
+	`, projectID, subject))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return a, nil
+}
+
+func (r *postgresLoginAttemptRepo) RecordFailure(ctx context.Context, projectID, subject string, resetAfter time.Duration) (*models.LoginAttempt, error) {
+	return scanLoginAttempt(r.db.QueryRow(ctx, `
+		INSERT INTO login_attempts (project_id, subject, failures)
+		VALUES ($1, $2, 1)
+		ON CONFLICT (project_id, subject) DO UPDATE SET
+			failures = CASE WHEN login_attempts.updated_at < $3 THEN 1 ELSE login_attempts.failures + 1 END,
+			lockouts = CASE WHEN login_attempts.updated_at < $3 THEN 0 ELSE login_attempts.lockouts END,
+			updated_at = NOW()
+		RETURNING `+loginAttemptColumns+`
+	`, projectID, subject, time.Now().Add(-resetAfter)))
+}
+
+func (r *postgresLoginAttemptRepo) Lock(ctx context.Context, projectID, subject string, until time.Time) error {
+	_, err := r.db.Exec(ctx, `
+		UPDATE login_attempts SET locked_until = $3, lockouts = lockouts + 1, updated_at = NOW()
+		WHERE project_id = $1 AND subject = $2
+	`, projectID, subject, until)
+	return err
+}
+
+func (r *postgresLoginAttemptRepo) Reset(ctx context.Context, projectID, subject string) error {
+	_, err := r.db.Exec(ctx, `DELETE FROM login_attempts WHERE project_id = $1 AND subject = $2`, projectID, subject)
+	return err
+}
@@ -0,0 +1,151 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/marcioecom/permit/internal/models"
+)
+
+type MFARepository interface {
+	// CreateFactor replaces a user's unconfirmed factor of the same type, if
+	// any, and fails if a confirmed one exists
+	CreateFactor(ctx context.Context, f *models.MFAFactor) error
+	// GetFactor returns nil when the user has no factor of the type
+	GetFactor(ctx context.Context, userID, projectID, factorType string) (*models.MFAFactor, error)
+	ConfirmFactor(ctx context.Context, id string) error
+	// UseFactorStep records the time step of an accepted code, returning
+	// pgx.ErrNoRows if that step or a later one was already used
+	UseFactorStep(ctx context.Context, id string, step int64) error
+	DeleteFactor(ctx context.Context, id string) error
+
+	CreateChallenge(ctx context.Context, c *models.MFAChallenge) error
+	GetChallenge(ctx context.Context, id string) (*models.MFAChallenge, error)
+	IncrementChallengeAttempts(ctx context.Context, id string) error
+	// MarkChallengeUsed returns pgx.ErrNoRows if the challenge was already used
+	MarkChallengeUsed(ctx context.Context, id string) error
+}
+
+type postgresMFARepo struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresMFARepo(db *pgxpool.Pool) MFARepository {
+	return &postgresMFARepo{db: db}
+}
+
+func (r *postgresMFARepo) CreateFactor(ctx context.Context, f *models.MFAFactor) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
+		DELETE FROM mfa_factors
+		WHERE user_id = $1 AND project_id = $2 AND type = $3 AND confirmed_at IS NULL
+		`, f.UserID, f.ProjectID, f.Type)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO mfa_factors (id, user_id, project_id, type, secret_encrypted)
+		VALUES ($1, $2, $3, $4, $5)
+		`, f.ID, f.UserID, f.ProjectID, f.Type, f.SecretEncrypted)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (r *postgresMFARepo) GetFactor(ctx context.Context, userID, projectID, factorType string) (*models.MFAFactor, error) {
+	var f models.MFAFactor
+	err := r.db.QueryRow(ctx, `
+		SELECT id, user_id, project_id, type, secret_encrypted, last_used_step, confirmed_at, created_at
+		FROM mfa_factors
+		WHERE user_id = $1 AND project_id = $2 AND type = $3
+		`, userID, projectID, factorType).Scan(
+		&f.ID, &f.UserID, &f.ProjectID, &f.Type, &f.SecretEncrypted, &f.LastUsedStep, &f.ConfirmedAt, &f.CreatedAt,
+	)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &f, nil
+}
+
+func (r *postgresMFARepo) ConfirmFactor(ctx context.Context, id string) error {
+	_, err := r.db.Exec(ctx, `
+		UPDATE mfa_factors SET confirmed_at = $1 WHERE id = $2 AND confirmed_at IS NULL
+		`, time.Now(), id)
+	return err
+}
+
+func (r *postgresMFARepo) UseFactorStep(ctx context.Context, id string, step int64) error {
+	tag, err := r.db.Exec(ctx, `
+		UPDATE mfa_factors SET last_used_step = $1 WHERE id = $2 AND last_used_step < $1
+		`, step, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+func (r *postgresMFARepo) DeleteFactor(ctx context.Context, id string) error {
+	_, err := r.db.Exec(ctx, `DELETE FROM mfa_factors WHERE id = $1`, id)
+	return err
+}
+
+func (r *postgresMFARepo) CreateChallenge(ctx context.Context, c *models.MFAChallenge) error {
+	_, err := r.db.Exec(ctx, `
+		INSERT INTO mfa_challenges (id, user_id, project_id, environment_id, provider, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		`, c.ID, c.UserID, c.ProjectID, c.EnvironmentID, c.Provider, c.TokenHash, c.ExpiresAt)
+	return err
+}
+
+func (r *postgresMFARepo) GetChallenge(ctx context.Context, id string) (*models.MFAChallenge, error) {
+	var c models.MFAChallenge
+	err := r.db.QueryRow(ctx, `
+		SELECT id, user_id, project_id, environment_id, provider, token_hash, attempts, expires_at, used_at, created_at
+		FROM mfa_challenges WHERE id = $1
+		`, id).Scan(
+		&c.ID, &c.UserID, &c.ProjectID, &c.EnvironmentID, &c.Provider, &c.TokenHash, &c.Attempts, &c.ExpiresAt, &c.UsedAt, &c.CreatedAt,
+	)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (r *postgresMFARepo) IncrementChallengeAttempts(ctx context.Context, id string) error {
+	_, err := r.db.Exec(ctx, `
+		UPDATE mfa_challenges SET attempts = attempts + 1 WHERE id = $1 AND used_at IS NULL
+		`, id)
+	return err
+}
+
+func (r *postgresMFARepo) MarkChallengeUsed(ctx context.Context, id string) error {
+	tag, err := r.db.Exec(ctx, `
+		UPDATE mfa_challenges SET used_at = $1 WHERE id = $2 AND used_at IS NULL
+		`, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
@@ -117,9 +117,13 @@ func (r *postgresOAuthRepo) CleanupExpiredStates(ctx context.Context) error {
 
 func (r *postgresOAuthRepo) CreateAuthorizationCode(ctx context.Context, code *models.OAuthAuthorizationCode) error {
 	_, err := r.db.Exec(ctx, `
-		INSERT INTO oauth_authorization_codes (id, environment_id, user_id, code, provider, expires_at)
-		VALUES ($1, $2, $3, $4, $5, $6)
-	`, code.ID, code.EnvironmentID, code.UserID, code.Code, code.Provider, code.ExpiresAt)
+		INSERT INTO oauth_authorization_codes (
+			id, environment_id, user_id, code, provider, expires_at,
+			client_id, redirect_uri, scope, nonce, code_challenge, code_challenge_method, auth_time, amr
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), NULLIF($8, ''), NULLIF($9, ''), NULLIF($10, ''), NULLIF($11, ''), NULLIF($12, ''), $13, $14)
+	`, code.ID, code.EnvironmentID, code.UserID, code.Code, code.Provider, code.ExpiresAt,
+		code.ClientID, code.RedirectURI, code.Scope, code.Nonce, code.CodeChallenge, code.CodeChallengeMethod, code.AuthTime, code.AMR)
 	return err
 }
 
@@ -129,8 +133,13 @@ func (r *postgresOAuthRepo) GetAndUseAuthorizationCode(ctx context.Context, code
 		UPDATE oauth_authorization_codes
 		SET used_at = NOW()
 		WHERE code = $1 AND used_at IS NULL AND expires_at > NOW()
-		RETURNING id, environment_id, user_id, code, provider, expires_at, used_at, created_at
-	`, codeValue).Scan(&c.ID, &c.EnvironmentID, &c.UserID, &c.Code, &c.Provider, &c.ExpiresAt, &c.UsedAt, &c.CreatedAt)
+		RETURNING id, environment_id, user_id, code, provider, expires_at, used_at, created_at,
+			COALESCE(client_id, ''), COALESCE(redirect_uri, ''), COALESCE(scope, ''), COALESCE(nonce, ''),
+			COALESCE(code_challenge, ''), COALESCE(code_challenge_method, ''), auth_time, amr
+	`, codeValue).Scan(
+		&c.ID, &c.EnvironmentID, &c.UserID, &c.Code, &c.Provider, &c.ExpiresAt, &c.UsedAt, &c.CreatedAt,
+		&c.ClientID, &c.RedirectURI, &c.Scope, &c.Nonce, &c.CodeChallenge, &c.CodeChallengeMethod, &c.AuthTime, &c.AMR,
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,133 @@
+package repository
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/marcioecom/permit/internal/models"
+)
+
+type OIDCRepository interface {
+	// Relying-party clients
+	CreateClient(ctx context.Context, client *models.OIDCClient) error
+	ListClients(ctx context.Context, environmentID string) ([]*models.OIDCClient, error)
+	GetClientByClientID(ctx context.Context, clientID string) (*models.OIDCClient, error)
+	DeleteClient(ctx context.Context, environmentID, id string) (bool, error)
+
+	// Authorization requests waiting for the user to sign in
+	CreateAuthorizationRequest(ctx context.Context, req *models.OIDCAuthorizationRequest) error
+	GetAndDeleteAuthorizationRequest(ctx context.Context, id string) (*models.OIDCAuthorizationRequest, error)
+}
+
+type postgresOIDCRepo struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresOIDCRepo(db *pgxpool.Pool) OIDCRepository {
+	return &postgresOIDCRepo{db: db}
+}
+
+const oidcClientColumns = `id, environment_id, name, client_id, client_secret_hash, redirect_uris, created_at`
+
+func scanOIDCClient(row pgx.Row) (*models.OIDCClient, error) {
+	var c models.OIDCClient
+	err := row.Scan(&c.ID, &c.EnvironmentID, &c.Name, &c.ClientID, &c.ClientSecretHash, &c.RedirectURIs, &c.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (r *postgresOIDCRepo) CreateClient(ctx context.Context, client *models.OIDCClient) error {
+	_, err := r.db.Exec(ctx, `
+		INSERT INTO oidc_clients (id, environment_id, name, client_id, client_secret_hash, redirect_uris)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, client.ID, client.EnvironmentID, client.Name, client.ClientID, client.ClientSecretHash, client.RedirectURIs)
+	return err
+}
+
+func (r *postgresOIDCRepo) ListClients(ctx context.Context, environmentID string) ([]*models.OIDCClient, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT `+oidcClientColumns+`
+		FROM oidc_clients WHERE environment_id = $1 ORDER BY created_at ASC
+	`, environmentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []*models.OIDCClient{}
+	for rows.Next() {
+		c, err := scanOIDCClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+	return clients, rows.Err()
+}
+
+func (r *postgresOIDCRepo) GetClientByClientID(ctx context.Context, clientID string) (*models.OIDCClient, error) {
+	c, err := scanOIDCClient(r.db.QueryRow(ctx, `
+		SELECT `+oidcClientColumns+` FROM oidc_clients WHERE client_id = $1
+	`, clientID))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+func (r *postgresOIDCRepo) DeleteClient(ctx context.Context, environmentID, id string) (bool, error) {
+	tag, err := r.db.Exec(ctx, `
+		DELETE FROM oidc_clients WHERE environment_id = $1 AND id = $2
+	`, environmentID, id)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (r *postgresOIDCRepo) CreateAuthorizationRequest(ctx context.Context, req *models.OIDCAuthorizationRequest) error {
+	_, err := r.db.Exec(ctx, `
+		INSERT INTO oidc_authorization_requests (
+			id, environment_id, client_id, redirect_uri, scope, state, nonce,
+			code_challenge, code_challenge_method, expires_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`, req.ID, req.EnvironmentID, req.ClientID, req.RedirectURI, req.Scope, req.State, req.Nonce,
+		req.CodeChallenge, req.CodeChallengeMethod, req.ExpiresAt)
+	return err
+}
+
+// GetAndDeleteAuthorizationRequest consumes an unexpired authorization
+// request, returning nil if there is none
+func (r *postgresOIDCRepo) GetAndDeleteAuthorizationRequest(ctx context.Context, id string) (*models.OIDCAuthorizationRequest, error) {
+	var req models.OIDCAuthorizationRequest
+	err := r.db.QueryRow(ctx, `
+		DELETE FROM oidc_authorization_requests WHERE id = $1 AND expires_at > NOW()
+		RETURNING id, environment_id, client_id, redirect_uri, scope, state, nonce,
+			code_challenge, code_challenge_method, expires_at, created_at
+	`, id).Scan(
+		&req.ID, &req.EnvironmentID, &req.ClientID, &req.RedirectURI, &req.Scope, &req.State, &req.Nonce,
+		&req.CodeChallenge, &req.CodeChallengeMethod, &req.ExpiresAt, &req.CreatedAt,
+	)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &req, nil
+}
+
+func GenerateOIDCClientID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return "oidc_" + hex.EncodeToString(b)
+}
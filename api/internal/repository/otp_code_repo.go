@@ -4,14 +4,31 @@ import (
 	"context"
 	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/marcioecom/permit/internal/models"
 )
 
 type OTPCodeRepository interface {
 	Create(ctx context.Context, p *models.OTPCode) error
-	GetByProjectAndCode(ctx context.Context, projectID string, code string) (*models.OTPCode, error)
+	GetByID(ctx context.Context, id string) (*models.OTPCode, error)
+	// ListPendingByUser returns a user's unused codes of a kind in a project,
+	// newest first, including expired ones
+	ListPendingByUser(ctx context.Context, projectID, userID, kind string) ([]*models.OTPCode, error)
+	// MarkCodeAsUsed returns pgx.ErrNoRows if the code was already used
 	MarkCodeAsUsed(ctx context.Context, codeID string) error
+	// IncrementAttempts counts a wrong guess against every pending code of a
+	// kind of a user in a project
+	IncrementAttempts(ctx context.Context, projectID, userID, kind string) error
+	// CountCreatedSince counts the codes of a kind created for a user in an
+	// environment since a time, used or not
+	CountCreatedSince(ctx context.Context, environmentID, userID, kind string, since time.Time) (int, error)
+	// LastCreatedAt returns when the newest code of a kind was created for a
+	// user in an environment, or nil if there is none
+	LastCreatedAt(ctx context.Context, environmentID, userID, kind string) (*time.Time, error)
+	// ExpirePending expires a user's pending codes of the given kinds in an
+	// environment, except the one with exceptID
+	ExpirePending(ctx context.Context, environmentID, userID string, kinds []string, exceptID string) error
 }
 
 type postgresOTPCodeRepo struct {
@@ -22,12 +39,34 @@ func NewPostgresOTPCodeRepo(db *pgxpool.Pool) OTPCodeRepository {
 	return &postgresOTPCodeRepo{db: db}
 }
 
+// pendingOTPLimit bounds how many codes a guess is checked against
+const pendingOTPLimit = 10
+
+const otpCodeColumns = `id, user_id, project_id, environment_id, kind, code_hash, attempts, COALESCE(redirect_url, ''), used_at, expires_at, created_at`
+
+func scanOTPCode(row pgx.Row) (*models.OTPCode, error) {
+	var c models.OTPCode
+	err := row.Scan(&c.ID, &c.UserID, &c.ProjectID, &c.EnvironmentID, &c.Kind, &c.CodeHash, &c.Attempts, &c.RedirectURL, &c.UsedAt, &c.ExpiresAt, &c.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
 func (r *postgresOTPCodeRepo) Create(ctx context.Context, p *models.OTPCode) error {
+	kind := p.Kind
+	if kind == "" {
+		kind = models.OTPKindCode
+	}
+	var redirectURL *string
+	if p.RedirectURL != "" {
+		redirectURL = &p.RedirectURL
+	}
 	_, err := r.db.Exec(ctx, `
-		INSERT INTO otp_codes (id, user_id, project_id, environment_id, code, expires_at)
-		VALUES ($1, $2, $3, $4, $5, $6);
+		INSERT INTO otp_codes (id, user_id, project_id, environment_id, kind, code_hash, redirect_url, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8);
 		`,
-		p.ID, p.UserID, p.ProjectID, p.EnvironmentID, p.Code, p.ExpiresAt)
+		p.ID, p.UserID, p.ProjectID, p.EnvironmentID, kind, p.CodeHash, redirectURL, p.ExpiresAt)
 	if err != nil {
 		return err
 	}
@@ -35,27 +74,93 @@ func (r *postgresOTPCodeRepo) Create(ctx context.Context, p *models.OTPCode) err
 	return nil
 }
 
-func (r *postgresOTPCodeRepo) GetByProjectAndCode(ctx context.Context, projectID string, code string) (*models.OTPCode, error) {
-	var otpCode models.OTPCode
+func (r *postgresOTPCodeRepo) GetByID(ctx context.Context, id string) (*models.OTPCode, error) {
+	c, err := scanOTPCode(r.db.QueryRow(ctx, `
+		SELECT `+otpCodeColumns+` FROM otp_codes WHERE id = $1
+		`, id))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return c, nil
+}
 
-	err := r.db.QueryRow(ctx, `
-		SELECT id, user_id, environment_id, code, used_at, expires_at FROM otp_codes WHERE project_id = $1 AND code = $2;
-		`, projectID, code).
-		Scan(&otpCode.ID, &otpCode.UserID, &otpCode.EnvironmentID, &otpCode.Code, &otpCode.UsedAt, &otpCode.ExpiresAt)
+func (r *postgresOTPCodeRepo) ListPendingByUser(ctx context.Context, projectID, userID, kind string) ([]*models.OTPCode, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT `+otpCodeColumns+` FROM otp_codes
+		WHERE project_id = $1 AND user_id = $2 AND kind = $3 AND used_at IS NULL
+		ORDER BY created_at DESC
+		LIMIT $4
+		`, projectID, userID, kind, pendingOTPLimit)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	return &otpCode, nil
+	codes := []*models.OTPCode{}
+	for rows.Next() {
+		c, err := scanOTPCode(rows)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, c)
+	}
+	return codes, rows.Err()
 }
 
 func (r *postgresOTPCodeRepo) MarkCodeAsUsed(ctx context.Context, codeID string) error {
-	_, err := r.db.Exec(ctx, `
-		UPDATE otp_codes SET used_at = $1 WHERE id = $2
+	tag, err := r.db.Exec(ctx, `
+		UPDATE otp_codes SET used_at = $1 WHERE id = $2 AND used_at IS NULL
 		`, time.Now(), codeID)
 	if err != nil {
 		return err
 	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
 
 	return nil
 }
+
+func (r *postgresOTPCodeRepo) IncrementAttempts(ctx context.Context, projectID, userID, kind string) error {
+	_, err := r.db.Exec(ctx, `
+		UPDATE otp_codes SET attempts = attempts + 1
+		WHERE project_id = $1 AND user_id = $2 AND kind = $3 AND used_at IS NULL AND expires_at > NOW()
+		`, projectID, userID, kind)
+	return err
+}
+
+func (r *postgresOTPCodeRepo) CountCreatedSince(ctx context.Context, environmentID, userID, kind string, since time.Time) (int, error) {
+	var count int
+	err := r.db.QueryRow(ctx, `
+		SELECT COUNT(*) FROM otp_codes
+		WHERE environment_id = $1 AND user_id = $2 AND kind = $3 AND created_at > $4
+		`, environmentID, userID, kind, since).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (r *postgresOTPCodeRepo) LastCreatedAt(ctx context.Context, environmentID, userID, kind string) (*time.Time, error) {
+	var createdAt *time.Time
+	err := r.db.QueryRow(ctx, `
+		SELECT MAX(created_at) FROM otp_codes
+		WHERE environment_id = $1 AND user_id = $2 AND kind = $3
+		`, environmentID, userID, kind).Scan(&createdAt)
+	if err != nil {
+		return nil, err
+	}
+	return createdAt, nil
+}
+
+func (r *postgresOTPCodeRepo) ExpirePending(ctx context.Context, environmentID, userID string, kinds []string, exceptID string) error {
+	_, err := r.db.Exec(ctx, `
+		UPDATE otp_codes SET expires_at = NOW()
+		WHERE environment_id = $1 AND user_id = $2 AND kind = ANY($3) AND id <> $4
+		AND used_at IS NULL AND expires_at > NOW()
+		`, environmentID, userID, kinds, exceptID)
+	return err
+}
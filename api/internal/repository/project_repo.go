@@ -37,6 +37,8 @@ type ProjectRepository interface {
 	GetDashboardStats(ctx context.Context, ownerID string) (*models.DashboardStats, error)
 	GetUserStats(ctx context.Context, ownerID string) (*models.UserStats, error)
 	UpsertProjectUser(ctx context.Context, projectID, environmentID, userID, provider string) error
+	GetProjectUserMetadata(ctx context.Context, environmentID, userID string) (json.RawMessage, error)
+	UpdateProjectUserMetadata(ctx context.Context, projectID, environmentID, userID string, metadata json.RawMessage) (bool, error)
 	DeleteProject(ctx context.Context, projectID string) error
 }
 
@@ -59,12 +61,12 @@ func (r *postgresProjectRepo) Create(ctx context.Context, p *models.Project) err
 
 func (r *postgresProjectRepo) GetByID(ctx context.Context, id string) (*models.Project, error) {
 	query := `
-		SELECT id, owner_id, name, description, allowed_origins, allowed_providers, created_at, updated_at
+		SELECT id, owner_id, name, description, allowed_origins, allowed_providers, claims_template, created_at, updated_at
 		FROM projects WHERE id = $1
 	`
 	p := &models.Project{}
 	err := r.db.QueryRow(ctx, query, id).Scan(
-		&p.ID, &p.OwnerID, &p.Name, &p.Description, &p.AllowedOrigins, &p.AllowedProviders, &p.CreatedAt, &p.UpdatedAt,
+		&p.ID, &p.OwnerID, &p.Name, &p.Description, &p.AllowedOrigins, &p.AllowedProviders, &p.ClaimsTemplate, &p.CreatedAt, &p.UpdatedAt,
 	)
 	if err != nil {
 		if err == pgx.ErrNoRows {
@@ -77,10 +79,12 @@ func (r *postgresProjectRepo) GetByID(ctx context.Context, id string) (*models.P
 
 func (r *postgresProjectRepo) Update(ctx context.Context, p *models.Project) error {
 	query := `
-		UPDATE projects SET name = $2, description = $3, allowed_origins = $4, allowed_providers = $5, updated_at = NOW()
+		UPDATE projects
+		SET name = $2, description = $3, allowed_origins = $4, allowed_providers = $5,
+			claims_template = COALESCE($6, claims_template), updated_at = NOW()
 		WHERE id = $1
 	`
-	_, err := r.db.Exec(ctx, query, p.ID, p.Name, p.Description, p.AllowedOrigins, p.AllowedProviders)
+	_, err := r.db.Exec(ctx, query, p.ID, p.Name, p.Description, p.AllowedOrigins, p.AllowedProviders, p.ClaimsTemplate)
 	return err
 }
 
@@ -125,11 +129,15 @@ func (r *postgresProjectRepo) UpdateWidget(ctx context.Context, w *models.Widget
 }
 
 func (r *postgresProjectRepo) CreateAPIKey(ctx context.Context, key *models.APIKey) error {
+	scopes := key.Scopes
+	if scopes == nil {
+		scopes = []string{}
+	}
 	query := `
-		INSERT INTO project_api_keys (id, project_id, environment_id, name, client_id, client_secret_hash, created_at)
-		VALUES ($1, $2, $3, $4, $5, $6, NOW())
+		INSERT INTO project_api_keys (id, project_id, environment_id, name, client_id, client_secret_hash, scopes, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NOW())
 	`
-	_, err := r.db.Exec(ctx, query, key.ID, key.ProjectID, key.EnvironmentID, key.Name, key.ClientID, key.ClientSecretHash)
+	_, err := r.db.Exec(ctx, query, key.ID, key.ProjectID, key.EnvironmentID, key.Name, key.ClientID, key.ClientSecretHash, scopes)
 	return err
 }
 
@@ -157,12 +165,12 @@ func (r *postgresProjectRepo) GetAPIKeys(ctx context.Context, projectID string)
 
 func (r *postgresProjectRepo) GetAPIKeyByClientID(ctx context.Context, clientID string) (*models.APIKey, error) {
 	query := `
-		SELECT id, project_id, name, client_id, client_secret_hash, last_used_at, created_at
+		SELECT id, project_id, environment_id, name, client_id, client_secret_hash, scopes, last_used_at, revoked_at, created_at
 		FROM project_api_keys WHERE client_id = $1
 	`
 	k := &models.APIKey{}
 	err := r.db.QueryRow(ctx, query, clientID).Scan(
-		&k.ID, &k.ProjectID, &k.Name, &k.ClientID, &k.ClientSecretHash, &k.LastUsedAt, &k.CreatedAt,
+		&k.ID, &k.ProjectID, &k.EnvironmentID, &k.Name, &k.ClientID, &k.ClientSecretHash, &k.Scopes, &k.LastUsedAt, &k.RevokedAt, &k.CreatedAt,
 	)
 	if err != nil {
 		if err == pgx.ErrNoRows {
@@ -276,7 +284,7 @@ func (r *postgresProjectRepo) GetProjectUsers(ctx context.Context, projectID str
 
 	// Get users
 	query := `
-		SELECT u.id, u.email, pu.name, p.name, pu.last_auth_provider, COALESCE(pu.login_count, 0), pu.created_at, pu.last_login
+		SELECT u.id, COALESCE(u.email, ''), pu.name, p.name, pu.last_auth_provider, COALESCE(pu.login_count, 0), pu.created_at, pu.last_login
 		FROM project_users pu
 		JOIN users u ON pu.user_id = u.id
 		JOIN projects p ON pu.project_id = p.id
@@ -353,7 +361,7 @@ func (r *postgresProjectRepo) GetAllProjectUsers(ctx context.Context, ownerID st
 
 	// Get users
 	query := `
-		SELECT u.id, u.email, pu.name, p.name, pu.last_auth_provider, COALESCE(pu.login_count, 0), pu.created_at, pu.last_login
+		SELECT u.id, COALESCE(u.email, ''), pu.name, p.name, pu.last_auth_provider, COALESCE(pu.login_count, 0), pu.created_at, pu.last_login
 		FROM project_users pu
 		JOIN users u ON pu.user_id = u.id
 		JOIN projects p ON pu.project_id = p.id
@@ -408,7 +416,7 @@ func (r *postgresProjectRepo) GetAllProjectUsers(ctx context.Context, ownerID st
 
 func (r *postgresProjectRepo) GetAPIKeysByProjectID(ctx context.Context, projectID string) ([]models.APIKeyInfo, error) {
 	query := `
-		SELECT k.id, k.name, k.client_id, k.client_secret_hash, k.last_used_at, k.created_at, COALESCE(e.name, '') as env_name
+		SELECT k.id, k.name, k.client_id, k.client_secret_hash, k.status, k.scopes, k.last_used_at, k.created_at, COALESCE(e.name, '') as env_name
 		FROM project_api_keys k
 		LEFT JOIN environments e ON e.id = k.environment_id
 		WHERE k.project_id = $1
@@ -426,7 +434,7 @@ func (r *postgresProjectRepo) GetAPIKeysByProjectID(ctx context.Context, project
 		var secretHash string
 		var createdAt time.Time
 		var lastUsed *time.Time
-		if err := rows.Scan(&k.ID, &k.Name, &k.ClientID, &secretHash, &lastUsed, &createdAt, &k.EnvironmentName); err != nil {
+		if err := rows.Scan(&k.ID, &k.Name, &k.ClientID, &secretHash, &k.Status, &k.Scopes, &lastUsed, &createdAt, &k.EnvironmentName); err != nil {
 			return nil, err
 		}
 		// Mask the secret
@@ -472,11 +480,11 @@ func (r *postgresProjectRepo) InsertAuthLog(ctx context.Context, log *models.Aut
 	}
 
 	query := `
-		INSERT INTO auth_logs (id, project_id, user_id, user_email, event_type, status, ip_address, user_agent, metadata, created_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		INSERT INTO auth_logs (id, project_id, environment_id, user_id, user_email, event_type, status, ip_address, user_agent, metadata, created_at)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6, $7, $8, $9, $10, $11)
 	`
 	_, err := r.db.Exec(ctx, query,
-		log.ID, log.ProjectID, log.UserID, log.UserEmail,
+		log.ID, log.ProjectID, log.EnvironmentID, log.UserID, log.UserEmail,
 		log.EventType, log.Status, log.IPAddress, log.UserAgent,
 		log.Metadata, log.CreatedAt,
 	)
@@ -754,6 +762,36 @@ func (r *postgresProjectRepo) UpsertProjectUser(ctx context.Context, projectID,
 	return err
 }
 
+// GetProjectUserMetadata returns the metadata of a user in an environment, or
+// nil if the user never signed in there
+func (r *postgresProjectRepo) GetProjectUserMetadata(ctx context.Context, environmentID, userID string) (json.RawMessage, error) {
+	var metadata json.RawMessage
+	err := r.db.QueryRow(ctx, `
+		SELECT metadata FROM project_users WHERE environment_id = $1 AND user_id = $2
+	`, environmentID, userID).Scan(&metadata)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// UpdateProjectUserMetadata replaces a user's metadata in every environment of
+// the project, or only in environmentID when it is set. It reports whether the
+// user was found.
+func (r *postgresProjectRepo) UpdateProjectUserMetadata(ctx context.Context, projectID, environmentID, userID string, metadata json.RawMessage) (bool, error) {
+	tag, err := r.db.Exec(ctx, `
+		UPDATE project_users SET metadata = $4
+		WHERE project_id = $1 AND user_id = $3 AND ($2 = '' OR environment_id = $2)
+	`, projectID, environmentID, userID, metadata)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
 func formatCount(n int) string {
 	if n < 1000 {
 		return fmt.Sprintf("%d", n)
@@ -783,6 +821,8 @@ func (r *postgresProjectRepo) DeleteProject(ctx context.Context, projectID strin
 		`DELETE FROM oauth_provider_configs WHERE environment_id IN (SELECT id FROM environments WHERE project_id = $1)`,
 		`DELETE FROM auth_logs WHERE project_id = $1`,
 		`DELETE FROM otp_codes WHERE project_id = $1`,
+		`DELETE FROM refresh_tokens WHERE project_id = $1`,
+		`DELETE FROM sessions WHERE project_id = $1`,
 		`DELETE FROM project_users WHERE project_id = $1`,
 		`DELETE FROM project_api_keys WHERE project_id = $1`,
 		`DELETE FROM widgets WHERE project_id = $1`,
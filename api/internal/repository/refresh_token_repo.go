@@ -0,0 +1,108 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/marcioecom/permit/internal/models"
+)
+
+type RefreshTokenRepository interface {
+	GetByHash(ctx context.Context, tokenHash string) (*models.RefreshToken, error)
+	// Rotate revokes the active token identified by currentID and stores next
+	// in its place. It returns pgx.ErrNoRows if currentID was already revoked.
+	Rotate(ctx context.Context, currentID string, next *models.RefreshToken) error
+	RevokeFamily(ctx context.Context, familyID string) error
+	RevokeAllForUser(ctx context.Context, userID, environmentID string) error
+	// RevokeAllForProjectUser revokes a user's sessions across a project, or
+	// a single environment of it when environmentID is set.
+	RevokeAllForProjectUser(ctx context.Context, projectID, userID, environmentID string) error
+}
+
+type postgresRefreshTokenRepo struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresRefreshTokenRepo(db *pgxpool.Pool) RefreshTokenRepository {
+	return &postgresRefreshTokenRepo{db: db}
+}
+
+func (r *postgresRefreshTokenRepo) GetByHash(ctx context.Context, tokenHash string) (*models.RefreshToken, error) {
+	var t models.RefreshToken
+	err := r.db.QueryRow(ctx, `
+		SELECT id, user_id, project_id, environment_id, family_id, token_hash, replaced_by, expires_at, revoked_at, created_at
+		FROM refresh_tokens WHERE token_hash = $1
+	`, tokenHash).Scan(
+		&t.ID, &t.UserID, &t.ProjectID, &t.EnvironmentID, &t.FamilyID, &t.TokenHash,
+		&t.ReplacedBy, &t.ExpiresAt, &t.RevokedAt, &t.CreatedAt,
+	)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (r *postgresRefreshTokenRepo) Rotate(ctx context.Context, currentID string, next *models.RefreshToken) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var revokedID string
+	err = tx.QueryRow(ctx, `
+		UPDATE refresh_tokens SET revoked_at = NOW(), replaced_by = $2
+		WHERE id = $1 AND revoked_at IS NULL
+		RETURNING id
+	`, currentID, next.ID).Scan(&revokedID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO refresh_tokens (id, user_id, project_id, environment_id, family_id, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, next.ID, next.UserID, next.ProjectID, next.EnvironmentID, next.FamilyID, next.TokenHash, next.ExpiresAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// RevokeFamily revokes every token in a family together with the session it
+// belongs to.
+func (r *postgresRefreshTokenRepo) RevokeFamily(ctx context.Context, familyID string) error {
+	return r.revoke(ctx, `family_id = $1`, `id = $1`, familyID)
+}
+
+func (r *postgresRefreshTokenRepo) RevokeAllForUser(ctx context.Context, userID, environmentID string) error {
+	cond := `user_id = $1 AND environment_id = $2`
+	return r.revoke(ctx, cond, cond, userID, environmentID)
+}
+
+func (r *postgresRefreshTokenRepo) RevokeAllForProjectUser(ctx context.Context, projectID, userID, environmentID string) error {
+	cond := `project_id = $1 AND user_id = $2 AND ($3 = '' OR environment_id = $3)`
+	return r.revoke(ctx, cond, cond, projectID, userID, environmentID)
+}
+
+func (r *postgresRefreshTokenRepo) revoke(ctx context.Context, tokenCond, sessionCond string, args ...any) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `UPDATE refresh_tokens SET revoked_at = NOW() WHERE revoked_at IS NULL AND `+tokenCond, args...); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `UPDATE sessions SET revoked_at = NOW() WHERE revoked_at IS NULL AND `+sessionCond, args...); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,141 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/marcioecom/permit/internal/models"
+)
+
+type SessionRepository interface {
+	// Create stores a new session together with the first refresh token of
+	// its family
+	Create(ctx context.Context, session *models.Session, refreshToken *models.RefreshToken) error
+	GetByID(ctx context.Context, id string) (*models.Session, error)
+	ListActiveByUser(ctx context.Context, userID, environmentID string) ([]*models.Session, error)
+	// ListActiveByProjectUser lists a user's sessions across a project, or a
+	// single environment of it when environmentID is set.
+	ListActiveByProjectUser(ctx context.Context, projectID, userID, environmentID string) ([]*models.Session, error)
+	Touch(ctx context.Context, id, ip, userAgent string, expiresAt time.Time) error
+	// UpdateAuthentication records that the session's user authenticated again
+	UpdateAuthentication(ctx context.Context, id string, authTime time.Time, amr []string) error
+}
+
+type postgresSessionRepo struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresSessionRepo(db *pgxpool.Pool) SessionRepository {
+	return &postgresSessionRepo{db: db}
+}
+
+const sessionColumns = `id, user_id, project_id, environment_id, COALESCE(provider, ''), COALESCE(ip_address, ''), COALESCE(user_agent, ''), auth_time, amr, COALESCE(client_id, ''), COALESCE(scope, ''), expires_at, revoked_at, last_used_at, created_at`
+
+func scanSession(row pgx.Row) (*models.Session, error) {
+	var s models.Session
+	err := row.Scan(
+		&s.ID, &s.UserID, &s.ProjectID, &s.EnvironmentID, &s.Provider, &s.IPAddress, &s.UserAgent,
+		&s.AuthTime, &s.AMR, &s.ClientID, &s.Scope, &s.ExpiresAt, &s.RevokedAt, &s.LastUsedAt, &s.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (r *postgresSessionRepo) Create(ctx context.Context, s *models.Session, t *models.RefreshToken) error {
+	amr := s.AMR
+	if amr == nil {
+		amr = []string{}
+	}
+
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO sessions (id, user_id, project_id, environment_id, provider, ip_address, user_agent, auth_time, amr, client_id, scope, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NULLIF($10, ''), NULLIF($11, ''), $12)
+	`, s.ID, s.UserID, s.ProjectID, s.EnvironmentID, s.Provider, s.IPAddress, s.UserAgent, s.AuthTime, amr, s.ClientID, s.Scope, s.ExpiresAt)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO refresh_tokens (id, user_id, project_id, environment_id, family_id, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, t.ID, t.UserID, t.ProjectID, t.EnvironmentID, t.FamilyID, t.TokenHash, t.ExpiresAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (r *postgresSessionRepo) GetByID(ctx context.Context, id string) (*models.Session, error) {
+	s, err := scanSession(r.db.QueryRow(ctx, `SELECT `+sessionColumns+` FROM sessions WHERE id = $1`, id))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+func (r *postgresSessionRepo) ListActiveByUser(ctx context.Context, userID, environmentID string) ([]*models.Session, error) {
+	return r.list(ctx, `
+		SELECT `+sessionColumns+`
+		FROM sessions
+		WHERE user_id = $1 AND environment_id = $2 AND revoked_at IS NULL AND expires_at > NOW()
+		ORDER BY last_used_at DESC
+	`, userID, environmentID)
+}
+
+func (r *postgresSessionRepo) ListActiveByProjectUser(ctx context.Context, projectID, userID, environmentID string) ([]*models.Session, error) {
+	return r.list(ctx, `
+		SELECT `+sessionColumns+`
+		FROM sessions
+		WHERE project_id = $1 AND user_id = $2 AND ($3 = '' OR environment_id = $3)
+			AND revoked_at IS NULL AND expires_at > NOW()
+		ORDER BY last_used_at DESC
+	`, projectID, userID, environmentID)
+}
+
+func (r *postgresSessionRepo) list(ctx context.Context, query string, args ...any) ([]*models.Session, error) {
+	rows, err := r.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*models.Session{}
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+func (r *postgresSessionRepo) Touch(ctx context.Context, id, ip, userAgent string, expiresAt time.Time) error {
+	_, err := r.db.Exec(ctx, `
+		UPDATE sessions SET last_used_at = NOW(), ip_address = $2, user_agent = $3, expires_at = $4
+		WHERE id = $1
+	`, id, ip, userAgent, expiresAt)
+	return err
+}
+
+func (r *postgresSessionRepo) UpdateAuthentication(ctx context.Context, id string, authTime time.Time, amr []string) error {
+	_, err := r.db.Exec(ctx, `
+		UPDATE sessions SET auth_time = $2, amr = $3, last_used_at = NOW()
+		WHERE id = $1
+	`, id, authTime, amr)
+	return err
+}
@@ -0,0 +1,106 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/marcioecom/permit/internal/models"
+)
+
+// signingKeysLockID serialises key ring changes across replicas
+const signingKeysLockID = 7316480211
+
+type SigningKeyRepository interface {
+	List(ctx context.Context) ([]*models.SigningKey, error)
+	// Update passes the stored key ring to fn while holding a lock shared by
+	// every replica, then persists the ring fn returns. Stored keys missing
+	// from the result are deleted.
+	Update(ctx context.Context, fn func(keys []*models.SigningKey) ([]*models.SigningKey, error)) error
+}
+
+type postgresSigningKeyRepo struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresSigningKeyRepo(db *pgxpool.Pool) SigningKeyRepository {
+	return &postgresSigningKeyRepo{db: db}
+}
+
+func (r *postgresSigningKeyRepo) List(ctx context.Context) ([]*models.SigningKey, error) {
+	return listSigningKeys(ctx, r.db)
+}
+
+func (r *postgresSigningKeyRepo) Update(ctx context.Context, fn func(keys []*models.SigningKey) ([]*models.SigningKey, error)) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, signingKeysLockID); err != nil {
+		return err
+	}
+
+	current, err := listSigningKeys(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	next, err := fn(current)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]string, 0, len(next))
+	scopes := make([]string, 0, len(next))
+	for _, k := range next {
+		ids = append(ids, k.ID)
+		scopes = append(scopes, k.EnvironmentID)
+		_, err := tx.Exec(ctx, `
+			INSERT INTO signing_keys (id, environment_id, algorithm, status, private_key, activated_at, expires_at, created_at)
+			VALUES ($1, NULLIF($2, ''), $3, $4, $5, $6, $7, $8)
+			ON CONFLICT ((COALESCE(environment_id, '')), id) DO UPDATE
+			SET status = EXCLUDED.status, activated_at = EXCLUDED.activated_at, expires_at = EXCLUDED.expires_at
+		`, k.ID, k.EnvironmentID, k.Algorithm, k.Status, k.PrivateKey, k.ActivatedAt, k.ExpiresAt, k.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(ctx, `
+		DELETE FROM signing_keys
+		WHERE (COALESCE(environment_id, ''), id) NOT IN (SELECT * FROM unnest($1::text[], $2::text[]))
+	`, scopes, ids)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+type querier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+func listSigningKeys(ctx context.Context, q querier) ([]*models.SigningKey, error) {
+	rows, err := q.Query(ctx, `
+		SELECT id, COALESCE(environment_id, ''), algorithm, status, private_key, activated_at, expires_at, created_at
+		FROM signing_keys
+		ORDER BY environment_id NULLS FIRST, created_at
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*models.SigningKey{}
+	for rows.Next() {
+		var k models.SigningKey
+		if err := rows.Scan(&k.ID, &k.EnvironmentID, &k.Algorithm, &k.Status, &k.PrivateKey, &k.ActivatedAt, &k.ExpiresAt, &k.CreatedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, &k)
+	}
+	return keys, rows.Err()
+}
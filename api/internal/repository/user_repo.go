@@ -25,7 +25,7 @@ func (r *postgresUserRepo) Create(ctx context.Context, u *models.User) (string,
 	var insertedUserID string
 	err := r.db.QueryRow(ctx, `
 		INSERT INTO users (id, email)
-		VALUES ($1, $2)
+		VALUES ($1, NULLIF($2, ''))
 		ON CONFLICT (email) DO UPDATE SET email = EXCLUDED.email
 		RETURNING id;
 		`,
@@ -41,7 +41,7 @@ func (r *postgresUserRepo) GetByID(ctx context.Context, id string) (*models.User
 	var user models.User
 
 	err := r.db.QueryRow(ctx, `
-		SELECT id, email, created_at
+		SELECT id, COALESCE(email, ''), created_at
 		FROM users WHERE id = $1;
 	`, id).Scan(&user.ID, &user.Email, &user.CreatedAt)
 	if err != nil {
@@ -55,7 +55,7 @@ func (r *postgresUserRepo) GetByEmail(ctx context.Context, email string) (*model
 	var user models.User
 
 	err := r.db.QueryRow(ctx, `
-		SELECT id, email, created_at
+		SELECT id, COALESCE(email, ''), created_at
 		FROM users WHERE email = $1;
 	`, email).Scan(&user.ID, &user.Email, &user.CreatedAt)
 	if err != nil {
@@ -2,14 +2,12 @@ package service
 
 import (
 	"context"
-	"crypto/rand"
 	"errors"
 	"fmt"
-	"math/big"
-	"strings"
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/marcioecom/permit/internal/config"
 	"github.com/marcioecom/permit/internal/crypto"
 	"github.com/marcioecom/permit/internal/infra"
 	"github.com/marcioecom/permit/internal/models"
@@ -19,55 +17,99 @@ import (
 )
 
 type AuthService struct {
-	jwtService   *crypto.JWTService
-	emailService infra.EmailSender
-	userRepo     repository.UserRepository
-	otpRepo      repository.OTPCodeRepository
-	identityRepo repository.IdentityRepository
-	projectRepo  repository.ProjectRepository
-	envRepo      repository.EnvironmentRepository
+	cfg            *config.Config
+	jwtService     *crypto.JWTService
+	codeHasher     *crypto.CodeHasher
+	sessionService *SessionService
+	mfaService     *MFAService
+	emailService   infra.EmailSender
+	smsService     infra.SMSSender
+	userRepo       repository.UserRepository
+	otpRepo        repository.OTPCodeRepository
+	attempts       attemptLimiter
+	oauthRepo      repository.OAuthRepository
+	identityRepo   repository.IdentityRepository
+	projectRepo    repository.ProjectRepository
+	envRepo        repository.EnvironmentRepository
 }
 
 func NewAuthService(
+	cfg *config.Config,
 	jwtService *crypto.JWTService,
+	codeHasher *crypto.CodeHasher,
+	sessionService *SessionService,
+	mfaService *MFAService,
 	emailService infra.EmailSender,
+	smsService infra.SMSSender,
 	userRepo repository.UserRepository,
 	otpRepo repository.OTPCodeRepository,
+	loginAttemptRepo repository.LoginAttemptRepository,
+	oauthRepo repository.OAuthRepository,
 	identityRepo repository.IdentityRepository,
 	projectRepo repository.ProjectRepository,
 	envRepo repository.EnvironmentRepository,
 ) *AuthService {
 	return &AuthService{
-		jwtService:   jwtService,
-		emailService: emailService,
-		userRepo:     userRepo,
-		otpRepo:      otpRepo,
-		identityRepo: identityRepo,
-		projectRepo:  projectRepo,
-		envRepo:      envRepo,
+		cfg:            cfg,
+		jwtService:     jwtService,
+		codeHasher:     codeHasher,
+		sessionService: sessionService,
+		mfaService:     mfaService,
+		emailService:   emailService,
+		smsService:     smsService,
+		userRepo:       userRepo,
+		otpRepo:        otpRepo,
+		attempts:       attemptLimiter{repo: loginAttemptRepo},
+		oauthRepo:      oauthRepo,
+		identityRepo:   identityRepo,
+		projectRepo:    projectRepo,
+		envRepo:        envRepo,
 	}
 }
 
 type CreateAuthInput struct {
 	Email     string
 	ProjectID string
-	IPAddress string
-	UserAgent string
+	// EnvironmentID defaults to the project's default environment
+	EnvironmentID string
+	IPAddress     string
+	UserAgent     string
+
+	// MagicLink also emails a sign-in link that redirects to RedirectURL, a
+	// callback path on ClientOrigin, with a Permit authorization code
+	MagicLink    bool
+	RedirectURL  string
+	ClientOrigin string
+}
+
+type CreateAuthOutput struct {
+	// ChallengeID identifies the code that was sent; verifying with it
+	// instead of the email checks the guess against that code only
+	ChallengeID string    `json:"challengeId"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+
+	// CodeLength and CodeAlphabet describe the code that was sent, following
+	// the environment's OTP policy
+	CodeLength   int    `json:"codeLength"`
+	CodeAlphabet string `json:"codeAlphabet"`
+
+	// ResendAfter is when another code can be requested
+	ResendAfter time.Time `json:"resendAfter"`
 }
 
-func (s *AuthService) CreateOTPCode(ctx context.Context, input CreateAuthInput) error {
+func (s *AuthService) CreateOTPCode(ctx context.Context, input CreateAuthInput) (*CreateAuthOutput, error) {
 	project, err := s.projectRepo.GetByID(ctx, input.ProjectID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if project == nil {
-		return fmt.Errorf("project_not_found")
+		return nil, fmt.Errorf("project_not_found")
 	}
 
 	user, err := s.userRepo.GetByEmail(ctx, input.Email)
 	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
-		return err
+		return nil, err
 	}
 
 	var userID string
@@ -77,39 +119,34 @@ func (s *AuthService) CreateOTPCode(ctx context.Context, input CreateAuthInput)
 			Email: input.Email,
 		})
 		if err != nil {
-			return err
+			return nil, err
 		}
 	} else {
 		userID = user.ID
 	}
 
-	digits := make([]string, 6)
-	for i := range digits {
-		n, _ := rand.Int(rand.Reader, big.NewInt(10))
-		digits[i] = n.String()
-	}
-	code := strings.Join(digits, "")
-
-	env, err := s.envRepo.GetDefaultForProject(ctx, input.ProjectID)
-	if err != nil || env == nil {
-		return fmt.Errorf("environment_not_found")
-	}
-
-	err = s.otpRepo.Create(ctx, &models.OTPCode{
-		ID:            ulid.Make().String(),
-		UserID:        userID,
-		ProjectID:     input.ProjectID,
-		EnvironmentID: env.ID,
-		Code:          code,
-		ExpiresAt:     time.Now().Add(time.Minute * 10),
-	})
+	env, err := s.loginEnvironment(ctx, input.ProjectID, input.EnvironmentID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if err := s.emailService.SendOTP(input.Email, code, project.Name); err != nil {
-		log.Warn().Err(err).Str("email", input.Email).Msg("OTP creation failed")
-		return fmt.Errorf("email_delivery_failed")
+	var otp *sentCode
+	var metadata map[string]string
+	if input.MagicLink {
+		redirectURL, err := magicLinkRedirect(env, project, input.ClientOrigin, input.RedirectURL)
+		if err != nil {
+			return nil, err
+		}
+		otp, err = s.sendMagicLink(ctx, project, env, userID, input.Email, redirectURL)
+		if err != nil {
+			return nil, err
+		}
+		metadata = map[string]string{"method": "magic_link"}
+	} else {
+		otp, err = s.sendOTPCode(ctx, project, env, userID, input.Email)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// Log auth event
@@ -122,35 +159,151 @@ func (s *AuthService) CreateOTPCode(ctx context.Context, input CreateAuthInput)
 		Status:    "OTP_SENT",
 		IPAddress: input.IPAddress,
 		UserAgent: input.UserAgent,
+		Metadata:  metadata,
 		CreatedAt: time.Now(),
 	})
 	if err != nil {
 		log.Warn().Err(err).Msg("failed to log auth event")
 	}
 
-	return nil
+	return newCreateAuthOutput(otp, env), nil
+}
+
+func newCreateAuthOutput(otp *sentCode, env *models.Environment) *CreateAuthOutput {
+	policy := otpPolicyFor(env)
+	return &CreateAuthOutput{
+		ChallengeID:  otp.ID,
+		ExpiresAt:    otp.ExpiresAt,
+		CodeLength:   policy.Length,
+		CodeAlphabet: policy.Alphabet,
+		ResendAfter:  otp.ResendAfter,
+	}
+}
+
+// loginEnvironment returns the project environment a sign-in happens in,
+// the project's default one unless another is given
+func (s *AuthService) loginEnvironment(ctx context.Context, projectID, environmentID string) (*models.Environment, error) {
+	var env *models.Environment
+	var err error
+	if environmentID == "" {
+		env, err = s.envRepo.GetDefaultForProject(ctx, projectID)
+	} else {
+		env, err = s.envRepo.GetByID(ctx, environmentID)
+	}
+	if err != nil || env == nil || env.ProjectID != projectID {
+		return nil, fmt.Errorf("environment_not_found")
+	}
+	return env, nil
+}
+
+// sendOTPCode stores a new one-time code for a user and emails it to them
+func (s *AuthService) sendOTPCode(ctx context.Context, project *models.Project, env *models.Environment, userID, email string) (*sentCode, error) {
+	otp, code, err := s.createOTPCode(ctx, models.OTPKindCode, project.ID, env, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.emailService.SendOTP(email, code, project.Name, otpPolicyFor(env).TTL); err != nil {
+		log.Warn().Err(err).Str("email", email).Msg("OTP creation failed")
+		return nil, fmt.Errorf("email_delivery_failed")
+	}
+	return otp, nil
 }
 
+// sentCode is a code that was just created, along with when the user may
+// request the next one
+type sentCode struct {
+	*models.OTPCode
+	ResendAfter time.Time
+}
+
+// createOTPCode stores a new one-time code of a kind for a user, following
+// the environment's OTP policy, and returns it along with the plain code.
+// Only the code's keyed hash is stored. The new code supersedes the user's
+// pending ones in the environment, which expire so that only one code can
+// be guessed at a time.
+func (s *AuthService) createOTPCode(ctx context.Context, kind, projectID string, env *models.Environment, userID string) (*sentCode, string, error) {
+	policy := otpPolicyFor(env)
+
+	last, err := s.otpRepo.LastCreatedAt(ctx, env.ID, userID, kind)
+	if err != nil {
+		return nil, "", err
+	}
+	if last != nil && time.Since(*last) < otpResendCooldown {
+		return nil, "", &ResendCooldownError{RetryAt: last.Add(otpResendCooldown)}
+	}
+
+	sent, err := s.otpRepo.CountCreatedSince(ctx, env.ID, userID, kind, time.Now().Add(-policy.TTL))
+	if err != nil {
+		return nil, "", err
+	}
+	if sent > policy.MaxResends {
+		return nil, "", fmt.Errorf("too_many_resends")
+	}
+
+	code := policy.generate()
+	otp := &models.OTPCode{
+		ID:            ulid.Make().String(),
+		UserID:        userID,
+		ProjectID:     projectID,
+		EnvironmentID: env.ID,
+		Kind:          kind,
+		ExpiresAt:     time.Now().Add(policy.TTL),
+	}
+	otp.CodeHash = s.codeHasher.Hash(otp.ID, code)
+	if err := s.otpRepo.Create(ctx, otp); err != nil {
+		return nil, "", err
+	}
+
+	// Magic links are emailed along with a code, so a new email code also
+	// supersedes them
+	superseded := []string{kind}
+	if kind == models.OTPKindCode {
+		superseded = append(superseded, models.OTPKindMagicLink)
+	}
+	if err := s.otpRepo.ExpirePending(ctx, env.ID, userID, superseded, otp.ID); err != nil {
+		return nil, "", err
+	}
+
+	// Once the resends are used up, the next code can only be requested when
+	// this one expires
+	resendAfter := time.Now().Add(otpResendCooldown)
+	if sent >= policy.MaxResends {
+		resendAfter = otp.ExpiresAt
+	}
+	return &sentCode{OTPCode: otp, ResendAfter: resendAfter}, code, nil
+}
+
+// VerifyAuthInput identifies the code being verified by either the email it
+// was sent to or the challenge ID CreateOTPCode returned
 type VerifyAuthInput struct {
-	Code      string
-	ProjectID string
-	IPAddress string
-	UserAgent string
+	Code        string
+	Email       string
+	ChallengeID string
+	ProjectID   string
+	IPAddress   string
+	UserAgent   string
 }
 
+// VerifyAuthOutput carries either tokens or, when the sign-in needs a second
+// factor, the MFA challenge to complete first
 type VerifyAuthOutput struct {
-	AccessToken  string    `json:"accessToken"`
-	RefreshToken string    `json:"refreshToken"`
-	User         *UserInfo `json:"user"`
+	AccessToken  string              `json:"accessToken,omitempty"`
+	RefreshToken string              `json:"refreshToken,omitempty"`
+	MFA          *MFAChallengeOutput `json:"mfa,omitempty"`
+	User         *UserInfo           `json:"user"`
 }
 
 type UserInfo struct {
 	ID    string `json:"id"`
 	Email string `json:"email"`
+	Phone string `json:"phone,omitempty"`
 }
 
-func (s *AuthService) logAuthEvent(ctx context.Context, projectID, userID, email, eventType, status, ip, ua string, metadata map[string]string) {
-	err := s.projectRepo.InsertAuthLog(ctx, &models.AuthLog{
+// logAuthEvent records an auth log entry for a project. A failure is only
+// logged, it never fails the flow being audited.
+func logAuthEvent(ctx context.Context, projectRepo repository.ProjectRepository, projectID, userID, email, eventType, status, ip, ua string, metadata map[string]string) {
+	err := projectRepo.InsertAuthLog(ctx, &models.AuthLog{
 		ID:        ulid.Make().String(),
 		ProjectID: projectID,
 		UserID:    userID,
@@ -167,27 +320,201 @@ func (s *AuthService) logAuthEvent(ctx context.Context, projectID, userID, email
 	}
 }
 
-func (s *AuthService) VerifyOTPCode(ctx context.Context, input VerifyAuthInput) (*VerifyAuthOutput, error) {
-	otp, err := s.otpRepo.GetByProjectAndCode(ctx, input.ProjectID, input.Code)
-	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			s.logAuthEvent(ctx, input.ProjectID, "", "", "login", "FAILED", input.IPAddress, input.UserAgent, map[string]string{"provider": "email"})
-			return nil, fmt.Errorf("invalid_code")
+// otpVerification is a one-time code presented for verification. The guess
+// is only checked against codes of its kind issued to the user the
+// challenge, user ID, email or phone number identifies.
+type otpVerification struct {
+	ProjectID   string
+	Kind        string // models.OTPKindCode or models.OTPKindSMS
+	ChallengeID string
+	UserID      string
+	Email       string
+	Phone       string // E.164, for SMS codes
+	Code        string
+	EventType   string // auth log event failures are recorded under
+	IPAddress   string
+	UserAgent   string
+}
+
+// otpCandidates returns the codes a guess may match and the user they belong
+// to, filling in the email or phone number when only the challenge was given
+func (s *AuthService) otpCandidates(ctx context.Context, v *otpVerification) ([]*models.OTPCode, error) {
+	if v.ChallengeID != "" {
+		otp, err := s.otpRepo.GetByID(ctx, v.ChallengeID)
+		if err != nil || otp == nil {
+			return nil, err
+		}
+		if otp.ProjectID != v.ProjectID || otp.Kind != v.Kind {
+			return nil, nil
+		}
+		user, err := s.userRepo.GetByID(ctx, otp.UserID)
+		if err != nil || user == nil {
+			return nil, err
+		}
+		if (v.UserID != "" && v.UserID != user.ID) || (v.Email != "" && v.Email != user.Email) {
+			return nil, nil
+		}
+		v.UserID = user.ID
+		if v.Kind == models.OTPKindSMS {
+			identity, err := s.identityRepo.GetByUserAndProvider(ctx, user.ID, models.ProviderPhone)
+			if err != nil || identity == nil {
+				return nil, err
+			}
+			if v.Phone != "" && v.Phone != identity.ProviderUserID {
+				return nil, nil
+			}
+			v.Phone = identity.ProviderUserID
+		} else {
+			v.Email = user.Email
 		}
+		return []*models.OTPCode{otp}, nil
+	}
+
+	if v.UserID == "" && v.Phone != "" {
+		identity, err := s.identityRepo.GetByProviderUserID(ctx, models.ProviderPhone, v.Phone)
+		if err != nil {
+			return nil, err
+		}
+		if identity == nil {
+			return nil, nil
+		}
+		v.UserID = identity.UserID
+	}
+
+	if v.UserID == "" && v.Email != "" {
+		user, err := s.userRepo.GetByEmail(ctx, v.Email)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return nil, err
+		}
+		if user == nil {
+			return nil, nil
+		}
+		v.UserID = user.ID
+	}
+	if v.UserID == "" {
+		return nil, nil
+	}
+	return s.otpRepo.ListPendingByUser(ctx, v.ProjectID, v.UserID, v.Kind)
+}
+
+// consumeOTPCode checks a one-time code and marks it as used. Wrong guesses
+// count against the user's pending codes and towards locking out the email
+// or phone number and IP they came from.
+func (s *AuthService) consumeOTPCode(ctx context.Context, v otpVerification) (*models.OTPCode, error) {
+	candidates, err := s.otpCandidates(ctx, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	subjects := []string{ipSubject(v.IPAddress)}
+	metadata := map[string]string{"provider": models.ProviderEmail}
+	var subject string
+	if v.Phone != "" {
+		subject = phoneSubject(v.Phone)
+		metadata = map[string]string{"provider": models.ProviderPhone, "phone": v.Phone}
+	} else if v.Email != "" {
+		subject = emailSubject(v.Email)
+	}
+	if subject != "" {
+		subjects = append(subjects, subject)
+	}
+
+	lockedUntil, err := s.attempts.lockedUntil(ctx, v.ProjectID, subjects...)
+	if err != nil {
 		return nil, err
 	}
+	if lockedUntil != nil {
+		metadata["lockedUntil"] = lockedUntil.Format(time.RFC3339)
+		logAuthEvent(ctx, s.projectRepo, v.ProjectID, v.UserID, v.Email, v.EventType, "TOO_MANY_ATTEMPTS", v.IPAddress, v.UserAgent, metadata)
+		return nil, fmt.Errorf("too_many_attempts")
+	}
+
+	// Codes are checked against the policy of the environment they were sent
+	// in, so a malformed guess is rejected without counting as an attempt
+	code := v.Code
+	if len(candidates) > 0 {
+		env, err := s.envRepo.GetByID(ctx, candidates[0].EnvironmentID)
+		if err != nil {
+			return nil, err
+		}
+		policy := otpPolicyFor(env)
+		code = policy.normalize(code)
+		if !policy.valid(code) {
+			return nil, fmt.Errorf("invalid_code_format")
+		}
+	}
+
+	var otp *models.OTPCode
+	for _, candidate := range candidates {
+		if s.codeHasher.Verify(candidate.ID, code, candidate.CodeHash) {
+			otp = candidate
+			break
+		}
+	}
+	if otp == nil {
+		if v.UserID != "" {
+			if err := s.otpRepo.IncrementAttempts(ctx, v.ProjectID, v.UserID, v.Kind); err != nil {
+				log.Warn().Err(err).Str("userId", v.UserID).Msg("failed to count OTP attempt")
+			}
+		}
+		if s.attempts.recordFailure(ctx, v.ProjectID, subjects...) {
+			logAuthEvent(ctx, s.projectRepo, v.ProjectID, v.UserID, v.Email, v.EventType, "TOO_MANY_ATTEMPTS", v.IPAddress, v.UserAgent, metadata)
+			return nil, fmt.Errorf("too_many_attempts")
+		}
+		logAuthEvent(ctx, s.projectRepo, v.ProjectID, v.UserID, v.Email, v.EventType, "FAILED", v.IPAddress, v.UserAgent, metadata)
+		return nil, fmt.Errorf("invalid_code")
+	}
+
+	if otp.Attempts >= maxOTPAttempts {
+		logAuthEvent(ctx, s.projectRepo, v.ProjectID, otp.UserID, v.Email, v.EventType, "TOO_MANY_ATTEMPTS", v.IPAddress, v.UserAgent, metadata)
+		return nil, fmt.Errorf("too_many_attempts")
+	}
 
 	if otp.UsedAt != nil {
-		s.logAuthEvent(ctx, input.ProjectID, otp.UserID, "", "login", "FAILED", input.IPAddress, input.UserAgent, map[string]string{"provider": "email"})
+		logAuthEvent(ctx, s.projectRepo, v.ProjectID, otp.UserID, v.Email, v.EventType, "FAILED", v.IPAddress, v.UserAgent, metadata)
 		return nil, fmt.Errorf("code_already_used")
 	}
 
 	if time.Now().After(otp.ExpiresAt) {
-		s.logAuthEvent(ctx, input.ProjectID, otp.UserID, "", "login", "EXPIRED", input.IPAddress, input.UserAgent, map[string]string{"provider": "email"})
+		logAuthEvent(ctx, s.projectRepo, v.ProjectID, otp.UserID, v.Email, v.EventType, "EXPIRED", v.IPAddress, v.UserAgent, metadata)
 		return nil, fmt.Errorf("code_expired")
 	}
 
 	if err = s.otpRepo.MarkCodeAsUsed(ctx, otp.ID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			logAuthEvent(ctx, s.projectRepo, v.ProjectID, otp.UserID, v.Email, v.EventType, "FAILED", v.IPAddress, v.UserAgent, metadata)
+			return nil, fmt.Errorf("code_already_used")
+		}
+		return nil, err
+	}
+	// The magic link emailed along with the code is for the same sign-in
+	if otp.Kind == models.OTPKindCode {
+		if err := s.otpRepo.ExpirePending(ctx, otp.EnvironmentID, otp.UserID, []string{models.OTPKindMagicLink}, otp.ID); err != nil {
+			return nil, err
+		}
+	}
+	if subject != "" {
+		s.attempts.reset(ctx, v.ProjectID, subject)
+	}
+	return otp, nil
+}
+
+func (s *AuthService) VerifyOTPCode(ctx context.Context, input VerifyAuthInput) (*VerifyAuthOutput, error) {
+	if input.Email == "" && input.ChallengeID == "" {
+		return nil, fmt.Errorf("challenge_required")
+	}
+
+	otp, err := s.consumeOTPCode(ctx, otpVerification{
+		ProjectID:   input.ProjectID,
+		Kind:        models.OTPKindCode,
+		ChallengeID: input.ChallengeID,
+		Email:       input.Email,
+		Code:        input.Code,
+		EventType:   "login",
+		IPAddress:   input.IPAddress,
+		UserAgent:   input.UserAgent,
+	})
+	if err != nil {
 		return nil, err
 	}
 
@@ -196,41 +523,213 @@ func (s *AuthService) VerifyOTPCode(ctx context.Context, input VerifyAuthInput)
 		return nil, err
 	}
 
+	s.linkEmailIdentity(ctx, user)
+
+	return s.completeLogin(ctx, user, otp, models.ProviderEmail, input.IPAddress, input.UserAgent, map[string]string{"provider": "email"})
+}
+
+// completeLogin starts a session for a user who just consumed a one-time
+// code, or the MFA challenge that stands in for one
+func (s *AuthService) completeLogin(ctx context.Context, user *models.User, otp *models.OTPCode, provider, ip, ua string, metadata map[string]string) (*VerifyAuthOutput, error) {
+	tokens, challenge, err := s.mfaService.beginSession(ctx, CreateSessionInput{
+		UserID:        user.ID,
+		Email:         user.Email,
+		ProjectID:     otp.ProjectID,
+		EnvironmentID: otp.EnvironmentID,
+		Provider:      provider,
+		IPAddress:     ip,
+		UserAgent:     ua,
+	}, metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	output := &VerifyAuthOutput{
+		MFA: challenge,
+		User: &UserInfo{
+			ID:    user.ID,
+			Email: user.Email,
+		},
+	}
+	if tokens != nil {
+		output.AccessToken = tokens.AccessToken
+		output.RefreshToken = tokens.RefreshToken
+	}
+	return output, nil
+}
+
+// linkEmailIdentity records that a user proved ownership of their email, the
+// first time they do
+func (s *AuthService) linkEmailIdentity(ctx context.Context, user *models.User) {
 	existingIdentity, _ := s.identityRepo.GetByUserAndProvider(ctx, user.ID, models.ProviderEmail)
-	if existingIdentity == nil {
-		if err := s.identityRepo.Create(ctx, &models.Identity{
-			ID:       ulid.Make().String(),
-			UserID:   user.ID,
-			Provider: models.ProviderEmail,
-			Email:    user.Email,
-		}); err != nil {
-			log.Warn().Err(err).Str("userId", user.ID).Msg("failed to link email identity")
+	if existingIdentity != nil {
+		return
+	}
+	if err := s.identityRepo.Create(ctx, &models.Identity{
+		ID:       ulid.Make().String(),
+		UserID:   user.ID,
+		Provider: models.ProviderEmail,
+		Email:    user.Email,
+	}); err != nil {
+		log.Warn().Err(err).Str("userId", user.ID).Msg("failed to link email identity")
+	}
+}
+
+type StartReauthenticationInput struct {
+	Claims *crypto.AccessTokenClaims
+	// MaxAge skips re-authentication when the user already authenticated
+	// within it; nil always requires it
+	MaxAge    *time.Duration
+	IPAddress string
+	UserAgent string
+}
+
+type StartReauthenticationOutput struct {
+	// Required is false when the session is recent enough, in which case no
+	// code is sent and the current access token can be used as is
+	Required bool `json:"required"`
+
+	// CodeLength, CodeAlphabet and ResendAfter describe the code sent when
+	// Required
+	CodeLength   int        `json:"codeLength,omitempty"`
+	CodeAlphabet string     `json:"codeAlphabet,omitempty"`
+	ResendAfter  *time.Time `json:"resendAfter,omitempty"`
+}
+
+// StartReauthentication sends a one-time code to the user behind an access
+// token, unless they authenticated within the requested max age. Users who
+// signed in with their phone number get it by SMS, everyone else by email.
+func (s *AuthService) StartReauthentication(ctx context.Context, input StartReauthenticationInput) (*StartReauthenticationOutput, error) {
+	claims := input.Claims
+
+	if input.MaxAge != nil {
+		recent, err := s.sessionService.AuthenticatedWithin(ctx, claims, *input.MaxAge)
+		if err != nil {
+			return nil, err
+		}
+		if recent {
+			return &StartReauthenticationOutput{Required: false}, nil
 		}
+	} else if _, err := s.sessionService.activeSession(ctx, claims); err != nil {
+		return nil, err
 	}
 
-	accessToken, err := s.jwtService.SignAccessToken(user.Email, user.ID, input.ProjectID, otp.EnvironmentID, "email")
+	project, err := s.projectRepo.GetByID(ctx, claims.ProjectID)
+	if err != nil || project == nil {
+		return nil, fmt.Errorf("project_not_found")
+	}
+
+	env, err := s.envRepo.GetByID(ctx, claims.EnvironmentID)
+	if err != nil || env == nil {
+		return nil, fmt.Errorf("environment_not_found")
+	}
+
+	phone, err := s.reauthenticationPhone(ctx, claims)
 	if err != nil {
-		return nil, fmt.Errorf("token_generation_failed")
+		return nil, err
+	}
+
+	metadata := map[string]string{"sessionId": claims.SessionID}
+	var otp *sentCode
+	if phone != "" {
+		var code string
+		otp, code, err = s.createOTPCode(ctx, models.OTPKindSMS, project.ID, env, claims.UserID)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.smsService.SendOTP(phone, code, project.Name, otpPolicyFor(env).TTL); err != nil {
+			log.Warn().Err(err).Str("phone", phone).Msg("SMS OTP creation failed")
+			return nil, fmt.Errorf("sms_delivery_failed")
+		}
+		metadata["phone"] = phone
+	} else {
+		otp, err = s.sendOTPCode(ctx, project, env, claims.UserID, claims.Email)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	refreshToken, err := s.jwtService.SignRefreshToken(user.ID, input.ProjectID)
+	logAuthEvent(ctx, s.projectRepo, claims.ProjectID, claims.UserID, claims.Email, "reauthentication", "OTP_SENT", input.IPAddress, input.UserAgent, metadata)
+
+	policy := otpPolicyFor(env)
+	return &StartReauthenticationOutput{
+		Required:     true,
+		CodeLength:   policy.Length,
+		CodeAlphabet: policy.Alphabet,
+		ResendAfter:  &otp.ResendAfter,
+	}, nil
+}
+
+// reauthenticationPhone returns the phone number re-authentication codes are
+// texted to for sessions signed in with one, or "" when they're emailed
+func (s *AuthService) reauthenticationPhone(ctx context.Context, claims *crypto.AccessTokenClaims) (string, error) {
+	if claims.Provider != models.ProviderPhone {
+		return "", nil
+	}
+	identity, err := s.identityRepo.GetByUserAndProvider(ctx, claims.UserID, models.ProviderPhone)
+	if err != nil || identity == nil {
+		return "", fmt.Errorf("identity_not_found")
+	}
+	return identity.ProviderUserID, nil
+}
+
+type VerifyReauthenticationInput struct {
+	Claims    *crypto.AccessTokenClaims
+	Code      string
+	IPAddress string
+	UserAgent string
+}
+
+type VerifyReauthenticationOutput struct {
+	AccessToken string    `json:"accessToken"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+// VerifyReauthentication checks the code sent by StartReauthentication and
+// returns an access token for the same session with a fresh auth_time.
+func (s *AuthService) VerifyReauthentication(ctx context.Context, input VerifyReauthenticationInput) (*VerifyReauthenticationOutput, error) {
+	claims := input.Claims
+	if _, err := s.sessionService.activeSession(ctx, claims); err != nil {
+		return nil, err
+	}
+
+	phone, err := s.reauthenticationPhone(ctx, claims)
 	if err != nil {
-		return nil, fmt.Errorf("token_generation_failed")
+		return nil, err
 	}
 
-	// Upsert project_users to track login count and last_login
-	if err := s.projectRepo.UpsertProjectUser(ctx, input.ProjectID, otp.EnvironmentID, user.ID, "email"); err != nil {
-		log.Warn().Err(err).Str("userId", user.ID).Str("projectId", input.ProjectID).Msg("failed to upsert project user")
+	verification := otpVerification{
+		ProjectID: claims.ProjectID,
+		Kind:      models.OTPKindCode,
+		UserID:    claims.UserID,
+		Email:     claims.Email,
+		Code:      input.Code,
+		EventType: "reauthentication",
+		IPAddress: input.IPAddress,
+		UserAgent: input.UserAgent,
+	}
+	method := AMROTP
+	if phone != "" {
+		verification.Kind = models.OTPKindSMS
+		verification.Phone = phone
+		method = AMRSMS
+	}
+	if _, err := s.consumeOTPCode(ctx, verification); err != nil {
+		return nil, err
 	}
 
-	s.logAuthEvent(ctx, input.ProjectID, user.ID, user.Email, "login", "SUCCESS", input.IPAddress, input.UserAgent, map[string]string{"provider": "email"})
+	tokens, err := s.sessionService.Reauthenticate(ctx, ReauthenticateSessionInput{
+		Claims:    claims,
+		Method:    method,
+		IPAddress: input.IPAddress,
+		UserAgent: input.UserAgent,
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	return &VerifyAuthOutput{
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
-		User: &UserInfo{
-			ID:    user.ID,
-			Email: user.Email,
-		},
+	return &VerifyReauthenticationOutput{
+		AccessToken: tokens.AccessToken,
+		ExpiresAt:   tokens.ExpiresAt,
 	}, nil
 }
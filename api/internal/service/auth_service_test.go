@@ -2,10 +2,18 @@ package service_test
 
 import (
 	"context"
+	"errors"
+	"net/url"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/marcioecom/permit/internal/config"
+	"github.com/marcioecom/permit/internal/crypto"
 	"github.com/marcioecom/permit/internal/models"
+	"github.com/marcioecom/permit/internal/repository"
 	"github.com/marcioecom/permit/internal/service"
 	"github.com/oklog/ulid/v2"
 )
@@ -45,32 +53,110 @@ func newMockOTPRepo() *mockOTPRepo {
 }
 
 func (m *mockOTPRepo) Create(ctx context.Context, otp *models.OTPCode) error {
-	m.codes[otp.Code] = otp
+	if otp.CreatedAt.IsZero() {
+		otp.CreatedAt = time.Now()
+	}
+	m.codes[otp.ID] = otp
 	return nil
 }
 
-func (m *mockOTPRepo) GetByProjectAndCode(ctx context.Context, projectID, code string) (*models.OTPCode, error) {
+func (m *mockOTPRepo) GetByID(ctx context.Context, id string) (*models.OTPCode, error) {
+	return m.codes[id], nil
+}
+
+func (m *mockOTPRepo) ListPendingByUser(ctx context.Context, projectID, userID, kind string) ([]*models.OTPCode, error) {
+	codes := []*models.OTPCode{}
 	for _, o := range m.codes {
-		if o.ProjectID == projectID && o.Code == code {
-			return o, nil
+		if o.ProjectID == projectID && o.UserID == userID && o.Kind == kind && o.UsedAt == nil {
+			codes = append(codes, o)
 		}
 	}
-	return nil, nil
+	return codes, nil
 }
 
 func (m *mockOTPRepo) MarkCodeAsUsed(ctx context.Context, id string) error {
+	o := m.codes[id]
+	if o == nil || o.UsedAt != nil {
+		return pgx.ErrNoRows
+	}
+	now := time.Now()
+	o.UsedAt = &now
+	return nil
+}
+
+func (m *mockOTPRepo) IncrementAttempts(ctx context.Context, projectID, userID, kind string) error {
 	for _, o := range m.codes {
-		if o.ID == id {
-			now := time.Now()
-			o.UsedAt = &now
+		if o.ProjectID == projectID && o.UserID == userID && o.Kind == kind && o.UsedAt == nil {
+			o.Attempts++
+		}
+	}
+	return nil
+}
+
+func (m *mockOTPRepo) CountCreatedSince(ctx context.Context, environmentID, userID, kind string, since time.Time) (int, error) {
+	count := 0
+	for _, o := range m.codes {
+		if o.EnvironmentID == environmentID && o.UserID == userID && o.Kind == kind && o.CreatedAt.After(since) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *mockOTPRepo) LastCreatedAt(ctx context.Context, environmentID, userID, kind string) (*time.Time, error) {
+	var last *time.Time
+	for _, o := range m.codes {
+		if o.EnvironmentID == environmentID && o.UserID == userID && o.Kind == kind && (last == nil || o.CreatedAt.After(*last)) {
+			last = &o.CreatedAt
+		}
+	}
+	return last, nil
+}
+
+func (m *mockOTPRepo) ExpirePending(ctx context.Context, environmentID, userID string, kinds []string, exceptID string) error {
+	for _, o := range m.codes {
+		if o.EnvironmentID == environmentID && o.UserID == userID && slices.Contains(kinds, o.Kind) && o.ID != exceptID && o.UsedAt == nil && o.ExpiresAt.After(time.Now()) {
+			o.ExpiresAt = time.Now()
 		}
 	}
 	return nil
 }
 
-type mockIdentityRepo struct{}
+// age moves every code's creation back, as if d had passed
+func (m *mockOTPRepo) age(d time.Duration) {
+	for _, o := range m.codes {
+		o.CreatedAt = o.CreatedAt.Add(-d)
+	}
+}
+
+func newTestCodeHasher(t *testing.T) *crypto.CodeHasher {
+	t.Helper()
+	hasher, err := crypto.NewEphemeralCodeHasher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hasher
+}
+
+// newTestOTPCode returns a pending code for a user, stored as its hash
+func newTestOTPCode(hasher *crypto.CodeHasher, userID, projectID, code string, expiresAt time.Time) *models.OTPCode {
+	otp := &models.OTPCode{
+		ID:        ulid.Make().String(),
+		UserID:    userID,
+		ProjectID: projectID,
+		Kind:      models.OTPKindCode,
+		ExpiresAt: expiresAt,
+	}
+	otp.CodeHash = hasher.Hash(otp.ID, code)
+	return otp
+}
+
+type mockIdentityRepo struct {
+	identities []*models.Identity
+}
 
 func (m *mockIdentityRepo) Create(ctx context.Context, identity *models.Identity) error {
+	m.identities = append(m.identities, identity)
 	return nil
 }
 
@@ -83,6 +169,20 @@ func (m *mockIdentityRepo) GetByProviderAndEmail(ctx context.Context, provider,
 }
 
 func (m *mockIdentityRepo) GetByUserAndProvider(ctx context.Context, userID, provider string) (*models.Identity, error) {
+	for _, i := range m.identities {
+		if i.UserID == userID && i.Provider == provider {
+			return i, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *mockIdentityRepo) GetByProviderUserID(ctx context.Context, provider, providerUserID string) (*models.Identity, error) {
+	for _, i := range m.identities {
+		if i.Provider == provider && i.ProviderUserID == providerUserID {
+			return i, nil
+		}
+	}
 	return nil, nil
 }
 
@@ -98,11 +198,29 @@ func newMockEmailService() *mockEmailService {
 	return &mockEmailService{sentEmails: make(map[string]string)}
 }
 
-func (m *mockEmailService) SendOTP(to, code, projectName string) error {
+func (m *mockEmailService) SendOTP(to, code, projectName string, expiresIn time.Duration) error {
 	m.sentEmails[to] = code
 	return nil
 }
 
+func (m *mockEmailService) SendMagicLink(to, link, code, projectName string, expiresIn time.Duration) error {
+	m.sentEmails[to] = link
+	return nil
+}
+
+type mockSMSService struct {
+	sent map[string]string
+}
+
+func newMockSMSService() *mockSMSService {
+	return &mockSMSService{sent: make(map[string]string)}
+}
+
+func (m *mockSMSService) SendOTP(to, code, projectName string, expiresIn time.Duration) error {
+	m.sent[to] = code
+	return nil
+}
+
 type mockJWTService struct{}
 
 func (m *mockJWTService) SignAccessToken(email, userID, projectID, environmentID, source string) (string, error) {
@@ -157,84 +275,715 @@ func TestCreateOTPCode_ExistingUser(t *testing.T) {
 }
 
 func TestVerifyOTPCode_ValidCode(t *testing.T) {
-	userID := ulid.Make().String()
+	user := &models.User{ID: ulid.Make().String(), Email: "test@example.com"}
 	projectID := ulid.Make().String()
+	hasher := newTestCodeHasher(t)
 
 	userRepo := newMockUserRepo()
-	userRepo.users[userID] = &models.User{
-		ID:    userID,
-		Email: "test@example.com",
+	userRepo.users[user.ID] = user
+	otpRepo := newMockOTPRepo()
+	stored := newTestOTPCode(hasher, user.ID, projectID, "123456", time.Now().Add(10*time.Minute))
+	stored.EnvironmentID = ulid.Make().String()
+	otpRepo.codes[stored.ID] = stored
+	if stored.CodeHash == "123456" {
+		t.Fatal("Expected the code to be stored as a hash")
 	}
 
-	otpRepo := newMockOTPRepo()
-	otpRepo.codes["123456"] = &models.OTPCode{
-		ID:        ulid.Make().String(),
-		UserID:    userID,
-		ProjectID: projectID,
+	jwtService := newTestJWTService(t)
+	cipher, err := crypto.NewEphemeralKeyCipher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	projectRepo := &mockProjectLookupRepo{}
+	refreshTokens := newMockRefreshTokenRepo()
+	sessionRepo := newMockSessionRepo(refreshTokens)
+	sessionService := newTestSessionService(jwtService, userRepo, refreshTokens, sessionRepo, projectRepo, &mockEnvRepo{})
+	mfaService := service.NewMFAService(cipher, hasher, sessionService, newMockMFARepo(), userRepo, &mockIdentityRepo{}, projectRepo, &mockEnvRepo{})
+	authService := service.NewAuthService(nil, jwtService, hasher, sessionService, mfaService, newMockEmailService(), newMockSMSService(), userRepo, otpRepo, newMockLoginAttemptRepo(), &mockOAuthRepo{}, &mockIdentityRepo{}, projectRepo, &mockEnvRepo{})
+
+	output, err := authService.VerifyOTPCode(context.Background(), service.VerifyAuthInput{
 		Code:      "123456",
-		ExpiresAt: time.Now().Add(10 * time.Minute),
+		Email:     user.Email,
+		ProjectID: projectID,
+	})
+	if err != nil {
+		t.Fatalf("VerifyOTPCode failed: %v", err)
+	}
+	if output.MFA != nil || output.AccessToken == "" || output.RefreshToken == "" {
+		t.Fatalf("Expected tokens, got %+v", output)
+	}
+	claims, err := jwtService.VerifyAccessToken(output.AccessToken)
+	if err != nil {
+		t.Fatalf("Expected a valid access token: %v", err)
+	}
+	if claims.UserID != user.ID || claims.ProjectID != projectID || sessionRepo.sessions[claims.SessionID] == nil {
+		t.Errorf("Unexpected access token claims: %+v", claims)
+	}
+	if stored.UsedAt == nil {
+		t.Error("Expected the code to be marked as used")
 	}
 
-	otp, err := otpRepo.GetByProjectAndCode(context.Background(), projectID, "123456")
-	if err != nil || otp == nil {
-		t.Error("Expected to find OTP code")
+	last := projectRepo.authLogs[len(projectRepo.authLogs)-1]
+	if last.EventType != "login" || last.Status != "SUCCESS" {
+		t.Errorf("Expected the login to be logged, got %s %s", last.EventType, last.Status)
+	}
+	if len(projectRepo.projectUsers) != 1 {
+		t.Errorf("Expected the project user to be counted once, got %d", len(projectRepo.projectUsers))
 	}
 
-	if otp.Code != "123456" {
-		t.Errorf("Expected code 123456, got %s", otp.Code)
+	if _, err := authService.VerifyOTPCode(context.Background(), service.VerifyAuthInput{
+		Code:      "123456",
+		Email:     user.Email,
+		ProjectID: projectID,
+	}); err == nil {
+		t.Error("Expected the code not to verify twice")
 	}
+}
 
-	t.Log("Valid OTP code found correctly")
+func newTestAuthService(t *testing.T, hasher *crypto.CodeHasher, userRepo *mockUserRepo, otpRepo *mockOTPRepo, projectRepo *mockProjectRepo) *service.AuthService {
+	t.Helper()
+	return service.NewAuthService(nil, nil, hasher, nil, nil, newMockEmailService(), newMockSMSService(), userRepo, otpRepo, newMockLoginAttemptRepo(), &mockOAuthRepo{}, &mockIdentityRepo{}, projectRepo, &mockEnvRepo{})
 }
 
 func TestVerifyOTPCode_ExpiredCode(t *testing.T) {
 	userID := ulid.Make().String()
 	projectID := ulid.Make().String()
+	hasher := newTestCodeHasher(t)
+
+	userRepo := newMockUserRepo()
+	userRepo.users[userID] = &models.User{ID: userID, Email: "test@example.com"}
 
 	otpRepo := newMockOTPRepo()
-	otpRepo.codes["expired"] = &models.OTPCode{
-		ID:        ulid.Make().String(),
-		UserID:    userID,
+	expired := newTestOTPCode(hasher, userID, projectID, "123456", time.Now().Add(-1*time.Minute))
+	otpRepo.codes[expired.ID] = expired
+
+	authService := newTestAuthService(t, hasher, userRepo, otpRepo, &mockProjectRepo{})
+	_, err := authService.VerifyOTPCode(context.Background(), service.VerifyAuthInput{
+		Code:      "123456",
+		Email:     "test@example.com",
 		ProjectID: projectID,
-		Code:      "expired",
-		ExpiresAt: time.Now().Add(-1 * time.Minute),
+	})
+	if err == nil || err.Error() != "code_expired" {
+		t.Errorf("Expected code_expired, got %v", err)
+	}
+}
+
+func TestVerifyOTPCode_AlreadyUsed(t *testing.T) {
+	userID := ulid.Make().String()
+	projectID := ulid.Make().String()
+	hasher := newTestCodeHasher(t)
+	usedAt := time.Now()
+
+	userRepo := newMockUserRepo()
+	userRepo.users[userID] = &models.User{ID: userID, Email: "test@example.com"}
+
+	otpRepo := newMockOTPRepo()
+	used := newTestOTPCode(hasher, userID, projectID, "123456", time.Now().Add(10*time.Minute))
+	used.UsedAt = &usedAt
+	otpRepo.codes[used.ID] = used
+
+	authService := newTestAuthService(t, hasher, userRepo, otpRepo, &mockProjectRepo{})
+	_, err := authService.VerifyOTPCode(context.Background(), service.VerifyAuthInput{
+		Code:        "123456",
+		ChallengeID: used.ID,
+		ProjectID:   projectID,
+	})
+	if err == nil || err.Error() != "code_already_used" {
+		t.Errorf("Expected code_already_used, got %v", err)
+	}
+}
+
+func TestVerifyOTPCode_BoundToEmail(t *testing.T) {
+	projectID := ulid.Make().String()
+	hasher := newTestCodeHasher(t)
+
+	userRepo := newMockUserRepo()
+	otpRepo := newMockOTPRepo()
+	var codes []*models.OTPCode
+	for _, email := range []string{"alice@example.com", "bob@example.com"} {
+		userID := ulid.Make().String()
+		userRepo.users[userID] = &models.User{ID: userID, Email: email}
+		otp := newTestOTPCode(hasher, userID, projectID, "123456", time.Now().Add(10*time.Minute))
+		otpRepo.codes[otp.ID] = otp
+		codes = append(codes, otp)
+	}
+
+	authService := newTestAuthService(t, hasher, userRepo, otpRepo, &mockProjectRepo{})
+
+	// Bob's code doesn't work with a challenge issued to Alice
+	_, err := authService.VerifyOTPCode(context.Background(), service.VerifyAuthInput{
+		Code:        "123456",
+		Email:       "bob@example.com",
+		ChallengeID: codes[0].ID,
+		ProjectID:   projectID,
+	})
+	if err == nil || err.Error() != "invalid_code" {
+		t.Errorf("Expected invalid_code for a mismatched challenge, got %v", err)
 	}
 
-	otp, _ := otpRepo.GetByProjectAndCode(context.Background(), projectID, "expired")
-	if otp == nil {
-		t.Error("Expected to find expired OTP")
+	_, err = authService.VerifyOTPCode(context.Background(), service.VerifyAuthInput{
+		Code:      "123456",
+		ProjectID: projectID,
+	})
+	if err == nil || err.Error() != "challenge_required" {
+		t.Errorf("Expected challenge_required without an email or challenge, got %v", err)
 	}
 
-	if time.Now().Before(otp.ExpiresAt) {
-		t.Error("Expected OTP to be expired")
+	for _, otp := range codes {
+		if otp.UsedAt != nil {
+			t.Error("Expected no code to be consumed")
+		}
 	}
+}
 
-	t.Log("Expired OTP detected correctly")
+type mockProjectRepo struct {
+	repository.ProjectRepository
+	authLogs     []*models.AuthLog
+	projectUsers []string
 }
 
-func TestVerifyOTPCode_AlreadyUsed(t *testing.T) {
+func (m *mockProjectRepo) InsertAuthLog(ctx context.Context, authLog *models.AuthLog) error {
+	m.authLogs = append(m.authLogs, authLog)
+	return nil
+}
+
+func (m *mockProjectRepo) UpsertProjectUser(ctx context.Context, projectID, environmentID, userID, provider string) error {
+	m.projectUsers = append(m.projectUsers, userID)
+	return nil
+}
+
+type mockOAuthRepo struct {
+	repository.OAuthRepository
+	authCodes []*models.OAuthAuthorizationCode
+}
+
+func (m *mockOAuthRepo) CreateAuthorizationCode(ctx context.Context, code *models.OAuthAuthorizationCode) error {
+	m.authCodes = append(m.authCodes, code)
+	return nil
+}
+
+func (m *mockOAuthRepo) GetAndUseAuthorizationCode(ctx context.Context, code string) (*models.OAuthAuthorizationCode, error) {
+	for _, c := range m.authCodes {
+		if c.Code == code && c.UsedAt == nil && time.Now().Before(c.ExpiresAt) {
+			now := time.Now()
+			c.UsedAt = &now
+			return c, nil
+		}
+	}
+	return nil, pgx.ErrNoRows
+}
+
+type mockLoginAttemptRepo struct {
+	attempts map[string]*models.LoginAttempt
+}
+
+func newMockLoginAttemptRepo() *mockLoginAttemptRepo {
+	return &mockLoginAttemptRepo{attempts: make(map[string]*models.LoginAttempt)}
+}
+
+func (m *mockLoginAttemptRepo) Get(ctx context.Context, projectID, subject string) (*models.LoginAttempt, error) {
+	return m.attempts[projectID+subject], nil
+}
+
+func (m *mockLoginAttemptRepo) RecordFailure(ctx context.Context, projectID, subject string, resetAfter time.Duration) (*models.LoginAttempt, error) {
+	attempt := m.attempts[projectID+subject]
+	if attempt == nil {
+		attempt = &models.LoginAttempt{ProjectID: projectID, Subject: subject}
+		m.attempts[projectID+subject] = attempt
+	}
+	attempt.Failures++
+	return attempt, nil
+}
+
+func (m *mockLoginAttemptRepo) Lock(ctx context.Context, projectID, subject string, until time.Time) error {
+	attempt := m.attempts[projectID+subject]
+	attempt.LockedUntil = &until
+	attempt.Lockouts++
+	return nil
+}
+
+func (m *mockLoginAttemptRepo) Reset(ctx context.Context, projectID, subject string) error {
+	delete(m.attempts, projectID+subject)
+	return nil
+}
+
+func TestVerifyOTPCode_LocksOutAfterFailedAttempts(t *testing.T) {
 	userID := ulid.Make().String()
 	projectID := ulid.Make().String()
-	usedAt := time.Now()
 
+	userRepo := newMockUserRepo()
+	userRepo.users[userID] = &models.User{ID: userID, Email: "test@example.com"}
+
+	hasher := newTestCodeHasher(t)
 	otpRepo := newMockOTPRepo()
-	otpRepo.codes["used"] = &models.OTPCode{
-		ID:        ulid.Make().String(),
-		UserID:    userID,
-		ProjectID: projectID,
-		Code:      "used",
-		ExpiresAt: time.Now().Add(10 * time.Minute),
-		UsedAt:    &usedAt,
+	otp := newTestOTPCode(hasher, userID, projectID, "123456", time.Now().Add(10*time.Minute))
+	otpRepo.codes[otp.ID] = otp
+
+	projectRepo := &mockProjectRepo{}
+	authService := newTestAuthService(t, hasher, userRepo, otpRepo, projectRepo)
+
+	verify := func(code string) error {
+		_, err := authService.VerifyOTPCode(context.Background(), service.VerifyAuthInput{
+			Code:      code,
+			Email:     "test@example.com",
+			ProjectID: projectID,
+			IPAddress: "203.0.113.7:51234",
+		})
+		return err
+	}
+
+	for i := 1; i < 5; i++ {
+		if err := verify("000000"); err == nil || err.Error() != "invalid_code" {
+			t.Fatalf("attempt %d: expected invalid_code, got %v", i, err)
+		}
+	}
+	if err := verify("000000"); err == nil || err.Error() != "too_many_attempts" {
+		t.Fatalf("expected the fifth wrong guess to lock the email out, got %v", err)
+	}
+	if attempts := otp.Attempts; attempts != 5 {
+		t.Errorf("expected 5 attempts counted against the pending code, got %d", attempts)
+	}
+
+	if err := verify("123456"); err == nil || err.Error() != "too_many_attempts" {
+		t.Errorf("expected the right code to be refused while locked out, got %v", err)
+	}
+	if otp.UsedAt != nil {
+		t.Error("expected the code to stay unused")
+	}
+
+	last := projectRepo.authLogs[len(projectRepo.authLogs)-1]
+	if last.Status != "TOO_MANY_ATTEMPTS" {
+		t.Errorf("expected lockout to be logged, got %s", last.Status)
+	}
+}
+
+func TestRedeemMagicLink_SingleUse(t *testing.T) {
+	userID := ulid.Make().String()
+	projectID := ulid.Make().String()
+	hasher := newTestCodeHasher(t)
+
+	userRepo := newMockUserRepo()
+	userRepo.users[userID] = &models.User{ID: userID, Email: "test@example.com"}
+
+	otpRepo := newMockOTPRepo()
+	link := newTestOTPCode(hasher, userID, projectID, "link-secret", time.Now().Add(10*time.Minute))
+	link.Kind = models.OTPKindMagicLink
+	link.EnvironmentID = ulid.Make().String()
+	link.RedirectURL = "https://app.example.com/sso-callback"
+	otpRepo.codes[link.ID] = link
+
+	oauthRepo := &mockOAuthRepo{}
+	authService := service.NewAuthService(nil, nil, hasher, nil, nil, newMockEmailService(), newMockSMSService(), userRepo, otpRepo, newMockLoginAttemptRepo(), oauthRepo, &mockIdentityRepo{}, &mockProjectRepo{}, nil)
+	redeem := func(token string) (*service.RedeemMagicLinkOutput, error) {
+		return authService.RedeemMagicLink(context.Background(), service.RedeemMagicLinkInput{Token: token})
+	}
+
+	if _, err := redeem(link.ID + ".wrong-secret"); err == nil || err.Error() != "invalid_link" {
+		t.Errorf("Expected invalid_link for a wrong secret, got %v", err)
+	}
+
+	// A magic link can't be verified as a code
+	if _, err := authService.VerifyOTPCode(context.Background(), service.VerifyAuthInput{
+		Code:        "link-secret",
+		ChallengeID: link.ID,
+		ProjectID:   projectID,
+	}); err == nil {
+		t.Error("Expected a magic link to be refused as an OTP challenge")
+	}
+
+	output, err := redeem(link.ID + ".link-secret")
+	if err != nil {
+		t.Fatalf("Expected link to redeem: %v", err)
+	}
+	if len(oauthRepo.authCodes) != 1 {
+		t.Fatalf("Expected one authorization code, got %d", len(oauthRepo.authCodes))
+	}
+	authCode := oauthRepo.authCodes[0]
+	if authCode.EnvironmentID != link.EnvironmentID || authCode.Provider != models.ProviderEmail {
+		t.Errorf("Unexpected authorization code: %+v", authCode)
+	}
+	if want := link.RedirectURL + "?code=" + url.QueryEscape(authCode.Code); output.RedirectURL != want {
+		t.Errorf("Expected redirect to %s, got %s", want, output.RedirectURL)
+	}
+
+	if _, err := redeem(link.ID + ".link-secret"); err == nil || err.Error() != "link_already_used" {
+		t.Errorf("Expected link_already_used on reuse, got %v", err)
+	}
+}
+
+func TestRedeemMagicLink_OneSignInPerEmail(t *testing.T) {
+	user := &models.User{ID: ulid.Make().String(), Email: "test@example.com"}
+	projectID := ulid.Make().String()
+	envID := ulid.Make().String()
+	hasher := newTestCodeHasher(t)
+
+	userRepo := newMockUserRepo()
+	userRepo.users[user.ID] = user
+	otpRepo := newMockOTPRepo()
+	jwtService := newTestJWTService(t)
+	cipher, err := crypto.NewEphemeralKeyCipher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	projectRepo := &mockProjectLookupRepo{}
+	refreshTokens := newMockRefreshTokenRepo()
+	sessionService := newTestSessionService(jwtService, userRepo, refreshTokens, newMockSessionRepo(refreshTokens), projectRepo, &mockEnvRepo{})
+	mfaService := service.NewMFAService(cipher, hasher, sessionService, newMockMFARepo(), userRepo, &mockIdentityRepo{}, projectRepo, &mockEnvRepo{})
+	authService := service.NewAuthService(nil, jwtService, hasher, sessionService, mfaService, newMockEmailService(), newMockSMSService(), userRepo, otpRepo, newMockLoginAttemptRepo(), &mockOAuthRepo{}, &mockIdentityRepo{}, projectRepo, &mockEnvRepo{})
+	ctx := context.Background()
+
+	// email stores a code and the magic link sent along with it
+	email := func() (*models.OTPCode, *models.OTPCode) {
+		code := newTestOTPCode(hasher, user.ID, projectID, "123456", time.Now().Add(10*time.Minute))
+		code.EnvironmentID = envID
+		link := newTestOTPCode(hasher, user.ID, projectID, "link-secret", time.Now().Add(10*time.Minute))
+		link.Kind = models.OTPKindMagicLink
+		link.EnvironmentID = envID
+		link.RedirectURL = "https://app.example.com/sso-callback"
+		otpRepo.codes[code.ID] = code
+		otpRepo.codes[link.ID] = link
+		return code, link
+	}
+	verify := func(code *models.OTPCode) error {
+		_, err := authService.VerifyOTPCode(ctx, service.VerifyAuthInput{Code: "123456", ChallengeID: code.ID, ProjectID: projectID})
+		return err
+	}
+	redeem := func(link *models.OTPCode) error {
+		_, err := authService.RedeemMagicLink(ctx, service.RedeemMagicLinkInput{Token: link.ID + ".link-secret"})
+		return err
+	}
+
+	code, link := email()
+	if err := redeem(link); err != nil {
+		t.Fatalf("RedeemMagicLink failed: %v", err)
+	}
+	if err := verify(code); err == nil || err.Error() != "code_expired" {
+		t.Errorf("Expected the code to expire once its link is used, got %v", err)
+	}
+
+	code, link = email()
+	if err := verify(code); err != nil {
+		t.Fatalf("VerifyOTPCode failed: %v", err)
+	}
+	if err := redeem(link); err == nil || err.Error() != "link_expired" {
+		t.Errorf("Expected the link to expire once its code is used, got %v", err)
+	}
+}
+
+type mockEnvRepo struct {
+	repository.EnvironmentRepository
+	env *models.Environment
+}
+
+func (m *mockEnvRepo) GetDefaultForProject(ctx context.Context, projectID string) (*models.Environment, error) {
+	return m.env, nil
+}
+
+func (m *mockEnvRepo) GetByID(ctx context.Context, id string) (*models.Environment, error) {
+	if m.env != nil && m.env.ID == id {
+		return m.env, nil
+	}
+	return &models.Environment{ID: id}, nil
+}
+
+func (m *mockEnvRepo) List(ctx context.Context) ([]*models.Environment, error) {
+	if m.env == nil {
+		return nil, nil
+	}
+	return []*models.Environment{m.env}, nil
+}
+
+func (m *mockEnvRepo) Update(ctx context.Context, env *models.Environment) error {
+	m.env = env
+	return nil
+}
+
+type mockProjectLookupRepo struct {
+	mockProjectRepo
+	project *models.Project
+}
+
+func (m *mockProjectLookupRepo) GetByID(ctx context.Context, id string) (*models.Project, error) {
+	return m.project, nil
+}
+
+func TestCreateOTPCode_MagicLinkOrigin(t *testing.T) {
+	project := &models.Project{ID: ulid.Make().String(), Name: "Acme"}
+	env := &models.Environment{
+		ID:             ulid.Make().String(),
+		ProjectID:      project.ID,
+		Type:           models.EnvTypeProduction,
+		AllowedOrigins: []string{"*.example.com"},
+	}
+
+	otpRepo := newMockOTPRepo()
+	emailService := newMockEmailService()
+	authService := service.NewAuthService(&config.Config{PublicURL: "https://auth.example.com"}, nil, newTestCodeHasher(t), nil, nil, emailService, newMockSMSService(), newMockUserRepo(), otpRepo, newMockLoginAttemptRepo(), &mockOAuthRepo{}, &mockIdentityRepo{}, &mockProjectLookupRepo{project: project}, &mockEnvRepo{env: env})
+
+	start := func(origin, redirectURL string) error {
+		_, err := authService.CreateOTPCode(context.Background(), service.CreateAuthInput{
+			Email:        "test@example.com",
+			ProjectID:    project.ID,
+			MagicLink:    true,
+			RedirectURL:  redirectURL,
+			ClientOrigin: origin,
+		})
+		return err
+	}
+
+	if err := start("https://evil.test", "/sso-callback"); err == nil || err.Error() != "origin_not_allowed" {
+		t.Errorf("Expected origin_not_allowed, got %v", err)
+	}
+	if err := start("https://app.example.com", "@evil.test/sso-callback"); err == nil || err.Error() != "invalid_redirect_url" {
+		t.Errorf("Expected invalid_redirect_url for a path that changes the host, got %v", err)
+	}
+	if len(otpRepo.codes) != 0 {
+		t.Errorf("Expected nothing to be stored for a refused origin, got %d", len(otpRepo.codes))
+	}
+
+	if err := start("https://app.example.com", "/sso-callback"); err != nil {
+		t.Fatalf("Expected magic link to be sent: %v", err)
+	}
+	var link *models.OTPCode
+	for _, o := range otpRepo.codes {
+		if o.Kind == models.OTPKindMagicLink {
+			link = o
+		}
+	}
+	if link == nil || link.RedirectURL != "https://app.example.com/sso-callback" {
+		t.Fatalf("Expected a magic link for the callback, got %+v", link)
+	}
+	if sent := emailService.sentEmails["test@example.com"]; !strings.HasPrefix(sent, "https://auth.example.com/api/v1/auth/magic-link?token="+link.ID+".") {
+		t.Errorf("Expected the emailed link to carry the token, got %s", sent)
+	}
+}
+
+func TestVerifySMSCode_BoundToPhone(t *testing.T) {
+	project := &models.Project{ID: ulid.Make().String(), Name: "Acme"}
+	env := &models.Environment{ID: ulid.Make().String(), ProjectID: project.ID}
+
+	userRepo := newMockUserRepo()
+	otpRepo := newMockOTPRepo()
+	identityRepo := &mockIdentityRepo{}
+	smsService := newMockSMSService()
+	hasher := newTestCodeHasher(t)
+	authService := service.NewAuthService(nil, nil, hasher, nil, nil, newMockEmailService(), smsService, userRepo, otpRepo, newMockLoginAttemptRepo(), &mockOAuthRepo{}, identityRepo, &mockProjectLookupRepo{project: project}, &mockEnvRepo{env: env})
+	ctx := context.Background()
+
+	if _, err := authService.CreateSMSCode(ctx, service.CreateSMSCodeInput{Phone: "11 98765-4321", ProjectID: project.ID}); err == nil || err.Error() != "invalid_phone_number" {
+		t.Errorf("Expected invalid_phone_number without a country code, got %v", err)
+	}
+
+	output, err := authService.CreateSMSCode(ctx, service.CreateSMSCodeInput{Phone: "+55 (11) 98765-4321", ProjectID: project.ID})
+	if err != nil {
+		t.Fatalf("Expected code to be sent: %v", err)
+	}
+	code, ok := smsService.sent["+5511987654321"]
+	if !ok {
+		t.Fatalf("Expected the code to be texted to the E.164 number, got %v", smsService.sent)
+	}
+	identity, _ := identityRepo.GetByProviderUserID(ctx, models.ProviderPhone, "+5511987654321")
+	if identity == nil {
+		t.Fatal("Expected a phone identity for the new user")
+	}
+
+	// Texting the same number again reuses the user
+	otpRepo.age(time.Minute)
+	if _, err := authService.CreateSMSCode(ctx, service.CreateSMSCodeInput{Phone: "005511987654321", ProjectID: project.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if len(userRepo.users) != 1 || len(identityRepo.identities) != 1 {
+		t.Errorf("Expected one user and identity, got %d and %d", len(userRepo.users), len(identityRepo.identities))
+	}
+
+	_, err = authService.VerifySMSCode(ctx, service.VerifySMSCodeInput{
+		Code:        code,
+		Phone:       "+14155550123",
+		ChallengeID: output.ChallengeID,
+		ProjectID:   project.ID,
+	})
+	if err == nil || err.Error() != "invalid_code" {
+		t.Errorf("Expected invalid_code for a challenge sent to another number, got %v", err)
+	}
+
+	// An SMS code isn't accepted as an email code
+	_, err = authService.VerifyOTPCode(ctx, service.VerifyAuthInput{
+		Code:        code,
+		ChallengeID: output.ChallengeID,
+		ProjectID:   project.ID,
+	})
+	if err == nil || err.Error() != "invalid_code" {
+		t.Errorf("Expected invalid_code for an SMS challenge on the email endpoint, got %v", err)
+	}
+
+	if otp := otpRepo.codes[output.ChallengeID]; otp.UsedAt != nil || otp.Kind != models.OTPKindSMS {
+		t.Errorf("Expected an unused SMS code, got %+v", otp)
+	}
+}
+
+func TestCreateOTPCode_EnvironmentPolicy(t *testing.T) {
+	project := &models.Project{ID: ulid.Make().String(), Name: "Acme"}
+	env := &models.Environment{
+		ID:            ulid.Make().String(),
+		ProjectID:     project.ID,
+		OTPLength:     8,
+		OTPAlphabet:   models.OTPAlphabetAlphanumeric,
+		OTPTTL:        120,
+		OTPMaxResends: 1,
+	}
+
+	userRepo := newMockUserRepo()
+	otpRepo := newMockOTPRepo()
+	emailService := newMockEmailService()
+	authService := service.NewAuthService(nil, nil, newTestCodeHasher(t), nil, nil, emailService, newMockSMSService(), userRepo, otpRepo, newMockLoginAttemptRepo(), &mockOAuthRepo{}, &mockIdentityRepo{}, &mockProjectLookupRepo{project: project}, &mockEnvRepo{env: env})
+	ctx := context.Background()
+	start := func() (*service.CreateAuthOutput, error) {
+		return authService.CreateOTPCode(ctx, service.CreateAuthInput{Email: "test@example.com", ProjectID: project.ID})
+	}
+
+	output, err := start()
+	if err != nil {
+		t.Fatalf("Expected code to be sent: %v", err)
+	}
+	if output.CodeLength != 8 || output.CodeAlphabet != models.OTPAlphabetAlphanumeric {
+		t.Errorf("Expected the response to describe the policy, got %+v", output)
+	}
+	if ttl := time.Until(output.ExpiresAt); ttl > 2*time.Minute || ttl < time.Minute {
+		t.Errorf("Expected the code to expire in 2 minutes, got %s", ttl)
 	}
 
-	otp, _ := otpRepo.GetByProjectAndCode(context.Background(), projectID, "used")
-	if otp == nil {
-		t.Error("Expected to find used OTP")
+	// One resend is allowed within the code's lifetime
+	otpRepo.age(time.Minute / 2)
+	if output, err = start(); err != nil {
+		t.Fatalf("Expected a resend to be allowed: %v", err)
 	}
+	otpRepo.age(time.Minute / 2)
+	if _, err := start(); err == nil || err.Error() != "too_many_resends" {
+		t.Errorf("Expected too_many_resends, got %v", err)
+	}
+
+	code := emailService.sentEmails["test@example.com"]
+	if len(code) != 8 || strings.ToUpper(code) != code {
+		t.Fatalf("Expected an 8 character uppercase code, got %q", code)
+	}
+
+	verify := func(code string) error {
+		_, err := authService.VerifyOTPCode(ctx, service.VerifyAuthInput{Code: code, ChallengeID: output.ChallengeID, ProjectID: project.ID})
+		return err
+	}
+	if err := verify("123456"); err == nil || err.Error() != "invalid_code_format" {
+		t.Errorf("Expected invalid_code_format for a 6 digit code, got %v", err)
+	}
+	if otp := otpRepo.codes[output.ChallengeID]; otp.Attempts != 0 {
+		t.Errorf("Expected a malformed code not to count as an attempt, got %d", otp.Attempts)
+	}
+
+	// Codes match case-insensitively; expiring it first shows the match
+	// without issuing tokens
+	otpRepo.codes[output.ChallengeID].ExpiresAt = time.Now().Add(-time.Second)
+	if err := verify(strings.ToLower(code)); err == nil || err.Error() != "code_expired" {
+		t.Errorf("Expected a lowercase code to match, got %v", err)
+	}
+}
+
+func TestCreateOTPCode_SupersedesPendingCodes(t *testing.T) {
+	project := &models.Project{ID: ulid.Make().String(), Name: "Acme"}
+	env := &models.Environment{ID: ulid.Make().String(), ProjectID: project.ID}
+
+	otpRepo := newMockOTPRepo()
+	emailService := newMockEmailService()
+	authService := service.NewAuthService(nil, nil, newTestCodeHasher(t), nil, nil, emailService, newMockSMSService(), newMockUserRepo(), otpRepo, newMockLoginAttemptRepo(), &mockOAuthRepo{}, &mockIdentityRepo{}, &mockProjectLookupRepo{project: project}, &mockEnvRepo{env: env})
+	ctx := context.Background()
+	start := func() (*service.CreateAuthOutput, error) {
+		return authService.CreateOTPCode(ctx, service.CreateAuthInput{Email: "test@example.com", ProjectID: project.ID})
+	}
+
+	first, err := start()
+	if err != nil {
+		t.Fatalf("Expected code to be sent: %v", err)
+	}
+	if wait := time.Until(first.ResendAfter); wait <= 0 || wait > time.Minute {
+		t.Errorf("Expected a resend cooldown, got resendAfter in %s", wait)
+	}
+	firstCode := emailService.sentEmails["test@example.com"]
 
-	if otp.UsedAt == nil {
-		t.Error("Expected OTP to be marked as used")
+	_, err = start()
+	var cooldown *service.ResendCooldownError
+	if !errors.As(err, &cooldown) || !cooldown.RetryAt.After(time.Now()) {
+		t.Fatalf("Expected resend_cooldown, got %v", err)
+	}
+	if len(otpRepo.codes) != 1 {
+		t.Errorf("Expected no code to be stored during the cooldown, got %d", len(otpRepo.codes))
+	}
+
+	otpRepo.age(time.Minute)
+	second, err := start()
+	if err != nil {
+		t.Fatalf("Expected a resend after the cooldown: %v", err)
+	}
+	if otpRepo.codes[second.ChallengeID].ExpiresAt.Before(time.Now()) {
+		t.Error("Expected the new code to be pending")
+	}
+
+	// The first code no longer signs in, even with its own challenge
+	_, err = authService.VerifyOTPCode(ctx, service.VerifyAuthInput{Code: firstCode, ChallengeID: first.ChallengeID, ProjectID: project.ID})
+	if err == nil || err.Error() != "code_expired" {
+		t.Errorf("Expected code_expired for a superseded code, got %v", err)
+	}
+}
+
+func TestStartReauthentication_TextsPhoneSessions(t *testing.T) {
+	project := &models.Project{ID: ulid.Make().String(), Name: "Acme"}
+	env := &models.Environment{ID: ulid.Make().String(), ProjectID: project.ID}
+	user := &models.User{ID: ulid.Make().String()}
+	session := &models.Session{
+		ID:            ulid.Make().String(),
+		UserID:        user.ID,
+		ProjectID:     project.ID,
+		EnvironmentID: env.ID,
+		Provider:      models.ProviderPhone,
+		AuthTime:      time.Now().Add(-time.Hour),
+		ExpiresAt:     time.Now().Add(time.Hour),
 	}
 
-	t.Log("Already used OTP detected correctly")
+	userRepo := newMockUserRepo()
+	userRepo.users[user.ID] = user
+	sessionRepo := newMockSessionRepo(nil)
+	sessionRepo.sessions[session.ID] = session
+	identityRepo := &mockIdentityRepo{identities: []*models.Identity{
+		{ID: ulid.Make().String(), UserID: user.ID, Provider: models.ProviderPhone, ProviderUserID: "+5511987654321"},
+	}}
+	otpRepo := newMockOTPRepo()
+	emailService := newMockEmailService()
+	smsService := newMockSMSService()
+	projectRepo := &mockProjectLookupRepo{project: project}
+	sessionService := service.NewSessionService(nil, userRepo, nil, sessionRepo, nil, projectRepo, &mockEnvRepo{env: env}, identityRepo, nil)
+	authService := service.NewAuthService(nil, nil, newTestCodeHasher(t), sessionService, nil, emailService, smsService, userRepo, otpRepo, newMockLoginAttemptRepo(), &mockOAuthRepo{}, identityRepo, projectRepo, &mockEnvRepo{env: env})
+
+	output, err := authService.StartReauthentication(context.Background(), service.StartReauthenticationInput{
+		Claims: &crypto.AccessTokenClaims{
+			UserID:        user.ID,
+			ProjectID:     project.ID,
+			EnvironmentID: env.ID,
+			SessionID:     session.ID,
+			Provider:      models.ProviderPhone,
+		},
+	})
+	if err != nil {
+		t.Fatalf("StartReauthentication failed: %v", err)
+	}
+	if !output.Required {
+		t.Error("Expected re-authentication to be required")
+	}
+	if _, ok := smsService.sent["+5511987654321"]; !ok {
+		t.Errorf("Expected the code to be texted to the session's phone, got %v", smsService.sent)
+	}
+	if len(emailService.sentEmails) != 0 {
+		t.Errorf("Expected no email, got %v", emailService.sentEmails)
+	}
+	for _, otp := range otpRepo.codes {
+		if otp.Kind != models.OTPKindSMS {
+			t.Errorf("Expected an SMS code, got %s", otp.Kind)
+		}
+	}
 }
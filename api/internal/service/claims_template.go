@@ -0,0 +1,171 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/marcioecom/permit/internal/crypto"
+)
+
+// maxClaimsTemplateSize keeps templated claims from bloating every token
+const maxClaimsTemplateSize = 4096
+
+// claimsPlaceholder matches a {{path}} reference such as {{user.metadata.role}}
+var claimsPlaceholder = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}`)
+
+// claimsTemplateRoots are the data a template can reference
+var claimsTemplateRoots = []string{"user", "identity", "project", "environment"}
+
+// ClaimsTemplateData is what a claims template is rendered from
+type ClaimsTemplateData struct {
+	User        map[string]any
+	Identity    map[string]any
+	Project     map[string]any
+	Environment map[string]any
+}
+
+func (d ClaimsTemplateData) root(name string) map[string]any {
+	switch name {
+	case "user":
+		return d.User
+	case "identity":
+		return d.Identity
+	case "project":
+		return d.Project
+	case "environment":
+		return d.Environment
+	default:
+		return nil
+	}
+}
+
+// lookup resolves a dotted path such as user.metadata.role
+func (d ClaimsTemplateData) lookup(path string) (any, bool) {
+	parts := strings.Split(path, ".")
+	var value any = d.root(parts[0])
+	for _, part := range parts[1:] {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[part]; !ok {
+			return nil, false
+		}
+	}
+	return value, value != nil
+}
+
+// ValidateClaimsTemplate checks that a claims template is a JSON object that
+// leaves the reserved claims alone and only references known data.
+func ValidateClaimsTemplate(template json.RawMessage) error {
+	if len(template) > maxClaimsTemplateSize {
+		return fmt.Errorf("claims_template_too_large")
+	}
+
+	var claims map[string]any
+	if err := json.Unmarshal(template, &claims); err != nil || claims == nil {
+		return fmt.Errorf("invalid_claims_template")
+	}
+
+	for name := range claims {
+		if crypto.IsReservedClaim(name) {
+			return fmt.Errorf("reserved_claim")
+		}
+	}
+
+	for _, match := range claimsPlaceholder.FindAllSubmatch(template, -1) {
+		root, _, _ := strings.Cut(string(match[1]), ".")
+		if !isClaimsTemplateRoot(root) {
+			return fmt.Errorf("invalid_claims_template")
+		}
+	}
+	return nil
+}
+
+func isClaimsTemplateRoot(name string) bool {
+	for _, root := range claimsTemplateRoots {
+		if name == root {
+			return true
+		}
+	}
+	return false
+}
+
+// RenderClaimsTemplate renders a claims template into custom claims. A string
+// made of a single placeholder takes the referenced value as is, so arrays
+// and numbers keep their type, and is left out when the value is missing.
+// Placeholders inside longer strings are interpolated.
+func RenderClaimsTemplate(template json.RawMessage, data ClaimsTemplateData) (map[string]any, error) {
+	if len(bytes.TrimSpace(template)) == 0 {
+		return nil, nil
+	}
+
+	var claims map[string]any
+	if err := json.Unmarshal(template, &claims); err != nil {
+		return nil, fmt.Errorf("invalid_claims_template")
+	}
+
+	rendered := make(map[string]any, len(claims))
+	for name, value := range claims {
+		if crypto.IsReservedClaim(name) {
+			continue
+		}
+		if value, ok := renderClaimValue(value, data); ok {
+			rendered[name] = value
+		}
+	}
+	if len(rendered) == 0 {
+		return nil, nil
+	}
+	return rendered, nil
+}
+
+func renderClaimValue(value any, data ClaimsTemplateData) (any, bool) {
+	switch v := value.(type) {
+	case string:
+		return renderClaimString(v, data)
+	case map[string]any:
+		object := make(map[string]any, len(v))
+		for name, item := range v {
+			if item, ok := renderClaimValue(item, data); ok {
+				object[name] = item
+			}
+		}
+		return object, true
+	case []any:
+		list := make([]any, 0, len(v))
+		for _, item := range v {
+			if item, ok := renderClaimValue(item, data); ok {
+				list = append(list, item)
+			}
+		}
+		return list, true
+	default:
+		return v, true
+	}
+}
+
+func renderClaimString(s string, data ClaimsTemplateData) (any, bool) {
+	if match := claimsPlaceholder.FindStringSubmatchIndex(s); match != nil && match[0] == 0 && match[1] == len(s) {
+		return data.lookup(s[match[2]:match[3]])
+	}
+
+	return claimsPlaceholder.ReplaceAllStringFunc(s, func(placeholder string) string {
+		path := claimsPlaceholder.FindStringSubmatch(placeholder)[1]
+		value, ok := data.lookup(path)
+		if !ok {
+			return ""
+		}
+		if str, isString := value.(string); isString {
+			return str
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return ""
+		}
+		return string(encoded)
+	}), true
+}
@@ -0,0 +1,82 @@
+package service_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/marcioecom/permit/internal/service"
+)
+
+func TestValidateClaimsTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		wantErr  string
+	}{
+		{name: "metadata reference", template: `{"role": "{{user.metadata.role}}"}`},
+		{name: "empty", template: `{}`},
+		{name: "reserved sub", template: `{"sub": "{{user.id}}"}`, wantErr: "reserved_claim"},
+		{name: "reserved exp", template: `{"exp": 0}`, wantErr: "reserved_claim"},
+		{name: "reserved act", template: `{"act": "{{user.id}}"}`, wantErr: "reserved_claim"},
+		{name: "not an object", template: `["role"]`, wantErr: "invalid_claims_template"},
+		{name: "unknown root", template: `{"role": "{{session.id}}"}`, wantErr: "invalid_claims_template"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := service.ValidateClaimsTemplate(json.RawMessage(tt.template))
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("expected template to be valid, got %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("expected %s, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestRenderClaimsTemplate(t *testing.T) {
+	template := json.RawMessage(`{
+		"role": "{{user.metadata.role}}",
+		"groups": "{{user.metadata.groups}}",
+		"tenant": "tenant-{{user.metadata.tenant}}",
+		"missing": "{{user.metadata.missing}}",
+		"sub": "{{user.id}}",
+		"org": {"provider": "{{identity.provider}}"}
+	}`)
+	data := service.ClaimsTemplateData{
+		User: map[string]any{
+			"id": "user-1",
+			"metadata": map[string]any{
+				"role":   "admin",
+				"groups": []any{"a", "b"},
+				"tenant": float64(42),
+			},
+		},
+		Identity: map[string]any{"provider": "google"},
+	}
+
+	claims, err := service.RenderClaimsTemplate(template, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims["role"] != "admin" {
+		t.Errorf("expected role admin, got %v", claims["role"])
+	}
+	if groups, ok := claims["groups"].([]any); !ok || len(groups) != 2 {
+		t.Errorf("expected groups to keep their array type, got %v", claims["groups"])
+	}
+	if claims["tenant"] != "tenant-42" {
+		t.Errorf("expected tenant-42, got %v", claims["tenant"])
+	}
+	if _, ok := claims["missing"]; ok {
+		t.Error("expected claim referencing missing data to be left out")
+	}
+	if _, ok := claims["sub"]; ok {
+		t.Error("expected reserved claim to be dropped")
+	}
+	if org, ok := claims["org"].(map[string]any); !ok || org["provider"] != "google" {
+		t.Errorf("expected nested claim to render, got %v", claims["org"])
+	}
+}
@@ -3,7 +3,10 @@ package service
 import (
 	"context"
 	"fmt"
+	"net/url"
+	"time"
 
+	"github.com/marcioecom/permit/internal/crypto"
 	"github.com/marcioecom/permit/internal/models"
 	"github.com/marcioecom/permit/internal/repository"
 	"github.com/oklog/ulid/v2"
@@ -12,17 +15,20 @@ import (
 type EnvironmentService struct {
 	envRepo     repository.EnvironmentRepository
 	oauthRepo   repository.OAuthRepository
+	oidcRepo    repository.OIDCRepository
 	projectRepo repository.ProjectRepository
 }
 
 func NewEnvironmentService(
 	envRepo repository.EnvironmentRepository,
 	oauthRepo repository.OAuthRepository,
+	oidcRepo repository.OIDCRepository,
 	projectRepo repository.ProjectRepository,
 ) *EnvironmentService {
 	return &EnvironmentService{
 		envRepo:     envRepo,
 		oauthRepo:   oauthRepo,
+		oidcRepo:    oidcRepo,
 		projectRepo: projectRepo,
 	}
 }
@@ -87,12 +93,43 @@ func (s *EnvironmentService) GetByID(ctx context.Context, envID, ownerID string)
 }
 
 type UpdateEnvironmentInput struct {
-	EnvironmentID  string
-	Name           *string
-	AllowedOrigins []string
-	OwnerID        string
+	EnvironmentID    string
+	Name             *string
+	AllowedOrigins   []string
+	SigningAlgorithm *string
+
+	// Lifetimes in seconds; zero disables the idle timeout and the absolute
+	// session lifetime
+	AccessTokenTTL     *int
+	RefreshTokenTTL    *int
+	SessionIdleTimeout *int
+	SessionMaxLifetime *int
+
+	// Page where users sign in when the environment acts as an OIDC
+	// provider; empty disables the authorization endpoint
+	LoginURL *string
+
+	// One-time code policy; OTPTTL is in seconds
+	OTPLength     *int
+	OTPAlphabet   *string
+	OTPTTL        *int
+	OTPMaxResends *int
+
+	// MFARequired makes every user complete a TOTP second factor, enrolling
+	// an authenticator on their next sign-in if they have none
+	MFARequired *bool
+
+	OwnerID string
 }
 
+// Bounds for the lifetimes an environment can configure
+const (
+	minAccessTokenTTL     = time.Minute
+	minRefreshTokenTTL    = 5 * time.Minute
+	minSessionLifetime    = 5 * time.Minute
+	maxSessionMaxLifetime = 365 * 24 * time.Hour
+)
+
 func (s *EnvironmentService) Update(ctx context.Context, input UpdateEnvironmentInput) (*models.Environment, error) {
 	env, err := s.envRepo.GetByID(ctx, input.EnvironmentID)
 	if err != nil {
@@ -109,6 +146,51 @@ func (s *EnvironmentService) Update(ctx context.Context, input UpdateEnvironment
 	if input.AllowedOrigins != nil {
 		env.AllowedOrigins = input.AllowedOrigins
 	}
+	if input.SigningAlgorithm != nil {
+		if !crypto.IsSupportedAlgorithm(*input.SigningAlgorithm) {
+			return nil, fmt.Errorf("unsupported_signing_algorithm")
+		}
+		env.SigningAlgorithm = *input.SigningAlgorithm
+	}
+	if input.AccessTokenTTL != nil {
+		env.AccessTokenTTL = *input.AccessTokenTTL
+	}
+	if input.RefreshTokenTTL != nil {
+		env.RefreshTokenTTL = *input.RefreshTokenTTL
+	}
+	if input.SessionIdleTimeout != nil {
+		env.SessionIdleTimeout = *input.SessionIdleTimeout
+	}
+	if input.SessionMaxLifetime != nil {
+		env.SessionMaxLifetime = *input.SessionMaxLifetime
+	}
+	if !validTokenLifetimes(env) {
+		return nil, fmt.Errorf("invalid_token_lifetime")
+	}
+	if input.LoginURL != nil {
+		if *input.LoginURL != "" && !validAbsoluteURL(*input.LoginURL) {
+			return nil, fmt.Errorf("invalid_login_url")
+		}
+		env.LoginURL = *input.LoginURL
+	}
+	if input.OTPLength != nil {
+		env.OTPLength = *input.OTPLength
+	}
+	if input.OTPAlphabet != nil {
+		env.OTPAlphabet = *input.OTPAlphabet
+	}
+	if input.OTPTTL != nil {
+		env.OTPTTL = *input.OTPTTL
+	}
+	if input.OTPMaxResends != nil {
+		env.OTPMaxResends = *input.OTPMaxResends
+	}
+	if !validOTPPolicy(env) {
+		return nil, fmt.Errorf("invalid_otp_policy")
+	}
+	if input.MFARequired != nil {
+		env.MFARequired = *input.MFARequired
+	}
 
 	if err := s.envRepo.Update(ctx, env); err != nil {
 		return nil, err
@@ -180,3 +262,112 @@ func (s *EnvironmentService) DeleteOAuthProvider(ctx context.Context, envID, pro
 	}
 	return s.oauthRepo.DeleteProviderConfig(ctx, envID, provider)
 }
+
+// OIDC client management
+
+func (s *EnvironmentService) ListOIDCClients(ctx context.Context, envID, ownerID string) ([]*models.OIDCClient, error) {
+	if _, err := s.GetByID(ctx, envID, ownerID); err != nil {
+		return nil, err
+	}
+	return s.oidcRepo.ListClients(ctx, envID)
+}
+
+type CreateOIDCClientInput struct {
+	EnvironmentID string
+	Name          string
+	RedirectURIs  []string
+	Public        bool // public clients get no secret and must use PKCE
+	OwnerID       string
+}
+
+type CreateOIDCClientOutput struct {
+	*models.OIDCClient
+	ClientSecret string `json:"clientSecret,omitempty"`
+}
+
+func (s *EnvironmentService) CreateOIDCClient(ctx context.Context, input CreateOIDCClientInput) (*CreateOIDCClientOutput, error) {
+	if _, err := s.GetByID(ctx, input.EnvironmentID, input.OwnerID); err != nil {
+		return nil, err
+	}
+
+	if len(input.RedirectURIs) == 0 {
+		return nil, fmt.Errorf("invalid_redirect_uri")
+	}
+	for _, uri := range input.RedirectURIs {
+		if !validAbsoluteURL(uri) {
+			return nil, fmt.Errorf("invalid_redirect_uri")
+		}
+	}
+
+	client := &models.OIDCClient{
+		ID:            ulid.Make().String(),
+		EnvironmentID: input.EnvironmentID,
+		Name:          input.Name,
+		ClientID:      repository.GenerateOIDCClientID(),
+		RedirectURIs:  input.RedirectURIs,
+	}
+
+	var clientSecret string
+	if !input.Public {
+		plain, hash, err := repository.GenerateClientSecret()
+		if err != nil {
+			return nil, err
+		}
+		clientSecret = plain
+		client.ClientSecretHash = &hash
+	}
+
+	if err := s.oidcRepo.CreateClient(ctx, client); err != nil {
+		return nil, err
+	}
+	client.CreatedAt = time.Now()
+
+	return &CreateOIDCClientOutput{OIDCClient: client, ClientSecret: clientSecret}, nil
+}
+
+func (s *EnvironmentService) DeleteOIDCClient(ctx context.Context, envID, clientID, ownerID string) error {
+	if _, err := s.GetByID(ctx, envID, ownerID); err != nil {
+		return err
+	}
+	deleted, err := s.oidcRepo.DeleteClient(ctx, envID, clientID)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return fmt.Errorf("oidc_client_not_found")
+	}
+	return nil
+}
+
+// validAbsoluteURL reports whether raw is an absolute http(s) URL without a
+// fragment, as OAuth requires of redirect URIs
+func validAbsoluteURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "https" || u.Scheme == "http") && u.Host != "" && u.Fragment == ""
+}
+
+// validTokenLifetimes reports whether an environment's lifetimes are within
+// bounds. An access token must not outlive the refresh token that renews it.
+func validTokenLifetimes(env *models.Environment) bool {
+	access := time.Duration(env.AccessTokenTTL) * time.Second
+	refresh := time.Duration(env.RefreshTokenTTL) * time.Second
+	idle := time.Duration(env.SessionIdleTimeout) * time.Second
+	lifetime := time.Duration(env.SessionMaxLifetime) * time.Second
+
+	if access < minAccessTokenTTL || access > crypto.MaxAccessTokenDuration {
+		return false
+	}
+	if refresh < minRefreshTokenTTL || refresh > crypto.MaxRefreshTokenDuration || refresh < access {
+		return false
+	}
+	if idle != 0 && (idle < minSessionLifetime || idle > crypto.MaxRefreshTokenDuration) {
+		return false
+	}
+	if lifetime != 0 && (lifetime < minSessionLifetime || lifetime > maxSessionMaxLifetime) {
+		return false
+	}
+	return true
+}
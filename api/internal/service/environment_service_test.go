@@ -0,0 +1,64 @@
+package service_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/marcioecom/permit/internal/models"
+	"github.com/marcioecom/permit/internal/service"
+	"github.com/oklog/ulid/v2"
+)
+
+func TestEnvironmentUpdate_TokenLifetimeBounds(t *testing.T) {
+	owner := ulid.Make().String()
+	project := &models.Project{ID: ulid.Make().String(), Name: "Acme", OwnerID: owner}
+	ctx := context.Background()
+
+	seconds := func(n int) *int { return &n }
+	const minute, hour, day = 60, 3600, 86400
+
+	tests := []struct {
+		name  string
+		input service.UpdateEnvironmentInput
+		valid bool
+	}{
+		{"defaults", service.UpdateEnvironmentInput{}, true},
+		{"short access token", service.UpdateEnvironmentInput{AccessTokenTTL: seconds(30)}, false},
+		{"day-long access token", service.UpdateEnvironmentInput{AccessTokenTTL: seconds(day)}, true},
+		{"access token over a day", service.UpdateEnvironmentInput{AccessTokenTTL: seconds(day + 1)}, false},
+		{"short refresh token", service.UpdateEnvironmentInput{RefreshTokenTTL: seconds(minute)}, false},
+		{"refresh token over 90 days", service.UpdateEnvironmentInput{RefreshTokenTTL: seconds(91 * day)}, false},
+		{"refresh token shorter than access token", service.UpdateEnvironmentInput{AccessTokenTTL: seconds(2 * hour), RefreshTokenTTL: seconds(hour)}, false},
+		{"idle timeout", service.UpdateEnvironmentInput{SessionIdleTimeout: seconds(30 * minute)}, true},
+		{"short idle timeout", service.UpdateEnvironmentInput{SessionIdleTimeout: seconds(minute)}, false},
+		{"idle timeout over 90 days", service.UpdateEnvironmentInput{SessionIdleTimeout: seconds(91 * day)}, false},
+		{"max lifetime", service.UpdateEnvironmentInput{SessionMaxLifetime: seconds(30 * day)}, true},
+		{"short max lifetime", service.UpdateEnvironmentInput{SessionMaxLifetime: seconds(minute)}, false},
+		{"max lifetime over a year", service.UpdateEnvironmentInput{SessionMaxLifetime: seconds(366 * day)}, false},
+		{"negative max lifetime", service.UpdateEnvironmentInput{SessionMaxLifetime: seconds(-1)}, false},
+	}
+	for _, tt := range tests {
+		env := &models.Environment{
+			ID:              ulid.Make().String(),
+			ProjectID:       project.ID,
+			AccessTokenTTL:  15 * minute,
+			RefreshTokenTTL: 7 * day,
+			OTPLength:       6,
+			OTPAlphabet:     models.OTPAlphabetNumeric,
+			OTPTTL:          10 * minute,
+			OTPMaxResends:   5,
+		}
+		envRepo := &mockEnvRepo{env: env}
+		envService := service.NewEnvironmentService(envRepo, &mockOAuthRepo{}, nil, &mockProjectLookupRepo{project: project})
+
+		input := tt.input
+		input.EnvironmentID, input.OwnerID = env.ID, owner
+		_, err := envService.Update(ctx, input)
+		if tt.valid && err != nil {
+			t.Errorf("%s: expected the update to pass, got %v", tt.name, err)
+		}
+		if !tt.valid && (err == nil || err.Error() != "invalid_token_lifetime") {
+			t.Errorf("%s: expected invalid_token_lifetime, got %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package service
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/marcioecom/permit/internal/repository"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// maxOTPAttempts is how many wrong guesses invalidate a user's pending
+	// codes
+	maxOTPAttempts = 5
+
+	// Failed verifications before an email, phone number or IP is locked out.
+	// IPs get more room since offices and carriers put many users behind one
+	// address.
+	emailLockoutThreshold = 5
+	ipLockoutThreshold    = 20
+
+	// Lockouts start at baseLockout and double each time, up to maxLockout.
+	// Failures are forgotten after lockoutResetAfter without any.
+	baseLockout       = time.Minute
+	maxLockout        = 24 * time.Hour
+	lockoutResetAfter = 24 * time.Hour
+)
+
+func emailSubject(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func phoneSubject(phone string) string {
+	return "phone:" + phone
+}
+
+// ipSubject keys lockouts on the client's address without its port
+func ipSubject(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return "ip:" + addr
+}
+
+func lockoutThreshold(subject string) int {
+	if strings.HasPrefix(subject, "ip:") {
+		return ipLockoutThreshold
+	}
+	return emailLockoutThreshold
+}
+
+func lockoutDuration(lockouts int) time.Duration {
+	duration := baseLockout
+	for i := 0; i < lockouts && duration < maxLockout; i++ {
+		duration *= 2
+	}
+	return min(duration, maxLockout)
+}
+
+// attemptLimiter locks out emails, phone numbers and IPs that keep failing
+// verification, for progressively longer each time
+type attemptLimiter struct {
+	repo repository.LoginAttemptRepository
+}
+
+// lockedUntil returns when the latest lockout among subjects ends, or nil
+// when none of them is locked out
+func (l attemptLimiter) lockedUntil(ctx context.Context, projectID string, subjects ...string) (*time.Time, error) {
+	var until *time.Time
+	for _, subject := range subjects {
+		attempt, err := l.repo.Get(ctx, projectID, subject)
+		if err != nil {
+			return nil, err
+		}
+		if attempt == nil || attempt.LockedUntil == nil || !attempt.LockedUntil.After(time.Now()) {
+			continue
+		}
+		if until == nil || attempt.LockedUntil.After(*until) {
+			until = attempt.LockedUntil
+		}
+	}
+	return until, nil
+}
+
+// recordFailure counts a failed verification against each subject, locking
+// out those reaching their threshold. It reports whether any got locked out.
+func (l attemptLimiter) recordFailure(ctx context.Context, projectID string, subjects ...string) bool {
+	locked := false
+	for _, subject := range subjects {
+		attempt, err := l.repo.RecordFailure(ctx, projectID, subject, lockoutResetAfter)
+		if err != nil {
+			log.Warn().Err(err).Str("subject", subject).Msg("failed to record login failure")
+			continue
+		}
+		if attempt.Failures%lockoutThreshold(subject) != 0 {
+			continue
+		}
+
+		until := time.Now().Add(lockoutDuration(attempt.Lockouts))
+		if err := l.repo.Lock(ctx, projectID, subject, until); err != nil {
+			log.Warn().Err(err).Str("subject", subject).Msg("failed to lock out subject")
+			continue
+		}
+		locked = true
+	}
+	return locked
+}
+
+// reset forgets a subject's failures after it verified successfully
+func (l attemptLimiter) reset(ctx context.Context, projectID, subject string) {
+	if err := l.repo.Reset(ctx, projectID, subject); err != nil {
+		log.Warn().Err(err).Str("subject", subject).Msg("failed to reset login failures")
+	}
+}
@@ -0,0 +1,178 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/marcioecom/permit/internal/models"
+	"github.com/oklog/ulid/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// devAllowedOrigins are accepted as magic link destinations in development
+// environments that don't list any allowed origins
+var devAllowedOrigins = []string{
+	"http://localhost:3000",
+	"http://localhost:5173",
+	"http://localhost:8080",
+}
+
+// magicLinkRedirect returns where a magic link sends the user: the client's
+// callback path on the origin the sign-in started from. The origin must be
+// one the environment, or failing that the project, allows, since whoever
+// holds the link's redirect can redeem the authorization code on it.
+func magicLinkRedirect(env *models.Environment, project *models.Project, clientOrigin, redirectPath string) (string, error) {
+	allowed := env.AllowedOrigins
+	if len(allowed) == 0 {
+		allowed = project.AllowedOrigins
+	}
+	if len(allowed) == 0 && env.Type == models.EnvTypeDevelopment {
+		allowed = devAllowedOrigins
+	}
+	if clientOrigin == "" || !originAllowed(clientOrigin, allowed) {
+		return "", fmt.Errorf("origin_not_allowed")
+	}
+
+	if !strings.HasPrefix(redirectPath, "/") || strings.HasPrefix(redirectPath, "//") {
+		return "", fmt.Errorf("invalid_redirect_url")
+	}
+	u, err := url.Parse(clientOrigin + redirectPath)
+	if err != nil || u.Scheme+"://"+u.Host != clientOrigin {
+		return "", fmt.Errorf("invalid_redirect_url")
+	}
+	return u.String(), nil
+}
+
+// originAllowed matches an origin against exact origins, "*" and
+// "*.example.com" style wildcards, as the CORS middleware does
+func originAllowed(origin string, allowed []string) bool {
+	if slices.Contains(allowed, "*") || slices.Contains(allowed, origin) {
+		return true
+	}
+	for _, pattern := range allowed {
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(origin, strings.TrimPrefix(pattern, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendMagicLink stores a one-time code and a magic link for a user and emails
+// both, returning the code so it can still be verified by challenge ID. The
+// link expires with the code and, like it, only its keyed hash is stored.
+// Sending a new code supersedes the link along with it, and using either one
+// expires the other.
+func (s *AuthService) sendMagicLink(ctx context.Context, project *models.Project, env *models.Environment, userID, email, redirectURL string) (*sentCode, error) {
+	otp, code, err := s.createOTPCode(ctx, models.OTPKindCode, project.ID, env, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	magicLink := &models.OTPCode{
+		ID:            ulid.Make().String(),
+		UserID:        userID,
+		ProjectID:     project.ID,
+		EnvironmentID: env.ID,
+		Kind:          models.OTPKindMagicLink,
+		RedirectURL:   redirectURL,
+		ExpiresAt:     otp.ExpiresAt,
+	}
+	magicLink.CodeHash = s.codeHasher.Hash(magicLink.ID, secret)
+	if err := s.otpRepo.Create(ctx, magicLink); err != nil {
+		return nil, err
+	}
+
+	link := s.cfg.PublicURL + "/api/v1/auth/magic-link?token=" + url.QueryEscape(magicLink.ID+"."+secret)
+	if err := s.emailService.SendMagicLink(email, link, code, project.Name, otpPolicyFor(env).TTL); err != nil {
+		log.Warn().Err(err).Str("email", email).Msg("magic link creation failed")
+		return nil, fmt.Errorf("email_delivery_failed")
+	}
+	return otp, nil
+}
+
+type RedeemMagicLinkInput struct {
+	Token     string
+	IPAddress string
+	UserAgent string
+}
+
+type RedeemMagicLinkOutput struct {
+	RedirectURL string // client callback URL, including Permit auth code
+}
+
+// RedeemMagicLink signs in the user a magic link was sent to. Like an OAuth
+// callback it hands the client a Permit authorization code, which the client
+// exchanges for tokens with ExchangeToken.
+func (s *AuthService) RedeemMagicLink(ctx context.Context, input RedeemMagicLinkInput) (*RedeemMagicLinkOutput, error) {
+	id, secret, ok := strings.Cut(input.Token, ".")
+	if !ok || id == "" || secret == "" {
+		return nil, fmt.Errorf("invalid_link")
+	}
+
+	link, err := s.otpRepo.GetByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if link == nil || link.Kind != models.OTPKindMagicLink || !s.codeHasher.Verify(link.ID, secret, link.CodeHash) {
+		return nil, fmt.Errorf("invalid_link")
+	}
+
+	user, err := s.userRepo.GetByID(ctx, link.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, fmt.Errorf("invalid_link")
+	}
+
+	metadata := map[string]string{"provider": "email", "method": "magic_link"}
+
+	if link.UsedAt != nil {
+		logAuthEvent(ctx, s.projectRepo, link.ProjectID, user.ID, user.Email, "login", "FAILED", input.IPAddress, input.UserAgent, metadata)
+		return nil, fmt.Errorf("link_already_used")
+	}
+
+	if time.Now().After(link.ExpiresAt) {
+		logAuthEvent(ctx, s.projectRepo, link.ProjectID, user.ID, user.Email, "login", "EXPIRED", input.IPAddress, input.UserAgent, metadata)
+		return nil, fmt.Errorf("link_expired")
+	}
+
+	if err := s.otpRepo.MarkCodeAsUsed(ctx, link.ID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			logAuthEvent(ctx, s.projectRepo, link.ProjectID, user.ID, user.Email, "login", "FAILED", input.IPAddress, input.UserAgent, metadata)
+			return nil, fmt.Errorf("link_already_used")
+		}
+		return nil, err
+	}
+	// The code emailed along with the link is for the same sign-in
+	if err := s.otpRepo.ExpirePending(ctx, link.EnvironmentID, link.UserID, []string{models.OTPKindCode}, link.ID); err != nil {
+		return nil, err
+	}
+
+	s.linkEmailIdentity(ctx, user)
+
+	permitCode, err := issueAuthorizationCode(ctx, s.oauthRepo, link.EnvironmentID, user.ID, models.ProviderEmail)
+	if err != nil {
+		return nil, err
+	}
+
+	redirectURL, err := url.Parse(link.RedirectURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid_redirect_url")
+	}
+	query := redirectURL.Query()
+	query.Set("code", permitCode)
+	redirectURL.RawQuery = query.Encode()
+
+	return &RedeemMagicLinkOutput{RedirectURL: redirectURL.String()}, nil
+}
@@ -0,0 +1,399 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/marcioecom/permit/internal/crypto"
+	"github.com/marcioecom/permit/internal/models"
+	"github.com/marcioecom/permit/internal/repository"
+	"github.com/oklog/ulid/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// mfaChallengeTTL is how long a user has to complete their second factor
+// after the first
+const mfaChallengeTTL = 5 * time.Minute
+
+// MFAService enrolls TOTP authenticators and holds back the tokens of
+// sign-ins that need a second factor until it is verified
+type MFAService struct {
+	cipher         *crypto.KeyCipher
+	codeHasher     *crypto.CodeHasher
+	sessionService *SessionService
+	mfaRepo        repository.MFARepository
+	userRepo       repository.UserRepository
+	identityRepo   repository.IdentityRepository
+	projectRepo    repository.ProjectRepository
+	envRepo        repository.EnvironmentRepository
+}
+
+func NewMFAService(
+	cipher *crypto.KeyCipher,
+	codeHasher *crypto.CodeHasher,
+	sessionService *SessionService,
+	mfaRepo repository.MFARepository,
+	userRepo repository.UserRepository,
+	identityRepo repository.IdentityRepository,
+	projectRepo repository.ProjectRepository,
+	envRepo repository.EnvironmentRepository,
+) *MFAService {
+	return &MFAService{
+		cipher:         cipher,
+		codeHasher:     codeHasher,
+		sessionService: sessionService,
+		mfaRepo:        mfaRepo,
+		userRepo:       userRepo,
+		identityRepo:   identityRepo,
+		projectRepo:    projectRepo,
+		envRepo:        envRepo,
+	}
+}
+
+// MFAChallengeOutput is returned instead of tokens when a sign-in needs a
+// second factor. The token is exchanged for tokens along with a TOTP code at
+// /auth/mfa/verify; when EnrollmentRequired the user first enrolls an
+// authenticator with it at /auth/mfa/enroll.
+type MFAChallengeOutput struct {
+	Token              string    `json:"mfaToken"`
+	Methods            []string  `json:"methods"`
+	EnrollmentRequired bool      `json:"enrollmentRequired"`
+	ExpiresAt          time.Time `json:"expiresAt"`
+}
+
+// MFAEnrollment is a new, unconfirmed authenticator. Secret is what users
+// type into their app; ProvisioningURI is the same as an otpauth:// URI to
+// show as a QR code.
+type MFAEnrollment struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioningUri"`
+}
+
+// beginSession issues tokens for a sign-in that passed its first factor, or
+// a challenge instead when the user has an authenticator or the environment
+// requires one. Only a sign-in that gets its tokens is recorded as a login.
+func (s *MFAService) beginSession(ctx context.Context, input CreateSessionInput, metadata map[string]string) (*SessionTokens, *MFAChallengeOutput, error) {
+	factor, err := s.mfaRepo.GetFactor(ctx, input.UserID, input.ProjectID, models.MFAFactorTOTP)
+	if err != nil {
+		return nil, nil, err
+	}
+	enrolled := factor != nil && factor.ConfirmedAt != nil
+
+	if !enrolled {
+		env, err := s.envRepo.GetByID(ctx, input.EnvironmentID)
+		if err != nil || env == nil {
+			return nil, nil, fmt.Errorf("environment_not_found")
+		}
+		if !env.MFARequired {
+			tokens, err := s.sessionService.CreateSession(ctx, input)
+			if err != nil {
+				return nil, nil, err
+			}
+			s.recordLogin(ctx, input.ProjectID, input.EnvironmentID, input.UserID, input.Email, input.Provider, input.IPAddress, input.UserAgent, metadata)
+			return tokens, nil, nil
+		}
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		return nil, nil, err
+	}
+	challenge := &models.MFAChallenge{
+		ID:            ulid.Make().String(),
+		UserID:        input.UserID,
+		ProjectID:     input.ProjectID,
+		EnvironmentID: input.EnvironmentID,
+		Provider:      input.Provider,
+		ExpiresAt:     time.Now().Add(mfaChallengeTTL),
+	}
+	challenge.TokenHash = s.codeHasher.Hash(challenge.ID, secret)
+	if err := s.mfaRepo.CreateChallenge(ctx, challenge); err != nil {
+		return nil, nil, err
+	}
+
+	logAuthEvent(ctx, s.projectRepo, input.ProjectID, input.UserID, input.Email, "login", "MFA_REQUIRED", input.IPAddress, input.UserAgent, metadata)
+
+	return nil, &MFAChallengeOutput{
+		Token:              challenge.ID + "." + secret,
+		Methods:            []string{models.MFAFactorTOTP},
+		EnrollmentRequired: !enrolled,
+		ExpiresAt:          challenge.ExpiresAt,
+	}, nil
+}
+
+// recordLogin counts a completed sign-in against the project's user and logs
+// it
+func (s *MFAService) recordLogin(ctx context.Context, projectID, environmentID, userID, email, provider, ip, ua string, metadata map[string]string) {
+	if err := s.projectRepo.UpsertProjectUser(ctx, projectID, environmentID, userID, provider); err != nil {
+		log.Warn().Err(err).Str("userId", userID).Str("projectId", projectID).Msg("failed to upsert project user")
+	}
+	logAuthEvent(ctx, s.projectRepo, projectID, userID, email, "login", "SUCCESS", ip, ua, metadata)
+}
+
+// pendingChallenge returns the unused, unexpired challenge a token belongs to
+func (s *MFAService) pendingChallenge(ctx context.Context, token string) (*models.MFAChallenge, error) {
+	id, secret, ok := strings.Cut(token, ".")
+	if !ok || id == "" || secret == "" {
+		return nil, fmt.Errorf("invalid_mfa_token")
+	}
+	challenge, err := s.mfaRepo.GetChallenge(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if challenge == nil || challenge.UsedAt != nil || !s.codeHasher.Verify(challenge.ID, secret, challenge.TokenHash) {
+		return nil, fmt.Errorf("invalid_mfa_token")
+	}
+	if time.Now().After(challenge.ExpiresAt) {
+		return nil, fmt.Errorf("mfa_token_expired")
+	}
+	return challenge, nil
+}
+
+// EnrollChallenge starts enrolling an authenticator for a user who must
+// complete a second factor but has none yet. Verifying the challenge with a
+// first code confirms it.
+func (s *MFAService) EnrollChallenge(ctx context.Context, token string) (*MFAEnrollment, error) {
+	challenge, err := s.pendingChallenge(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	return s.enroll(ctx, challenge.UserID, challenge.ProjectID)
+}
+
+type VerifyMFAInput struct {
+	Token     string
+	Code      string
+	IPAddress string
+	UserAgent string
+}
+
+// VerifyChallenge completes a sign-in with a TOTP code, issuing the tokens
+// held back by its challenge. A pending enrollment is confirmed by it.
+func (s *MFAService) VerifyChallenge(ctx context.Context, input VerifyMFAInput) (*VerifyAuthOutput, error) {
+	challenge, err := s.pendingChallenge(ctx, input.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.userRepo.GetByID(ctx, challenge.UserID)
+	if err != nil || user == nil {
+		return nil, fmt.Errorf("invalid_mfa_token")
+	}
+
+	metadata := map[string]string{"provider": challenge.Provider, "method": models.MFAFactorTOTP}
+	if challenge.Attempts >= maxOTPAttempts {
+		logAuthEvent(ctx, s.projectRepo, challenge.ProjectID, user.ID, user.Email, "mfa", "TOO_MANY_ATTEMPTS", input.IPAddress, input.UserAgent, metadata)
+		return nil, fmt.Errorf("too_many_attempts")
+	}
+
+	factor, err := s.mfaRepo.GetFactor(ctx, user.ID, challenge.ProjectID, models.MFAFactorTOTP)
+	if err != nil {
+		return nil, err
+	}
+	if factor == nil {
+		return nil, fmt.Errorf("mfa_enrollment_required")
+	}
+
+	if err := s.useCode(ctx, factor, input.Code); err != nil {
+		if err.Error() != "invalid_code" && err.Error() != "code_already_used" {
+			return nil, err
+		}
+		if err := s.mfaRepo.IncrementChallengeAttempts(ctx, challenge.ID); err != nil {
+			log.Warn().Err(err).Str("userId", user.ID).Msg("failed to count MFA attempt")
+		}
+		if challenge.Attempts+1 >= maxOTPAttempts {
+			logAuthEvent(ctx, s.projectRepo, challenge.ProjectID, user.ID, user.Email, "mfa", "TOO_MANY_ATTEMPTS", input.IPAddress, input.UserAgent, metadata)
+			return nil, fmt.Errorf("too_many_attempts")
+		}
+		logAuthEvent(ctx, s.projectRepo, challenge.ProjectID, user.ID, user.Email, "mfa", "FAILED", input.IPAddress, input.UserAgent, metadata)
+		return nil, err
+	}
+
+	if err := s.mfaRepo.MarkChallengeUsed(ctx, challenge.ID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("invalid_mfa_token")
+		}
+		return nil, err
+	}
+
+	if factor.ConfirmedAt == nil {
+		if err := s.mfaRepo.ConfirmFactor(ctx, factor.ID); err != nil {
+			return nil, err
+		}
+		logAuthEvent(ctx, s.projectRepo, challenge.ProjectID, user.ID, user.Email, "mfa_enrollment", "SUCCESS", input.IPAddress, input.UserAgent, metadata)
+	}
+
+	tokens, err := s.sessionService.CreateSession(ctx, CreateSessionInput{
+		UserID:        user.ID,
+		Email:         user.Email,
+		ProjectID:     challenge.ProjectID,
+		EnvironmentID: challenge.EnvironmentID,
+		Provider:      challenge.Provider,
+		AMR:           []string{AMRTOTP, AMRMFA},
+		IPAddress:     input.IPAddress,
+		UserAgent:     input.UserAgent,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logAuthEvent(ctx, s.projectRepo, challenge.ProjectID, user.ID, user.Email, "mfa", "SUCCESS", input.IPAddress, input.UserAgent, metadata)
+	s.recordLogin(ctx, challenge.ProjectID, challenge.EnvironmentID, user.ID, user.Email, challenge.Provider, input.IPAddress, input.UserAgent, metadata)
+
+	output := &VerifyAuthOutput{
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		User: &UserInfo{
+			ID:    user.ID,
+			Email: user.Email,
+		},
+	}
+	if challenge.Provider == models.ProviderPhone {
+		identity, err := s.identityRepo.GetByUserAndProvider(ctx, user.ID, models.ProviderPhone)
+		if err != nil || identity == nil {
+			return nil, fmt.Errorf("identity_not_found")
+		}
+		output.User.Phone = identity.ProviderUserID
+	}
+	return output, nil
+}
+
+// Enroll starts enrolling an authenticator for the signed-in user, replacing
+// one they didn't confirm. ConfirmEnrollment completes it.
+func (s *MFAService) Enroll(ctx context.Context, claims *crypto.AccessTokenClaims) (*MFAEnrollment, error) {
+	return s.enroll(ctx, claims.UserID, claims.ProjectID)
+}
+
+type MFACodeInput struct {
+	Claims    *crypto.AccessTokenClaims
+	Code      string
+	IPAddress string
+	UserAgent string
+}
+
+// ConfirmEnrollment confirms the signed-in user's new authenticator with a
+// first code, after which their sign-ins ask for it
+func (s *MFAService) ConfirmEnrollment(ctx context.Context, input MFACodeInput) error {
+	claims := input.Claims
+	factor, err := s.mfaRepo.GetFactor(ctx, claims.UserID, claims.ProjectID, models.MFAFactorTOTP)
+	if err != nil {
+		return err
+	}
+	if factor == nil {
+		return fmt.Errorf("mfa_not_enrolled")
+	}
+	if factor.ConfirmedAt != nil {
+		return fmt.Errorf("mfa_already_enrolled")
+	}
+
+	metadata := map[string]string{"method": models.MFAFactorTOTP}
+	if err := s.useCode(ctx, factor, input.Code); err != nil {
+		logAuthEvent(ctx, s.projectRepo, claims.ProjectID, claims.UserID, claims.Email, "mfa_enrollment", "FAILED", input.IPAddress, input.UserAgent, metadata)
+		return err
+	}
+	if err := s.mfaRepo.ConfirmFactor(ctx, factor.ID); err != nil {
+		return err
+	}
+
+	logAuthEvent(ctx, s.projectRepo, claims.ProjectID, claims.UserID, claims.Email, "mfa_enrollment", "SUCCESS", input.IPAddress, input.UserAgent, metadata)
+	return nil
+}
+
+// RemoveFactor removes the signed-in user's authenticator, proven with a
+// current code. In environments that require MFA they enroll a new one on
+// their next sign-in.
+func (s *MFAService) RemoveFactor(ctx context.Context, input MFACodeInput) error {
+	claims := input.Claims
+	factor, err := s.mfaRepo.GetFactor(ctx, claims.UserID, claims.ProjectID, models.MFAFactorTOTP)
+	if err != nil {
+		return err
+	}
+	if factor == nil || factor.ConfirmedAt == nil {
+		return fmt.Errorf("mfa_not_enrolled")
+	}
+
+	metadata := map[string]string{"method": models.MFAFactorTOTP}
+	if err := s.useCode(ctx, factor, input.Code); err != nil {
+		logAuthEvent(ctx, s.projectRepo, claims.ProjectID, claims.UserID, claims.Email, "mfa_removal", "FAILED", input.IPAddress, input.UserAgent, metadata)
+		return err
+	}
+	if err := s.mfaRepo.DeleteFactor(ctx, factor.ID); err != nil {
+		return err
+	}
+
+	logAuthEvent(ctx, s.projectRepo, claims.ProjectID, claims.UserID, claims.Email, "mfa_removal", "SUCCESS", input.IPAddress, input.UserAgent, metadata)
+	return nil
+}
+
+// enroll stores a new TOTP secret for a user, unless they already have a
+// confirmed authenticator. Authenticator apps label it with the project's
+// name and the user's email, or their ID when they have none.
+func (s *MFAService) enroll(ctx context.Context, userID, projectID string) (*MFAEnrollment, error) {
+	existing, err := s.mfaRepo.GetFactor(ctx, userID, projectID, models.MFAFactorTOTP)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && existing.ConfirmedAt != nil {
+		return nil, fmt.Errorf("mfa_already_enrolled")
+	}
+
+	user, err := s.userRepo.GetByID(ctx, userID)
+	if err != nil || user == nil {
+		return nil, fmt.Errorf("user_not_found")
+	}
+	project, err := s.projectRepo.GetByID(ctx, projectID)
+	if err != nil || project == nil {
+		return nil, fmt.Errorf("project_not_found")
+	}
+
+	secret, err := crypto.GenerateTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := s.cipher.Encrypt(secret)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.mfaRepo.CreateFactor(ctx, &models.MFAFactor{
+		ID:              ulid.Make().String(),
+		UserID:          userID,
+		ProjectID:       projectID,
+		Type:            models.MFAFactorTOTP,
+		SecretEncrypted: encrypted,
+	}); err != nil {
+		return nil, err
+	}
+
+	account := user.Email
+	if account == "" {
+		account = user.ID
+	}
+	return &MFAEnrollment{
+		Secret:          crypto.EncodeTOTPSecret(secret),
+		ProvisioningURI: crypto.TOTPProvisioningURI(project.Name, account, secret),
+	}, nil
+}
+
+// useCode checks a TOTP code against a factor and records its time step, so
+// the same code can't be used twice
+func (s *MFAService) useCode(ctx context.Context, factor *models.MFAFactor, code string) error {
+	secret, err := s.cipher.Decrypt(factor.SecretEncrypted)
+	if err != nil {
+		return err
+	}
+	step, ok := crypto.VerifyTOTP(secret, code, time.Now())
+	if !ok {
+		return fmt.Errorf("invalid_code")
+	}
+	if err := s.mfaRepo.UseFactorStep(ctx, factor.ID, step); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("code_already_used")
+		}
+		return err
+	}
+	return nil
+}
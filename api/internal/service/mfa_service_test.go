@@ -0,0 +1,282 @@
+package service_test
+
+import (
+	"context"
+	"encoding/base32"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/marcioecom/permit/internal/crypto"
+	"github.com/marcioecom/permit/internal/models"
+	"github.com/marcioecom/permit/internal/service"
+	"github.com/oklog/ulid/v2"
+)
+
+type mockMFARepo struct {
+	factors    map[string]*models.MFAFactor
+	challenges map[string]*models.MFAChallenge
+}
+
+func newMockMFARepo() *mockMFARepo {
+	return &mockMFARepo{
+		factors:    make(map[string]*models.MFAFactor),
+		challenges: make(map[string]*models.MFAChallenge),
+	}
+}
+
+func (m *mockMFARepo) CreateFactor(ctx context.Context, f *models.MFAFactor) error {
+	for id, existing := range m.factors {
+		if existing.UserID == f.UserID && existing.ProjectID == f.ProjectID && existing.Type == f.Type && existing.ConfirmedAt == nil {
+			delete(m.factors, id)
+		}
+	}
+	m.factors[f.ID] = f
+	return nil
+}
+
+func (m *mockMFARepo) GetFactor(ctx context.Context, userID, projectID, factorType string) (*models.MFAFactor, error) {
+	for _, f := range m.factors {
+		if f.UserID == userID && f.ProjectID == projectID && f.Type == factorType {
+			return f, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *mockMFARepo) ConfirmFactor(ctx context.Context, id string) error {
+	now := time.Now()
+	m.factors[id].ConfirmedAt = &now
+	return nil
+}
+
+func (m *mockMFARepo) UseFactorStep(ctx context.Context, id string, step int64) error {
+	f := m.factors[id]
+	if step <= f.LastUsedStep {
+		return pgx.ErrNoRows
+	}
+	f.LastUsedStep = step
+	return nil
+}
+
+func (m *mockMFARepo) DeleteFactor(ctx context.Context, id string) error {
+	delete(m.factors, id)
+	return nil
+}
+
+func (m *mockMFARepo) CreateChallenge(ctx context.Context, c *models.MFAChallenge) error {
+	m.challenges[c.ID] = c
+	return nil
+}
+
+func (m *mockMFARepo) GetChallenge(ctx context.Context, id string) (*models.MFAChallenge, error) {
+	return m.challenges[id], nil
+}
+
+func (m *mockMFARepo) IncrementChallengeAttempts(ctx context.Context, id string) error {
+	m.challenges[id].Attempts++
+	return nil
+}
+
+func (m *mockMFARepo) MarkChallengeUsed(ctx context.Context, id string) error {
+	c := m.challenges[id]
+	if c.UsedAt != nil {
+		return pgx.ErrNoRows
+	}
+	now := time.Now()
+	c.UsedAt = &now
+	return nil
+}
+
+func newTestMFAService(t *testing.T, hasher *crypto.CodeHasher, mfaRepo *mockMFARepo, userRepo *mockUserRepo, project *models.Project) *service.MFAService {
+	t.Helper()
+	cipher, err := crypto.NewEphemeralKeyCipher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return service.NewMFAService(cipher, hasher, nil, mfaRepo, userRepo, &mockIdentityRepo{}, &mockProjectLookupRepo{project: project}, &mockEnvRepo{})
+}
+
+func TestMFAEnrollment_ConfirmAndRemove(t *testing.T) {
+	project := &models.Project{ID: ulid.Make().String(), Name: "Acme"}
+	user := &models.User{ID: ulid.Make().String(), Email: "test@example.com"}
+	userRepo := newMockUserRepo()
+	userRepo.users[user.ID] = user
+	mfaRepo := newMockMFARepo()
+	mfaService := newTestMFAService(t, newTestCodeHasher(t), mfaRepo, userRepo, project)
+	claims := &crypto.AccessTokenClaims{UserID: user.ID, Email: user.Email, ProjectID: project.ID}
+	ctx := context.Background()
+
+	enrollment, err := mfaService.Enroll(ctx, claims)
+	if err != nil {
+		t.Fatalf("Enroll failed: %v", err)
+	}
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrollment.Secret)
+	if err != nil {
+		t.Fatalf("Expected a base32 secret, got %q", enrollment.Secret)
+	}
+	if enrollment.ProvisioningURI != crypto.TOTPProvisioningURI("Acme", "test@example.com", secret) {
+		t.Errorf("Unexpected provisioning URI %q", enrollment.ProvisioningURI)
+	}
+	for _, f := range mfaRepo.factors {
+		if string(f.SecretEncrypted) == string(secret) {
+			t.Error("Expected the secret to be stored encrypted")
+		}
+	}
+
+	confirm := func(code string) error {
+		return mfaService.ConfirmEnrollment(ctx, service.MFACodeInput{Claims: claims, Code: code})
+	}
+	step := crypto.TOTPStep(time.Now())
+	if err := confirm(crypto.TOTPCode(secret, step+10)); err == nil || err.Error() != "invalid_code" {
+		t.Errorf("Expected invalid_code for a code outside the window, got %v", err)
+	}
+	if err := confirm(crypto.TOTPCode(secret, step)); err != nil {
+		t.Fatalf("ConfirmEnrollment failed: %v", err)
+	}
+	if _, err := mfaService.Enroll(ctx, claims); err == nil || err.Error() != "mfa_already_enrolled" {
+		t.Errorf("Expected mfa_already_enrolled, got %v", err)
+	}
+
+	remove := func(code string) error {
+		return mfaService.RemoveFactor(ctx, service.MFACodeInput{Claims: claims, Code: code})
+	}
+	if err := remove(crypto.TOTPCode(secret, step)); err == nil || err.Error() != "code_already_used" {
+		t.Errorf("Expected code_already_used on replay, got %v", err)
+	}
+	if err := remove(crypto.TOTPCode(secret, step+1)); err != nil {
+		t.Fatalf("RemoveFactor failed: %v", err)
+	}
+	if len(mfaRepo.factors) != 0 {
+		t.Error("Expected the factor to be removed")
+	}
+	if err := remove(crypto.TOTPCode(secret, step+1)); err == nil || err.Error() != "mfa_not_enrolled" {
+		t.Errorf("Expected mfa_not_enrolled, got %v", err)
+	}
+}
+
+func TestMFAChallenge_InvalidTokens(t *testing.T) {
+	hasher := newTestCodeHasher(t)
+	mfaRepo := newMockMFARepo()
+	mfaService := newTestMFAService(t, hasher, mfaRepo, newMockUserRepo(), nil)
+	ctx := context.Background()
+
+	expired := &models.MFAChallenge{ID: ulid.Make().String(), ExpiresAt: time.Now().Add(-time.Minute)}
+	expired.TokenHash = hasher.Hash(expired.ID, "secret")
+	mfaRepo.challenges[expired.ID] = expired
+
+	tests := []struct {
+		token string
+		want  string
+	}{
+		{"", "invalid_mfa_token"},
+		{"no-separator", "invalid_mfa_token"},
+		{ulid.Make().String() + ".secret", "invalid_mfa_token"},
+		{expired.ID + ".wrong", "invalid_mfa_token"},
+		{expired.ID + ".secret", "mfa_token_expired"},
+	}
+	for _, tt := range tests {
+		_, err := mfaService.VerifyChallenge(ctx, service.VerifyMFAInput{Token: tt.token, Code: "123456"})
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("VerifyChallenge(%q): expected %s, got %v", tt.token, tt.want, err)
+		}
+		if _, err := mfaService.EnrollChallenge(ctx, tt.token); err == nil || err.Error() != tt.want {
+			t.Errorf("EnrollChallenge(%q): expected %s, got %v", tt.token, tt.want, err)
+		}
+	}
+}
+
+func TestVerifyOTPCode_MFAChallengeIsNotALogin(t *testing.T) {
+	user := &models.User{ID: ulid.Make().String(), Email: "test@example.com"}
+	projectID := ulid.Make().String()
+	env := &models.Environment{ID: ulid.Make().String(), ProjectID: projectID, MFARequired: true}
+	hasher := newTestCodeHasher(t)
+
+	userRepo := newMockUserRepo()
+	userRepo.users[user.ID] = user
+	otpRepo := newMockOTPRepo()
+	otp := newTestOTPCode(hasher, user.ID, projectID, "123456", time.Now().Add(10*time.Minute))
+	otp.EnvironmentID = env.ID
+	otpRepo.codes[otp.ID] = otp
+	projectRepo := &mockProjectRepo{}
+	envRepo := &mockEnvRepo{env: env}
+
+	cipher, err := crypto.NewEphemeralKeyCipher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfaService := service.NewMFAService(cipher, hasher, nil, newMockMFARepo(), userRepo, &mockIdentityRepo{}, projectRepo, envRepo)
+	authService := service.NewAuthService(nil, nil, hasher, nil, mfaService, newMockEmailService(), newMockSMSService(), userRepo, otpRepo, newMockLoginAttemptRepo(), &mockOAuthRepo{}, &mockIdentityRepo{}, projectRepo, envRepo)
+
+	output, err := authService.VerifyOTPCode(context.Background(), service.VerifyAuthInput{
+		Code:      "123456",
+		Email:     user.Email,
+		ProjectID: projectID,
+	})
+	if err != nil {
+		t.Fatalf("VerifyOTPCode failed: %v", err)
+	}
+	if output.MFA == nil || output.AccessToken != "" {
+		t.Fatalf("Expected an MFA challenge instead of tokens, got %+v", output)
+	}
+
+	if len(projectRepo.projectUsers) != 0 {
+		t.Error("Expected the project user not to be counted before the second factor")
+	}
+	for _, l := range projectRepo.authLogs {
+		if l.EventType == "login" && l.Status == "SUCCESS" {
+			t.Error("Expected no successful login to be logged before the second factor")
+		}
+	}
+	last := projectRepo.authLogs[len(projectRepo.authLogs)-1]
+	if last.EventType != "login" || last.Status != "MFA_REQUIRED" {
+		t.Errorf("Expected the login to be logged as MFA_REQUIRED, got %s %s", last.EventType, last.Status)
+	}
+}
+
+func TestVerifyChallenge_PhoneSignInIncludesPhone(t *testing.T) {
+	user := &models.User{ID: ulid.Make().String()}
+	project := &models.Project{ID: ulid.Make().String(), Name: "Acme"}
+	hasher := newTestCodeHasher(t)
+	userRepo := newMockUserRepo()
+	userRepo.users[user.ID] = user
+	identityRepo := &mockIdentityRepo{identities: []*models.Identity{
+		{ID: ulid.Make().String(), UserID: user.ID, Provider: models.ProviderPhone, ProviderUserID: "+5511999990000"},
+	}}
+	mfaRepo := newMockMFARepo()
+	projectRepo := &mockProjectLookupRepo{project: project}
+	refreshTokens := newMockRefreshTokenRepo()
+	sessionService := newTestSessionService(newTestJWTService(t), userRepo, refreshTokens, newMockSessionRepo(refreshTokens), projectRepo, &mockEnvRepo{})
+	cipher, err := crypto.NewEphemeralKeyCipher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfaService := service.NewMFAService(cipher, hasher, sessionService, mfaRepo, userRepo, identityRepo, projectRepo, &mockEnvRepo{})
+	ctx := context.Background()
+
+	challenge := &models.MFAChallenge{
+		ID:        ulid.Make().String(),
+		UserID:    user.ID,
+		ProjectID: project.ID,
+		Provider:  models.ProviderPhone,
+		ExpiresAt: time.Now().Add(5 * time.Minute),
+	}
+	challenge.TokenHash = hasher.Hash(challenge.ID, "secret")
+	mfaRepo.challenges[challenge.ID] = challenge
+	enrollment, err := mfaService.EnrollChallenge(ctx, challenge.ID+".secret")
+	if err != nil {
+		t.Fatalf("EnrollChallenge failed: %v", err)
+	}
+	secret, _ := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrollment.Secret)
+
+	output, err := mfaService.VerifyChallenge(ctx, service.VerifyMFAInput{
+		Token: challenge.ID + ".secret",
+		Code:  crypto.TOTPCode(secret, crypto.TOTPStep(time.Now())),
+	})
+	if err != nil {
+		t.Fatalf("VerifyChallenge failed: %v", err)
+	}
+	if output.AccessToken == "" || output.User.Phone != "+5511999990000" {
+		t.Errorf("Expected tokens and the user's phone, got %+v %+v", output, output.User)
+	}
+}
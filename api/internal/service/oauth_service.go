@@ -23,19 +23,23 @@ import (
 )
 
 type OAuthService struct {
-	cfg          *config.Config
-	jwtService   *crypto.JWTService
-	oauthRepo    repository.OAuthRepository
-	envRepo      repository.EnvironmentRepository
-	userRepo     repository.UserRepository
-	identityRepo repository.IdentityRepository
-	projectRepo  repository.ProjectRepository
-	httpClient   *http.Client
+	cfg            *config.Config
+	jwtService     *crypto.JWTService
+	sessionService *SessionService
+	mfaService     *MFAService
+	oauthRepo      repository.OAuthRepository
+	envRepo        repository.EnvironmentRepository
+	userRepo       repository.UserRepository
+	identityRepo   repository.IdentityRepository
+	projectRepo    repository.ProjectRepository
+	httpClient     *http.Client
 }
 
 func NewOAuthService(
 	cfg *config.Config,
 	jwtService *crypto.JWTService,
+	sessionService *SessionService,
+	mfaService *MFAService,
 	oauthRepo repository.OAuthRepository,
 	envRepo repository.EnvironmentRepository,
 	userRepo repository.UserRepository,
@@ -43,14 +47,16 @@ func NewOAuthService(
 	projectRepo repository.ProjectRepository,
 ) *OAuthService {
 	return &OAuthService{
-		cfg:          cfg,
-		jwtService:   jwtService,
-		oauthRepo:    oauthRepo,
-		envRepo:      envRepo,
-		userRepo:     userRepo,
-		identityRepo: identityRepo,
-		projectRepo:  projectRepo,
-		httpClient:   &http.Client{Timeout: 10 * time.Second},
+		cfg:            cfg,
+		jwtService:     jwtService,
+		sessionService: sessionService,
+		mfaService:     mfaService,
+		oauthRepo:      oauthRepo,
+		envRepo:        envRepo,
+		userRepo:       userRepo,
+		identityRepo:   identityRepo,
+		projectRepo:    projectRepo,
+		httpClient:     &http.Client{Timeout: 10 * time.Second},
 	}
 }
 
@@ -207,42 +213,48 @@ func (s *OAuthService) HandleCallback(ctx context.Context, input CallbackInput)
 		}
 	}
 
-	// 6. Upsert project_users
-	if err := s.projectRepo.UpsertProjectUser(ctx, env.ProjectID, oauthState.EnvironmentID, userID, oauthState.Provider); err != nil {
-		log.Warn().Err(err).Msg("failed to upsert project user")
+	// 6. Generate Permit authorization code; the login is recorded once it
+	// is exchanged for tokens
+	permitCode, err := issueAuthorizationCode(ctx, s.oauthRepo, oauthState.EnvironmentID, userID, oauthState.Provider)
+	if err != nil {
+		return nil, err
 	}
 
-	// 7. Log auth event
-	s.logAuthEvent(ctx, env.ProjectID, userID, profile.Email, "login", "SUCCESS", input.IPAddress, input.UserAgent, map[string]string{"provider": oauthState.Provider})
+	// 7. Build redirect URL back to client
+	redirectURL := oauthState.ClientOrigin + oauthState.RedirectURL + "?code=" + url.QueryEscape(permitCode)
+
+	return &CallbackOutput{RedirectURL: redirectURL}, nil
+}
 
-	// 8. Generate Permit authorization code
+// issueAuthorizationCode stores a short-lived Permit authorization code for a
+// user who signed in with a provider. The client redeems it with
+// ExchangeToken.
+func issueAuthorizationCode(ctx context.Context, oauthRepo repository.OAuthRepository, environmentID, userID, provider string) (string, error) {
 	codeBytes := make([]byte, 32)
 	if _, err := rand.Read(codeBytes); err != nil {
-		return nil, fmt.Errorf("code_generation_failed")
+		return "", fmt.Errorf("code_generation_failed")
 	}
 	permitCode := base64.URLEncoding.EncodeToString(codeBytes)
 
 	authCode := &models.OAuthAuthorizationCode{
 		ID:            ulid.Make().String(),
-		EnvironmentID: oauthState.EnvironmentID,
+		EnvironmentID: environmentID,
 		UserID:        userID,
 		Code:          permitCode,
-		Provider:      oauthState.Provider,
+		Provider:      provider,
 		ExpiresAt:     time.Now().Add(60 * time.Second),
 	}
-	if err := s.oauthRepo.CreateAuthorizationCode(ctx, authCode); err != nil {
-		return nil, fmt.Errorf("auth_code_save_failed: %w", err)
+	if err := oauthRepo.CreateAuthorizationCode(ctx, authCode); err != nil {
+		return "", fmt.Errorf("auth_code_save_failed: %w", err)
 	}
-
-	// 9. Build redirect URL back to client
-	redirectURL := oauthState.ClientOrigin + oauthState.RedirectURL + "?code=" + url.QueryEscape(permitCode)
-
-	return &CallbackOutput{RedirectURL: redirectURL}, nil
+	return permitCode, nil
 }
 
 type TokenExchangeInput struct {
 	Code          string
 	EnvironmentID string
+	IPAddress     string
+	UserAgent     string
 }
 
 func (s *OAuthService) ExchangeToken(ctx context.Context, input TokenExchangeInput) (*VerifyAuthOutput, error) {
@@ -254,6 +266,11 @@ func (s *OAuthService) ExchangeToken(ctx context.Context, input TokenExchangeInp
 		return nil, err
 	}
 
+	// Codes issued to OIDC clients can only be redeemed at the OIDC token endpoint
+	if authCode.ClientID != "" {
+		return nil, fmt.Errorf("invalid_code")
+	}
+
 	if authCode.EnvironmentID != input.EnvironmentID {
 		return nil, fmt.Errorf("environment_mismatch")
 	}
@@ -268,24 +285,31 @@ func (s *OAuthService) ExchangeToken(ctx context.Context, input TokenExchangeInp
 		return nil, err
 	}
 
-	accessToken, err := s.jwtService.SignAccessToken(user.Email, user.ID, env.ProjectID, authCode.EnvironmentID, authCode.Provider)
+	tokens, challenge, err := s.mfaService.beginSession(ctx, CreateSessionInput{
+		UserID:        user.ID,
+		Email:         user.Email,
+		ProjectID:     env.ProjectID,
+		EnvironmentID: authCode.EnvironmentID,
+		Provider:      authCode.Provider,
+		IPAddress:     input.IPAddress,
+		UserAgent:     input.UserAgent,
+	}, map[string]string{"provider": authCode.Provider})
 	if err != nil {
-		return nil, fmt.Errorf("token_generation_failed")
-	}
-
-	refreshToken, err := s.jwtService.SignRefreshToken(user.ID, env.ProjectID)
-	if err != nil {
-		return nil, fmt.Errorf("token_generation_failed")
+		return nil, err
 	}
 
-	return &VerifyAuthOutput{
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
+	output := &VerifyAuthOutput{
+		MFA: challenge,
 		User: &UserInfo{
 			ID:    user.ID,
 			Email: user.Email,
 		},
-	}, nil
+	}
+	if tokens != nil {
+		output.AccessToken = tokens.AccessToken
+		output.RefreshToken = tokens.RefreshToken
+	}
+	return output, nil
 }
 
 // resolveCredentials returns clientID and clientSecret for the given environment and provider.
@@ -499,21 +523,3 @@ func (s *OAuthService) fetchGitHubPrimaryEmail(accessToken string) (string, erro
 
 	return "", fmt.Errorf("no verified email found")
 }
-
-func (s *OAuthService) logAuthEvent(ctx context.Context, projectID, userID, email, eventType, status, ip, ua string, metadata map[string]string) {
-	err := s.projectRepo.InsertAuthLog(ctx, &models.AuthLog{
-		ID:        ulid.Make().String(),
-		ProjectID: projectID,
-		UserID:    userID,
-		UserEmail: email,
-		EventType: eventType,
-		Status:    status,
-		IPAddress: ip,
-		UserAgent: ua,
-		Metadata:  metadata,
-		CreatedAt: time.Now(),
-	})
-	if err != nil {
-		log.Warn().Err(err).Msg("failed to log auth event")
-	}
-}
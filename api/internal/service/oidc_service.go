@@ -0,0 +1,535 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/marcioecom/permit/internal/config"
+	"github.com/marcioecom/permit/internal/crypto"
+	"github.com/marcioecom/permit/internal/models"
+	"github.com/marcioecom/permit/internal/repository"
+	"github.com/oklog/ulid/v2"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	oidcAuthorizationRequestTTL = 10 * time.Minute
+	oidcAuthorizationCodeTTL    = 60 * time.Second
+)
+
+// OIDC scopes an environment grants. openid is required, email adds the
+// email claims and offline_access returns a refresh token.
+const (
+	ScopeOpenID        = "openid"
+	ScopeEmail         = "email"
+	ScopeOfflineAccess = "offline_access"
+)
+
+var OIDCScopes = []string{ScopeOpenID, ScopeEmail, ScopeOfflineAccess}
+
+// OIDCService lets an environment act as an OpenID Connect provider for its
+// registered relying-party clients, using the authorization code flow with
+// PKCE. Users sign in on the environment's login page, which hands the
+// authorization back with AcceptLogin.
+type OIDCService struct {
+	cfg            *config.Config
+	jwtService     *crypto.JWTService
+	sessionService *SessionService
+	oidcRepo       repository.OIDCRepository
+	oauthRepo      repository.OAuthRepository
+	envRepo        repository.EnvironmentRepository
+	userRepo       repository.UserRepository
+}
+
+func NewOIDCService(
+	cfg *config.Config,
+	jwtService *crypto.JWTService,
+	sessionService *SessionService,
+	oidcRepo repository.OIDCRepository,
+	oauthRepo repository.OAuthRepository,
+	envRepo repository.EnvironmentRepository,
+	userRepo repository.UserRepository,
+) *OIDCService {
+	return &OIDCService{
+		cfg:            cfg,
+		jwtService:     jwtService,
+		sessionService: sessionService,
+		oidcRepo:       oidcRepo,
+		oauthRepo:      oauthRepo,
+		envRepo:        envRepo,
+		userRepo:       userRepo,
+	}
+}
+
+// Issuer returns the OIDC issuer URL of an environment
+func (s *OIDCService) Issuer(environmentID string) string {
+	return s.cfg.PublicURL + "/oidc/" + environmentID
+}
+
+// OpenIDProviderMetadata is an environment's OpenID Connect discovery
+// document, describing it as a provider for relying parties
+type OpenIDProviderMetadata struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+// Discovery returns an environment's OpenID Provider metadata
+func (s *OIDCService) Discovery(ctx context.Context, environmentID string) (*OpenIDProviderMetadata, error) {
+	env, err := s.envRepo.GetByID(ctx, environmentID)
+	if err != nil || env == nil {
+		return nil, fmt.Errorf("environment_not_found")
+	}
+
+	issuer := s.Issuer(env.ID)
+	algorithm := env.SigningAlgorithm
+	if algorithm == "" {
+		algorithm = crypto.DefaultAlgorithm
+	}
+
+	return &OpenIDProviderMetadata{
+		Issuer:                            issuer,
+		AuthorizationEndpoint:             issuer + "/authorize",
+		TokenEndpoint:                     issuer + "/token",
+		UserInfoEndpoint:                  issuer + "/userinfo",
+		JWKSURI:                           issuer + "/jwks.json",
+		ResponseTypesSupported:            []string{"code"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{algorithm},
+		ScopesSupported:                   OIDCScopes,
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		GrantTypesSupported:               []string{"authorization_code", "refresh_token"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported:                   []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "email", "email_verified"},
+	}, nil
+}
+
+// JWKS returns the keys that verify an environment's tokens
+func (s *OIDCService) JWKS(ctx context.Context, environmentID string) (*crypto.JWKSResponse, error) {
+	env, err := s.envRepo.GetByID(ctx, environmentID)
+	if err != nil || env == nil {
+		return nil, fmt.Errorf("environment_not_found")
+	}
+
+	jwks := s.jwtService.GetKeyManager().EnvironmentJWKS(env.ID)
+	return &jwks, nil
+}
+
+type OIDCAuthorizeInput struct {
+	EnvironmentID       string
+	ClientID            string
+	RedirectURI         string
+	ResponseType        string
+	Scope               string
+	State               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+type OIDCAuthorizeOutput struct {
+	RedirectURL string `json:"redirectUrl"`
+}
+
+// Authorize validates an authorization request and sends the user to the
+// environment's login page with a login challenge. Once the client and
+// redirect URI are known to be valid, errors are reported to the relying
+// party through its redirect URI rather than returned.
+func (s *OIDCService) Authorize(ctx context.Context, input OIDCAuthorizeInput) (*OIDCAuthorizeOutput, error) {
+	client, err := s.oidcRepo.GetClientByClientID(ctx, input.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil || client.EnvironmentID != input.EnvironmentID {
+		return nil, fmt.Errorf("invalid_client")
+	}
+	if !slices.Contains(client.RedirectURIs, input.RedirectURI) {
+		return nil, fmt.Errorf("invalid_redirect_uri")
+	}
+
+	fail := func(code string) (*OIDCAuthorizeOutput, error) {
+		return &OIDCAuthorizeOutput{RedirectURL: authorizationRedirect(input.RedirectURI, url.Values{
+			"error": {code},
+			"state": {input.State},
+		})}, nil
+	}
+
+	if input.ResponseType != "code" {
+		return fail("unsupported_response_type")
+	}
+
+	scopes := grantedScopes(input.Scope)
+	if !slices.Contains(scopes, ScopeOpenID) {
+		return fail("invalid_scope")
+	}
+
+	if input.CodeChallenge == "" {
+		if client.IsPublic() {
+			return fail("invalid_request")
+		}
+	} else if input.CodeChallengeMethod != "S256" {
+		return fail("invalid_request")
+	}
+
+	env, err := s.envRepo.GetByID(ctx, input.EnvironmentID)
+	if err != nil || env == nil {
+		return nil, fmt.Errorf("environment_not_found")
+	}
+	if env.LoginURL == "" {
+		log.Warn().Str("environmentId", env.ID).Msg("OIDC authorization requested but no login URL is configured")
+		return fail("temporarily_unavailable")
+	}
+	loginURL, err := url.Parse(env.LoginURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid_login_url")
+	}
+
+	challenge, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.oidcRepo.CreateAuthorizationRequest(ctx, &models.OIDCAuthorizationRequest{
+		ID:                  challenge,
+		EnvironmentID:       env.ID,
+		ClientID:            client.ClientID,
+		RedirectURI:         input.RedirectURI,
+		Scope:               strings.Join(scopes, " "),
+		State:               input.State,
+		Nonce:               input.Nonce,
+		CodeChallenge:       input.CodeChallenge,
+		CodeChallengeMethod: input.CodeChallengeMethod,
+		ExpiresAt:           time.Now().Add(oidcAuthorizationRequestTTL),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("authorization_request_save_failed: %w", err)
+	}
+
+	query := loginURL.Query()
+	query.Set("login_challenge", challenge)
+	loginURL.RawQuery = query.Encode()
+
+	return &OIDCAuthorizeOutput{RedirectURL: loginURL.String()}, nil
+}
+
+type AcceptLoginInput struct {
+	Challenge string
+	Claims    *crypto.AccessTokenClaims // the user who signed in on the login page
+}
+
+// AcceptLogin completes an authorization request once the user has signed in,
+// returning where to send them with an authorization code for the relying
+// party.
+func (s *OIDCService) AcceptLogin(ctx context.Context, input AcceptLoginInput) (*OIDCAuthorizeOutput, error) {
+	req, err := s.oidcRepo.GetAndDeleteAuthorizationRequest(ctx, input.Challenge)
+	if err != nil {
+		return nil, err
+	}
+	if req == nil {
+		return nil, fmt.Errorf("invalid_login_challenge")
+	}
+	if req.EnvironmentID != input.Claims.EnvironmentID {
+		return nil, fmt.Errorf("environment_mismatch")
+	}
+
+	code, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	// The relying party's session keeps how the user authenticated here,
+	// including any second factor
+	authTime := time.Now()
+	if input.Claims.AuthTime != 0 {
+		authTime = time.Unix(input.Claims.AuthTime, 0)
+	} else if input.Claims.IssuedAt != nil {
+		authTime = input.Claims.IssuedAt.Time
+	}
+
+	err = s.oauthRepo.CreateAuthorizationCode(ctx, &models.OAuthAuthorizationCode{
+		ID:                  ulid.Make().String(),
+		EnvironmentID:       req.EnvironmentID,
+		UserID:              input.Claims.UserID,
+		Code:                code,
+		Provider:            input.Claims.Provider,
+		ExpiresAt:           time.Now().Add(oidcAuthorizationCodeTTL),
+		ClientID:            req.ClientID,
+		RedirectURI:         req.RedirectURI,
+		Scope:               req.Scope,
+		Nonce:               req.Nonce,
+		CodeChallenge:       req.CodeChallenge,
+		CodeChallengeMethod: req.CodeChallengeMethod,
+		AuthTime:            &authTime,
+		AMR:                 input.Claims.AMR,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("auth_code_save_failed: %w", err)
+	}
+
+	return &OIDCAuthorizeOutput{RedirectURL: authorizationRedirect(req.RedirectURI, url.Values{
+		"code":  {code},
+		"state": {req.State},
+	})}, nil
+}
+
+type OIDCTokenInput struct {
+	EnvironmentID string
+	GrantType     string
+	Code          string
+	RedirectURI   string
+	CodeVerifier  string
+	RefreshToken  string
+	ClientID      string
+	ClientSecret  string
+	IPAddress     string
+	UserAgent     string
+}
+
+// OIDCTokenResponse is a token endpoint response as defined by RFC 6749 and
+// OpenID Connect Core
+type OIDCTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// Token serves the authorization_code and refresh_token grants. Errors are
+// RFC 6749 error codes.
+func (s *OIDCService) Token(ctx context.Context, input OIDCTokenInput) (*OIDCTokenResponse, error) {
+	client, err := s.authenticateClient(ctx, input.EnvironmentID, input.ClientID, input.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	switch input.GrantType {
+	case "authorization_code":
+		return s.exchangeCode(ctx, client, input)
+	case "refresh_token":
+		return s.refresh(ctx, client, input)
+	case "":
+		return nil, fmt.Errorf("invalid_request")
+	default:
+		return nil, fmt.Errorf("unsupported_grant_type")
+	}
+}
+
+func (s *OIDCService) authenticateClient(ctx context.Context, environmentID, clientID, clientSecret string) (*models.OIDCClient, error) {
+	if clientID == "" {
+		return nil, fmt.Errorf("invalid_client")
+	}
+
+	client, err := s.oidcRepo.GetClientByClientID(ctx, clientID)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil || client.EnvironmentID != environmentID {
+		return nil, fmt.Errorf("invalid_client")
+	}
+
+	if !client.IsPublic() {
+		if err := bcrypt.CompareHashAndPassword([]byte(*client.ClientSecretHash), []byte(clientSecret)); err != nil {
+			return nil, fmt.Errorf("invalid_client")
+		}
+	}
+	return client, nil
+}
+
+func (s *OIDCService) exchangeCode(ctx context.Context, client *models.OIDCClient, input OIDCTokenInput) (*OIDCTokenResponse, error) {
+	if input.Code == "" {
+		return nil, fmt.Errorf("invalid_request")
+	}
+
+	authCode, err := s.oauthRepo.GetAndUseAuthorizationCode(ctx, input.Code)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("invalid_grant")
+		}
+		return nil, err
+	}
+	if authCode.ClientID != client.ClientID || authCode.EnvironmentID != input.EnvironmentID || authCode.RedirectURI != input.RedirectURI {
+		return nil, fmt.Errorf("invalid_grant")
+	}
+	if authCode.CodeChallenge != "" && !verifyCodeChallenge(input.CodeVerifier, authCode.CodeChallenge) {
+		return nil, fmt.Errorf("invalid_grant")
+	}
+
+	env, err := s.envRepo.GetByID(ctx, authCode.EnvironmentID)
+	if err != nil || env == nil {
+		return nil, fmt.Errorf("invalid_grant")
+	}
+	user, err := s.userRepo.GetByID(ctx, authCode.UserID)
+	if err != nil || user == nil {
+		return nil, fmt.Errorf("invalid_grant")
+	}
+
+	authTime := authCode.CreatedAt
+	if authCode.AuthTime != nil {
+		authTime = *authCode.AuthTime
+	}
+
+	tokens, err := s.sessionService.CreateSession(ctx, CreateSessionInput{
+		UserID:        user.ID,
+		Email:         user.Email,
+		ProjectID:     env.ProjectID,
+		EnvironmentID: env.ID,
+		Provider:      authCode.Provider,
+		AMR:           authCode.AMR,
+		AuthTime:      authTime,
+		ClientID:      client.ClientID,
+		Scope:         authCode.Scope,
+		IPAddress:     input.IPAddress,
+		UserAgent:     input.UserAgent,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	scopes := strings.Fields(authCode.Scope)
+	idTokenInput := crypto.IDTokenInput{
+		Issuer:        s.Issuer(env.ID),
+		UserID:        user.ID,
+		ClientID:      client.ClientID,
+		EnvironmentID: env.ID,
+		Nonce:         authCode.Nonce,
+		AuthTime:      authTime,
+		Algorithm:     env.SigningAlgorithm,
+		ExpiresAt:     tokens.ExpiresAt,
+	}
+	if slices.Contains(scopes, ScopeEmail) {
+		idTokenInput.Email = user.Email
+	}
+	idToken, err := s.jwtService.SignIDToken(idTokenInput)
+	if err != nil {
+		return nil, fmt.Errorf("token_generation_failed")
+	}
+
+	response := &OIDCTokenResponse{
+		AccessToken: tokens.AccessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(time.Until(tokens.ExpiresAt).Seconds()),
+		IDToken:     idToken,
+		Scope:       authCode.Scope,
+	}
+	if slices.Contains(scopes, ScopeOfflineAccess) {
+		response.RefreshToken = tokens.RefreshToken
+	}
+	return response, nil
+}
+
+func (s *OIDCService) refresh(ctx context.Context, client *models.OIDCClient, input OIDCTokenInput) (*OIDCTokenResponse, error) {
+	claims, err := s.jwtService.VerifyRefreshToken(input.RefreshToken)
+	if err != nil || claims.EnvironmentID != input.EnvironmentID {
+		return nil, fmt.Errorf("invalid_grant")
+	}
+
+	tokens, err := s.sessionService.RefreshToken(ctx, RefreshTokenInput{
+		RefreshToken: input.RefreshToken,
+		ClientID:     client.ClientID,
+		IPAddress:    input.IPAddress,
+		UserAgent:    input.UserAgent,
+	})
+	if err != nil {
+		log.Debug().Err(err).Msg("OIDC refresh failed")
+		return nil, fmt.Errorf("invalid_grant")
+	}
+
+	return &OIDCTokenResponse{
+		AccessToken:  tokens.AccessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(time.Until(tokens.ExpiresAt).Seconds()),
+		RefreshToken: tokens.RefreshToken,
+	}, nil
+}
+
+// UserInfo returns the claims about the user behind an access token issued
+// by the environment. The email claims need the email scope, as in the ID
+// token, and a user who signed in by phone has none.
+func (s *OIDCService) UserInfo(ctx context.Context, environmentID string, claims *crypto.AccessTokenClaims) (map[string]any, error) {
+	if claims.EnvironmentID != environmentID {
+		return nil, fmt.Errorf("invalid_token")
+	}
+
+	user, err := s.userRepo.GetByID(ctx, claims.UserID)
+	if err != nil || user == nil {
+		return nil, fmt.Errorf("invalid_token")
+	}
+
+	info := map[string]any{"sub": user.ID}
+	if slices.Contains(strings.Fields(claims.Scope), ScopeEmail) && user.Email != "" {
+		info["email"] = user.Email
+		info["email_verified"] = true
+	}
+	return info, nil
+}
+
+// grantedScopes returns the supported scopes among those requested; unknown
+// scopes are ignored as OpenID Connect recommends
+func grantedScopes(scope string) []string {
+	var granted []string
+	for _, requested := range strings.Fields(scope) {
+		if slices.Contains(OIDCScopes, requested) && !slices.Contains(granted, requested) {
+			granted = append(granted, requested)
+		}
+	}
+	return granted
+}
+
+// verifyCodeChallenge checks a PKCE code verifier against an S256 challenge
+func verifyCodeChallenge(verifier, challenge string) bool {
+	if verifier == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// authorizationRedirect appends response parameters to a relying party's
+// redirect URI, leaving out empty ones
+func authorizationRedirect(redirectURI string, params url.Values) string {
+	target, err := url.Parse(redirectURI)
+	if err != nil {
+		return redirectURI
+	}
+
+	query := target.Query()
+	for name, values := range params {
+		if len(values) > 0 && values[0] != "" {
+			query.Set(name, values[0])
+		}
+	}
+	target.RawQuery = query.Encode()
+	return target.String()
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
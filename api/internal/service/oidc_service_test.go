@@ -0,0 +1,298 @@
+package service_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcioecom/permit/internal/config"
+	"github.com/marcioecom/permit/internal/crypto"
+	"github.com/marcioecom/permit/internal/models"
+	"github.com/marcioecom/permit/internal/repository"
+	"github.com/marcioecom/permit/internal/service"
+	"github.com/oklog/ulid/v2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type mockOIDCRepo struct {
+	repository.OIDCRepository
+	clients  map[string]*models.OIDCClient
+	requests map[string]*models.OIDCAuthorizationRequest
+}
+
+func newMockOIDCRepo(clients ...*models.OIDCClient) *mockOIDCRepo {
+	m := &mockOIDCRepo{
+		clients:  make(map[string]*models.OIDCClient),
+		requests: make(map[string]*models.OIDCAuthorizationRequest),
+	}
+	for _, c := range clients {
+		m.clients[c.ClientID] = c
+	}
+	return m
+}
+
+func (m *mockOIDCRepo) GetClientByClientID(ctx context.Context, clientID string) (*models.OIDCClient, error) {
+	return m.clients[clientID], nil
+}
+
+func (m *mockOIDCRepo) CreateAuthorizationRequest(ctx context.Context, req *models.OIDCAuthorizationRequest) error {
+	m.requests[req.ID] = req
+	return nil
+}
+
+func (m *mockOIDCRepo) GetAndDeleteAuthorizationRequest(ctx context.Context, id string) (*models.OIDCAuthorizationRequest, error) {
+	req := m.requests[id]
+	delete(m.requests, id)
+	return req, nil
+}
+
+// newTestOIDCService returns an OIDC provider for env with a confidential
+// client "rp_web" (secret "rp_secret") and a public client "rp_app", both
+// redirecting to https://rp.example.com/callback
+func newTestOIDCService(t *testing.T, env *models.Environment, userRepo *mockUserRepo) (*service.OIDCService, *crypto.JWTService) {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte("rp_secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretHash := string(hash)
+	oidcRepo := newMockOIDCRepo(
+		&models.OIDCClient{ID: ulid.Make().String(), EnvironmentID: env.ID, ClientID: "rp_web", ClientSecretHash: &secretHash, RedirectURIs: []string{"https://rp.example.com/callback"}},
+		&models.OIDCClient{ID: ulid.Make().String(), EnvironmentID: env.ID, ClientID: "rp_app", RedirectURIs: []string{"https://rp.example.com/callback"}},
+	)
+
+	jwtService := newTestJWTService(t)
+	refreshTokens := newMockRefreshTokenRepo()
+	envRepo := &mockEnvRepo{env: env}
+	sessionService := newTestSessionService(jwtService, userRepo, refreshTokens, newMockSessionRepo(refreshTokens), &mockProjectLookupRepo{}, envRepo)
+	cfg := &config.Config{PublicURL: "https://auth.example.com"}
+	return service.NewOIDCService(cfg, jwtService, sessionService, oidcRepo, &mockOAuthRepo{}, envRepo, userRepo), jwtService
+}
+
+func TestOIDCAuthorize_RejectsInvalidRequests(t *testing.T) {
+	env := &models.Environment{ID: ulid.Make().String(), ProjectID: ulid.Make().String(), LoginURL: "https://app.example.com/login"}
+	oidcService, _ := newTestOIDCService(t, env, newMockUserRepo())
+	ctx := context.Background()
+
+	valid := service.OIDCAuthorizeInput{
+		EnvironmentID:       env.ID,
+		ClientID:            "rp_app",
+		RedirectURI:         "https://rp.example.com/callback",
+		ResponseType:        "code",
+		Scope:               "openid email",
+		State:               "xyz",
+		CodeChallenge:       "challenge",
+		CodeChallengeMethod: "S256",
+	}
+
+	rejected := []struct {
+		name   string
+		modify func(*service.OIDCAuthorizeInput)
+		want   string
+	}{
+		{"unknown client", func(in *service.OIDCAuthorizeInput) { in.ClientID = "rp_unknown" }, "invalid_client"},
+		{"other environment", func(in *service.OIDCAuthorizeInput) { in.EnvironmentID = ulid.Make().String() }, "invalid_client"},
+		{"unregistered redirect", func(in *service.OIDCAuthorizeInput) { in.RedirectURI = "https://evil.test/callback" }, "invalid_redirect_uri"},
+	}
+	for _, tt := range rejected {
+		input := valid
+		tt.modify(&input)
+		if _, err := oidcService.Authorize(ctx, input); err == nil || err.Error() != tt.want {
+			t.Errorf("%s: expected %s, got %v", tt.name, tt.want, err)
+		}
+	}
+
+	// Once the client and redirect URI check out, errors go to the relying party
+	redirects := []struct {
+		name   string
+		modify func(*service.OIDCAuthorizeInput)
+		want   string
+	}{
+		{"implicit flow", func(in *service.OIDCAuthorizeInput) { in.ResponseType = "token" }, "unsupported_response_type"},
+		{"no openid scope", func(in *service.OIDCAuthorizeInput) { in.Scope = "email" }, "invalid_scope"},
+		{"public client without PKCE", func(in *service.OIDCAuthorizeInput) { in.CodeChallenge = "" }, "invalid_request"},
+		{"plain PKCE", func(in *service.OIDCAuthorizeInput) { in.CodeChallengeMethod = "plain" }, "invalid_request"},
+	}
+	for _, tt := range redirects {
+		input := valid
+		tt.modify(&input)
+		output, err := oidcService.Authorize(ctx, input)
+		if err != nil {
+			t.Fatalf("%s: Authorize failed: %v", tt.name, err)
+		}
+		if want := "https://rp.example.com/callback?error=" + tt.want + "&state=xyz"; output.RedirectURL != want {
+			t.Errorf("%s: expected redirect to %s, got %s", tt.name, want, output.RedirectURL)
+		}
+	}
+
+	output, err := oidcService.Authorize(ctx, valid)
+	if err != nil {
+		t.Fatalf("Authorize failed: %v", err)
+	}
+	if !strings.HasPrefix(output.RedirectURL, "https://app.example.com/login?login_challenge=") {
+		t.Errorf("Expected a redirect to the login page, got %s", output.RedirectURL)
+	}
+}
+
+func TestOIDCToken_AuthorizationCodeGrant(t *testing.T) {
+	user := &models.User{ID: ulid.Make().String(), Email: "test@example.com"}
+	env := &models.Environment{ID: ulid.Make().String(), ProjectID: ulid.Make().String(), LoginURL: "https://app.example.com/login"}
+	userRepo := newMockUserRepo()
+	userRepo.users[user.ID] = user
+	oidcService, _ := newTestOIDCService(t, env, userRepo)
+	ctx := context.Background()
+
+	verifier := "a-code-verifier-long-enough-for-pkce-0123456789"
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	// issueCode runs an authorization request through the login page and
+	// returns the code handed to the relying party
+	issueCode := func(clientID, scope string) string {
+		t.Helper()
+		output, err := oidcService.Authorize(ctx, service.OIDCAuthorizeInput{
+			EnvironmentID:       env.ID,
+			ClientID:            clientID,
+			RedirectURI:         "https://rp.example.com/callback",
+			ResponseType:        "code",
+			Scope:               scope,
+			CodeChallenge:       challenge,
+			CodeChallengeMethod: "S256",
+		})
+		if err != nil {
+			t.Fatalf("Authorize failed: %v", err)
+		}
+		login, _ := url.Parse(output.RedirectURL)
+		output, err = oidcService.AcceptLogin(ctx, service.AcceptLoginInput{
+			Challenge: login.Query().Get("login_challenge"),
+			Claims:    &crypto.AccessTokenClaims{UserID: user.ID, EnvironmentID: env.ID, Provider: models.ProviderEmail, AMR: []string{service.AMROTP}},
+		})
+		if err != nil {
+			t.Fatalf("AcceptLogin failed: %v", err)
+		}
+		callback, _ := url.Parse(output.RedirectURL)
+		return callback.Query().Get("code")
+	}
+	exchange := func(code, clientID, redirectURI, codeVerifier string) (*service.OIDCTokenResponse, error) {
+		return oidcService.Token(ctx, service.OIDCTokenInput{
+			EnvironmentID: env.ID,
+			GrantType:     "authorization_code",
+			Code:          code,
+			RedirectURI:   redirectURI,
+			CodeVerifier:  codeVerifier,
+			ClientID:      clientID,
+			ClientSecret:  map[string]string{"rp_web": "rp_secret"}[clientID],
+		})
+	}
+	const callback = "https://rp.example.com/callback"
+
+	rejected := []struct {
+		name                            string
+		clientID, redirectURI, verifier string
+	}{
+		{"PKCE mismatch", "rp_web", callback, "another-code-verifier-0123456789"},
+		{"missing verifier", "rp_web", callback, ""},
+		{"other client", "rp_app", callback, verifier},
+		{"other redirect URI", "rp_web", "https://rp.example.com/other", verifier},
+	}
+	for _, tt := range rejected {
+		code := issueCode("rp_web", "openid")
+		if _, err := exchange(code, tt.clientID, tt.redirectURI, tt.verifier); err == nil || err.Error() != "invalid_grant" {
+			t.Errorf("%s: expected invalid_grant, got %v", tt.name, err)
+		}
+	}
+
+	if _, err := oidcService.Token(ctx, service.OIDCTokenInput{EnvironmentID: env.ID, GrantType: "authorization_code", Code: issueCode("rp_web", "openid"), ClientID: "rp_web", ClientSecret: "wrong"}); err == nil || err.Error() != "invalid_client" {
+		t.Errorf("Expected invalid_client for a wrong secret, got %v", err)
+	}
+
+	code := issueCode("rp_web", "openid")
+	response, err := exchange(code, "rp_web", callback, verifier)
+	if err != nil {
+		t.Fatalf("Token failed: %v", err)
+	}
+	if response.AccessToken == "" || response.IDToken == "" {
+		t.Errorf("Expected an access and ID token, got %+v", response)
+	}
+	if response.RefreshToken != "" {
+		t.Error("Expected no refresh token without offline_access")
+	}
+	if _, err := exchange(code, "rp_web", callback, verifier); err == nil || err.Error() != "invalid_grant" {
+		t.Errorf("Expected invalid_grant on code replay, got %v", err)
+	}
+
+	response, err = exchange(issueCode("rp_web", "openid offline_access"), "rp_web", callback, verifier)
+	if err != nil {
+		t.Fatalf("Token failed: %v", err)
+	}
+	if response.RefreshToken == "" {
+		t.Fatal("Expected a refresh token with offline_access")
+	}
+
+	refresh := func(clientID string) (*service.OIDCTokenResponse, error) {
+		return oidcService.Token(ctx, service.OIDCTokenInput{
+			EnvironmentID: env.ID,
+			GrantType:     "refresh_token",
+			RefreshToken:  response.RefreshToken,
+			ClientID:      clientID,
+			ClientSecret:  map[string]string{"rp_web": "rp_secret"}[clientID],
+		})
+	}
+	if _, err := refresh("rp_app"); err == nil || err.Error() != "invalid_grant" {
+		t.Errorf("Expected invalid_grant refreshing through another client, got %v", err)
+	}
+	refreshed, err := refresh("rp_web")
+	if err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if refreshed.AccessToken == "" || refreshed.RefreshToken == "" || refreshed.RefreshToken == response.RefreshToken {
+		t.Errorf("Expected rotated tokens, got %+v", refreshed)
+	}
+}
+
+func TestOIDCUserInfo_EmailNeedsScope(t *testing.T) {
+	user := &models.User{ID: ulid.Make().String(), Email: "test@example.com"}
+	phoneUser := &models.User{ID: ulid.Make().String()}
+	env := &models.Environment{ID: ulid.Make().String(), ProjectID: ulid.Make().String()}
+	userRepo := newMockUserRepo()
+	userRepo.users[user.ID] = user
+	userRepo.users[phoneUser.ID] = phoneUser
+	oidcService, jwtService := newTestOIDCService(t, env, userRepo)
+	ctx := context.Background()
+
+	userInfo := func(userID, scope string) map[string]any {
+		t.Helper()
+		token, err := jwtService.SignAccessToken(crypto.AccessTokenInput{UserID: userID, ProjectID: env.ProjectID, EnvironmentID: env.ID, Scope: scope, ExpiresAt: time.Now().Add(time.Minute)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := jwtService.VerifyAccessToken(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := oidcService.UserInfo(ctx, env.ID, claims)
+		if err != nil {
+			t.Fatalf("UserInfo failed: %v", err)
+		}
+		return info
+	}
+
+	if info := userInfo(user.ID, "openid"); info["sub"] != user.ID || info["email"] != nil || info["email_verified"] != nil {
+		t.Errorf("Expected only the subject without the email scope, got %v", info)
+	}
+	if info := userInfo(user.ID, "openid email"); info["email"] != user.Email || info["email_verified"] != true {
+		t.Errorf("Expected the email claims with the email scope, got %v", info)
+	}
+	if info := userInfo(phoneUser.ID, "openid email"); info["email"] != nil || info["email_verified"] != nil {
+		t.Errorf("Expected no email claims for a user without an email, got %v", info)
+	}
+
+	claims := &crypto.AccessTokenClaims{UserID: user.ID, EnvironmentID: ulid.Make().String(), Scope: "openid email"}
+	if _, err := oidcService.UserInfo(ctx, env.ID, claims); err == nil || err.Error() != "invalid_token" {
+		t.Errorf("Expected invalid_token for another environment's token, got %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package service
+
+import (
+	"crypto/rand"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/marcioecom/permit/internal/models"
+)
+
+// Defaults and bounds for the one-time code policy an environment can
+// configure
+const (
+	defaultOTPLength     = 6
+	defaultOTPTTL        = 10 * time.Minute
+	defaultOTPMaxResends = 5
+
+	minOTPLength     = 4
+	maxOTPLength     = 10
+	minOTPTTL        = time.Minute
+	maxOTPTTL        = time.Hour
+	maxOTPMaxResends = 20
+)
+
+// otpResendCooldown is how long a user waits between codes sent to the same
+// email or phone
+const otpResendCooldown = 30 * time.Second
+
+// ResendCooldownError is returned when a code is requested again before
+// otpResendCooldown is over
+type ResendCooldownError struct {
+	RetryAt time.Time
+}
+
+func (e *ResendCooldownError) Error() string {
+	return "resend_cooldown"
+}
+
+var otpCharsets = map[string]string{
+	models.OTPAlphabetNumeric:      "0123456789",
+	models.OTPAlphabetAlphanumeric: "23456789ABCDEFGHJKLMNPQRSTUVWXYZ",
+}
+
+// otpPolicy is how an environment's one-time codes look, how long they stay
+// valid and how often they can be resent
+type otpPolicy struct {
+	Length     int
+	Alphabet   string // models.OTPAlphabetNumeric or models.OTPAlphabetAlphanumeric
+	TTL        time.Duration
+	MaxResends int
+}
+
+// otpPolicyFor returns an environment's policy. Environments are created
+// with the default policy, which is also used when one wasn't loaded.
+func otpPolicyFor(env *models.Environment) otpPolicy {
+	if env == nil || env.OTPLength == 0 {
+		return otpPolicy{
+			Length:     defaultOTPLength,
+			Alphabet:   models.OTPAlphabetNumeric,
+			TTL:        defaultOTPTTL,
+			MaxResends: defaultOTPMaxResends,
+		}
+	}
+	policy := otpPolicy{
+		Length:     env.OTPLength,
+		Alphabet:   env.OTPAlphabet,
+		TTL:        time.Duration(env.OTPTTL) * time.Second,
+		MaxResends: env.OTPMaxResends,
+	}
+	if _, ok := otpCharsets[policy.Alphabet]; !ok {
+		policy.Alphabet = models.OTPAlphabetNumeric
+	}
+	return policy
+}
+
+// generate returns a random code following the policy
+func (p otpPolicy) generate() string {
+	charset := otpCharsets[p.Alphabet]
+	code := make([]byte, p.Length)
+	for i := range code {
+		n, _ := rand.Int(rand.Reader, big.NewInt(int64(len(charset))))
+		code[i] = charset[n.Int64()]
+	}
+	return string(code)
+}
+
+// normalize puts a code as typed by a user in the form it was generated in
+func (p otpPolicy) normalize(code string) string {
+	code = strings.TrimSpace(code)
+	if p.Alphabet == models.OTPAlphabetAlphanumeric {
+		code = strings.ToUpper(code)
+	}
+	return code
+}
+
+// valid reports whether a normalized code could have been generated by the
+// policy
+func (p otpPolicy) valid(code string) bool {
+	if len(code) != p.Length {
+		return false
+	}
+	charset := otpCharsets[p.Alphabet]
+	for _, c := range code {
+		if !strings.ContainsRune(charset, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// validOTPPolicy reports whether an environment's one-time code policy is
+// within bounds
+func validOTPPolicy(env *models.Environment) bool {
+	if _, ok := otpCharsets[env.OTPAlphabet]; !ok {
+		return false
+	}
+	ttl := time.Duration(env.OTPTTL) * time.Second
+	return env.OTPLength >= minOTPLength && env.OTPLength <= maxOTPLength &&
+		ttl >= minOTPTTL && ttl <= maxOTPTTL &&
+		env.OTPMaxResends >= 0 && env.OTPMaxResends <= maxOTPMaxResends
+}
@@ -2,7 +2,9 @@ package service
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"slices"
 
 	"github.com/marcioecom/permit/internal/models"
 	"github.com/marcioecom/permit/internal/repository"
@@ -179,13 +181,15 @@ type CreateAPIKeyInput struct {
 	ProjectID     string
 	Name          string
 	EnvironmentID string
+	Scopes        []string // grantable through the client credentials grant
 }
 
 type CreateAPIKeyOutput struct {
-	ID           string `json:"id"`
-	ClientID     string `json:"clientId"`
-	ClientSecret string `json:"clientSecret"`
-	Name         string `json:"name"`
+	ID           string   `json:"id"`
+	ClientID     string   `json:"clientId"`
+	ClientSecret string   `json:"clientSecret"`
+	Name         string   `json:"name"`
+	Scopes       []string `json:"scopes"`
 }
 
 func (s *ProjectService) CreateAPIKey(ctx context.Context, input CreateAPIKeyInput) (*CreateAPIKeyOutput, error) {
@@ -199,6 +203,16 @@ func (s *ProjectService) CreateAPIKey(ctx context.Context, input CreateAPIKeyInp
 		envID = env.ID
 	}
 
+	scopes := []string{}
+	for _, scope := range input.Scopes {
+		if !validScopeToken(scope) {
+			return nil, fmt.Errorf("invalid_scope")
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
 	clientID := repository.GenerateClientID()
 	clientSecret, secretHash, err := repository.GenerateClientSecret()
 	if err != nil {
@@ -217,6 +231,7 @@ func (s *ProjectService) CreateAPIKey(ctx context.Context, input CreateAPIKeyInp
 		Name:             name,
 		ClientID:         clientID,
 		ClientSecretHash: secretHash,
+		Scopes:           scopes,
 	}
 
 	if err := s.repo.CreateAPIKey(ctx, apiKey); err != nil {
@@ -228,6 +243,7 @@ func (s *ProjectService) CreateAPIKey(ctx context.Context, input CreateAPIKeyInp
 		ClientID:     clientID,
 		ClientSecret: clientSecret,
 		Name:         name,
+		Scopes:       scopes,
 	}, nil
 }
 
@@ -292,3 +308,79 @@ func (s *ProjectService) RevokeAPIKey(ctx context.Context, projectID, keyID, own
 
 	return s.repo.RevokeAPIKey(ctx, projectID, keyID)
 }
+
+func (s *ProjectService) GetClaimsTemplate(ctx context.Context, projectID, ownerID string) (json.RawMessage, error) {
+	project, err := s.repo.GetByID(ctx, projectID)
+	if err != nil || project == nil {
+		return nil, fmt.Errorf("project_not_found")
+	}
+	if project.OwnerID != ownerID {
+		return nil, fmt.Errorf("forbidden")
+	}
+	return project.ClaimsTemplate, nil
+}
+
+type UpdateClaimsTemplateInput struct {
+	ProjectID string
+	OwnerID   string
+	Template  json.RawMessage
+}
+
+// UpdateClaimsTemplate replaces the template custom access token claims are
+// rendered from. It applies to tokens issued from then on.
+func (s *ProjectService) UpdateClaimsTemplate(ctx context.Context, input UpdateClaimsTemplateInput) (json.RawMessage, error) {
+	project, err := s.repo.GetByID(ctx, input.ProjectID)
+	if err != nil || project == nil {
+		return nil, fmt.Errorf("project_not_found")
+	}
+	if project.OwnerID != input.OwnerID {
+		return nil, fmt.Errorf("forbidden")
+	}
+
+	if err := ValidateClaimsTemplate(input.Template); err != nil {
+		return nil, err
+	}
+
+	project.ClaimsTemplate = input.Template
+	if err := s.repo.Update(ctx, project); err != nil {
+		return nil, err
+	}
+	return project.ClaimsTemplate, nil
+}
+
+type UpdateUserMetadataInput struct {
+	ProjectID     string
+	UserID        string
+	EnvironmentID string // optional; empty means every environment of the project
+	OwnerID       string
+	Metadata      json.RawMessage
+}
+
+// UpdateUserMetadata replaces the metadata claims templates see as
+// user.metadata
+func (s *ProjectService) UpdateUserMetadata(ctx context.Context, input UpdateUserMetadataInput) error {
+	project, err := s.repo.GetByID(ctx, input.ProjectID)
+	if err != nil || project == nil {
+		return fmt.Errorf("project_not_found")
+	}
+	if project.OwnerID != input.OwnerID {
+		return fmt.Errorf("forbidden")
+	}
+
+	var metadata map[string]any
+	if err := json.Unmarshal(input.Metadata, &metadata); err != nil || metadata == nil {
+		return fmt.Errorf("invalid_metadata")
+	}
+	if len(input.Metadata) > maxClaimsTemplateSize {
+		return fmt.Errorf("metadata_too_large")
+	}
+
+	found, err := s.repo.UpdateProjectUserMetadata(ctx, input.ProjectID, input.EnvironmentID, input.UserID, input.Metadata)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("user_not_found")
+	}
+	return nil
+}
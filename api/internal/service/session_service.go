@@ -2,31 +2,340 @@ package service
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"slices"
+	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/marcioecom/permit/internal/crypto"
+	"github.com/marcioecom/permit/internal/models"
 	"github.com/marcioecom/permit/internal/repository"
+	"github.com/oklog/ulid/v2"
+	"github.com/rs/zerolog/log"
 )
 
 type SessionService struct {
-	jwtService *crypto.JWTService
-	userRepo   repository.UserRepository
+	jwtService       *crypto.JWTService
+	userRepo         repository.UserRepository
+	refreshTokenRepo repository.RefreshTokenRepository
+	sessionRepo      repository.SessionRepository
+	denylistRepo     repository.AccessTokenDenylistRepository
+	projectRepo      repository.ProjectRepository
+	envRepo          repository.EnvironmentRepository
+	identityRepo     repository.IdentityRepository
+	keyProvisioner   KeyProvisioner
 }
 
-func NewSessionService(jwtService *crypto.JWTService, userRepo repository.UserRepository) *SessionService {
+func NewSessionService(
+	jwtService *crypto.JWTService,
+	userRepo repository.UserRepository,
+	refreshTokenRepo repository.RefreshTokenRepository,
+	sessionRepo repository.SessionRepository,
+	denylistRepo repository.AccessTokenDenylistRepository,
+	projectRepo repository.ProjectRepository,
+	envRepo repository.EnvironmentRepository,
+	identityRepo repository.IdentityRepository,
+	keyProvisioner KeyProvisioner,
+) *SessionService {
 	return &SessionService{
-		jwtService: jwtService,
-		userRepo:   userRepo,
+		jwtService:       jwtService,
+		userRepo:         userRepo,
+		refreshTokenRepo: refreshTokenRepo,
+		sessionRepo:      sessionRepo,
+		denylistRepo:     denylistRepo,
+		projectRepo:      projectRepo,
+		envRepo:          envRepo,
+		identityRepo:     identityRepo,
+		keyProvisioner:   keyProvisioner,
 	}
 }
 
+type CreateSessionInput struct {
+	UserID        string
+	Email         string
+	ProjectID     string
+	EnvironmentID string
+	Provider      string
+	// AMR lists methods completed on top of the provider's, such as a
+	// second factor
+	AMR []string
+	// AuthTime is when the user authenticated, for sessions started from an
+	// earlier sign-in; it defaults to now
+	AuthTime time.Time
+	// ClientID is the OIDC relying party the session is issued to, which
+	// alone may refresh it, and Scope the scopes it was granted
+	ClientID  string
+	Scope     string
+	IPAddress string
+	UserAgent string
+}
+
+type SessionTokens struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresAt    time.Time // when the access token expires
+}
+
+// CreateSession records a new session and issues its access token and the
+// first refresh token of its family.
+func (s *SessionService) CreateSession(ctx context.Context, input CreateSessionInput) (*SessionTokens, error) {
+	sessionID := ulid.Make().String()
+
+	policy := s.tokenPolicy(ctx, input.EnvironmentID)
+	now := time.Now()
+	accessExpiresAt := policy.accessExpiry(now, now)
+
+	refreshToken, stored, err := s.newRefreshToken(input.UserID, input.ProjectID, input.EnvironmentID, sessionID, policy.Algorithm, policy.refreshExpiry(now, now))
+	if err != nil {
+		return nil, err
+	}
+
+	amr := amrForProvider(input.Provider)
+	for _, method := range input.AMR {
+		if !slices.Contains(amr, method) {
+			amr = append(amr, method)
+		}
+	}
+	authTime := input.AuthTime
+	if authTime.IsZero() {
+		authTime = now
+	}
+
+	accessToken, err := s.jwtService.SignAccessToken(crypto.AccessTokenInput{
+		Email:         input.Email,
+		UserID:        input.UserID,
+		ProjectID:     input.ProjectID,
+		EnvironmentID: input.EnvironmentID,
+		SessionID:     sessionID,
+		Provider:      input.Provider,
+		Algorithm:     policy.Algorithm,
+		ExpiresAt:     accessExpiresAt,
+		CustomClaims:  s.customClaims(ctx, input.UserID, input.Email, input.ProjectID, input.Provider, policy.environment),
+		AuthTime:      authTime,
+		AMR:           amr,
+		Scope:         input.Scope,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("token_generation_failed")
+	}
+
+	err = s.sessionRepo.Create(ctx, &models.Session{
+		ID:            sessionID,
+		UserID:        input.UserID,
+		ProjectID:     input.ProjectID,
+		EnvironmentID: input.EnvironmentID,
+		Provider:      input.Provider,
+		IPAddress:     input.IPAddress,
+		UserAgent:     input.UserAgent,
+		AuthTime:      authTime,
+		AMR:           amr,
+		ClientID:      input.ClientID,
+		Scope:         input.Scope,
+		ExpiresAt:     stored.ExpiresAt,
+	}, stored)
+	if err != nil {
+		return nil, fmt.Errorf("session_save_failed: %w", err)
+	}
+
+	return &SessionTokens{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresAt:    accessExpiresAt,
+	}, nil
+}
+
+// Authentication methods of the amr claim, as registered by RFC 8176
+const (
+	AMROTP   = "otp"
+	AMRSMS   = "sms"
+	AMROAuth = "oauth" // not registered; a sign-in through a social provider
+	AMRTOTP  = "totp"  // not registered; an authenticator app's code
+	AMRMFA   = "mfa"
+)
+
+// amrForProvider returns the authentication methods behind a sign-in with
+// provider
+func amrForProvider(provider string) []string {
+	switch provider {
+	case "":
+		return nil
+	case models.ProviderEmail:
+		return []string{AMROTP}
+	case models.ProviderPhone:
+		return []string{AMRSMS}
+	default:
+		return []string{AMROAuth}
+	}
+}
+
+// tokenPolicy describes how an environment signs its tokens and how long
+// they and the sessions behind them live
+type tokenPolicy struct {
+	Algorithm       string
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	IdleTimeout     time.Duration // zero disables
+	MaxLifetime     time.Duration // zero disables
+
+	environment *models.Environment // nil when it couldn't be loaded
+}
+
+// accessExpiry returns when an access token issued now for a session started
+// at start expires
+func (p tokenPolicy) accessExpiry(start, now time.Time) time.Time {
+	return p.capLifetime(start, now.Add(p.AccessTokenTTL))
+}
+
+// refreshExpiry returns when a refresh token issued now for a session started
+// at start expires. Refreshing within the idle timeout keeps the session
+// alive until it reaches its maximum lifetime.
+func (p tokenPolicy) refreshExpiry(start, now time.Time) time.Time {
+	expiresAt := now.Add(p.RefreshTokenTTL)
+	if p.IdleTimeout > 0 && now.Add(p.IdleTimeout).Before(expiresAt) {
+		expiresAt = now.Add(p.IdleTimeout)
+	}
+	return p.capLifetime(start, expiresAt)
+}
+
+func (p tokenPolicy) capLifetime(start, expiresAt time.Time) time.Time {
+	if p.MaxLifetime > 0 && start.Add(p.MaxLifetime).Before(expiresAt) {
+		return start.Add(p.MaxLifetime)
+	}
+	return expiresAt
+}
+
+// tokenPolicy loads an environment's signing algorithm and lifetimes, falling
+// back to the defaults when the environment can't be loaded. The
+// environment's keys for its algorithm are provisioned on first use.
+func (s *SessionService) tokenPolicy(ctx context.Context, environmentID string) tokenPolicy {
+	policy := tokenPolicy{
+		Algorithm:       crypto.DefaultAlgorithm,
+		AccessTokenTTL:  crypto.AccessTokenDuration,
+		RefreshTokenTTL: crypto.RefreshTokenDuration,
+	}
+	if environmentID == "" {
+		return policy
+	}
+
+	env, err := s.envRepo.GetByID(ctx, environmentID)
+	if err == nil && env != nil {
+		policy.environment = env
+		if env.SigningAlgorithm != "" {
+			policy.Algorithm = env.SigningAlgorithm
+		}
+		if env.AccessTokenTTL > 0 {
+			policy.AccessTokenTTL = time.Duration(env.AccessTokenTTL) * time.Second
+		}
+		if env.RefreshTokenTTL > 0 {
+			policy.RefreshTokenTTL = time.Duration(env.RefreshTokenTTL) * time.Second
+		}
+		policy.IdleTimeout = time.Duration(env.SessionIdleTimeout) * time.Second
+		policy.MaxLifetime = time.Duration(env.SessionMaxLifetime) * time.Second
+	}
+
+	if s.keyProvisioner != nil {
+		if err := s.keyProvisioner.EnsureEnvironmentKeys(ctx, environmentID, policy.Algorithm); err != nil {
+			log.Error().Err(err).Str("environmentId", environmentID).Msg("failed to provision signing keys")
+		}
+	}
+	return policy
+}
+
+// customClaims renders the project's claims template for a user signing in
+// with provider. Failures are logged and leave the custom claims out rather
+// than failing the sign-in.
+func (s *SessionService) customClaims(ctx context.Context, userID, email, projectID, provider string, env *models.Environment) map[string]any {
+	project, err := s.projectRepo.GetByID(ctx, projectID)
+	if err != nil || project == nil || len(project.ClaimsTemplate) == 0 || string(project.ClaimsTemplate) == "{}" {
+		return nil
+	}
+
+	data := ClaimsTemplateData{
+		User:    map[string]any{"id": userID, "email": email, "metadata": map[string]any{}},
+		Project: map[string]any{"id": project.ID, "name": project.Name},
+	}
+
+	if env != nil {
+		data.Environment = map[string]any{"id": env.ID, "name": env.Name, "type": env.Type}
+
+		metadata, err := s.projectRepo.GetProjectUserMetadata(ctx, env.ID, userID)
+		if err != nil {
+			log.Warn().Err(err).Str("userId", userID).Msg("failed to load user metadata for claims")
+		} else if len(metadata) > 0 {
+			data.User["metadata"] = decodeMetadata(metadata)
+		}
+	}
+
+	if s.identityRepo != nil && provider != "" {
+		identity, err := s.identityRepo.GetByUserAndProvider(ctx, userID, provider)
+		if err != nil {
+			log.Warn().Err(err).Str("userId", userID).Msg("failed to load identity for claims")
+		} else if identity != nil {
+			data.Identity = map[string]any{
+				"provider":       identity.Provider,
+				"providerUserId": identity.ProviderUserID,
+				"email":          identity.Email,
+				"metadata":       decodeMetadata(identity.Metadata),
+			}
+		}
+	}
+
+	claims, err := RenderClaimsTemplate(project.ClaimsTemplate, data)
+	if err != nil {
+		log.Error().Err(err).Str("projectId", projectID).Msg("failed to render claims template")
+		return nil
+	}
+	return claims
+}
+
+func decodeMetadata(raw json.RawMessage) map[string]any {
+	metadata := map[string]any{}
+	if len(raw) > 0 {
+		_ = json.Unmarshal(raw, &metadata)
+	}
+	return metadata
+}
+
+// newRefreshToken signs a refresh token and builds its persisted record within
+// the given family, which is also the ID of the owning session.
+func (s *SessionService) newRefreshToken(userID, projectID, environmentID, familyID, algorithm string, expiresAt time.Time) (string, *models.RefreshToken, error) {
+	token, err := s.jwtService.SignRefreshToken(crypto.RefreshTokenInput{
+		UserID:        userID,
+		ProjectID:     projectID,
+		EnvironmentID: environmentID,
+		Algorithm:     algorithm,
+		ExpiresAt:     expiresAt,
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("token_generation_failed")
+	}
+
+	return token, &models.RefreshToken{
+		ID:            ulid.Make().String(),
+		UserID:        userID,
+		ProjectID:     projectID,
+		EnvironmentID: environmentID,
+		FamilyID:      familyID,
+		TokenHash:     crypto.HashToken(token),
+		ExpiresAt:     expiresAt,
+	}, nil
+}
+
 type RefreshTokenInput struct {
 	RefreshToken string
+	// ClientID is the OIDC relying party presenting the token; empty for
+	// first-party refreshes
+	ClientID  string
+	IPAddress string
+	UserAgent string
 }
 
 type RefreshTokenOutput struct {
-	AccessToken  string `json:"accessToken"`
-	RefreshToken string `json:"refreshToken"`
+	AccessToken  string    `json:"accessToken"`
+	RefreshToken string    `json:"refreshToken"`
+	ExpiresAt    time.Time `json:"-"` // when the access token expires
 }
 
 func (s *SessionService) RefreshToken(ctx context.Context, input RefreshTokenInput) (*RefreshTokenOutput, error) {
@@ -35,24 +344,512 @@ func (s *SessionService) RefreshToken(ctx context.Context, input RefreshTokenInp
 		return nil, fmt.Errorf("invalid_refresh_token")
 	}
 
-	user, err := s.userRepo.GetByID(ctx, claims.UserID)
+	stored, err := s.refreshTokenRepo.GetByHash(ctx, crypto.HashToken(input.RefreshToken))
+	if err != nil {
+		return nil, err
+	}
+	if stored == nil || stored.UserID != claims.UserID {
+		return nil, fmt.Errorf("invalid_refresh_token")
+	}
+
+	// A token only refreshes through the client its session was issued to,
+	// checked first so another client can't burn it
+	session, err := s.sessionRepo.GetByID(ctx, stored.FamilyID)
+	if err != nil {
+		return nil, err
+	}
+	if (session == nil && input.ClientID != "") || (session != nil && session.ClientID != input.ClientID) {
+		return nil, fmt.Errorf("invalid_refresh_token")
+	}
+
+	user, err := s.userRepo.GetByID(ctx, stored.UserID)
 	if err != nil || user == nil {
 		return nil, fmt.Errorf("user_not_found")
 	}
 
-	accessToken, err := s.jwtService.SignAccessToken(user.Email, user.ID, claims.ProjectID, "", "refresh")
+	if stored.RevokedAt != nil {
+		if stored.ReplacedBy != nil {
+			s.handleReuse(ctx, stored, user.Email, input)
+			return nil, fmt.Errorf("refresh_token_reused")
+		}
+		return nil, fmt.Errorf("refresh_token_revoked")
+	}
+
+	if time.Now().After(stored.ExpiresAt) {
+		return nil, fmt.Errorf("invalid_refresh_token")
+	}
+
+	start := stored.CreatedAt
+	environmentID := stored.EnvironmentID
+	provider := ""
+	authTime := start
+	var amr []string
+	var scope string
+	if session != nil {
+		start = session.CreatedAt
+		provider = session.Provider
+		authTime = session.AuthTime
+		amr = session.AMR
+		scope = session.Scope
+		if environmentID == "" {
+			environmentID = session.EnvironmentID
+		}
+	}
+	if environmentID == "" {
+		environmentID = claims.EnvironmentID
+	}
+
+	policy := s.tokenPolicy(ctx, environmentID)
+	now := time.Now()
+	if policy.MaxLifetime > 0 && !now.Before(start.Add(policy.MaxLifetime)) {
+		if err := s.refreshTokenRepo.RevokeFamily(ctx, stored.FamilyID); err != nil {
+			log.Error().Err(err).Str("familyId", stored.FamilyID).Msg("failed to revoke refresh token family")
+		}
+		return nil, fmt.Errorf("session_expired")
+	}
+	accessExpiresAt := policy.accessExpiry(start, now)
+
+	accessToken, err := s.jwtService.SignAccessToken(crypto.AccessTokenInput{
+		Email:         user.Email,
+		UserID:        user.ID,
+		ProjectID:     stored.ProjectID,
+		EnvironmentID: environmentID,
+		SessionID:     stored.FamilyID,
+		Provider:      provider,
+		Algorithm:     policy.Algorithm,
+		ExpiresAt:     accessExpiresAt,
+		CustomClaims:  s.customClaims(ctx, user.ID, user.Email, stored.ProjectID, provider, policy.environment),
+		AuthTime:      authTime,
+		AMR:           amr,
+		Scope:         scope,
+	})
 	if err != nil {
 		return nil, fmt.Errorf("token_generation_failed")
 	}
 
-	refreshToken, err := s.jwtService.SignRefreshToken(user.ID, claims.ProjectID)
+	refreshToken, next, err := s.newRefreshToken(user.ID, stored.ProjectID, environmentID, stored.FamilyID, policy.Algorithm, policy.refreshExpiry(start, now))
 	if err != nil {
-		return nil, fmt.Errorf("token_generation_failed")
+		return nil, err
+	}
+
+	if err := s.refreshTokenRepo.Rotate(ctx, stored.ID, next); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			// Lost a race against another request presenting the same token.
+			s.handleReuse(ctx, stored, user.Email, input)
+			return nil, fmt.Errorf("refresh_token_reused")
+		}
+		return nil, err
+	}
+
+	if err := s.sessionRepo.Touch(ctx, stored.FamilyID, input.IPAddress, input.UserAgent, next.ExpiresAt); err != nil {
+		log.Warn().Err(err).Str("sessionId", stored.FamilyID).Msg("failed to update session activity")
 	}
 
 	return &RefreshTokenOutput{
 		AccessToken:  accessToken,
 		RefreshToken: refreshToken,
+		ExpiresAt:    accessExpiresAt,
+	}, nil
+}
+
+// handleReuse revokes every token in the family of a replayed refresh token
+// and records the incident, since either the legitimate client or an attacker
+// now holds a stolen token.
+func (s *SessionService) handleReuse(ctx context.Context, stored *models.RefreshToken, email string, input RefreshTokenInput) {
+	if err := s.refreshTokenRepo.RevokeFamily(ctx, stored.FamilyID); err != nil {
+		log.Error().Err(err).Str("familyId", stored.FamilyID).Msg("failed to revoke refresh token family")
+	}
+
+	log.Warn().Str("userId", stored.UserID).Str("familyId", stored.FamilyID).Msg("refresh token reuse detected")
+
+	s.logAuthEvent(ctx, stored.ProjectID, stored.EnvironmentID, stored.UserID, email, "token_refresh", "REUSE_DETECTED", input.IPAddress, input.UserAgent, map[string]string{"familyId": stored.FamilyID})
+}
+
+func (s *SessionService) logAuthEvent(ctx context.Context, projectID, environmentID, userID, email, eventType, status, ip, ua string, metadata map[string]string) {
+	err := s.projectRepo.InsertAuthLog(ctx, &models.AuthLog{
+		ID:            ulid.Make().String(),
+		ProjectID:     projectID,
+		EnvironmentID: environmentID,
+		UserID:        userID,
+		UserEmail:     email,
+		EventType:     eventType,
+		Status:        status,
+		IPAddress:     ip,
+		UserAgent:     ua,
+		Metadata:      metadata,
+		CreatedAt:     time.Now(),
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to log auth event")
+	}
+}
+
+// activeSession loads the session behind an access token, provided it is
+// still signed in
+func (s *SessionService) activeSession(ctx context.Context, claims *crypto.AccessTokenClaims) (*models.Session, error) {
+	if claims.SessionID == "" || claims.Actor != nil {
+		return nil, fmt.Errorf("session_required")
+	}
+
+	session, err := s.sessionRepo.GetByID(ctx, claims.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	if session == nil || session.UserID != claims.UserID || session.RevokedAt != nil || time.Now().After(session.ExpiresAt) {
+		return nil, fmt.Errorf("session_not_found")
+	}
+	return session, nil
+}
+
+// AuthenticatedWithin reports whether the user behind an access token
+// actively authenticated within maxAge
+func (s *SessionService) AuthenticatedWithin(ctx context.Context, claims *crypto.AccessTokenClaims, maxAge time.Duration) (bool, error) {
+	session, err := s.activeSession(ctx, claims)
+	if err != nil {
+		return false, err
+	}
+	return time.Since(session.AuthTime) <= maxAge, nil
+}
+
+type ReauthenticateSessionInput struct {
+	Claims    *crypto.AccessTokenClaims
+	Method    string // amr value of the method the user just completed
+	IPAddress string
+	UserAgent string
+}
+
+// Reauthenticate records that the user behind an access token proved their
+// identity again and issues an access token with the new auth_time. The
+// session and its refresh tokens are kept, and later refreshes carry the new
+// auth_time.
+func (s *SessionService) Reauthenticate(ctx context.Context, input ReauthenticateSessionInput) (*SessionTokens, error) {
+	claims := input.Claims
+	session, err := s.activeSession(ctx, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.userRepo.GetByID(ctx, session.UserID)
+	if err != nil || user == nil {
+		return nil, fmt.Errorf("user_not_found")
+	}
+
+	now := time.Now()
+	// A second factor completed at sign-in still holds for the session
+	amr := []string{input.Method}
+	for _, method := range session.AMR {
+		if (method == AMRTOTP || method == AMRMFA) && !slices.Contains(amr, method) {
+			amr = append(amr, method)
+		}
+	}
+	if err := s.sessionRepo.UpdateAuthentication(ctx, session.ID, now, amr); err != nil {
+		return nil, err
+	}
+
+	policy := s.tokenPolicy(ctx, session.EnvironmentID)
+	accessExpiresAt := policy.accessExpiry(session.CreatedAt, now)
+
+	accessToken, err := s.jwtService.SignAccessToken(crypto.AccessTokenInput{
+		Email:         user.Email,
+		UserID:        user.ID,
+		ProjectID:     session.ProjectID,
+		EnvironmentID: session.EnvironmentID,
+		SessionID:     session.ID,
+		Provider:      session.Provider,
+		Algorithm:     policy.Algorithm,
+		ExpiresAt:     accessExpiresAt,
+		CustomClaims:  s.customClaims(ctx, user.ID, user.Email, session.ProjectID, session.Provider, policy.environment),
+		AuthTime:      now,
+		AMR:           amr,
+		Scope:         session.Scope,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("token_generation_failed")
+	}
+
+	s.logAuthEvent(ctx, session.ProjectID, session.EnvironmentID, user.ID, user.Email, "reauthentication", "SUCCESS", input.IPAddress, input.UserAgent, map[string]string{"sessionId": session.ID, "method": input.Method})
+
+	return &SessionTokens{
+		AccessToken: accessToken,
+		ExpiresAt:   accessExpiresAt,
+	}, nil
+}
+
+type LogoutInput struct {
+	Claims *crypto.AccessTokenClaims
+	// Everywhere revokes every session the user has in the token's
+	// environment instead of only the current one.
+	Everywhere bool
+	IPAddress  string
+	UserAgent  string
+}
+
+// Logout revokes the refresh token family behind the caller's access token and
+// denylists the access token itself so it stops working before it expires.
+func (s *SessionService) Logout(ctx context.Context, input LogoutInput) error {
+	claims := input.Claims
+
+	if input.Everywhere {
+		if claims.EnvironmentID == "" {
+			return fmt.Errorf("environment_required")
+		}
+		if err := s.refreshTokenRepo.RevokeAllForUser(ctx, claims.UserID, claims.EnvironmentID); err != nil {
+			return err
+		}
+	} else if claims.SessionID != "" {
+		if err := s.refreshTokenRepo.RevokeFamily(ctx, claims.SessionID); err != nil {
+			return err
+		}
+	}
+
+	if claims.ID != "" && claims.ExpiresAt != nil {
+		if err := s.denylistRepo.Add(ctx, claims.ID, claims.UserID, claims.ExpiresAt.Time); err != nil {
+			return err
+		}
+	}
+
+	status := "SUCCESS"
+	if input.Everywhere {
+		status = "ALL_SESSIONS"
+	}
+	s.logAuthEvent(ctx, claims.ProjectID, claims.EnvironmentID, claims.UserID, claims.Email, "logout", status, input.IPAddress, input.UserAgent, map[string]string{"provider": claims.Provider})
+
+	return nil
+}
+
+type SessionInfo struct {
+	ID            string    `json:"id"`
+	EnvironmentID string    `json:"environmentId"`
+	Device        string    `json:"device"`
+	IPAddress     string    `json:"ipAddress"`
+	UserAgent     string    `json:"userAgent"`
+	Provider      string    `json:"provider"`
+	Current       bool      `json:"current"`
+	CreatedAt     time.Time `json:"createdAt"`
+	LastUsedAt    time.Time `json:"lastUsedAt"`
+}
+
+func toSessionInfos(sessions []*models.Session, currentID string) []SessionInfo {
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		infos = append(infos, SessionInfo{
+			ID:            session.ID,
+			EnvironmentID: session.EnvironmentID,
+			Device:        describeDevice(session.UserAgent),
+			IPAddress:     session.IPAddress,
+			UserAgent:     session.UserAgent,
+			Provider:      session.Provider,
+			Current:       currentID != "" && session.ID == currentID,
+			CreatedAt:     session.CreatedAt,
+			LastUsedAt:    session.LastUsedAt,
+		})
+	}
+	return infos
+}
+
+// ListSessions returns the caller's active sessions in the environment their
+// access token was issued for.
+func (s *SessionService) ListSessions(ctx context.Context, claims *crypto.AccessTokenClaims) ([]SessionInfo, error) {
+	if claims.EnvironmentID == "" {
+		return nil, fmt.Errorf("environment_required")
+	}
+
+	sessions, err := s.sessionRepo.ListActiveByUser(ctx, claims.UserID, claims.EnvironmentID)
+	if err != nil {
+		return nil, err
+	}
+
+	return toSessionInfos(sessions, claims.SessionID), nil
+}
+
+type RevokeSessionInput struct {
+	Claims    *crypto.AccessTokenClaims
+	SessionID string
+	IPAddress string
+	UserAgent string
+}
+
+// RevokeSession signs one of the caller's own devices out. Revoking the
+// current session behaves like Logout.
+func (s *SessionService) RevokeSession(ctx context.Context, input RevokeSessionInput) error {
+	if input.SessionID == input.Claims.SessionID {
+		return s.Logout(ctx, LogoutInput{
+			Claims:    input.Claims,
+			IPAddress: input.IPAddress,
+			UserAgent: input.UserAgent,
+		})
+	}
+
+	session, err := s.sessionRepo.GetByID(ctx, input.SessionID)
+	if err != nil {
+		return err
+	}
+	if session == nil || session.UserID != input.Claims.UserID || session.EnvironmentID != input.Claims.EnvironmentID {
+		return fmt.Errorf("session_not_found")
+	}
+
+	if err := s.refreshTokenRepo.RevokeFamily(ctx, session.ID); err != nil {
+		return err
+	}
+
+	claims := input.Claims
+	s.logAuthEvent(ctx, claims.ProjectID, claims.EnvironmentID, claims.UserID, claims.Email, "session_revoked", "SUCCESS", input.IPAddress, input.UserAgent, map[string]string{"provider": session.Provider, "sessionId": session.ID})
+
+	return nil
+}
+
+// Dashboard session administration
+
+type ProjectUserSessionsInput struct {
+	ProjectID     string
+	UserID        string
+	EnvironmentID string // optional; empty means every environment of the project
+	SessionID     string // optional; only used when revoking a single session
+	OwnerID       string
+	OwnerEmail    string
+	IPAddress     string
+	UserAgent     string
+}
+
+func (s *SessionService) authorizeOwner(ctx context.Context, projectID, ownerID string) error {
+	project, err := s.projectRepo.GetByID(ctx, projectID)
+	if err != nil || project == nil {
+		return fmt.Errorf("project_not_found")
+	}
+	if project.OwnerID != ownerID {
+		return fmt.Errorf("forbidden")
+	}
+	return nil
+}
+
+func (s *SessionService) ListProjectUserSessions(ctx context.Context, input ProjectUserSessionsInput) ([]SessionInfo, error) {
+	if err := s.authorizeOwner(ctx, input.ProjectID, input.OwnerID); err != nil {
+		return nil, err
+	}
+
+	sessions, err := s.sessionRepo.ListActiveByProjectUser(ctx, input.ProjectID, input.UserID, input.EnvironmentID)
+	if err != nil {
+		return nil, err
+	}
+
+	return toSessionInfos(sessions, ""), nil
+}
+
+// RevokeProjectUserSessions lets a project owner force-logout one of their
+// users, either from a single session or from every session in an environment.
+func (s *SessionService) RevokeProjectUserSessions(ctx context.Context, input ProjectUserSessionsInput) error {
+	if err := s.authorizeOwner(ctx, input.ProjectID, input.OwnerID); err != nil {
+		return err
+	}
+
+	environmentID := input.EnvironmentID
+	if input.SessionID != "" {
+		session, err := s.sessionRepo.GetByID(ctx, input.SessionID)
+		if err != nil {
+			return err
+		}
+		if session == nil || session.ProjectID != input.ProjectID || session.UserID != input.UserID {
+			return fmt.Errorf("session_not_found")
+		}
+		if err := s.refreshTokenRepo.RevokeFamily(ctx, session.ID); err != nil {
+			return err
+		}
+		environmentID = session.EnvironmentID
+	} else {
+		if err := s.refreshTokenRepo.RevokeAllForProjectUser(ctx, input.ProjectID, input.UserID, input.EnvironmentID); err != nil {
+			return err
+		}
+	}
+
+	email := ""
+	if user, err := s.userRepo.GetByID(ctx, input.UserID); err == nil && user != nil {
+		email = user.Email
+	}
+
+	metadata := map[string]string{"actorId": input.OwnerID, "actorEmail": input.OwnerEmail}
+	if input.SessionID != "" {
+		metadata["sessionId"] = input.SessionID
+	}
+	s.logAuthEvent(ctx, input.ProjectID, environmentID, input.UserID, email, "session_revoked", "FORCED", input.IPAddress, input.UserAgent, metadata)
+
+	return nil
+}
+
+// maxImpersonationTTL caps impersonation tokens below the environment's
+// access token lifetime
+const maxImpersonationTTL = 15 * time.Minute
+
+type ImpersonateInput struct {
+	ProjectID     string
+	UserID        string
+	EnvironmentID string // optional; defaults to the project's default environment
+	OwnerID       string
+	OwnerEmail    string
+	IPAddress     string
+	UserAgent     string
+}
+
+type ImpersonateOutput struct {
+	AccessToken   string    `json:"accessToken"`
+	ExpiresAt     time.Time `json:"expiresAt"`
+	EnvironmentID string    `json:"environmentId"`
+}
+
+// Impersonate lets a project owner act as one of their users. The access
+// token carries an act claim naming the owner, is short-lived and comes
+// without a refresh token or session.
+func (s *SessionService) Impersonate(ctx context.Context, input ImpersonateInput) (*ImpersonateOutput, error) {
+	if err := s.authorizeOwner(ctx, input.ProjectID, input.OwnerID); err != nil {
+		return nil, err
+	}
+
+	var env *models.Environment
+	var err error
+	if input.EnvironmentID == "" {
+		env, err = s.envRepo.GetDefaultForProject(ctx, input.ProjectID)
+	} else {
+		env, err = s.envRepo.GetByID(ctx, input.EnvironmentID)
+	}
+	if err != nil || env == nil || env.ProjectID != input.ProjectID {
+		return nil, fmt.Errorf("environment_not_found")
+	}
+
+	metadata, err := s.projectRepo.GetProjectUserMetadata(ctx, env.ID, input.UserID)
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.userRepo.GetByID(ctx, input.UserID)
+	if metadata == nil || err != nil || user == nil {
+		return nil, fmt.Errorf("user_not_found")
+	}
+
+	policy := s.tokenPolicy(ctx, env.ID)
+	expiresAt := time.Now().Add(min(policy.AccessTokenTTL, maxImpersonationTTL))
+
+	accessToken, err := s.jwtService.SignAccessToken(crypto.AccessTokenInput{
+		Email:         user.Email,
+		UserID:        user.ID,
+		ProjectID:     input.ProjectID,
+		EnvironmentID: env.ID,
+		Algorithm:     policy.Algorithm,
+		ExpiresAt:     expiresAt,
+		CustomClaims:  s.customClaims(ctx, user.ID, user.Email, input.ProjectID, "", env),
+		Actor:         &crypto.Actor{Subject: input.OwnerID, Email: input.OwnerEmail},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("token_generation_failed")
+	}
+
+	s.logAuthEvent(ctx, input.ProjectID, env.ID, user.ID, user.Email, "impersonation", "SUCCESS", input.IPAddress, input.UserAgent, map[string]string{
+		"actorId":    input.OwnerID,
+		"actorEmail": input.OwnerEmail,
+		"expiresAt":  expiresAt.Format(time.RFC3339),
+	})
+
+	return &ImpersonateOutput{
+		AccessToken:   accessToken,
+		ExpiresAt:     expiresAt,
+		EnvironmentID: env.ID,
 	}, nil
 }
 
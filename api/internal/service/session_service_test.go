@@ -3,8 +3,12 @@ package service_test
 import (
 	"context"
 	"testing"
+	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/marcioecom/permit/internal/crypto"
 	"github.com/marcioecom/permit/internal/models"
+	"github.com/marcioecom/permit/internal/repository"
 	"github.com/marcioecom/permit/internal/service"
 	"github.com/oklog/ulid/v2"
 )
@@ -35,6 +39,341 @@ func (m *mockSessionUserRepo) GetByEmail(ctx context.Context, email string) (*mo
 	return nil, nil
 }
 
+type mockSessionRepo struct {
+	repository.SessionRepository
+	sessions      map[string]*models.Session
+	refreshTokens *mockRefreshTokenRepo // where new sessions' first tokens go
+}
+
+func newMockSessionRepo(refreshTokens *mockRefreshTokenRepo) *mockSessionRepo {
+	m := &mockSessionRepo{sessions: make(map[string]*models.Session), refreshTokens: refreshTokens}
+	if refreshTokens != nil {
+		refreshTokens.sessions = m.sessions
+	}
+	return m
+}
+
+func (m *mockSessionRepo) Create(ctx context.Context, session *models.Session, refreshToken *models.RefreshToken) error {
+	if session.CreatedAt.IsZero() {
+		session.CreatedAt = time.Now()
+	}
+	m.sessions[session.ID] = session
+	return m.refreshTokens.Create(ctx, refreshToken)
+}
+
+func (m *mockSessionRepo) GetByID(ctx context.Context, id string) (*models.Session, error) {
+	return m.sessions[id], nil
+}
+
+func (m *mockSessionRepo) ListActiveByUser(ctx context.Context, userID, environmentID string) ([]*models.Session, error) {
+	return m.active(func(s *models.Session) bool {
+		return s.UserID == userID && s.EnvironmentID == environmentID
+	}), nil
+}
+
+func (m *mockSessionRepo) ListActiveByProjectUser(ctx context.Context, projectID, userID, environmentID string) ([]*models.Session, error) {
+	return m.active(func(s *models.Session) bool {
+		return s.ProjectID == projectID && s.UserID == userID && (environmentID == "" || s.EnvironmentID == environmentID)
+	}), nil
+}
+
+func (m *mockSessionRepo) active(match func(*models.Session) bool) []*models.Session {
+	var active []*models.Session
+	for _, s := range m.sessions {
+		if match(s) && s.RevokedAt == nil && time.Now().Before(s.ExpiresAt) {
+			active = append(active, s)
+		}
+	}
+	return active
+}
+
+func (m *mockSessionRepo) UpdateAuthentication(ctx context.Context, id string, authTime time.Time, amr []string) error {
+	m.sessions[id].AuthTime = authTime
+	m.sessions[id].AMR = amr
+	return nil
+}
+
+func (m *mockSessionRepo) Touch(ctx context.Context, id, ip, userAgent string, expiresAt time.Time) error {
+	m.sessions[id].ExpiresAt = expiresAt
+	return nil
+}
+
+type mockRefreshTokenRepo struct {
+	repository.RefreshTokenRepository
+	tokens map[string]*models.RefreshToken // by hash
+	// beforeRotate runs once at the start of the next Rotate, to interleave
+	// a concurrent request
+	beforeRotate func()
+	// sessions are revoked along with their families, as in postgres
+	sessions map[string]*models.Session
+}
+
+func newMockRefreshTokenRepo() *mockRefreshTokenRepo {
+	return &mockRefreshTokenRepo{tokens: make(map[string]*models.RefreshToken)}
+}
+
+func (m *mockRefreshTokenRepo) Create(ctx context.Context, token *models.RefreshToken) error {
+	if token.CreatedAt.IsZero() {
+		token.CreatedAt = time.Now()
+	}
+	m.tokens[token.TokenHash] = token
+	return nil
+}
+
+func (m *mockRefreshTokenRepo) GetByHash(ctx context.Context, tokenHash string) (*models.RefreshToken, error) {
+	return m.tokens[tokenHash], nil
+}
+
+func (m *mockRefreshTokenRepo) Rotate(ctx context.Context, currentID string, next *models.RefreshToken) error {
+	if hook := m.beforeRotate; hook != nil {
+		m.beforeRotate = nil
+		hook()
+	}
+	for _, t := range m.tokens {
+		if t.ID == currentID {
+			if t.RevokedAt != nil {
+				return pgx.ErrNoRows
+			}
+			now := time.Now()
+			t.RevokedAt = &now
+			t.ReplacedBy = &next.ID
+			return m.Create(ctx, next)
+		}
+	}
+	return pgx.ErrNoRows
+}
+
+func (m *mockRefreshTokenRepo) RevokeFamily(ctx context.Context, familyID string) error {
+	return m.revoke(func(family, _, _, _ string) bool { return family == familyID })
+}
+
+func (m *mockRefreshTokenRepo) RevokeAllForProjectUser(ctx context.Context, projectID, userID, environmentID string) error {
+	return m.revoke(func(_, project, user, environment string) bool {
+		return project == projectID && user == userID && (environmentID == "" || environment == environmentID)
+	})
+}
+
+func (m *mockRefreshTokenRepo) revoke(match func(familyID, projectID, userID, environmentID string) bool) error {
+	now := time.Now()
+	for _, t := range m.tokens {
+		if match(t.FamilyID, t.ProjectID, t.UserID, t.EnvironmentID) && t.RevokedAt == nil {
+			t.RevokedAt = &now
+		}
+	}
+	for _, s := range m.sessions {
+		if match(s.ID, s.ProjectID, s.UserID, s.EnvironmentID) && s.RevokedAt == nil {
+			s.RevokedAt = &now
+		}
+	}
+	return nil
+}
+
+// active returns the family's tokens that are still usable
+func (m *mockRefreshTokenRepo) active(familyID string) []*models.RefreshToken {
+	var active []*models.RefreshToken
+	for _, t := range m.tokens {
+		if t.FamilyID == familyID && t.RevokedAt == nil {
+			active = append(active, t)
+		}
+	}
+	return active
+}
+
+func newTestJWTService(t *testing.T) *crypto.JWTService {
+	t.Helper()
+	keyManager := crypto.NewKeyManager()
+	if err := keyManager.GenerateKeyPair(); err != nil {
+		t.Fatal(err)
+	}
+	return crypto.NewJWTService(keyManager, "permit")
+}
+
+func newTestSessionService(jwtService *crypto.JWTService, userRepo *mockUserRepo, refreshTokens *mockRefreshTokenRepo, sessionRepo *mockSessionRepo, projectRepo repository.ProjectRepository, envRepo *mockEnvRepo) *service.SessionService {
+	return service.NewSessionService(jwtService, userRepo, refreshTokens, sessionRepo, nil, projectRepo, envRepo, &mockIdentityRepo{}, nil)
+}
+
+func TestSessionRefreshToken_Rotates(t *testing.T) {
+	user := &models.User{ID: ulid.Make().String(), Email: "test@example.com"}
+	userRepo := newMockUserRepo()
+	userRepo.users[user.ID] = user
+	refreshTokens := newMockRefreshTokenRepo()
+	sessionRepo := newMockSessionRepo(refreshTokens)
+	sessionService := newTestSessionService(newTestJWTService(t), userRepo, refreshTokens, sessionRepo, &mockProjectLookupRepo{}, &mockEnvRepo{})
+	ctx := context.Background()
+
+	tokens, err := sessionService.CreateSession(ctx, service.CreateSessionInput{UserID: user.ID, Email: user.Email, ProjectID: ulid.Make().String(), Provider: models.ProviderEmail})
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+
+	output, err := sessionService.RefreshToken(ctx, service.RefreshTokenInput{RefreshToken: tokens.RefreshToken})
+	if err != nil {
+		t.Fatalf("RefreshToken failed: %v", err)
+	}
+	if output.RefreshToken == tokens.RefreshToken {
+		t.Error("Expected a new refresh token")
+	}
+	if output.AccessToken == "" {
+		t.Error("Expected an access token")
+	}
+
+	old := refreshTokens.tokens[crypto.HashToken(tokens.RefreshToken)]
+	next := refreshTokens.tokens[crypto.HashToken(output.RefreshToken)]
+	if old.RevokedAt == nil || old.ReplacedBy == nil || *old.ReplacedBy != next.ID {
+		t.Error("Expected the presented token to be replaced by the new one")
+	}
+	if next.FamilyID != old.FamilyID || sessionRepo.sessions[next.FamilyID] == nil {
+		t.Errorf("Expected the new token to stay in the session's family, got %s", next.FamilyID)
+	}
+
+	if _, err := sessionService.RefreshToken(ctx, service.RefreshTokenInput{RefreshToken: output.RefreshToken}); err != nil {
+		t.Errorf("Expected the new token to refresh in turn: %v", err)
+	}
+}
+
+func TestSessionRefreshToken_ReuseRevokesFamily(t *testing.T) {
+	user := &models.User{ID: ulid.Make().String(), Email: "test@example.com"}
+	userRepo := newMockUserRepo()
+	userRepo.users[user.ID] = user
+	refreshTokens := newMockRefreshTokenRepo()
+	projectRepo := &mockProjectLookupRepo{}
+	sessionService := newTestSessionService(newTestJWTService(t), userRepo, refreshTokens, newMockSessionRepo(refreshTokens), projectRepo, &mockEnvRepo{})
+	ctx := context.Background()
+
+	tokens, err := sessionService.CreateSession(ctx, service.CreateSessionInput{UserID: user.ID, Email: user.Email, ProjectID: ulid.Make().String(), Provider: models.ProviderEmail})
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	familyID := refreshTokens.tokens[crypto.HashToken(tokens.RefreshToken)].FamilyID
+
+	output, err := sessionService.RefreshToken(ctx, service.RefreshTokenInput{RefreshToken: tokens.RefreshToken})
+	if err != nil {
+		t.Fatalf("RefreshToken failed: %v", err)
+	}
+
+	if _, err := sessionService.RefreshToken(ctx, service.RefreshTokenInput{RefreshToken: tokens.RefreshToken}); err == nil || err.Error() != "refresh_token_reused" {
+		t.Fatalf("Expected refresh_token_reused for a replayed token, got %v", err)
+	}
+	if active := refreshTokens.active(familyID); len(active) != 0 {
+		t.Errorf("Expected the whole family to be revoked, %d tokens still active", len(active))
+	}
+	if _, err := sessionService.RefreshToken(ctx, service.RefreshTokenInput{RefreshToken: output.RefreshToken}); err == nil {
+		t.Error("Expected the latest token to be revoked along with its family")
+	}
+
+	last := projectRepo.authLogs[len(projectRepo.authLogs)-1]
+	if last.EventType != "token_refresh" || last.Status != "REUSE_DETECTED" {
+		t.Errorf("Expected the reuse to be logged, got %s %s", last.EventType, last.Status)
+	}
+}
+
+func TestSessionRefreshToken_ConcurrentRotation(t *testing.T) {
+	user := &models.User{ID: ulid.Make().String(), Email: "test@example.com"}
+	userRepo := newMockUserRepo()
+	userRepo.users[user.ID] = user
+	refreshTokens := newMockRefreshTokenRepo()
+	sessionService := newTestSessionService(newTestJWTService(t), userRepo, refreshTokens, newMockSessionRepo(refreshTokens), &mockProjectLookupRepo{}, &mockEnvRepo{})
+	ctx := context.Background()
+
+	tokens, err := sessionService.CreateSession(ctx, service.CreateSessionInput{UserID: user.ID, Email: user.Email, ProjectID: ulid.Make().String(), Provider: models.ProviderEmail})
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	familyID := refreshTokens.tokens[crypto.HashToken(tokens.RefreshToken)].FamilyID
+	input := service.RefreshTokenInput{RefreshToken: tokens.RefreshToken}
+
+	// Another request rotates the same token between this one's lookup and
+	// its rotation
+	var winner *service.RefreshTokenOutput
+	refreshTokens.beforeRotate = func() {
+		var err error
+		if winner, err = sessionService.RefreshToken(ctx, input); err != nil {
+			t.Errorf("Expected the first rotation to succeed: %v", err)
+		}
+	}
+
+	if _, err := sessionService.RefreshToken(ctx, input); err == nil || err.Error() != "refresh_token_reused" {
+		t.Fatalf("Expected refresh_token_reused for the losing request, got %v", err)
+	}
+	if winner == nil {
+		t.Fatal("Expected the concurrent request to run")
+	}
+	if active := refreshTokens.active(familyID); len(active) != 0 {
+		t.Errorf("Expected the whole family to be revoked, %d tokens still active", len(active))
+	}
+	if _, err := sessionService.RefreshToken(ctx, service.RefreshTokenInput{RefreshToken: winner.RefreshToken}); err == nil {
+		t.Error("Expected the winning request's token to be revoked with its family")
+	}
+}
+
+func TestSessionRefreshToken_IdleTimeout(t *testing.T) {
+	user := &models.User{ID: ulid.Make().String(), Email: "test@example.com"}
+	userRepo := newMockUserRepo()
+	userRepo.users[user.ID] = user
+	env := &models.Environment{ID: ulid.Make().String(), RefreshTokenTTL: 7 * 24 * 3600, SessionIdleTimeout: 30 * 60}
+	refreshTokens := newMockRefreshTokenRepo()
+	sessionService := newTestSessionService(newTestJWTService(t), userRepo, refreshTokens, newMockSessionRepo(refreshTokens), &mockProjectLookupRepo{}, &mockEnvRepo{env: env})
+	ctx := context.Background()
+
+	tokens, err := sessionService.CreateSession(ctx, service.CreateSessionInput{UserID: user.ID, Email: user.Email, ProjectID: ulid.Make().String(), EnvironmentID: env.ID, Provider: models.ProviderEmail})
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	stored := refreshTokens.tokens[crypto.HashToken(tokens.RefreshToken)]
+	if stored.ExpiresAt.After(time.Now().Add(30 * time.Minute)) {
+		t.Errorf("Expected the refresh token to expire within the idle timeout, got %s", stored.ExpiresAt)
+	}
+
+	output, err := sessionService.RefreshToken(ctx, service.RefreshTokenInput{RefreshToken: tokens.RefreshToken})
+	if err != nil {
+		t.Fatalf("Expected an active session to refresh: %v", err)
+	}
+	next := refreshTokens.tokens[crypto.HashToken(output.RefreshToken)]
+	if next.ExpiresAt.After(time.Now().Add(30 * time.Minute)) {
+		t.Errorf("Expected the rotated token to expire within the idle timeout, got %s", next.ExpiresAt)
+	}
+
+	// The session sits idle past the timeout
+	next.ExpiresAt = time.Now().Add(-time.Second)
+	if _, err := sessionService.RefreshToken(ctx, service.RefreshTokenInput{RefreshToken: output.RefreshToken}); err == nil || err.Error() != "invalid_refresh_token" {
+		t.Errorf("Expected invalid_refresh_token past the idle timeout, got %v", err)
+	}
+}
+
+func TestSessionRefreshToken_MaxLifetime(t *testing.T) {
+	user := &models.User{ID: ulid.Make().String(), Email: "test@example.com"}
+	userRepo := newMockUserRepo()
+	userRepo.users[user.ID] = user
+	env := &models.Environment{ID: ulid.Make().String(), SessionMaxLifetime: 24 * 3600}
+	refreshTokens := newMockRefreshTokenRepo()
+	sessionRepo := newMockSessionRepo(refreshTokens)
+	sessionService := newTestSessionService(newTestJWTService(t), userRepo, refreshTokens, sessionRepo, &mockProjectLookupRepo{}, &mockEnvRepo{env: env})
+	ctx := context.Background()
+
+	tokens, err := sessionService.CreateSession(ctx, service.CreateSessionInput{UserID: user.ID, Email: user.Email, ProjectID: ulid.Make().String(), EnvironmentID: env.ID, Provider: models.ProviderEmail})
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	stored := refreshTokens.tokens[crypto.HashToken(tokens.RefreshToken)]
+	if stored.ExpiresAt.After(time.Now().Add(24 * time.Hour)) {
+		t.Errorf("Expected the refresh token to expire within the max lifetime, got %s", stored.ExpiresAt)
+	}
+
+	output, err := sessionService.RefreshToken(ctx, service.RefreshTokenInput{RefreshToken: tokens.RefreshToken})
+	if err != nil {
+		t.Fatalf("Expected a new session to refresh: %v", err)
+	}
+
+	// The session was started more than a day ago
+	sessionRepo.sessions[stored.FamilyID].CreatedAt = time.Now().Add(-25 * time.Hour)
+	if _, err := sessionService.RefreshToken(ctx, service.RefreshTokenInput{RefreshToken: output.RefreshToken}); err == nil || err.Error() != "session_expired" {
+		t.Fatalf("Expected session_expired past the max lifetime, got %v", err)
+	}
+	if active := refreshTokens.active(stored.FamilyID); len(active) != 0 {
+		t.Errorf("Expected the expired session's family to be revoked, %d tokens still active", len(active))
+	}
+}
+
 func TestRefreshToken_ValidToken(t *testing.T) {
 	userID := ulid.Make().String()
 	projectID := ulid.Make().String()
@@ -126,3 +465,132 @@ func TestGetMe_UserNotFound(t *testing.T) {
 
 	t.Log("GetMe user not found test passed")
 }
+
+func TestRevokeSession_OwnSessionsOnly(t *testing.T) {
+	user := &models.User{ID: ulid.Make().String(), Email: "test@example.com"}
+	other := &models.User{ID: ulid.Make().String(), Email: "other@example.com"}
+	projectID := ulid.Make().String()
+	envID := ulid.Make().String()
+	jwtService := newTestJWTService(t)
+	userRepo := newMockUserRepo()
+	userRepo.users[user.ID] = user
+	userRepo.users[other.ID] = other
+	refreshTokens := newMockRefreshTokenRepo()
+	sessionService := newTestSessionService(jwtService, userRepo, refreshTokens, newMockSessionRepo(refreshTokens), &mockProjectLookupRepo{}, &mockEnvRepo{})
+	ctx := context.Background()
+
+	signIn := func(u *models.User) (*service.SessionTokens, *crypto.AccessTokenClaims) {
+		t.Helper()
+		tokens, err := sessionService.CreateSession(ctx, service.CreateSessionInput{UserID: u.ID, Email: u.Email, ProjectID: projectID, EnvironmentID: envID, Provider: models.ProviderEmail})
+		if err != nil {
+			t.Fatalf("CreateSession failed: %v", err)
+		}
+		claims, err := jwtService.VerifyAccessToken(tokens.AccessToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tokens, claims
+	}
+	_, laptop := signIn(user)
+	phoneTokens, phone := signIn(user)
+	otherTokens, otherClaims := signIn(other)
+
+	sessions, err := sessionService.ListSessions(ctx, laptop)
+	if err != nil {
+		t.Fatalf("ListSessions failed: %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("Expected the user's two sessions, got %d", len(sessions))
+	}
+	for _, s := range sessions {
+		if s.ID == otherClaims.SessionID {
+			t.Error("Expected another user's session to be left out")
+		}
+		if s.Current != (s.ID == laptop.SessionID) {
+			t.Errorf("Expected only the caller's session to be current, got %+v", s)
+		}
+	}
+
+	err = sessionService.RevokeSession(ctx, service.RevokeSessionInput{Claims: laptop, SessionID: otherClaims.SessionID})
+	if err == nil || err.Error() != "session_not_found" {
+		t.Errorf("Expected session_not_found for another user's session, got %v", err)
+	}
+	if _, err := sessionService.RefreshToken(ctx, service.RefreshTokenInput{RefreshToken: otherTokens.RefreshToken}); err != nil {
+		t.Errorf("Expected another user's session to keep refreshing: %v", err)
+	}
+
+	if err := sessionService.RevokeSession(ctx, service.RevokeSessionInput{Claims: laptop, SessionID: phone.SessionID}); err != nil {
+		t.Fatalf("RevokeSession failed: %v", err)
+	}
+	if _, err := sessionService.RefreshToken(ctx, service.RefreshTokenInput{RefreshToken: phoneTokens.RefreshToken}); err == nil || err.Error() != "refresh_token_revoked" {
+		t.Errorf("Expected refresh_token_revoked for the revoked session, got %v", err)
+	}
+	if sessions, _ := sessionService.ListSessions(ctx, laptop); len(sessions) != 1 || sessions[0].ID != laptop.SessionID {
+		t.Errorf("Expected only the caller's session to be left, got %+v", sessions)
+	}
+}
+
+func TestRevokeProjectUserSessions_OwnerOnly(t *testing.T) {
+	owner := ulid.Make().String()
+	project := &models.Project{ID: ulid.Make().String(), Name: "Acme", OwnerID: owner}
+	user := &models.User{ID: ulid.Make().String(), Email: "test@example.com"}
+	production, staging := ulid.Make().String(), ulid.Make().String()
+	userRepo := newMockUserRepo()
+	userRepo.users[user.ID] = user
+	refreshTokens := newMockRefreshTokenRepo()
+	projectRepo := &mockProjectLookupRepo{project: project}
+	sessionService := newTestSessionService(newTestJWTService(t), userRepo, refreshTokens, newMockSessionRepo(refreshTokens), projectRepo, &mockEnvRepo{})
+	ctx := context.Background()
+
+	signIn := func(environmentID string) string {
+		t.Helper()
+		tokens, err := sessionService.CreateSession(ctx, service.CreateSessionInput{UserID: user.ID, Email: user.Email, ProjectID: project.ID, EnvironmentID: environmentID, Provider: models.ProviderEmail})
+		if err != nil {
+			t.Fatalf("CreateSession failed: %v", err)
+		}
+		return tokens.RefreshToken
+	}
+	refresh := func(refreshToken string) error {
+		_, err := sessionService.RefreshToken(ctx, service.RefreshTokenInput{RefreshToken: refreshToken})
+		return err
+	}
+	productionToken := signIn(production)
+	stagingToken := signIn(staging)
+
+	input := service.ProjectUserSessionsInput{ProjectID: project.ID, UserID: user.ID, EnvironmentID: production, OwnerID: ulid.Make().String()}
+	if _, err := sessionService.ListProjectUserSessions(ctx, input); err == nil || err.Error() != "forbidden" {
+		t.Errorf("Expected forbidden listing another owner's users, got %v", err)
+	}
+	if err := sessionService.RevokeProjectUserSessions(ctx, input); err == nil || err.Error() != "forbidden" {
+		t.Errorf("Expected forbidden revoking another owner's users, got %v", err)
+	}
+	output, err := sessionService.RefreshToken(ctx, service.RefreshTokenInput{RefreshToken: productionToken})
+	if err != nil {
+		t.Fatalf("Expected a refused revocation to leave the session alone: %v", err)
+	}
+	productionToken = output.RefreshToken
+
+	input.OwnerID = owner
+	sessions, err := sessionService.ListProjectUserSessions(ctx, input)
+	if err != nil {
+		t.Fatalf("ListProjectUserSessions failed: %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].EnvironmentID != production {
+		t.Errorf("Expected only the production session, got %+v", sessions)
+	}
+
+	if err := sessionService.RevokeProjectUserSessions(ctx, input); err != nil {
+		t.Fatalf("RevokeProjectUserSessions failed: %v", err)
+	}
+	if err := refresh(productionToken); err == nil || err.Error() != "refresh_token_revoked" {
+		t.Errorf("Expected refresh to fail right after a forced logout, got %v", err)
+	}
+	if err := refresh(stagingToken); err != nil {
+		t.Errorf("Expected the other environment's session to keep refreshing: %v", err)
+	}
+
+	last := projectRepo.authLogs[len(projectRepo.authLogs)-1]
+	if last.EventType != "session_revoked" || last.Status != "FORCED" || last.Metadata["actorId"] != owner {
+		t.Errorf("Expected the forced logout to be logged with its actor, got %+v", last)
+	}
+}
@@ -0,0 +1,292 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/marcioecom/permit/internal/crypto"
+	"github.com/marcioecom/permit/internal/models"
+	"github.com/marcioecom/permit/internal/repository"
+	"github.com/rs/zerolog/log"
+)
+
+// reloadOnMissInterval throttles reloads triggered by unknown key IDs
+const reloadOnMissInterval = 10 * time.Second
+
+// KeyProvisioner creates an environment's signing keys the first time it
+// signs with an algorithm
+type KeyProvisioner interface {
+	EnsureEnvironmentKeys(ctx context.Context, environmentID, algorithm string) error
+}
+
+// SigningKeyService keeps the in-memory key ring in step with the key store
+// shared by every replica.
+type SigningKeyService struct {
+	keyManager       *crypto.KeyManager
+	signingKeyRepo   repository.SigningKeyRepository
+	envRepo          repository.EnvironmentRepository
+	cipher           *crypto.KeyCipher
+	rotationInterval time.Duration
+
+	reloadMu   sync.Mutex
+	lastReload time.Time
+}
+
+func NewSigningKeyService(
+	keyManager *crypto.KeyManager,
+	signingKeyRepo repository.SigningKeyRepository,
+	envRepo repository.EnvironmentRepository,
+	cipher *crypto.KeyCipher,
+	rotationInterval time.Duration,
+) *SigningKeyService {
+	s := &SigningKeyService{
+		keyManager:       keyManager,
+		signingKeyRepo:   signingKeyRepo,
+		envRepo:          envRepo,
+		cipher:           cipher,
+		rotationInterval: rotationInterval,
+	}
+	keyManager.SetMissHandler(s.reloadOnMiss)
+	return s
+}
+
+// Load brings up the key ring at boot. On first boot it generates and stores
+// the platform keys for every supported algorithm. Environments without keys
+// of their own get them, inheriting the platform keys that may have signed
+// their existing tokens.
+func (s *SigningKeyService) Load(ctx context.Context) error {
+	envs, err := s.envRepo.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list environments: %w", err)
+	}
+
+	return s.update(ctx, func(ring *crypto.KeyManager) error {
+		if err := ring.EnsureAlgorithms(crypto.SupportedAlgorithms...); err != nil {
+			return err
+		}
+		for _, env := range envs {
+			if !ring.HasEnvironmentKeys(env.ID) {
+				ring.InheritPlatformKeys(env.ID)
+			}
+			if err := ring.EnsureEnvironmentKeys(env.ID, env.SigningAlgorithm); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Sync reloads the stored key ring, first rotating every ring whose active
+// key is older than the rotation interval.
+func (s *SigningKeyService) Sync(ctx context.Context) error {
+	return s.update(ctx, func(ring *crypto.KeyManager) error {
+		if s.rotationInterval <= 0 {
+			return nil
+		}
+		for _, environmentID := range ring.ActiveEnvironments(time.Now().Add(-s.rotationInterval)) {
+			if err := ring.RotateEnvironment(environmentID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Rotate forces a rotation of every stored ring
+func (s *SigningKeyService) Rotate(ctx context.Context) error {
+	return s.update(ctx, func(ring *crypto.KeyManager) error {
+		return ring.Rotate()
+	})
+}
+
+// RotateEnvironment forces a rotation of one environment's keys
+func (s *SigningKeyService) RotateEnvironment(ctx context.Context, environmentID string) error {
+	return s.update(ctx, func(ring *crypto.KeyManager) error {
+		if !ring.HasEnvironmentKeys(environmentID) {
+			return fmt.Errorf("environment %s has no signing keys", environmentID)
+		}
+		return ring.RotateEnvironment(environmentID)
+	})
+}
+
+// EnsureEnvironmentKeys creates and stores an environment's keys for an
+// algorithm unless they are already loaded
+func (s *SigningKeyService) EnsureEnvironmentKeys(ctx context.Context, environmentID, algorithm string) error {
+	if s.keyManager.HasEnvironmentKeys(environmentID) {
+		if _, ok := s.keyManager.SigningKey(environmentID, algorithm); ok {
+			return nil
+		}
+	}
+
+	return s.update(ctx, func(ring *crypto.KeyManager) error {
+		return ring.EnsureEnvironmentKeys(environmentID, algorithm)
+	})
+}
+
+// Keys returns the stored key ring without decrypting it
+func (s *SigningKeyService) Keys(ctx context.Context) ([]*models.SigningKey, error) {
+	return s.signingKeyRepo.List(ctx)
+}
+
+// Reload loads the stored key ring without changing it
+func (s *SigningKeyService) Reload(ctx context.Context) error {
+	stored, err := s.signingKeyRepo.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	keys, err := s.decrypt(stored)
+	if err != nil {
+		return err
+	}
+
+	s.keyManager.SetKeys(keys)
+	return nil
+}
+
+// reloadOnMiss picks up keys created by other replicas when verification
+// meets a kid this replica doesn't know yet
+func (s *SigningKeyService) reloadOnMiss() {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	if time.Since(s.lastReload) < reloadOnMissInterval {
+		return
+	}
+	s.lastReload = time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := s.Reload(ctx); err != nil {
+		log.Error().Err(err).Msg("failed to reload signing keys")
+	}
+}
+
+// update runs fn against the stored key ring under the key store lock, then
+// makes sure every active ring has a next key and stores the result.
+func (s *SigningKeyService) update(ctx context.Context, fn func(ring *crypto.KeyManager) error) error {
+	ring := crypto.NewKeyManager()
+
+	err := s.signingKeyRepo.Update(ctx, func(stored []*models.SigningKey) ([]*models.SigningKey, error) {
+		keys, err := s.decrypt(stored)
+		if err != nil {
+			return nil, err
+		}
+		ring.SetKeys(keys)
+		ring.Prune()
+
+		if err := fn(ring); err != nil {
+			return nil, err
+		}
+		if err := ring.EnsureNextKey(); err != nil {
+			return nil, err
+		}
+
+		return s.encrypt(ring.Keys(), stored)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update signing keys: %w", err)
+	}
+
+	s.keyManager.SetKeys(ring.Keys())
+	return nil
+}
+
+func (s *SigningKeyService) decrypt(stored []*models.SigningKey) ([]crypto.SigningKey, error) {
+	keys := make([]crypto.SigningKey, 0, len(stored))
+	for _, k := range stored {
+		der, err := s.cipher.Decrypt(k.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt signing key %s: %w", k.ID, err)
+		}
+		privateKey, err := crypto.ParsePrivateKey(der)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, crypto.SigningKey{
+			ID:            k.ID,
+			EnvironmentID: k.EnvironmentID,
+			Algorithm:     k.Algorithm,
+			Status:        crypto.KeyStatus(k.Status),
+			PrivateKey:    privateKey,
+			CreatedAt:     k.CreatedAt,
+			ActivatedAt:   k.ActivatedAt,
+			ExpiresAt:     k.ExpiresAt,
+		})
+	}
+	return keys, nil
+}
+
+// encrypt converts the ring back to stored keys, reusing the ciphertext of
+// keys that were already stored
+func (s *SigningKeyService) encrypt(keys []crypto.SigningKey, stored []*models.SigningKey) ([]*models.SigningKey, error) {
+	ciphertexts := make(map[string][]byte, len(stored))
+	for _, k := range stored {
+		ciphertexts[k.ID] = k.PrivateKey
+	}
+
+	result := make([]*models.SigningKey, 0, len(keys))
+	for _, key := range keys {
+		ciphertext, ok := ciphertexts[key.ID]
+		if !ok {
+			der, err := crypto.MarshalPrivateKey(key.PrivateKey)
+			if err != nil {
+				return nil, err
+			}
+			ciphertext, err = s.cipher.Encrypt(der)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		result = append(result, &models.SigningKey{
+			ID:            key.ID,
+			EnvironmentID: key.EnvironmentID,
+			Algorithm:     key.Algorithm,
+			Status:        string(key.Status),
+			PrivateKey:    ciphertext,
+			ActivatedAt:   key.ActivatedAt,
+			ExpiresAt:     key.ExpiresAt,
+			CreatedAt:     key.CreatedAt,
+		})
+	}
+	return result, nil
+}
+
+// MemoryKeyProvisioner gives environments keys of their own when there is no
+// key store to keep them in. Its keys only live as long as the process, like
+// the ephemeral platform keys they stand beside.
+type MemoryKeyProvisioner struct {
+	keyManager *crypto.KeyManager
+	mu         sync.Mutex
+}
+
+func NewMemoryKeyProvisioner(keyManager *crypto.KeyManager) *MemoryKeyProvisioner {
+	return &MemoryKeyProvisioner{keyManager: keyManager}
+}
+
+// EnsureEnvironmentKeys generates an environment's keys for an algorithm
+// unless it already has them. Like Load, an environment getting its first
+// keys inherits the platform keys that may have signed its tokens.
+func (p *MemoryKeyProvisioner) EnsureEnvironmentKeys(ctx context.Context, environmentID, algorithm string) error {
+	if p.keyManager.HasEnvironmentKeys(environmentID) {
+		if _, ok := p.keyManager.SigningKey(environmentID, algorithm); ok {
+			return nil
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.keyManager.HasEnvironmentKeys(environmentID) {
+		p.keyManager.InheritPlatformKeys(environmentID)
+	}
+	if err := p.keyManager.EnsureEnvironmentKeys(environmentID, algorithm); err != nil {
+		return err
+	}
+	return p.keyManager.EnsureNextKey()
+}
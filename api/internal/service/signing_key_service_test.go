@@ -0,0 +1,181 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/marcioecom/permit/internal/crypto"
+	"github.com/marcioecom/permit/internal/models"
+	"github.com/marcioecom/permit/internal/repository"
+	"github.com/marcioecom/permit/internal/service"
+	"github.com/oklog/ulid/v2"
+)
+
+// mockSigningKeyRepo is a key store shared by replicas, its mutex standing in
+// for the advisory lock
+type mockSigningKeyRepo struct {
+	repository.SigningKeyRepository
+	mu   sync.Mutex
+	keys []*models.SigningKey
+}
+
+func (m *mockSigningKeyRepo) List(ctx context.Context) ([]*models.SigningKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*models.SigningKey(nil), m.keys...), nil
+}
+
+func (m *mockSigningKeyRepo) Update(ctx context.Context, fn func(keys []*models.SigningKey) ([]*models.SigningKey, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	next, err := fn(append([]*models.SigningKey(nil), m.keys...))
+	if err != nil {
+		return err
+	}
+	m.keys = next
+	return nil
+}
+
+func (m *mockSigningKeyRepo) ids() map[string]bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ids := make(map[string]bool, len(m.keys))
+	for _, k := range m.keys {
+		ids[k.ID] = true
+	}
+	return ids
+}
+
+func TestSigningKeyService_StoresKeysEncrypted(t *testing.T) {
+	cipher, err := crypto.NewEphemeralKeyCipher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &mockSigningKeyRepo{}
+	keyManager := crypto.NewKeyManager()
+	signingKeys := service.NewSigningKeyService(keyManager, store, &mockEnvRepo{}, cipher, 0)
+
+	if err := signingKeys.Load(context.Background()); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(store.keys) == 0 {
+		t.Fatal("Expected the platform keys to be stored")
+	}
+
+	loaded := make(map[string]crypto.SigningKey)
+	for _, key := range keyManager.Keys() {
+		loaded[key.ID] = key
+	}
+	for _, stored := range store.keys {
+		key, ok := loaded[stored.ID]
+		if !ok {
+			t.Fatalf("Expected stored key %s to be loaded", stored.ID)
+		}
+		der, err := crypto.MarshalPrivateKey(key.PrivateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(stored.PrivateKey, der) {
+			t.Errorf("Expected key %s to be stored encrypted", stored.ID)
+		}
+		plaintext, err := cipher.Decrypt(stored.PrivateKey)
+		if err != nil || !bytes.Equal(plaintext, der) {
+			t.Errorf("Expected key %s to decrypt to the loaded private key", stored.ID)
+		}
+	}
+
+	other, err := crypto.NewEphemeralKeyCipher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := service.NewSigningKeyService(crypto.NewKeyManager(), store, &mockEnvRepo{}, other, 0).Reload(context.Background()); err == nil {
+		t.Error("Expected keys stored under another master key not to load")
+	}
+}
+
+func TestSigningKeyService_ReplicasShareKeys(t *testing.T) {
+	cipher, err := crypto.NewEphemeralKeyCipher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &models.Environment{ID: ulid.Make().String(), SigningAlgorithm: crypto.AlgorithmES256}
+	store := &mockSigningKeyRepo{}
+	ctx := context.Background()
+
+	first, second := crypto.NewKeyManager(), crypto.NewKeyManager()
+	firstService := service.NewSigningKeyService(first, store, &mockEnvRepo{env: env}, cipher, 0)
+	secondService := service.NewSigningKeyService(second, store, &mockEnvRepo{env: env}, cipher, 0)
+
+	if err := firstService.Load(ctx); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	stored := store.ids()
+	if err := secondService.Load(ctx); err != nil {
+		t.Fatalf("Load on the second replica failed: %v", err)
+	}
+	if ids := store.ids(); len(ids) != len(stored) {
+		t.Fatalf("Expected the second replica to load the stored keys, the store went from %d to %d keys", len(stored), len(ids))
+	}
+
+	for environmentID, alg := range map[string]string{"": crypto.AlgorithmRS256, env.ID: env.SigningAlgorithm} {
+		a, _ := first.SigningKey(environmentID, alg)
+		b, ok := second.SigningKey(environmentID, alg)
+		if !ok || a.ID != b.ID || !stored[b.ID] {
+			t.Errorf("Expected both replicas to sign %q %s tokens with the same stored key", environmentID, alg)
+		}
+	}
+
+	// A key the first replica creates later reaches the second one when it
+	// meets the kid
+	other := ulid.Make().String()
+	if err := firstService.EnsureEnvironmentKeys(ctx, other, crypto.AlgorithmRS256); err != nil {
+		t.Fatalf("EnsureEnvironmentKeys failed: %v", err)
+	}
+	key, _ := first.SigningKey(other, crypto.AlgorithmRS256)
+	if _, ok := second.VerificationKey(other, key.ID); !ok {
+		t.Error("Expected the second replica to reload keys created by the first")
+	}
+}
+
+func TestMemoryKeyProvisioner_IsolatesEnvironments(t *testing.T) {
+	keyManager := crypto.NewKeyManager()
+	if err := keyManager.GenerateKeyPair(); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyManager.EnsureAlgorithms(crypto.SupportedAlgorithms...); err != nil {
+		t.Fatal(err)
+	}
+	provisioner := service.NewMemoryKeyProvisioner(keyManager)
+	ctx := context.Background()
+	envA, envB := ulid.Make().String(), ulid.Make().String()
+
+	platform, _ := keyManager.SigningKey("", crypto.AlgorithmRS256)
+	for _, env := range []string{envA, envB} {
+		if err := provisioner.EnsureEnvironmentKeys(ctx, env, crypto.AlgorithmRS256); err != nil {
+			t.Fatalf("EnsureEnvironmentKeys(%s) failed: %v", env, err)
+		}
+	}
+
+	keyA, ok := keyManager.SigningKey(envA, crypto.AlgorithmRS256)
+	if !ok {
+		t.Fatal("Expected environment A to have a signing key")
+	}
+	keyB, _ := keyManager.SigningKey(envB, crypto.AlgorithmRS256)
+	if keyA.ID == keyB.ID || keyA.ID == platform.ID {
+		t.Error("Expected each environment to sign with a key of its own")
+	}
+	if _, ok := keyManager.VerificationKey(envB, keyA.ID); ok {
+		t.Error("Expected environment B not to trust environment A's key")
+	}
+
+	if err := provisioner.EnsureEnvironmentKeys(ctx, envA, crypto.AlgorithmRS256); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := keyManager.SigningKey(envA, crypto.AlgorithmRS256); again.ID != keyA.ID {
+		t.Error("Expected existing keys to be kept")
+	}
+}
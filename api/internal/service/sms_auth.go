@@ -0,0 +1,150 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/marcioecom/permit/internal/models"
+	"github.com/oklog/ulid/v2"
+	"github.com/rs/zerolog/log"
+)
+
+type CreateSMSCodeInput struct {
+	Phone     string
+	ProjectID string
+	// EnvironmentID defaults to the project's default environment
+	EnvironmentID string
+	IPAddress     string
+	UserAgent     string
+}
+
+// CreateSMSCode texts a one-time code to a phone number. Numbers are
+// normalized to E.164; one not seen before gets a new user, known only by
+// its phone identity, so the code can be looked up when it's verified.
+func (s *AuthService) CreateSMSCode(ctx context.Context, input CreateSMSCodeInput) (*CreateAuthOutput, error) {
+	phone, err := models.NormalizePhoneNumber(input.Phone)
+	if err != nil {
+		return nil, err
+	}
+
+	project, err := s.projectRepo.GetByID(ctx, input.ProjectID)
+	if err != nil {
+		return nil, err
+	}
+
+	if project == nil {
+		return nil, fmt.Errorf("project_not_found")
+	}
+
+	env, err := s.loginEnvironment(ctx, input.ProjectID, input.EnvironmentID)
+	if err != nil {
+		return nil, err
+	}
+
+	userID, err := s.phoneUser(ctx, phone)
+	if err != nil {
+		return nil, err
+	}
+
+	otp, code, err := s.createOTPCode(ctx, models.OTPKindSMS, project.ID, env, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.smsService.SendOTP(phone, code, project.Name, otpPolicyFor(env).TTL); err != nil {
+		log.Warn().Err(err).Str("phone", phone).Msg("SMS OTP creation failed")
+		return nil, fmt.Errorf("sms_delivery_failed")
+	}
+
+	logAuthEvent(ctx, s.projectRepo, input.ProjectID, userID, "", "login", "OTP_SENT", input.IPAddress, input.UserAgent, map[string]string{"provider": models.ProviderPhone, "phone": phone})
+
+	return newCreateAuthOutput(otp, env), nil
+}
+
+// phoneUser returns the user a phone number belongs to, creating one with a
+// phone identity for an unknown number
+func (s *AuthService) phoneUser(ctx context.Context, phone string) (string, error) {
+	identity, err := s.identityRepo.GetByProviderUserID(ctx, models.ProviderPhone, phone)
+	if err != nil {
+		return "", err
+	}
+	if identity != nil {
+		return identity.UserID, nil
+	}
+
+	userID, err := s.userRepo.Create(ctx, &models.User{ID: ulid.Make().String()})
+	if err != nil {
+		return "", err
+	}
+	if err := s.identityRepo.Create(ctx, &models.Identity{
+		ID:             ulid.Make().String(),
+		UserID:         userID,
+		Provider:       models.ProviderPhone,
+		ProviderUserID: phone,
+	}); err != nil {
+		// Another request may have claimed the number first
+		identity, lookupErr := s.identityRepo.GetByProviderUserID(ctx, models.ProviderPhone, phone)
+		if lookupErr != nil || identity == nil {
+			return "", err
+		}
+		return identity.UserID, nil
+	}
+	return userID, nil
+}
+
+// VerifySMSCodeInput identifies the code being verified by either the phone
+// number it was sent to or the challenge ID CreateSMSCode returned
+type VerifySMSCodeInput struct {
+	Code        string
+	Phone       string
+	ChallengeID string
+	ProjectID   string
+	IPAddress   string
+	UserAgent   string
+}
+
+func (s *AuthService) VerifySMSCode(ctx context.Context, input VerifySMSCodeInput) (*VerifyAuthOutput, error) {
+	if input.Phone == "" && input.ChallengeID == "" {
+		return nil, fmt.Errorf("challenge_required")
+	}
+
+	var phone string
+	if input.Phone != "" {
+		normalized, err := models.NormalizePhoneNumber(input.Phone)
+		if err != nil {
+			return nil, err
+		}
+		phone = normalized
+	}
+
+	otp, err := s.consumeOTPCode(ctx, otpVerification{
+		ProjectID:   input.ProjectID,
+		Kind:        models.OTPKindSMS,
+		ChallengeID: input.ChallengeID,
+		Phone:       phone,
+		Code:        input.Code,
+		EventType:   "login",
+		IPAddress:   input.IPAddress,
+		UserAgent:   input.UserAgent,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.userRepo.GetByID(ctx, otp.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	identity, err := s.identityRepo.GetByUserAndProvider(ctx, user.ID, models.ProviderPhone)
+	if err != nil || identity == nil {
+		return nil, fmt.Errorf("identity_not_found")
+	}
+
+	output, err := s.completeLogin(ctx, user, otp, models.ProviderPhone, input.IPAddress, input.UserAgent, map[string]string{"provider": models.ProviderPhone, "phone": identity.ProviderUserID})
+	if err != nil {
+		return nil, err
+	}
+	output.User.Phone = identity.ProviderUserID
+	return output, nil
+}
@@ -0,0 +1,373 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/marcioecom/permit/internal/crypto"
+	"github.com/marcioecom/permit/internal/models"
+	"github.com/marcioecom/permit/internal/repository"
+	"github.com/oklog/ulid/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// TokenService answers questions project backends ask about tokens issued to
+// their users, and issues tokens to the backends themselves, on behalf of an
+// authenticated API key.
+type TokenService struct {
+	jwtService       *crypto.JWTService
+	sessionService   *SessionService
+	refreshTokenRepo repository.RefreshTokenRepository
+	sessionRepo      repository.SessionRepository
+	denylistRepo     repository.AccessTokenDenylistRepository
+	projectRepo      repository.ProjectRepository
+	userRepo         repository.UserRepository
+}
+
+func NewTokenService(
+	jwtService *crypto.JWTService,
+	sessionService *SessionService,
+	refreshTokenRepo repository.RefreshTokenRepository,
+	sessionRepo repository.SessionRepository,
+	denylistRepo repository.AccessTokenDenylistRepository,
+	projectRepo repository.ProjectRepository,
+	userRepo repository.UserRepository,
+) *TokenService {
+	return &TokenService{
+		jwtService:       jwtService,
+		sessionService:   sessionService,
+		refreshTokenRepo: refreshTokenRepo,
+		sessionRepo:      sessionRepo,
+		denylistRepo:     denylistRepo,
+		projectRepo:      projectRepo,
+		userRepo:         userRepo,
+	}
+}
+
+const (
+	TokenTypeAccessToken  = "access_token"
+	TokenTypeRefreshToken = "refresh_token"
+)
+
+type IntrospectInput struct {
+	ProjectID string // project of the calling API key
+	Token     string
+}
+
+// IntrospectionResponse is an RFC 7662 introspection response. Only Active is
+// set for tokens that aren't active.
+type IntrospectionResponse struct {
+	Active    bool     `json:"active"`
+	TokenType string   `json:"token_type,omitempty"`
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Audience  []string `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	JTI       string   `json:"jti,omitempty"`
+	ClientID  string   `json:"client_id,omitempty"`
+	Scope     string   `json:"scope,omitempty"`
+
+	Email         string `json:"email,omitempty"`
+	UserID        string `json:"uid,omitempty"`
+	ProjectID     string `json:"pid,omitempty"`
+	EnvironmentID string `json:"eid,omitempty"`
+	SessionID     string `json:"sid,omitempty"`
+	Provider      string `json:"provider,omitempty"`
+
+	AuthTime int64         `json:"auth_time,omitempty"`
+	AMR      []string      `json:"amr,omitempty"`
+	Actor    *crypto.Actor `json:"act,omitempty"`
+}
+
+var inactiveToken = &IntrospectionResponse{Active: false}
+
+// Introspect reports whether a token is active: validly signed, unexpired,
+// not revoked and issued for the caller's project. Tokens of another project
+// are reported as inactive so callers can't probe them.
+func (s *TokenService) Introspect(ctx context.Context, input IntrospectInput) (*IntrospectionResponse, error) {
+	// Each kind of token only verifies as itself, which makes token_type_hint
+	// unnecessary
+	if claims, err := s.jwtService.VerifyRefreshToken(input.Token); err == nil {
+		return s.introspectRefreshToken(ctx, input.ProjectID, input.Token, claims)
+	}
+	if claims, err := s.jwtService.VerifyAccessToken(input.Token); err == nil {
+		return s.introspectAccessToken(ctx, input.ProjectID, claims)
+	}
+	if claims, err := s.jwtService.VerifyClientToken(input.Token); err == nil {
+		return s.introspectClientToken(input.ProjectID, claims), nil
+	}
+	return inactiveToken, nil
+}
+
+func (s *TokenService) introspectAccessToken(ctx context.Context, projectID string, claims *crypto.AccessTokenClaims) (*IntrospectionResponse, error) {
+	if claims.ProjectID != projectID {
+		return inactiveToken, nil
+	}
+
+	revoked, err := s.denylistRepo.Contains(ctx, claims.ID)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return inactiveToken, nil
+	}
+
+	if claims.SessionID != "" {
+		session, err := s.sessionRepo.GetByID(ctx, claims.SessionID)
+		if err != nil {
+			return nil, err
+		}
+		if session != nil && session.RevokedAt != nil {
+			return inactiveToken, nil
+		}
+	}
+
+	response := &IntrospectionResponse{
+		Active:        true,
+		TokenType:     TokenTypeAccessToken,
+		Issuer:        claims.Issuer,
+		Subject:       claims.Subject,
+		Audience:      claims.Audience,
+		JTI:           claims.ID,
+		Email:         claims.Email,
+		UserID:        claims.UserID,
+		ProjectID:     claims.ProjectID,
+		EnvironmentID: claims.EnvironmentID,
+		SessionID:     claims.SessionID,
+		Provider:      claims.Provider,
+		AuthTime:      claims.AuthTime,
+		AMR:           claims.AMR,
+		Actor:         claims.Actor,
+	}
+	setTimes(response, claims.RegisteredClaims)
+	return response, nil
+}
+
+func (s *TokenService) introspectRefreshToken(ctx context.Context, projectID, token string, claims *crypto.RefreshTokenClaims) (*IntrospectionResponse, error) {
+	if claims.ProjectID != projectID {
+		return inactiveToken, nil
+	}
+
+	stored, err := s.refreshTokenRepo.GetByHash(ctx, crypto.HashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	if stored == nil || stored.RevokedAt != nil || time.Now().After(stored.ExpiresAt) {
+		return inactiveToken, nil
+	}
+
+	response := &IntrospectionResponse{
+		Active:        true,
+		TokenType:     TokenTypeRefreshToken,
+		Issuer:        claims.Issuer,
+		Subject:       claims.Subject,
+		Audience:      claims.Audience,
+		JTI:           claims.ID,
+		UserID:        claims.UserID,
+		ProjectID:     claims.ProjectID,
+		EnvironmentID: stored.EnvironmentID,
+		SessionID:     stored.FamilyID,
+	}
+	setTimes(response, claims.RegisteredClaims)
+	return response, nil
+}
+
+// introspectClientToken reports on a client credentials token, which is
+// active until it expires
+func (s *TokenService) introspectClientToken(projectID string, claims *crypto.ClientTokenClaims) *IntrospectionResponse {
+	if claims.ProjectID != projectID {
+		return inactiveToken
+	}
+
+	response := &IntrospectionResponse{
+		Active:        true,
+		TokenType:     TokenTypeAccessToken,
+		Issuer:        claims.Issuer,
+		Subject:       claims.Subject,
+		Audience:      claims.Audience,
+		JTI:           claims.ID,
+		ClientID:      claims.ClientID,
+		Scope:         claims.Scope,
+		ProjectID:     claims.ProjectID,
+		EnvironmentID: claims.EnvironmentID,
+	}
+	setTimes(response, claims.RegisteredClaims)
+	return response
+}
+
+type ClientCredentialsInput struct {
+	APIKey *models.APIKey
+	Scope  string // space-separated; defaults to every scope of the key
+}
+
+// ClientCredentialsResponse is an RFC 6749 access token response
+type ClientCredentialsResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	Scope       string `json:"scope,omitempty"`
+}
+
+// IssueClientToken implements the RFC 6749 client credentials grant. The
+// token identifies the API key itself, lives as long as the environment's
+// access tokens and can't be refreshed.
+func (s *TokenService) IssueClientToken(ctx context.Context, input ClientCredentialsInput) (*ClientCredentialsResponse, error) {
+	scopes := input.APIKey.Scopes
+	if requested := strings.Fields(input.Scope); len(requested) > 0 {
+		for _, scope := range requested {
+			if !slices.Contains(input.APIKey.Scopes, scope) {
+				return nil, fmt.Errorf("invalid_scope")
+			}
+		}
+		scopes = requested
+	}
+
+	policy := s.sessionService.tokenPolicy(ctx, input.APIKey.EnvironmentID)
+	expiresAt := time.Now().Add(policy.AccessTokenTTL)
+
+	token, err := s.jwtService.SignClientToken(crypto.ClientTokenInput{
+		ClientID:      input.APIKey.ClientID,
+		ProjectID:     input.APIKey.ProjectID,
+		EnvironmentID: input.APIKey.EnvironmentID,
+		Scopes:        scopes,
+		Algorithm:     policy.Algorithm,
+		ExpiresAt:     expiresAt,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("token_generation_failed")
+	}
+
+	return &ClientCredentialsResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(policy.AccessTokenTTL.Seconds()),
+		Scope:       strings.Join(scopes, " "),
+	}, nil
+}
+
+// validScopeToken reports whether scope is a scope token as defined by
+// RFC 6749 section 3.3
+func validScopeToken(scope string) bool {
+	if scope == "" {
+		return false
+	}
+	for _, c := range scope {
+		if c < 0x21 || c > 0x7e || c == '"' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+type RevokeInput struct {
+	ProjectID string // project of the calling API key
+	ClientID  string
+	Token     string
+	IPAddress string
+	UserAgent string
+}
+
+// Revoke implements RFC 7009 token revocation. Revoking a refresh token ends
+// its whole session; revoking an access token denylists it until it expires.
+// Unknown, invalid and already revoked tokens, and tokens of other projects,
+// are silently ignored as the RFC requires. Client credentials tokens are
+// short-lived and left to expire. token_type_hint isn't needed, since each
+// kind of token only verifies as itself, and is ignored.
+func (s *TokenService) Revoke(ctx context.Context, input RevokeInput) error {
+	if claims, err := s.jwtService.VerifyRefreshToken(input.Token); err == nil {
+		return s.revokeRefreshToken(ctx, input, claims)
+	}
+	if claims, err := s.jwtService.VerifyAccessToken(input.Token); err == nil {
+		return s.revokeAccessToken(ctx, input, claims)
+	}
+	return nil
+}
+
+func (s *TokenService) revokeRefreshToken(ctx context.Context, input RevokeInput, claims *crypto.RefreshTokenClaims) error {
+	if claims.ProjectID != input.ProjectID {
+		return nil
+	}
+
+	stored, err := s.refreshTokenRepo.GetByHash(ctx, crypto.HashToken(input.Token))
+	if err != nil {
+		return err
+	}
+	if stored == nil || stored.RevokedAt != nil {
+		return nil
+	}
+
+	if err := s.refreshTokenRepo.RevokeFamily(ctx, stored.FamilyID); err != nil {
+		return err
+	}
+
+	email := ""
+	if user, err := s.userRepo.GetByID(ctx, stored.UserID); err == nil && user != nil {
+		email = user.Email
+	}
+	s.logRevocation(ctx, input, stored.EnvironmentID, stored.UserID, email, TokenTypeRefreshToken, stored.FamilyID)
+	return nil
+}
+
+func (s *TokenService) revokeAccessToken(ctx context.Context, input RevokeInput, claims *crypto.AccessTokenClaims) error {
+	if claims.ProjectID != input.ProjectID || claims.ID == "" || claims.ExpiresAt == nil {
+		return nil
+	}
+
+	revoked, err := s.denylistRepo.Contains(ctx, claims.ID)
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return nil
+	}
+
+	if err := s.denylistRepo.Add(ctx, claims.ID, claims.UserID, claims.ExpiresAt.Time); err != nil {
+		return err
+	}
+
+	s.logRevocation(ctx, input, claims.EnvironmentID, claims.UserID, claims.Email, TokenTypeAccessToken, claims.SessionID)
+	return nil
+}
+
+func (s *TokenService) logRevocation(ctx context.Context, input RevokeInput, environmentID, userID, email, tokenType, sessionID string) {
+	metadata := map[string]string{"tokenType": tokenType, "clientId": input.ClientID}
+	if sessionID != "" {
+		metadata["sessionId"] = sessionID
+	}
+
+	err := s.projectRepo.InsertAuthLog(ctx, &models.AuthLog{
+		ID:            ulid.Make().String(),
+		ProjectID:     input.ProjectID,
+		EnvironmentID: environmentID,
+		UserID:        userID,
+		UserEmail:     email,
+		EventType:     "token_revoked",
+		Status:        "SUCCESS",
+		IPAddress:     input.IPAddress,
+		UserAgent:     input.UserAgent,
+		Metadata:      metadata,
+		CreatedAt:     time.Now(),
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to log auth event")
+	}
+}
+
+func setTimes(response *IntrospectionResponse, claims jwt.RegisteredClaims) {
+	response.ExpiresAt = unixTime(claims.ExpiresAt)
+	response.IssuedAt = unixTime(claims.IssuedAt)
+	response.NotBefore = unixTime(claims.NotBefore)
+}
+
+func unixTime(date *jwt.NumericDate) int64 {
+	if date == nil {
+		return 0
+	}
+	return date.Unix()
+}
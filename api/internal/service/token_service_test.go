@@ -0,0 +1,218 @@
+package service_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/marcioecom/permit/internal/crypto"
+	"github.com/marcioecom/permit/internal/models"
+	"github.com/marcioecom/permit/internal/repository"
+	"github.com/marcioecom/permit/internal/service"
+	"github.com/oklog/ulid/v2"
+)
+
+type mockDenylistRepo struct {
+	repository.AccessTokenDenylistRepository
+	jtis map[string]bool
+}
+
+func newMockDenylistRepo() *mockDenylistRepo {
+	return &mockDenylistRepo{jtis: make(map[string]bool)}
+}
+
+func (m *mockDenylistRepo) Add(ctx context.Context, jti, userID string, expiresAt time.Time) error {
+	m.jtis[jti] = true
+	return nil
+}
+
+func (m *mockDenylistRepo) Contains(ctx context.Context, jti string) (bool, error) {
+	return m.jtis[jti], nil
+}
+
+// newTestRefreshToken signs a refresh token in a session's family and stores
+// it
+func newTestRefreshToken(t *testing.T, jwtService *crypto.JWTService, refreshTokens *mockRefreshTokenRepo, userID, projectID, sessionID string) (string, *models.RefreshToken) {
+	t.Helper()
+	token, err := jwtService.SignRefreshToken(crypto.RefreshTokenInput{UserID: userID, ProjectID: projectID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := &models.RefreshToken{
+		ID:        ulid.Make().String(),
+		UserID:    userID,
+		ProjectID: projectID,
+		FamilyID:  sessionID,
+		TokenHash: crypto.HashToken(token),
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+	if err := refreshTokens.Create(context.Background(), stored); err != nil {
+		t.Fatal(err)
+	}
+	return token, stored
+}
+
+func TestIntrospect_OtherProjectIsInactive(t *testing.T) {
+	user := &models.User{ID: ulid.Make().String(), Email: "test@example.com"}
+	projectID := ulid.Make().String()
+	sessionID := ulid.Make().String()
+	jwtService := newTestJWTService(t)
+	refreshTokens := newMockRefreshTokenRepo()
+	sessionRepo := newMockSessionRepo(nil)
+	sessionRepo.sessions[sessionID] = &models.Session{ID: sessionID, UserID: user.ID, ProjectID: projectID}
+	tokenService := service.NewTokenService(jwtService, nil, refreshTokens, sessionRepo, newMockDenylistRepo(), &mockProjectRepo{}, newMockUserRepo())
+
+	accessToken, err := jwtService.SignAccessToken(crypto.AccessTokenInput{UserID: user.ID, ProjectID: projectID, SessionID: sessionID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshToken, _ := newTestRefreshToken(t, jwtService, refreshTokens, user.ID, projectID, sessionID)
+	clientToken, err := jwtService.SignClientToken(crypto.ClientTokenInput{ClientID: "pk_backend", ProjectID: projectID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	active := func(projectID, token string) bool {
+		response, err := tokenService.Introspect(context.Background(), service.IntrospectInput{ProjectID: projectID, Token: token})
+		if err != nil {
+			t.Fatalf("Introspect failed: %v", err)
+		}
+		return response.Active
+	}
+	otherProject := ulid.Make().String()
+	for name, token := range map[string]string{"access": accessToken, "refresh": refreshToken, "client": clientToken} {
+		if !active(projectID, token) {
+			t.Errorf("Expected the %s token to be active for its own project", name)
+		}
+		if active(otherProject, token) {
+			t.Errorf("Expected the %s token to be inactive for another project", name)
+		}
+	}
+}
+
+func TestIntrospect_RevokedTokensAreInactive(t *testing.T) {
+	user := &models.User{ID: ulid.Make().String(), Email: "test@example.com"}
+	projectID := ulid.Make().String()
+	sessionID := ulid.Make().String()
+	jwtService := newTestJWTService(t)
+	refreshTokens := newMockRefreshTokenRepo()
+	sessionRepo := newMockSessionRepo(nil)
+	sessionRepo.sessions[sessionID] = &models.Session{ID: sessionID, UserID: user.ID, ProjectID: projectID}
+	denylist := newMockDenylistRepo()
+	tokenService := service.NewTokenService(jwtService, nil, refreshTokens, sessionRepo, denylist, &mockProjectRepo{}, newMockUserRepo())
+
+	active := func(token string) bool {
+		response, err := tokenService.Introspect(context.Background(), service.IntrospectInput{ProjectID: projectID, Token: token})
+		if err != nil {
+			t.Fatalf("Introspect failed: %v", err)
+		}
+		return response.Active
+	}
+	signAccessToken := func() string {
+		token, err := jwtService.SignAccessToken(crypto.AccessTokenInput{UserID: user.ID, ProjectID: projectID, SessionID: sessionID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	accessToken := signAccessToken()
+	claims, _ := jwtService.VerifyAccessToken(accessToken)
+	denylist.jtis[claims.ID] = true
+	if active(accessToken) {
+		t.Error("Expected a denylisted access token to be inactive")
+	}
+
+	accessToken = signAccessToken()
+	refreshToken, stored := newTestRefreshToken(t, jwtService, refreshTokens, user.ID, projectID, sessionID)
+	now := time.Now()
+	stored.RevokedAt = &now
+	if active(refreshToken) {
+		t.Error("Expected a revoked refresh token to be inactive")
+	}
+
+	sessionRepo.sessions[sessionID].RevokedAt = &now
+	if active(accessToken) {
+		t.Error("Expected an access token of a revoked session to be inactive")
+	}
+}
+
+func TestRevoke_RefreshTokenRevokesFamily(t *testing.T) {
+	user := &models.User{ID: ulid.Make().String(), Email: "test@example.com"}
+	projectID := ulid.Make().String()
+	sessionID := ulid.Make().String()
+	jwtService := newTestJWTService(t)
+	userRepo := newMockUserRepo()
+	userRepo.users[user.ID] = user
+	refreshTokens := newMockRefreshTokenRepo()
+	projectRepo := &mockProjectRepo{}
+	tokenService := service.NewTokenService(jwtService, nil, refreshTokens, newMockSessionRepo(nil), newMockDenylistRepo(), projectRepo, userRepo)
+	ctx := context.Background()
+
+	refreshToken, _ := newTestRefreshToken(t, jwtService, refreshTokens, user.ID, projectID, sessionID)
+	siblingToken, sibling := newTestRefreshToken(t, jwtService, refreshTokens, user.ID, projectID, sessionID)
+
+	input := service.RevokeInput{ProjectID: ulid.Make().String(), ClientID: "pk_other", Token: refreshToken}
+	if err := tokenService.Revoke(ctx, input); err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+	if len(refreshTokens.active(sessionID)) != 2 {
+		t.Fatal("Expected a token of another project to be left alone")
+	}
+
+	input.ProjectID, input.ClientID = projectID, "pk_backend"
+	if err := tokenService.Revoke(ctx, input); err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+	if active := refreshTokens.active(sessionID); len(active) != 0 {
+		t.Errorf("Expected the whole family to be revoked, %d tokens still active", len(active))
+	}
+	response, err := tokenService.Introspect(ctx, service.IntrospectInput{ProjectID: projectID, Token: siblingToken})
+	if err != nil || response.Active || sibling.RevokedAt == nil {
+		t.Error("Expected the family's other tokens to be inactive")
+	}
+
+	if len(projectRepo.authLogs) != 1 {
+		t.Fatalf("Expected one auth log, got %d", len(projectRepo.authLogs))
+	}
+	logged := projectRepo.authLogs[0]
+	if logged.EventType != "token_revoked" || logged.UserID != user.ID || logged.UserEmail != user.Email {
+		t.Errorf("Unexpected auth log: %+v", logged)
+	}
+	if logged.Metadata["tokenType"] != service.TokenTypeRefreshToken || logged.Metadata["sessionId"] != sessionID || logged.Metadata["clientId"] != "pk_backend" {
+		t.Errorf("Unexpected auth log metadata: %v", logged.Metadata)
+	}
+
+	// Revoking again is a no-op
+	if err := tokenService.Revoke(ctx, input); err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+	if len(projectRepo.authLogs) != 1 {
+		t.Error("Expected an already revoked token not to be logged again")
+	}
+}
+
+func TestRevoke_AccessTokenIsDenylisted(t *testing.T) {
+	projectID := ulid.Make().String()
+	jwtService := newTestJWTService(t)
+	denylist := newMockDenylistRepo()
+	tokenService := service.NewTokenService(jwtService, nil, newMockRefreshTokenRepo(), newMockSessionRepo(nil), denylist, &mockProjectRepo{}, newMockUserRepo())
+	ctx := context.Background()
+
+	accessToken, err := jwtService.SignAccessToken(crypto.AccessTokenInput{UserID: ulid.Make().String(), ProjectID: projectID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, _ := jwtService.VerifyAccessToken(accessToken)
+
+	if err := tokenService.Revoke(ctx, service.RevokeInput{ProjectID: projectID, Token: accessToken}); err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+	if !denylist.jtis[claims.ID] {
+		t.Error("Expected the access token to be denylisted")
+	}
+	response, err := tokenService.Introspect(ctx, service.IntrospectInput{ProjectID: projectID, Token: accessToken})
+	if err != nil || response.Active {
+		t.Error("Expected a revoked access token to be inactive")
+	}
+}
@@ -0,0 +1,76 @@
+package permit
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Actor identifies who is acting as the user, as in RFC 8693
+type Actor struct {
+	Subject string `json:"sub"`
+	Email   string `json:"email,omitempty"`
+}
+
+// Claims are the claims of a Permit access token
+type Claims struct {
+	jwt.RegisteredClaims
+	Email         string `json:"email"`
+	UserID        string `json:"uid"`
+	ProjectID     string `json:"pid"`
+	EnvironmentID string `json:"eid,omitempty"`
+	SessionID     string `json:"sid,omitempty"`
+	Provider      string `json:"provider,omitempty"`
+
+	// AuthTime is when the user last actively authenticated, as a Unix time.
+	// AMR lists the methods used then, such as "otp" or "oauth".
+	AuthTime int64    `json:"auth_time,omitempty"`
+	AMR      []string `json:"amr,omitempty"`
+
+	// Actor is set on impersonation tokens, minted by a project owner to act
+	// as the user
+	Actor *Actor `json:"act,omitempty"`
+
+	// TokenType is set on refresh and client credentials tokens, which
+	// Verify rejects
+	TokenType string `json:"type,omitempty"`
+
+	// Custom holds the claims rendered from the project's claims template
+	Custom map[string]any `json:"-"`
+}
+
+var knownClaims = []string{
+	"iss", "sub", "aud", "exp", "nbf", "iat", "jti",
+	"email", "uid", "pid", "eid", "sid", "provider", "type", "act",
+	"auth_time", "amr",
+}
+
+// AuthenticatedWithin reports whether the user actively authenticated within
+// maxAge. Tokens without an auth_time never have.
+func (c *Claims) AuthenticatedWithin(maxAge time.Duration) bool {
+	if c.AuthTime == 0 {
+		return false
+	}
+	return time.Since(time.Unix(c.AuthTime, 0)) <= maxAge
+}
+
+// UnmarshalJSON decodes the claims, collecting unknown ones into Custom
+func (c *Claims) UnmarshalJSON(data []byte) error {
+	type plain Claims
+	if err := json.Unmarshal(data, (*plain)(c)); err != nil {
+		return err
+	}
+
+	var all map[string]any
+	if err := json.Unmarshal(data, &all); err != nil {
+		return err
+	}
+	for _, name := range knownClaims {
+		delete(all, name)
+	}
+	if len(all) > 0 {
+		c.Custom = all
+	}
+	return nil
+}
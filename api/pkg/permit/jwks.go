@@ -0,0 +1,240 @@
+package permit
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var supportedAlgorithms = []string{"RS256", "ES256", "EdDSA"}
+
+// PublicKey is a verification key from a JWKS
+type PublicKey struct {
+	ID        string
+	Algorithm string
+	PublicKey crypto.PublicKey
+}
+
+// KeySetOptions configures a KeySet; zero values use the defaults described
+// on Config
+type KeySetOptions struct {
+	HTTPClient         *http.Client
+	CacheTTL           time.Duration
+	MinRefreshInterval time.Duration
+}
+
+// KeySet fetches and caches the keys of a JWKS endpoint. It is safe for
+// concurrent use.
+type KeySet struct {
+	url        string
+	client     *http.Client
+	ttl        time.Duration
+	minRefresh time.Duration
+
+	mu        sync.RWMutex
+	keys      map[string]PublicKey
+	fetchedAt time.Time
+	inflight  *keySetFetch
+}
+
+// keySetFetch is a fetch in progress, shared by every caller that needs it
+type keySetFetch struct {
+	done chan struct{}
+	err  error
+}
+
+func NewKeySet(url string, opts KeySetOptions) *KeySet {
+	ks := &KeySet{
+		url:        url,
+		client:     opts.HTTPClient,
+		ttl:        opts.CacheTTL,
+		minRefresh: opts.MinRefreshInterval,
+	}
+	if ks.client == nil {
+		ks.client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if ks.ttl <= 0 {
+		ks.ttl = time.Hour
+	}
+	if ks.minRefresh <= 0 {
+		ks.minRefresh = time.Minute
+	}
+	return ks
+}
+
+// Key returns the key with a kid. The key set is refetched once the cache
+// expires, or when the kid is unknown and the last fetch is older than the
+// minimum refresh interval. Stale keys keep being used if a refetch fails.
+// Cached keys are served under a read lock, and concurrent callers share a
+// single refetch.
+func (ks *KeySet) Key(ctx context.Context, kid string) (PublicKey, error) {
+	ks.mu.RLock()
+	key, found := ks.keys[kid]
+	fetchedAt := ks.fetchedAt
+	stale := ks.keys == nil || time.Since(fetchedAt) >= ks.ttl
+	ks.mu.RUnlock()
+
+	if stale || (!found && time.Since(fetchedAt) >= ks.minRefresh) {
+		err := ks.refresh(ctx, fetchedAt)
+
+		ks.mu.RLock()
+		loaded := ks.keys != nil
+		key, found = ks.keys[kid]
+		ks.mu.RUnlock()
+
+		if err != nil && !loaded {
+			return PublicKey{}, err
+		}
+	}
+
+	if !found {
+		return PublicKey{}, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// refresh refetches the key set unless a fetch has started since fetchedAt,
+// waiting for the fetch in progress if there is one
+func (ks *KeySet) refresh(ctx context.Context, fetchedAt time.Time) error {
+	ks.mu.Lock()
+	if call := ks.inflight; call != nil {
+		ks.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if !ks.fetchedAt.Equal(fetchedAt) {
+		ks.mu.Unlock()
+		return nil
+	}
+
+	// Failed attempts count too, so an unavailable endpoint isn't hammered
+	ks.fetchedAt = time.Now()
+	call := &keySetFetch{done: make(chan struct{})}
+	ks.inflight = call
+	ks.mu.Unlock()
+
+	keys, err := ks.fetch(ctx)
+
+	ks.mu.Lock()
+	if err == nil {
+		ks.keys = keys
+	}
+	ks.inflight = nil
+	ks.mu.Unlock()
+
+	call.err = err
+	close(call.done)
+	return err
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetch returns the keys currently published. Keys of unsupported types are
+// skipped.
+func (ks *KeySet) fetch(ctx context.Context) (map[string]PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ks.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ks.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("permit: fetching JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("permit: fetching JWKS: unexpected status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("permit: decoding JWKS: %w", err)
+	}
+
+	keys := make(map[string]PublicKey, len(body.Keys))
+	for _, jwk := range body.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		publicKey, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = PublicKey{ID: jwk.Kid, Algorithm: jwk.Alg, PublicKey: publicKey}
+	}
+	return keys, nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch {
+	case k.Kty == "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case k.Kty == "EC" && k.Crv == "P-256":
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if !publicKey.Curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on the curve")
+		}
+		return publicKey, nil
+	case k.Kty == "OKP" && k.Crv == "Ed25519":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,129 @@
+package permit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type contextKey string
+
+const (
+	UserIDKey    contextKey = "userId"
+	ProjectIDKey contextKey = "projectId"
+	EmailKey     contextKey = "email"
+	ClaimsKey    contextKey = "claims"
+)
+
+// RequireAuth is net/http middleware, also usable with chi's Use and With,
+// that rejects requests without a valid bearer access token and puts the
+// token's claims into the request context
+func (v *Verifier) RequireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeader := r.Header.Get("Authorization")
+		if authHeader == "" {
+			writeUnauthorized(w, "missing_token", "Authorization header required")
+			return
+		}
+
+		parts := strings.Split(authHeader, " ")
+		if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
+			writeUnauthorized(w, "invalid_token", "Invalid authorization header format")
+			return
+		}
+
+		claims, err := v.Verify(r.Context(), parts[1])
+		if err != nil {
+			if errors.Is(err, ErrTokenExpired) {
+				writeUnauthorized(w, "token_expired", "Token has expired")
+				return
+			}
+			writeUnauthorized(w, "invalid_token", "Invalid or expired token")
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithClaims(r.Context(), claims)))
+	})
+}
+
+// RequireAuthFunc wraps a handler function with RequireAuth
+func (v *Verifier) RequireAuthFunc(next http.HandlerFunc) http.HandlerFunc {
+	return v.RequireAuth(next).ServeHTTP
+}
+
+// RequireRecentAuth returns middleware, to be used after RequireAuth, that
+// rejects tokens whose user didn't authenticate within maxAge. The challenge
+// follows RFC 9470 so clients know to have the user re-authenticate through
+// Permit's /auth/reauth endpoints before retrying.
+func RequireRecentAuth(maxAge time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims := GetClaims(r.Context())
+			if claims == nil {
+				writeUnauthorized(w, "missing_token", "Authorization header required")
+				return
+			}
+			if !claims.AuthenticatedWithin(maxAge) {
+				seconds := int64(maxAge / time.Second)
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_user_authentication", error_description="A more recent authentication is required", max_age=%d`, seconds))
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"data":null,"error":{"code":"insufficient_user_authentication","message":"A more recent authentication is required"}}`))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// WithClaims returns a context carrying a token's claims, as RequireAuth sets
+// them
+func WithClaims(ctx context.Context, claims *Claims) context.Context {
+	ctx = context.WithValue(ctx, UserIDKey, claims.UserID)
+	ctx = context.WithValue(ctx, ProjectIDKey, claims.ProjectID)
+	ctx = context.WithValue(ctx, EmailKey, claims.Email)
+	ctx = context.WithValue(ctx, ClaimsKey, claims)
+	return ctx
+}
+
+func GetUserID(ctx context.Context) string {
+	if v := ctx.Value(UserIDKey); v != nil {
+		return v.(string)
+	}
+	return ""
+}
+
+func GetProjectID(ctx context.Context) string {
+	if v := ctx.Value(ProjectIDKey); v != nil {
+		return v.(string)
+	}
+	return ""
+}
+
+func GetEmail(ctx context.Context) string {
+	if v := ctx.Value(EmailKey); v != nil {
+		return v.(string)
+	}
+	return ""
+}
+
+func GetClaims(ctx context.Context) *Claims {
+	if v := ctx.Value(ClaimsKey); v != nil {
+		return v.(*Claims)
+	}
+	return nil
+}
+
+func writeUnauthorized(w http.ResponseWriter, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	if code == "missing_token" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	} else {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write([]byte(`{"data":null,"error":{"code":"` + code + `","message":"` + message + `"}}`))
+}
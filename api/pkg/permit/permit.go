@@ -0,0 +1,174 @@
+// Package permit verifies access tokens issued by Permit in Go services.
+//
+// A Verifier fetches the project's public keys from its JWKS endpoint, caches
+// them and refetches when a token is signed with a key it hasn't seen yet,
+// such as right after a rotation:
+//
+//	verifier, err := permit.NewVerifier(permit.Config{
+//		BaseURL:   "https://auth.example.com",
+//		ProjectID: "01HX...",
+//	})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//
+//	r := chi.NewRouter()
+//	r.Use(verifier.RequireAuth)
+//	r.Get("/me", func(w http.ResponseWriter, r *http.Request) {
+//		claims := permit.GetClaims(r.Context())
+//		fmt.Fprintln(w, claims.UserID)
+//	})
+//
+// Verification is done locally, so a revoked access token is accepted until
+// it expires. Use the introspection endpoint where that matters.
+package permit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// DefaultIssuer is the iss claim of Permit access tokens
+const DefaultIssuer = "permit"
+
+var (
+	ErrInvalidToken        = errors.New("permit: invalid token")
+	ErrTokenExpired        = errors.New("permit: token has expired")
+	ErrInvalidAudience     = errors.New("permit: token was issued for another project")
+	ErrEnvironmentMismatch = errors.New("permit: token was issued for another environment")
+	ErrUnknownKey          = errors.New("permit: token is signed with an unknown key")
+)
+
+// Config configures a Verifier
+type Config struct {
+	// BaseURL is the Permit API's public URL, used to locate the JWKS
+	BaseURL string
+
+	// ProjectID is the project tokens must be issued for
+	ProjectID string
+
+	// EnvironmentID restricts tokens to one of the project's environments;
+	// empty accepts all of them
+	EnvironmentID string
+
+	// JWKSURL overrides where keys are fetched from. It defaults to the
+	// environment's key set when EnvironmentID is set and to the project's
+	// otherwise.
+	JWKSURL string
+
+	// Issuer defaults to DefaultIssuer
+	Issuer string
+
+	// HTTPClient defaults to a client with a 10 second timeout
+	HTTPClient *http.Client
+
+	// CacheTTL is how long fetched keys are used before being refreshed.
+	// Defaults to one hour.
+	CacheTTL time.Duration
+
+	// MinRefreshInterval bounds how often tokens with an unknown kid can
+	// trigger a refetch. Defaults to one minute.
+	MinRefreshInterval time.Duration
+
+	// Leeway tolerates clock skew when checking exp and nbf
+	Leeway time.Duration
+}
+
+// Verifier verifies Permit access tokens for one project
+type Verifier struct {
+	keys          *KeySet
+	parser        *jwt.Parser
+	projectID     string
+	environmentID string
+}
+
+// NewVerifier creates a Verifier. No keys are fetched until the first token
+// is verified.
+func NewVerifier(cfg Config) (*Verifier, error) {
+	if cfg.ProjectID == "" {
+		return nil, errors.New("permit: ProjectID is required")
+	}
+
+	jwksURL := cfg.JWKSURL
+	if jwksURL == "" {
+		if cfg.BaseURL == "" {
+			return nil, errors.New("permit: BaseURL or JWKSURL is required")
+		}
+		baseURL := strings.TrimSuffix(cfg.BaseURL, "/")
+		if cfg.EnvironmentID != "" {
+			jwksURL = baseURL + "/environments/" + cfg.EnvironmentID + "/.well-known/jwks.json"
+		} else {
+			jwksURL = baseURL + "/projects/" + cfg.ProjectID + "/.well-known/jwks.json"
+		}
+	}
+
+	issuer := cfg.Issuer
+	if issuer == "" {
+		issuer = DefaultIssuer
+	}
+
+	return &Verifier{
+		keys: NewKeySet(jwksURL, KeySetOptions{
+			HTTPClient:         cfg.HTTPClient,
+			CacheTTL:           cfg.CacheTTL,
+			MinRefreshInterval: cfg.MinRefreshInterval,
+		}),
+		parser: jwt.NewParser(
+			jwt.WithValidMethods(supportedAlgorithms),
+			jwt.WithIssuer(issuer),
+			jwt.WithAudience(cfg.ProjectID),
+			jwt.WithExpirationRequired(),
+			jwt.WithLeeway(cfg.Leeway),
+		),
+		projectID:     cfg.ProjectID,
+		environmentID: cfg.EnvironmentID,
+	}, nil
+}
+
+// Verify checks a token's signature, lifetime, issuer, project and
+// environment, returning its claims. Refresh tokens and client credentials
+// tokens are rejected.
+func (v *Verifier) Verify(ctx context.Context, tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := v.parser.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := v.keys.Key(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+		if key.Algorithm != "" && key.Algorithm != token.Method.Alg() {
+			return nil, fmt.Errorf("%w: algorithm mismatch", ErrInvalidToken)
+		}
+		return key.PublicKey, nil
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrUnknownKey):
+			return nil, ErrUnknownKey
+		case errors.Is(err, jwt.ErrTokenExpired):
+			return nil, ErrTokenExpired
+		case errors.Is(err, jwt.ErrTokenInvalidAudience):
+			return nil, ErrInvalidAudience
+		default:
+			return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+		}
+	}
+
+	if claims.TokenType != "" || claims.UserID == "" {
+		return nil, fmt.Errorf("%w: not an access token", ErrInvalidToken)
+	}
+	if claims.ProjectID != v.projectID {
+		return nil, ErrInvalidAudience
+	}
+	if v.environmentID != "" && claims.EnvironmentID != v.environmentID {
+		return nil, ErrEnvironmentMismatch
+	}
+
+	return claims, nil
+}
@@ -0,0 +1,253 @@
+package permit_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/marcioecom/permit/internal/crypto"
+	"github.com/marcioecom/permit/pkg/permit"
+)
+
+type testIssuer struct {
+	jwtService *crypto.JWTService
+	keyManager *crypto.KeyManager
+	server     *httptest.Server
+	publish    atomic.Bool
+	fetches    atomic.Int32
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+
+	keyManager := crypto.NewKeyManager()
+	if err := keyManager.GenerateKeyPair(); err != nil {
+		t.Fatal(err)
+	}
+	for _, env := range []string{"env-a", "env-b"} {
+		if err := keyManager.EnsureEnvironmentKeys(env, crypto.AlgorithmES256); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	issuer := &testIssuer{
+		jwtService: crypto.NewJWTService(keyManager, "permit"),
+		keyManager: keyManager,
+	}
+	issuer.publish.Store(true)
+	issuer.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		issuer.fetches.Add(1)
+		jwks := crypto.JWKSResponse{Keys: []crypto.JWK{}}
+		if issuer.publish.Load() {
+			jwks = keyManager.EnvironmentJWKS("env-a", "env-b")
+		}
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+func (i *testIssuer) accessToken(t *testing.T, projectID, environmentID string) string {
+	t.Helper()
+	token, err := i.jwtService.SignAccessToken(crypto.AccessTokenInput{
+		Email:         "user@example.com",
+		UserID:        "user-1",
+		ProjectID:     projectID,
+		EnvironmentID: environmentID,
+		Algorithm:     crypto.AlgorithmES256,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestVerifier_Verify(t *testing.T) {
+	issuer := newTestIssuer(t)
+	verifier, err := permit.NewVerifier(permit.Config{
+		JWKSURL:       issuer.server.URL,
+		ProjectID:     "project-1",
+		EnvironmentID: "env-a",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	claims, err := verifier.Verify(ctx, issuer.accessToken(t, "project-1", "env-a"))
+	if err != nil {
+		t.Fatalf("expected token to verify: %v", err)
+	}
+	if claims.UserID != "user-1" || claims.Email != "user@example.com" {
+		t.Errorf("unexpected claims: %+v", claims)
+	}
+
+	if _, err := verifier.Verify(ctx, issuer.accessToken(t, "project-2", "env-a")); !errors.Is(err, permit.ErrInvalidAudience) {
+		t.Errorf("expected ErrInvalidAudience for another project, got %v", err)
+	}
+	if _, err := verifier.Verify(ctx, issuer.accessToken(t, "project-1", "env-b")); !errors.Is(err, permit.ErrEnvironmentMismatch) {
+		t.Errorf("expected ErrEnvironmentMismatch for another environment, got %v", err)
+	}
+
+	refreshToken, err := issuer.jwtService.SignRefreshToken(crypto.RefreshTokenInput{
+		UserID:        "user-1",
+		ProjectID:     "project-1",
+		EnvironmentID: "env-a",
+		Algorithm:     crypto.AlgorithmES256,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.Verify(ctx, refreshToken); !errors.Is(err, permit.ErrInvalidToken) {
+		t.Errorf("expected refresh token to be rejected, got %v", err)
+	}
+
+	if fetches := issuer.fetches.Load(); fetches != 1 {
+		t.Errorf("expected keys to be fetched once and cached, got %d fetches", fetches)
+	}
+}
+
+func TestVerifier_RefetchesUnknownKid(t *testing.T) {
+	issuer := newTestIssuer(t)
+	issuer.publish.Store(false)
+	verifier, err := permit.NewVerifier(permit.Config{
+		JWKSURL:            issuer.server.URL,
+		ProjectID:          "project-1",
+		MinRefreshInterval: time.Nanosecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := issuer.accessToken(t, "project-1", "env-a")
+
+	if _, err := verifier.Verify(context.Background(), token); !errors.Is(err, permit.ErrUnknownKey) {
+		t.Fatalf("expected ErrUnknownKey before the key is published, got %v", err)
+	}
+
+	issuer.publish.Store(true)
+	if _, err := verifier.Verify(context.Background(), token); err != nil {
+		t.Errorf("expected unknown kid to trigger a refetch: %v", err)
+	}
+}
+
+func TestKeySet_SharesRefetch(t *testing.T) {
+	issuer := newTestIssuer(t)
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) > 1 {
+			<-release
+		}
+		json.NewEncoder(w).Encode(issuer.keyManager.EnvironmentJWKS("env-a"))
+	}))
+	t.Cleanup(server.Close)
+
+	keySet := permit.NewKeySet(server.URL, permit.KeySetOptions{MinRefreshInterval: 100 * time.Millisecond})
+	ctx := context.Background()
+	known, _ := issuer.keyManager.SigningKey("env-a", crypto.AlgorithmES256)
+	if _, err := keySet.Key(ctx, known.ID); err != nil {
+		t.Fatalf("expected the published key: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Unknown kids refetch while the endpoint hangs
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := keySet.Key(ctx, "unknown"); !errors.Is(err, permit.ErrUnknownKey) {
+				t.Errorf("expected ErrUnknownKey, got %v", err)
+			}
+		}()
+	}
+	for fetches.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := keySet.Key(ctx, known.ID)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected the cached key during a refetch: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected cached keys to be served while a refetch is in flight")
+	}
+
+	close(release)
+	wg.Wait()
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("expected concurrent misses to share one refetch, got %d fetches", n-1)
+	}
+}
+
+func TestVerifier_RequireAuth(t *testing.T) {
+	issuer := newTestIssuer(t)
+	verifier, err := permit.NewVerifier(permit.Config{JWKSURL: issuer.server.URL, ProjectID: "project-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := verifier.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(permit.GetUserID(r.Context())))
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a token, got %d", rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+issuer.accessToken(t, "project-1", "env-a"))
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "user-1" {
+		t.Errorf("expected claims in the context, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRequireRecentAuth(t *testing.T) {
+	handler := permit.RequireRecentAuth(5 * time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	serve := func(authTime time.Time) *httptest.ResponseRecorder {
+		claims := &permit.Claims{UserID: "user-1"}
+		if !authTime.IsZero() {
+			claims.AuthTime = authTime.Unix()
+		}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req.WithContext(permit.WithClaims(req.Context(), claims)))
+		return rec
+	}
+
+	if rec := serve(time.Now().Add(-time.Minute)); rec.Code != http.StatusNoContent {
+		t.Errorf("expected a recent authentication to pass, got %d", rec.Code)
+	}
+
+	rec := serve(time.Now().Add(-time.Hour))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a stale authentication to be rejected, got %d", rec.Code)
+	}
+	if challenge := rec.Header().Get("WWW-Authenticate"); !strings.Contains(challenge, `error="insufficient_user_authentication"`) || !strings.Contains(challenge, "max_age=300") {
+		t.Errorf("expected an RFC 9470 challenge, got %q", challenge)
+	}
+
+	if rec := serve(time.Time{}); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected a token without auth_time to be rejected, got %d", rec.Code)
+	}
+}
@@ -17,6 +17,8 @@ interface PermitConfig {
   theme?: "light" | "dark";
   /** Disable Shadow DOM isolation for styles. Useful for testing environments. */
   disableShadowDOM?: boolean;
+  /** Also email a sign-in link that returns to ssoCallbackUrl. The origin must be allowed for the environment. */
+  magicLink?: boolean;
 }
 
 interface PermitProviderProps {
@@ -53,6 +55,7 @@ export const PermitProvider = ({
   const queryClient = useMemo(() => createQueryClient(), []);
   const apiUrl = config?.apiUrl || DEFAULT_API_URL;
   const disableShadowDOM = config?.disableShadowDOM ?? false;
+  const magicLink = config?.magicLink ?? false;
 
   return (
     <QueryClientProvider client={queryClient}>
@@ -61,6 +64,7 @@ export const PermitProvider = ({
         ssoCallbackUrl={ssoCallbackUrl}
         apiUrl={apiUrl}
         disableShadowDOM={disableShadowDOM}
+        magicLink={magicLink}
       >
         {children}
       </PermitProviderInner>
@@ -73,6 +77,7 @@ interface PermitProviderInnerProps {
   ssoCallbackUrl: string;
   apiUrl: string;
   disableShadowDOM: boolean;
+  magicLink: boolean;
   children: ReactNode;
 }
 
@@ -81,6 +86,7 @@ const PermitProviderInner = ({
   ssoCallbackUrl,
   apiUrl,
   disableShadowDOM,
+  magicLink,
   children,
 }: PermitProviderInnerProps) => {
   const [isModalOpen, setIsModalOpen] = useState(false);
@@ -149,6 +155,7 @@ const PermitProviderInner = ({
         apiUrl,
         projectId,
         ssoCallbackUrl,
+        magicLink,
       }}
     >
       {children}
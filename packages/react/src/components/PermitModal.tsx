@@ -9,11 +9,13 @@ import { Input } from "@/components/ui/input";
 import { Label } from "@/components/ui/label";
 import type { User, WidgetConfig } from "@/context/PermitContext";
 import { usePermit } from "@/hooks/usePermit";
-import { oauthAuthorize, startOtp, verifyOtp } from "@/lib/api";
+import { enrollMfa, oauthAuthorize, startOtp, verifyMfa, verifyOtp } from "@/lib/api";
 import { ApiError } from "@/lib/api-client";
+import type { AuthResponse, MfaChallenge, MfaEnrollment } from "@/types/api";
 import { AnimatePresence, motion } from "framer-motion";
 import { AlertCircle, Lock } from "lucide-react";
-import { useState } from "react";
+import { REGEXP_ONLY_DIGITS, REGEXP_ONLY_DIGITS_AND_CHARS } from "input-otp";
+import { useEffect, useState } from "react";
 import { useTheme } from "./theme-provider";
 import { InputOTP, InputOTPGroup, InputOTPSlot } from "./ui/input-otp";
 import { GithubDark } from "./ui/svgs/githubDark";
@@ -40,14 +42,21 @@ export const PermitModal = ({
   const apiUrl = propApiUrl ?? context.apiUrl;
   const widgetConfig = propWidgetConfig ?? context.widgetConfig;
   const { configError } = context;
-  const [step, setStep] = useState<"email" | "otp">("email");
+  const [step, setStep] = useState<"email" | "otp" | "mfa">("email");
   const [email, setEmail] = useState("");
   const [otp, setOtp] = useState("");
+  const [challengeId, setChallengeId] = useState<string | undefined>();
+  const [codeLength, setCodeLength] = useState(6);
+  const [codeAlphabet, setCodeAlphabet] = useState<"numeric" | "alphanumeric">("numeric");
+  const [resendAfter, setResendAfter] = useState<Date | null>(null);
+  const [mfaChallenge, setMfaChallenge] = useState<MfaChallenge | null>(null);
+  const [mfaEnrollment, setMfaEnrollment] = useState<MfaEnrollment | null>(null);
+  const [mfaCode, setMfaCode] = useState("");
   const [loading, setLoading] = useState(false);
   const [error, setError] = useState<string | null>(null);
 
   const { theme } = useTheme();
-  const { ssoCallbackUrl } = context;
+  const { ssoCallbackUrl, magicLink } = context;
 
   const handleOAuthSignIn = async (provider: string) => {
     setLoading(true);
@@ -66,13 +75,24 @@ export const PermitModal = ({
     }
   };
 
-  const handleSendEmail = async (e: React.FormEvent) => {
+  const handleSendEmail = async (e: React.SyntheticEvent) => {
     e.preventDefault();
     setLoading(true);
     setError(null);
 
     try {
-      await startOtp(apiUrl, { email }, projectId);
+      const response = await startOtp(
+        apiUrl,
+        magicLink
+          ? { email, magicLink, redirectUrl: ssoCallbackUrl || "/sso-callback" }
+          : { email },
+        projectId
+      );
+      setChallengeId(response.challengeId);
+      setCodeLength(response.codeLength || 6);
+      setCodeAlphabet(response.codeAlphabet || "numeric");
+      setResendAfter(response.resendAfter ? new Date(response.resendAfter) : null);
+      setOtp("");
       setStep("otp");
     } catch (err) {
       const apiError = err as ApiError;
@@ -88,14 +108,25 @@ export const PermitModal = ({
     setError(null);
 
     try {
-      const response = await verifyOtp(apiUrl, { email, code: otp }, projectId);
+      const response = await verifyOtp(
+        apiUrl,
+        { email, challengeId, code: otp },
+        projectId
+      );
 
-      const user = {
-        id: response.user.id,
-        email: response.user.email,
-      };
+      if (response.mfa) {
+        setMfaEnrollment(
+          response.mfa.enrollmentRequired
+            ? await enrollMfa(apiUrl, response.mfa.mfaToken)
+            : null
+        );
+        setMfaChallenge(response.mfa);
+        setMfaCode("");
+        setStep("mfa");
+        return;
+      }
 
-      onSuccess?.(response.accessToken, response.refreshToken, user);
+      completeSignIn(response);
     } catch (err) {
       const apiError = err as ApiError;
       setError(apiError.message || "Invalid verification code");
@@ -104,6 +135,35 @@ export const PermitModal = ({
     }
   };
 
+  const handleVerifyMfa = async (e: React.FormEvent) => {
+    e.preventDefault();
+    if (!mfaChallenge) return;
+    setLoading(true);
+    setError(null);
+
+    try {
+      const response = await verifyMfa(apiUrl, {
+        mfaToken: mfaChallenge.mfaToken,
+        code: mfaCode,
+      });
+      completeSignIn(response);
+    } catch (err) {
+      const apiError = err as ApiError;
+      setError(apiError.message || "Invalid authenticator code");
+    } finally {
+      setLoading(false);
+    }
+  };
+
+  const completeSignIn = (response: AuthResponse) => {
+    const user = {
+      id: response.user.id,
+      email: response.user.email,
+    };
+
+    onSuccess?.(response.accessToken, response.refreshToken, user);
+  };
+
   function showCurrentStep() {
     if (step === "email") {
       return (
@@ -118,11 +178,30 @@ export const PermitModal = ({
       );
     }
 
+    if (step === "mfa") {
+      return (
+        <MFAFormStep
+          enrollment={mfaEnrollment}
+          code={mfaCode}
+          setCode={setMfaCode}
+          setStep={setStep}
+          loading={loading}
+          error={error}
+          handleVerifyMfa={handleVerifyMfa}
+          primaryColor={widgetConfig?.primaryColor}
+        />
+      );
+    }
+
     return (
       <OTPFormStep
         email={email}
         otp={otp}
         setOtp={setOtp}
+        codeLength={codeLength}
+        codeAlphabet={codeAlphabet}
+        resendAfter={resendAfter}
+        handleResend={handleSendEmail}
         setStep={setStep}
         loading={loading}
         error={error}
@@ -288,6 +367,10 @@ function OTPFormStep({
   email,
   otp,
   setOtp,
+  codeLength,
+  codeAlphabet,
+  resendAfter,
+  handleResend,
   setStep,
   loading,
   error,
@@ -297,6 +380,10 @@ function OTPFormStep({
   email: string;
   otp: string;
   setOtp: (otp: string) => void;
+  codeLength: number;
+  codeAlphabet: "numeric" | "alphanumeric";
+  resendAfter: Date | null;
+  handleResend: (e: React.SyntheticEvent) => void;
   setStep: (step: "email" | "otp") => void;
   loading: boolean;
   error: string | null;
@@ -325,30 +412,34 @@ function OTPFormStep({
       <div className="space-y-2 flex flex-col items-center">
         <Label htmlFor="otp">Verification Code</Label>
         <InputOTP
-          maxLength={6}
+          maxLength={codeLength}
           id="otp"
           value={otp}
-          onChange={setOtp}
+          onChange={(value) => setOtp(codeAlphabet === "alphanumeric" ? value.toUpperCase() : value)}
+          pattern={codeAlphabet === "alphanumeric" ? REGEXP_ONLY_DIGITS_AND_CHARS : REGEXP_ONLY_DIGITS}
+          inputMode={codeAlphabet === "alphanumeric" ? "text" : "numeric"}
           autoFocus
         >
           <InputOTPGroup>
-            <InputOTPSlot index={0} />
-            <InputOTPSlot index={1} />
-            <InputOTPSlot index={2} />
-            <InputOTPSlot index={3} />
-            <InputOTPSlot index={4} />
-            <InputOTPSlot index={5} />
+            {Array.from({ length: codeLength }, (_, index) => (
+              <InputOTPSlot key={index} index={index} />
+            ))}
           </InputOTPGroup>
         </InputOTP>
       </div>
       <Button
         type="submit"
-        disabled={loading || otp.length !== 6}
+        disabled={loading || otp.length !== codeLength}
         className="w-full"
         style={primaryColor ? { backgroundColor: primaryColor, borderColor: primaryColor } : undefined}
       >
         {loading ? "Verifying..." : "Sign in"}
       </Button>
+      <ResendButton
+        resendAfter={resendAfter}
+        loading={loading}
+        handleResend={handleResend}
+      />
       <Button
         type="button"
         variant="ghost"
@@ -360,3 +451,127 @@ function OTPFormStep({
     </motion.form>
   );
 }
+
+// MFAFormStep asks for an authenticator code, first showing the secret to
+// enroll when the user has no authenticator yet
+function MFAFormStep({
+  enrollment,
+  code,
+  setCode,
+  setStep,
+  loading,
+  error,
+  handleVerifyMfa,
+  primaryColor,
+}: {
+  enrollment: MfaEnrollment | null;
+  code: string;
+  setCode: (code: string) => void;
+  setStep: (step: "email" | "otp" | "mfa") => void;
+  loading: boolean;
+  error: string | null;
+  handleVerifyMfa: (e: React.FormEvent) => void;
+  primaryColor?: string;
+}) {
+  return (
+    <motion.form
+      key="mfa"
+      initial={{ opacity: 0, x: 20 }}
+      animate={{ opacity: 1, x: 0 }}
+      exit={{ opacity: 0, x: -20 }}
+      transition={{ duration: 0.2 }}
+      onSubmit={handleVerifyMfa}
+      className="space-y-4"
+    >
+      {enrollment ? (
+        <div className="space-y-2 text-sm text-center text-muted-foreground">
+          <p>
+            Add this account to your{" "}
+            <a href={enrollment.provisioningUri} className="text-blue-500 hover:underline">
+              authenticator app
+            </a>{" "}
+            with the key:
+          </p>
+          <p className="font-mono text-foreground break-all select-all">{enrollment.secret}</p>
+        </div>
+      ) : (
+        <p className="text-sm text-center text-muted-foreground">
+          Enter the code from your authenticator app
+        </p>
+      )}
+      {error && (
+        <div className="flex items-center gap-2 p-3 text-sm text-red-600 bg-red-50 dark:bg-red-950 dark:text-red-400 rounded-md">
+          <AlertCircle className="h-4 w-4 shrink-0" />
+          <span>{error}</span>
+        </div>
+      )}
+      <div className="space-y-2 flex flex-col items-center">
+        <Label htmlFor="mfa-code">Authenticator Code</Label>
+        <InputOTP
+          maxLength={6}
+          id="mfa-code"
+          value={code}
+          onChange={setCode}
+          pattern={REGEXP_ONLY_DIGITS}
+          inputMode="numeric"
+          autoFocus
+        >
+          <InputOTPGroup>
+            {Array.from({ length: 6 }, (_, index) => (
+              <InputOTPSlot key={index} index={index} />
+            ))}
+          </InputOTPGroup>
+        </InputOTP>
+      </div>
+      <Button
+        type="submit"
+        disabled={loading || code.length !== 6}
+        className="w-full"
+        style={primaryColor ? { backgroundColor: primaryColor, borderColor: primaryColor } : undefined}
+      >
+        {loading ? "Verifying..." : "Verify"}
+      </Button>
+      <Button
+        type="button"
+        variant="ghost"
+        onClick={() => setStep("email")}
+        className="w-full"
+      >
+        ← Back
+      </Button>
+    </motion.form>
+  );
+}
+
+// ResendButton counts down to when the server accepts another code request
+function ResendButton({
+  resendAfter,
+  loading,
+  handleResend,
+}: {
+  resendAfter: Date | null;
+  loading: boolean;
+  handleResend: (e: React.SyntheticEvent) => void;
+}) {
+  const [now, setNow] = useState(() => Date.now());
+
+  useEffect(() => {
+    if (!resendAfter || resendAfter.getTime() <= now) return;
+    const timeout = setTimeout(() => setNow(Date.now()), 1000);
+    return () => clearTimeout(timeout);
+  }, [resendAfter, now]);
+
+  const wait = resendAfter ? Math.ceil((resendAfter.getTime() - now) / 1000) : 0;
+
+  return (
+    <Button
+      type="button"
+      variant="ghost"
+      onClick={handleResend}
+      disabled={loading || wait > 0}
+      className="w-full"
+    >
+      {wait > 0 ? `Resend code in ${wait}s` : "Resend code"}
+    </Button>
+  );
+}
@@ -43,6 +43,14 @@ export const PermitSSOCallback = ({
           environmentId: widgetConfig?.defaultEnvironmentId || "",
         });
 
+        // The callback can't ask for a second factor yet; the modal can
+        if (response.mfa) {
+          const errorMsg = "A second factor is required. Please sign in with your email.";
+          setError(errorMsg);
+          onError?.(errorMsg);
+          return;
+        }
+
         // Store credentials using same localStorage pattern as OTP flow
         localStorage.setItem(`permit_token_${projectId}`, response.accessToken);
         localStorage.setItem(`permit_refresh_token_${projectId}`, response.refreshToken);
@@ -27,6 +27,7 @@ export interface PermitContextType {
   apiUrl: string;
   projectId: string;
   ssoCallbackUrl: string;
+  magicLink: boolean;
   login: () => void;
   logout: () => void;
   accessToken: string | null;
@@ -19,11 +19,19 @@ function createAuthRequestInterceptor(token?: string) {
   };
 }
 
-function responseErrorInterceptor(error: AxiosError<{ message?: string }>) {
+interface ErrorBody {
+  message?: string;
+  error?: { code?: string; message?: string } | null;
+}
+
+function responseErrorInterceptor(error: AxiosError<ErrorBody>) {
+  // API errors come as { data: null, error: { code, message } }
+  const body = error.response?.data;
   const apiError: ApiError = {
-    message: error.response?.data?.message || error.message || "Unknown error",
+    message:
+      body?.error?.message || body?.message || error.message || "Unknown error",
     status: error.response?.status,
-    code: error.code,
+    code: body?.error?.code || error.code,
   };
 
   return Promise.reject(apiError);
@@ -1,4 +1,4 @@
-import { AuthResponse, User } from "@/types/api";
+import { AuthResponse, MfaEnrollment, User } from "@/types/api";
 import { z } from "zod";
 import { createApiClient } from "./api-client";
 
@@ -6,23 +6,44 @@ import { createApiClient } from "./api-client";
 // OTP Authentication (Primary flow for SDK)
 // ============================================
 
+// magicLink also emails a sign-in link that redirects to redirectUrl, a
+// callback path on the current origin, like the OAuth flow
 export const otpStartSchema = z.object({
   email: z.string().min(1, "Email is required").email("Invalid email"),
+  magicLink: z.boolean().optional(),
+  redirectUrl: z.string().optional(),
 });
 
+// The code is bound to the email it was sent to; challengeId, returned by
+// startOtp, pins verification to that exact code
 export const otpVerifySchema = z.object({
   email: z.string().email(),
-  code: z.string().length(6, "Code must be 6 digits"),
+  challengeId: z.string().optional(),
+  code: z
+    .string()
+    .min(4, "Code must be at least 4 characters")
+    .max(10, "Code must be at most 10 characters"),
 });
 
 export type OtpStartInput = z.infer<typeof otpStartSchema>;
 export type OtpVerifyInput = z.infer<typeof otpVerifySchema>;
 
+export interface OtpStartResponse {
+  message: string;
+  challengeId: string;
+  expiresAt: string;
+  // The code follows the environment's OTP policy
+  codeLength: number;
+  codeAlphabet: "numeric" | "alphanumeric";
+  // When another code may be requested; earlier requests are refused
+  resendAfter: string;
+}
+
 export const startOtp = (
   apiUrl: string,
   data: OtpStartInput,
   projectId: string
-): Promise<{ message: string }> => {
+): Promise<OtpStartResponse> => {
   const api = createApiClient(apiUrl);
   return api.post("/auth/otp/start", { ...data, projectId });
 };
@@ -36,6 +57,29 @@ export const verifyOtp = (
   return api.post("/auth/otp/verify", { ...data, projectId });
 };
 
+// ============================================
+// Multi-factor Authentication
+// ============================================
+
+// Completes a sign-in that returned an mfa challenge with a TOTP code
+export const verifyMfa = (
+  apiUrl: string,
+  data: { mfaToken: string; code: string }
+): Promise<AuthResponse> => {
+  const api = createApiClient(apiUrl);
+  return api.post("/auth/mfa/verify", data);
+};
+
+// Starts enrolling an authenticator for a challenge with
+// enrollmentRequired; verifyMfa with its first code confirms it
+export const enrollMfa = (
+  apiUrl: string,
+  mfaToken: string
+): Promise<MfaEnrollment> => {
+  const api = createApiClient(apiUrl);
+  return api.post("/auth/mfa/enroll", { mfaToken });
+};
+
 // ============================================
 // User & Session
 // ============================================
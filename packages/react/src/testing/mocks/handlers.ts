@@ -4,7 +4,7 @@ const API_URL = "http://localhost:8080/api/v1";
 
 // Mock user database
 const users = new Map<string, { id: string; email: string }>();
-const otpCodes = new Map<string, string>(); // email -> code
+const otpCodes = new Map<string, { code: string; challengeId: string }>(); // email -> pending code
 
 export const handlers = [
   // Start OTP flow
@@ -13,10 +13,16 @@ export const handlers = [
 
     // Generate a mock OTP code
     const code = "123456";
-    otpCodes.set(body.email, code);
+    const challengeId = `otp_${Date.now()}`;
+    otpCodes.set(body.email, { code, challengeId });
 
     return HttpResponse.json({
       message: "Verification code sent",
+      challengeId,
+      expiresAt: new Date(Date.now() + 10 * 60 * 1000).toISOString(),
+      codeLength: 6,
+      codeAlphabet: "numeric",
+      resendAfter: new Date(Date.now() + 30 * 1000).toISOString(),
     });
   }),
 
@@ -24,13 +30,18 @@ export const handlers = [
   http.post(`${API_URL}/auth/otp/verify`, async ({ request }) => {
     const body = (await request.json()) as {
       email: string;
+      challengeId?: string;
       code: string;
       projectId: string;
     };
 
-    const expectedCode = otpCodes.get(body.email);
+    const pending = otpCodes.get(body.email);
 
-    if (!expectedCode || expectedCode !== body.code) {
+    if (
+      !pending ||
+      pending.code !== body.code ||
+      (body.challengeId && pending.challengeId !== body.challengeId)
+    ) {
       return HttpResponse.json(
         { message: "Invalid verification code" },
         { status: 401 }
@@ -65,6 +76,24 @@ export const handlers = [
     });
   }),
 
+  // Verify MFA
+  http.post(`${API_URL}/auth/mfa/verify`, async ({ request }) => {
+    const body = (await request.json()) as { mfaToken: string; code: string };
+
+    if (body.code !== "123456") {
+      return HttpResponse.json(
+        { message: "Invalid or expired code" },
+        { status: 400 }
+      );
+    }
+
+    return HttpResponse.json({
+      accessToken: "mock_access_token_" + Date.now(),
+      refreshToken: "mock_refresh_token_" + Date.now(),
+      user: { id: "user_123", email: "test@example.com" },
+    });
+  }),
+
   // Get current user
   http.get(`${API_URL}/auth/me`, ({ request }) => {
     const authHeader = request.headers.get("Authorization");
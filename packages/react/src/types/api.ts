@@ -29,12 +29,29 @@ export type User = Entity<{
 export type AuthResponse = {
   accessToken: string;
   refreshToken: string;
+  // Set instead of the tokens when the sign-in needs a second factor; they
+  // are issued by verifyMfa
+  mfa?: MfaChallenge;
   user: {
     id: string;
     email: string;
   };
 };
 
+export type MfaChallenge = {
+  mfaToken: string;
+  methods: "totp"[];
+  // The user has no authenticator yet and must enroll one with enrollMfa
+  enrollmentRequired: boolean;
+  expiresAt: string;
+};
+
+export type MfaEnrollment = {
+  secret: string;
+  // otpauth:// URI authenticator apps enroll from, usually shown as a QR code
+  provisioningUri: string;
+};
+
 export type Team = Entity<{
   name: string;
   description: string;
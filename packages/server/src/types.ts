@@ -26,6 +26,10 @@ export interface PermitUser {
   environmentId?: string;
   /** Auth provider: "email", "google", etc. */
   provider: string;
+  /** When the user last actively authenticated */
+  authTime?: Date;
+  /** Authentication methods used then: "otp", "oauth", etc. */
+  amr?: string[];
   /** When the token was issued */
   issuedAt: Date;
   /** When the token expires */
@@ -76,4 +80,6 @@ export interface PermitTokenClaims {
   pid: string;
   eid?: string;
   provider: string;
+  auth_time?: number;
+  amr?: string[];
 }
@@ -40,6 +40,8 @@ export async function verifyToken(
       appId: claims.pid,
       environmentId: claims.eid || undefined,
       provider: claims.provider,
+      authTime: claims.auth_time ? new Date(claims.auth_time * 1000) : undefined,
+      amr: claims.amr,
       issuedAt: new Date((claims.iat || 0) * 1000),
       expiresAt: new Date((claims.exp || 0) * 1000),
     };